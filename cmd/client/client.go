@@ -2,7 +2,8 @@ package main
 
 import (
 	"bufio"
-	"errors"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"os"
@@ -10,16 +11,26 @@ import (
 	"strings"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/vajafari/messagehub/cmd/client/internal/proxy"
+	"github.com/vajafari/messagehub/pkg/logging"
 	"github.com/vajafari/messagehub/pkg/socket"
 )
 
+const (
+	// shutdownTimeout is how long client waits for queued messages to be written on exit
+	shutdownTimeout = 5 * time.Second
+	// requestTimeout is how long client waits for response of hub
+	requestTimeout = 5 * time.Second
+)
+
 func main() {
 	err := configViper()
 	if err != nil {
 		fmt.Println(err.Error())
 		return
 	}
+	warnRemovedKeys()
 	clientConfig := getClientConf()
 	prx, err := connect(clientConfig)
 	if err != nil {
@@ -41,9 +52,23 @@ func main() {
 		}
 		switch cmd {
 		case 1:
-			prx.SendID()
+			ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+			id, err := prx.Identify(ctx)
+			cancel()
+			if err != nil {
+				fmt.Println(err.Error())
+				continue
+			}
+			fmt.Printf("Client id is %d\n", id)
 		case 2:
-			prx.SendList()
+			ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+			ids, err := prx.List(ctx)
+			cancel()
+			if err != nil {
+				fmt.Println(err.Error())
+				continue
+			}
+			fmt.Printf("Connected clients %v\n", ids)
 		case 3:
 			fmt.Println("How many client Id?")
 			ids := make([]uint64, 0)
@@ -71,8 +96,19 @@ func main() {
 			for i := 0; i < int(cliCnt); i++ {
 				bb[i] = byte(i % 256)
 			}
-			prx.SendRelay(ids, bb)
+			ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+			err = prx.Relay(ctx, ids, bb)
+			cancel()
+			if err != nil {
+				fmt.Println(err.Error())
+				continue
+			}
+			fmt.Println("Relay message sent")
 		case 4:
+			// Messages that are still queued are written before leaving
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			prx.Shutdown(ctx)
+			cancel()
 			return
 		default:
 			fmt.Println("Invalid command")
@@ -82,26 +118,129 @@ func main() {
 }
 
 func connect(clientConfig ClientConfig) (*proxy.Proxy, error) {
-	fmt.Printf("Connecting to %s ...\n", clientConfig.GetHostAddress())
-	d := net.Dialer{Timeout: time.Second * time.Duration(clientConfig.DailTimeout)}
-	conn, err := d.Dial(clientConfig.NetType, clientConfig.GetHostAddress())
+	features, msgFeatures, err := clientConfig.GetFeatures()
+	if err != nil {
+		return nil, err
+	}
+	limits, err := clientConfig.GetReassemblyLimits()
+	if err != nil {
+		return nil, err
+	}
+	policy, err := socket.ParseOverflowPolicy(clientConfig.OverflowPolicy)
+	if err != nil {
+		return nil, err
+	}
+	lanes, err := clientConfig.GetLanes()
+	if err != nil {
+		return nil, err
+	}
+	depths, err := socket.ParseLaneMap(clientConfig.LaneDepths)
+	if err != nil {
+		return nil, err
+	}
+	weights, err := socket.ParseLaneMap(clientConfig.LaneWeights)
+	if err != nil {
+		return nil, err
+	}
+	logger, err := logging.New(os.Stdout, clientConfig.LogLevel, clientConfig.LogFormat)
+	if err != nil {
+		return nil, err
+	}
+	var skt *socket.TCPSocket
+	if clientConfig.IsWebSocket() {
+		skt, err = dialWS(clientConfig)
+	} else {
+		skt, err = dial(clientConfig)
+	}
 	if err != nil {
 		return nil, err
 	}
-	tcpConn, ok := conn.(*net.TCPConn)
-	if !ok {
-		return nil, errors.New("Connection is not TCP")
+	if clientConfig.CompressMinSize > 0 {
+		skt.SetCompressMinSize(clientConfig.CompressMinSize)
 	}
-	skt := socket.NewTCPSocket(tcpConn, 0, clientConfig.SendQueueSize, clientConfig.ReadBufSize, clientConfig.WriteBufSize)
-	prx := proxy.NewProxy(clientConfig.ProxyQueueSize)
+	if clientConfig.FragmentSize > 0 {
+		skt.SetFragmentSize(clientConfig.FragmentSize)
+	}
+	skt.SetReassemblyLimits(limits)
+	skt.SetOverflowPolicy(policy)
+	skt.SetTimeouts(time.Duration(clientConfig.ReadTimeout)*time.Second, time.Duration(clientConfig.WriteTimeout)*time.Second)
+	interval := socket.DefaultHeartbeatInterval
+	if clientConfig.HeartbeatInterval > 0 {
+		interval = time.Duration(clientConfig.HeartbeatInterval) * time.Second
+	}
+	skt.SetHeartbeat(interval, clientConfig.MaxMissedPongs)
+	skt.SetLanes(lanes)
+	skt.SetLaneDepths(depths)
+	skt.SetLaneWeights(weights)
+	skt.SetWriteBatch(clientConfig.WriteBatchBytes, clientConfig.WriteBatchFrames)
+	skt.SetGarbageLimit(clientConfig.GarbageLimit)
+	skt.SetLogger(logger)
+	prx := proxy.NewProxy()
+	prx.SetFeatures(features)
+	prx.SetMessageFeatures(msgFeatures)
+	prx.SetReassemblyLimits(limits)
+	prx.SetLogger(logger)
+	prx.SetErrorHandler(func(err error) {
+		fmt.Println(err)
+	})
 	err = prx.SetSocket(skt)
 	if err != nil {
 		return nil, err
 	}
+	err = prx.SendHello()
+	if err != nil {
+		return nil, err
+	}
 	fmt.Println("Connected!!")
 	return prx, nil
 }
 
+func dial(clientConfig ClientConfig) (*socket.TCPSocket, error) {
+	fmt.Printf("Connecting to %s ...\n", clientConfig.GetHostAddress())
+	tlsConf, err := clientConfig.GetTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{Timeout: time.Second * time.Duration(clientConfig.DailTimeout)}
+	conn, err := d.Dial(clientConfig.NetType, clientConfig.GetHostAddress())
+	if err != nil {
+		return nil, err
+	}
+	if tlsConf == nil {
+		// Plain TCP or unix domain socket
+		return socket.NewConnSocket(conn, 0, clientConfig.SendQueueSize, clientConfig.ReadBufSize, clientConfig.WriteBufSize), nil
+	}
+	tlsConn := tls.Client(conn, tlsConf)
+	// Handshake here, so certificate problems reported before proxy starts
+	tlsConn.SetDeadline(time.Now().Add(time.Second * time.Duration(clientConfig.DailTimeout)))
+	err = tlsConn.Handshake()
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return socket.NewTLSSocket(tlsConn, 0, clientConfig.SendQueueSize, clientConfig.ReadBufSize, clientConfig.WriteBufSize), nil
+}
+
+func dialWS(clientConfig ClientConfig) (*socket.TCPSocket, error) {
+	fmt.Printf("Connecting to %s ...\n", clientConfig.GetWSURL())
+	tlsConf, err := clientConfig.GetTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	d := websocket.Dialer{
+		HandshakeTimeout: time.Second * time.Duration(clientConfig.DailTimeout),
+		TLSClientConfig:  tlsConf,
+		ReadBufferSize:   clientConfig.ReadBufSize,
+		WriteBufferSize:  clientConfig.WriteBufSize,
+	}
+	conn, _, err := d.Dial(clientConfig.GetWSURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return socket.NewWSSocket(conn, 0, clientConfig.SendQueueSize, clientConfig.ReadBufSize, clientConfig.WriteBufSize), nil
+}
+
 func scanInput(r *bufio.Reader) (uint64, error) {
 	text, err := r.ReadString('\n')
 	if err != nil {
@@ -1,21 +1,69 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"strconv"
 
 	"github.com/spf13/viper"
+	"github.com/vajafari/messagehub/pkg/message"
+	"github.com/vajafari/messagehub/pkg/socket"
 )
 
 // ClientConfig contain dynamic configurarion of client
 type ClientConfig struct {
-	Host           string
-	Port           int
-	NetType        string
-	SendQueueSize  int
-	ReadBufSize    int
-	WriteBufSize   int
-	ProxyQueueSize int
-	DailTimeout    int
+	Host          string
+	Port          int
+	NetType       string
+	SendQueueSize int
+	ReadBufSize   int
+	WriteBufSize  int
+	DailTimeout   int
+	// TLS settings. TLSCAFile and TLSServerName are used to verify the hub certificate,
+	// TLSCertFile and TLSKeyFile are the client certificate when hub requires mutual TLS
+	TLSEnabled    bool
+	TLSCAFile     string
+	TLSServerName string
+	TLSCertFile   string
+	TLSKeyFile    string
+	// Path of WebSocket endpoint on hub, used when NetType is ws or wss
+	WSPath string
+	// Names of optional features (checksum, compression, heartbeat, fragmentation, streams, correlation, errors) that client offers in handshake.
+	// Empty offers all the supported features
+	Features []string
+	// Packets with smaller data are not compressed. Zero uses socket default
+	CompressMinSize int
+	// Max data of one fragment when fragmentation is agreed. Zero uses socket default
+	FragmentSize int
+	// Max length of fragmented message that client reassembles, by name of message type.
+	// Types that are not set are limited to their max length in one frame
+	ReassemblyLimits map[string]int
+	// What socket does with messages when its send queue is full: block, drop-newest, drop-oldest or disconnect
+	OverflowPolicy string
+	// Seconds that socket waits for data of hub and for each write. Zero uses socket default
+	ReadTimeout  int
+	WriteTimeout int
+	// Seconds between pings when heartbeat is agreed and how many pings may stay unanswered
+	// before connection is closed. Zero uses socket default
+	HeartbeatInterval int
+	MaxMissedPongs    int
+	// Send lane (control, interactive or bulk) of message types, by name of message type.
+	// Types that are not set keep their default lane
+	Lanes map[string]string
+	// Depth and weight of each lane, by name of lane. Depth of lanes that are not set is SendQueueSize
+	LaneDepths  map[string]int
+	LaneWeights map[string]int
+	// Max bytes and frames of queued messages that are written together. Zero uses socket default
+	WriteBatchBytes  int
+	WriteBatchFrames int
+	// Bytes that hub may send without a valid frame before connection is closed. Zero is not limited
+	GarbageLimit int
+	// Level (debug, info, warn, error or off) and format (text or json) of logs. Empty is info and text
+	LogLevel  string
+	LogFormat string
 }
 
 func configViper() error {
@@ -25,20 +73,168 @@ func configViper() error {
 	return viper.ReadInConfig()
 }
 
+// warnRemovedKeys report keys of old config files that are ignored. Socket calls handlers of proxy
+// directly, so proxy has no queue of its own and proxyQueueSize is not used anymore
+func warnRemovedKeys() {
+	for _, key := range []string{"proxyQueueSize"} {
+		if viper.IsSet(key) {
+			fmt.Printf("Configuration %s is not used anymore and is ignored, please remove it\n", key)
+		}
+	}
+}
+
 func getClientConf() ClientConfig {
 	return ClientConfig{
-		Host:           viper.GetString("host"),
-		Port:           viper.GetInt("port"),
-		NetType:        viper.GetString("netType"),
-		SendQueueSize:  viper.GetInt("sendQueueSize"),
-		ReadBufSize:    viper.GetInt("readBufSize"),
-		WriteBufSize:   viper.GetInt("writeBufSize"),
-		ProxyQueueSize: viper.GetInt("proxyQueueSize"),
-		DailTimeout:    viper.GetInt("dailTimeout"),
+		Host:              viper.GetString("host"),
+		Port:              viper.GetInt("port"),
+		NetType:           viper.GetString("netType"),
+		SendQueueSize:     viper.GetInt("sendQueueSize"),
+		ReadBufSize:       viper.GetInt("readBufSize"),
+		WriteBufSize:      viper.GetInt("writeBufSize"),
+		DailTimeout:       viper.GetInt("dailTimeout"),
+		TLSEnabled:        viper.GetBool("tlsEnabled"),
+		TLSCAFile:         viper.GetString("tlsCAFile"),
+		TLSServerName:     viper.GetString("tlsServerName"),
+		TLSCertFile:       viper.GetString("tlsCertFile"),
+		TLSKeyFile:        viper.GetString("tlsKeyFile"),
+		WSPath:            viper.GetString("wsPath"),
+		Features:          viper.GetStringSlice("features"),
+		CompressMinSize:   viper.GetInt("compressMinSize"),
+		FragmentSize:      viper.GetInt("fragmentSize"),
+		ReassemblyLimits:  getIntMap("reassemblyLimits"),
+		OverflowPolicy:    viper.GetString("overflowPolicy"),
+		ReadTimeout:       viper.GetInt("readTimeout"),
+		WriteTimeout:      viper.GetInt("writeTimeout"),
+		HeartbeatInterval: viper.GetInt("heartbeatInterval"),
+		MaxMissedPongs:    viper.GetInt("maxMissedPongs"),
+		Lanes:             viper.GetStringMapString("lanes"),
+		LaneDepths:        getIntMap("laneDepths"),
+		LaneWeights:       getIntMap("laneWeights"),
+		WriteBatchBytes:   viper.GetInt("writeBatchBytes"),
+		WriteBatchFrames:  viper.GetInt("writeBatchFrames"),
+		GarbageLimit:      viper.GetInt("garbageLimit"),
+		LogLevel:          viper.GetString("logLevel"),
+		LogFormat:         viper.GetString("logFormat"),
+	}
+}
+
+// getIntMap read a map of integers like {"relay": 52428800} from config. Invalid values are ignored
+func getIntMap(key string) map[string]int {
+	res := make(map[string]int)
+	for name, value := range viper.GetStringMapString(key) {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+		res[name] = n
+	}
+	return res
+}
+
+// GetFeatures return features that client offers in handshake
+func (conf *ClientConfig) GetFeatures() (socket.Features, message.Features, error) {
+	if len(conf.Features) == 0 {
+		return socket.SupportedFeatures, message.SupportedFeatures, nil
+	}
+	// One list holds features of socket and features of messages
+	var socketNames, messageNames []string
+	for _, name := range conf.Features {
+		if message.IsFeature(name) {
+			messageNames = append(messageNames, name)
+		} else {
+			socketNames = append(socketNames, name)
+		}
+	}
+	socketFeatures, err := socket.ParseFeatures(socketNames)
+	if err != nil {
+		return 0, 0, err
+	}
+	messageFeatures, err := message.ParseFeatures(messageNames)
+	return socketFeatures, messageFeatures, err
+}
+
+// GetReassemblyLimits return max length of reassembled message of each message type
+func (conf *ClientConfig) GetReassemblyLimits() (map[byte]int, error) {
+	limits := make(map[byte]int)
+	for name, limit := range conf.ReassemblyLimits {
+		typ, err := message.ParseMsgType(name)
+		if err != nil {
+			return nil, err
+		}
+		limits[byte(typ)] = limit
+	}
+	return limits, nil
+}
+
+// GetLanes return send lane of each message type. Handshake is sent in control lane and relay
+// messages in bulk lane, unless config sets another lane for them
+func (conf *ClientConfig) GetLanes() (map[byte]socket.Lane, error) {
+	lanes := map[byte]socket.Lane{
+		byte(message.HelloMgsCode): socket.LaneControl,
+		byte(message.RelayMgsCode): socket.LaneBulk,
 	}
+	for name, laneName := range conf.Lanes {
+		typ, err := message.ParseMsgType(name)
+		if err != nil {
+			return nil, err
+		}
+		lane, err := socket.ParseLane(laneName)
+		if err != nil {
+			return nil, err
+		}
+		lanes[byte(typ)] = lane
+	}
+	return lanes, nil
 }
 
 // GetHostAddress Apprend host address and port number together and return  full address of site
+// For unix and unixpacket networks Host is path of the hub socket file
 func (conf *ClientConfig) GetHostAddress() string {
+	if conf.NetType == "unix" || conf.NetType == "unixpacket" {
+		return conf.Host
+	}
 	return conf.Host + ":" + strconv.Itoa(conf.Port)
 }
+
+// IsWebSocket report whether client must connect to WebSocket endpoint of hub
+func (conf *ClientConfig) IsWebSocket() bool {
+	return conf.NetType == "ws" || conf.NetType == "wss"
+}
+
+// GetWSURL return url of hub WebSocket endpoint
+func (conf *ClientConfig) GetWSURL() string {
+	return conf.NetType + "://" + conf.GetHostAddress() + conf.WSPath
+}
+
+// GetTLSConfig build client side tls configuration. It returns nil when TLS is not enabled
+func (conf *ClientConfig) GetTLSConfig() (*tls.Config, error) {
+	if !conf.TLSEnabled && conf.NetType != "wss" {
+		return nil, nil
+	}
+	tlsConf := &tls.Config{
+		ServerName: conf.TLSServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if tlsConf.ServerName == "" {
+		tlsConf.ServerName = conf.Host
+	}
+	if conf.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(conf.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No valid certificate found in CA file")
+		}
+		tlsConf.RootCAs = pool
+	}
+	if conf.TLSCertFile != "" || conf.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.TLSCertFile, conf.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
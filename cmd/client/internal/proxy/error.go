@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/vajafari/messagehub/pkg/logging"
+	"github.com/vajafari/messagehub/pkg/message"
+	"github.com/vajafari/messagehub/pkg/socket"
+)
+
+// HubError happen when hub rejects a message of client
+type HubError struct {
+	ReqType message.MsgType   // Type of message that is rejected
+	Code    message.ErrorCode // Why message is rejected
+	Reason  string            // Human readable reason sent by hub
+	IDs     []uint64          // Recipients of relay message that did not get it
+}
+
+func (e *HubError) Error() string {
+	return fmt.Sprintf("Hub rejected message of type %d: %s", e.ReqType, e.Reason)
+}
+
+// Is report whether the rejection has the same meaning as target, so errors.Is(err, ErrNotIdentified)
+// holds when hub rejects a request of unidentified client
+func (e *HubError) Is(target error) bool {
+	return target == ErrNotIdentified && e.Code == message.ErrCodeNotIdentified
+}
+
+// SetErrorHandler set handler of rejections that do not belong to a request, e.g. rejected relay messages,
+// and of relay messages that socket dropped. Handler is called by go routines of socket, so it must not block
+func (prx *Proxy) SetErrorHandler(handler func(err error)) {
+	prx.mutx.Lock()
+	defer prx.mutx.Unlock()
+	prx.errHandler = handler
+}
+
+// handleError return rejection to the request that waits for it, other rejections go to error handler
+func (prx *Proxy) handleError(reqData socket.RData, msg message.ErrorMsg) {
+	err := &HubError{ReqType: msg.ReqType, Code: msg.Code, Reason: msg.Reason, IDs: msg.IDs}
+	prx.mutx.Lock()
+	resolved := prx.resolve(msg.ReqType, msg.CorrID, result{err: err})
+	handler := prx.errHandler
+	prx.mutx.Unlock()
+	if resolved {
+		return
+	}
+	prx.log.Warn("Message rejected by hub", logging.MsgType, msg.ReqType, "code", msg.Code, logging.Err, err)
+	if handler != nil {
+		handler(err)
+	}
+}
@@ -1,10 +1,11 @@
 package proxy
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"sync"
 
+	"github.com/vajafari/messagehub/pkg/logging"
 	"github.com/vajafari/messagehub/pkg/message"
 	"github.com/vajafari/messagehub/pkg/socket"
 )
@@ -14,206 +15,458 @@ var (
 	ErrNotConnected = errors.New("No socket set for this proxy")
 	// ErrNotIdentified happen when try to send list or relay message to the hub
 	ErrNotIdentified = errors.New("This socket is not identified")
+	// ErrFrameTooLarge happen when message is larger than max frame size agreed in handshake
+	ErrFrameTooLarge = errors.New("Message is larger than max frame size agreed with hub")
 )
 
 const (
-	maxIDMsgLen   int = 8                        // Max length for id message in cli
-	maxListMsgLen int = message.ListMaxItems * 8 // Max message size
+	maxIDMsgLen   int = 8 + message.CorrIDLen // Max length for id message in cli
+	maxListMsgLen int = message.ListMaxLen    // Max message size
 	// Max length for relay message: 1024 * 1024 bytes for body and 8 bytes for sender Id
 	maxRelayMsgLen int = message.RelayMaxBodySize + 8
+	// Max length of relay request that proxy sends when reassembly limit of relay messages is not set,
+	// it is what hub receives in one frame
+	maxRelayReqLen int = message.RelayMaxBodySize + (message.RelayMaxReciverCount * 8) + 1 + 1 + message.CorrIDLen
 )
 
 // Proxy is clinet side socket manager
 type Proxy struct {
 	skt        socket.Socket
-	readChan   chan socket.RData
-	writeChan  chan socket.WData
-	probChan   chan socket.ProbData
-	msgTypeLen map[byte]int
+	reg        *message.Registry[socket.RData] // Message types that proxy reads and their handlers
 	mutx       sync.RWMutex
+	caps       socket.Capabilities // Capabilities that proxy advertise in hello message
+	agreed     socket.Capabilities // Capabilities agreed with hub. Zero value before welcome message
+	msgs       message.Features    // Features of messages that proxy advertise in hello message
+	agreedMsgs message.Features    // Features of messages agreed with hub. Zero value before welcome message
+	streams    map[uint32]*Stream  // Open streams of socket by their id
+	pending    []*pending          // Requests that wait for response, in the order they are sent
+	corrID     uint32              // Correlation id of the last request
+	maxRelay   int                 // Max length of relay request, see SetReassemblyLimits
+	// Handler of rejections that do not belong to a request
+	errHandler func(err error)
+	log        logging.Logger
 }
 
-// NewProxy Create a new instance and initialize properties of the proxy struct
-func NewProxy(queueSize int) *Proxy {
+// NewProxy Create a new instance and initialize properties of the proxy struct. Socket calls handlers
+// of proxy directly, so unlike older versions it has no queue and takes no queue size
+func NewProxy() *Proxy {
 	prx := Proxy{
-		readChan:   make(chan socket.RData, queueSize),
-		writeChan:  make(chan socket.WData, queueSize),
-		probChan:   make(chan socket.ProbData, queueSize),
-		msgTypeLen: make(map[byte]int),
+		reg:      message.NewRegistry[socket.RData](),
+		streams:  make(map[uint32]*Stream),
+		caps:     socket.LocalCapabilities(maxRelayMsgLen, socket.SupportedFeatures), // Relay is the largest message proxy accepts
+		msgs:     message.SupportedFeatures,
+		maxRelay: maxRelayReqLen,
+		log:      logging.Default(),
 	}
-	prx.msgTypeLen[byte(message.IDMgsCode)] = maxIDMsgLen
-	prx.msgTypeLen[byte(message.ListMgsCode)] = maxListMsgLen
-	prx.msgTypeLen[byte(message.RelayMgsCode)] = maxRelayMsgLen
+	prx.reg.Register(message.HelloMgsCode, message.Codec[socket.RData]{
+		MaxLen: message.HelloMaxLen,
+		Decode: message.Decode(message.DeserializeWelcome),
+		Handle: message.Handle(prx.handleWelcome),
+	})
+	prx.reg.Register(message.IDMgsCode, message.Codec[socket.RData]{
+		MaxLen: maxIDMsgLen,
+		Decode: message.Decode(message.DeserializeIDRes),
+		Handle: message.Handle(prx.handleIDReq),
+	})
+	prx.reg.Register(message.ListMgsCode, message.Codec[socket.RData]{
+		MaxLen: maxListMsgLen,
+		Decode: message.Decode(message.DeserializeListRes),
+		Handle: message.Handle(prx.handleListReq),
+	})
+	prx.reg.Register(message.RelayMgsCode, message.Codec[socket.RData]{
+		MaxLen: maxRelayMsgLen,
+		Decode: message.DeserializeRelayFromHub,
+		Handle: prx.handleRelay,
+	})
+	prx.reg.Register(message.ErrorMgsCode, message.Codec[socket.RData]{
+		MaxLen: message.ErrorMaxLen,
+		Decode: message.Decode(message.DeserializeError),
+		Handle: message.Handle(prx.handleError),
+	})
+	return &prx
+}
 
-	go prx.probHandler()
-	go prx.readHandler()
-	go prx.writeHandler()
+// Register add a message type that proxy reads from hub, e.g. a message type of application.
+// It must be called before setting socket. Handlers are called in order by reader of socket
+func (prx *Proxy) Register(typ message.MsgType, codec message.Codec[socket.RData]) error {
+	return prx.reg.Register(typ, codec)
+}
 
-	return &prx
+// Send push a message to send queue of socket, e.g. a message of a registered type. Like other send methods
+// of proxy, it waits for room in queue and returns the error when message is not queued, e.g. ErrClosed
+func (prx *Proxy) Send(pkt socket.Packet) error {
+	skt, err := prx.checkedSocket(nil)
+	if err != nil {
+		return err
+	}
+	return skt.SendContext(context.Background(), pkt)
+}
+
+// checkedSocket return socket of proxy when check passes. Sending may wait for room in send queue, and handlers
+// of socket need the lock of proxy meanwhile, so messages are sent after lock is released
+func (prx *Proxy) checkedSocket(check func(skt socket.Socket) error) (socket.Socket, error) {
+	prx.mutx.RLock()
+	defer prx.mutx.RUnlock()
+	if prx.skt == nil {
+		return nil, ErrNotConnected
+	}
+	if check != nil {
+		if err := check(prx.skt); err != nil {
+			return nil, err
+		}
+	}
+	return prx.skt, nil
+}
+
+// SetFeatures limit features that proxy advertise in hello message
+func (prx *Proxy) SetFeatures(features socket.Features) {
+	prx.mutx.Lock()
+	defer prx.mutx.Unlock()
+	prx.caps = socket.LocalCapabilities(prx.caps.MaxFrameSize, features)
+}
+
+// SetMessageFeatures limit features of messages that proxy advertise in hello message
+func (prx *Proxy) SetMessageFeatures(features message.Features) {
+	prx.mutx.Lock()
+	defer prx.mutx.Unlock()
+	prx.msgs = features & message.SupportedFeatures
+}
+
+// SetReassemblyLimits set max length of relay requests from reassembly limit of relay messages, the same
+// limits that socket of proxy and sockets of hub are configured with. Larger relay requests are sent in
+// fragments when fragmentation is agreed. It must be called before setting socket
+func (prx *Proxy) SetReassemblyLimits(limits map[byte]int) {
+	if limit, ok := limits[byte(message.RelayMgsCode)]; ok && limit > 0 {
+		prx.maxRelay = limit
+	}
+}
+
+// SetLogger set logger of proxy events. It must be called before setting socket
+func (prx *Proxy) SetLogger(l logging.Logger) {
+	prx.log = l
+}
+
+// Capabilities return capabilities agreed with hub. It is zero value until welcome message received
+func (prx *Proxy) Capabilities() socket.Capabilities {
+	prx.mutx.RLock()
+	defer prx.mutx.RUnlock()
+	return prx.agreed
+}
+
+// MessageFeatures return features of messages agreed with hub. It is zero until welcome message received
+func (prx *Proxy) MessageFeatures() message.Features {
+	prx.mutx.RLock()
+	defer prx.mutx.RUnlock()
+	return prx.agreedMsgs
 }
 
 // SetSocket process send and receive data
 func (prx *Proxy) SetSocket(skt socket.Socket) error {
+	return prx.SetSocketContext(context.Background(), skt)
+}
+
+// SetSocketContext process send and receive data of socket until ctx is done, then socket is closed
+func (prx *Proxy) SetSocketContext(ctx context.Context, skt socket.Socket) error {
 	if skt == nil {
 		return ErrNotConnected
 	}
+	prx.mutx.Lock()
+	defer prx.mutx.Unlock()
 	if prx.skt != nil {
 		return errors.New("A socket already set for proxy")
 	}
-	prx.mutx.Lock()
-	defer prx.mutx.Unlock()
+	// Streams give credit when their messages are received, see Stream.Recv
+	skt.SetManualCredit(true)
+	if err := skt.StartHandler(ctx, sktHandler{prx: prx, skt: skt}, prx.reg.MsgTypeLen()); err != nil {
+		return err
+	}
 	prx.skt = skt
-	prx.skt.Start(prx.writeChan, prx.readChan, prx.probChan, prx.msgTypeLen)
 	return nil
 }
 
+// sktHandler pass events of a socket to proxy, see socket.Handler
+type sktHandler struct {
+	prx *Proxy
+	skt socket.Socket
+}
+
+func (sh sktHandler) OnPacket(rData socket.RData) {
+	if rData.Stream != 0 {
+		sh.prx.handleStreamPacket(rData)
+		return
+	}
+	sh.prx.handlePacket(rData)
+}
+
+func (sh sktHandler) OnWritten(wData socket.WData) {
+}
+
+func (sh sktHandler) OnError(sig socket.ProbData) {
+	sh.prx.handleProb(sig)
+}
+
+func (sh sktHandler) OnClose(id uint64, err error) {
+	sh.prx.releaseSocket(sh.skt, err)
+}
+
 // CloseSocket close current socket of proxy
 func (prx *Proxy) CloseSocket() error {
+	prx.mutx.Lock()
+	defer prx.mutx.Unlock()
 	if prx.skt == nil {
 		return ErrNotConnected
 	}
-	prx.mutx.Lock()
-	defer prx.mutx.Unlock()
 	err := prx.skt.Close()
 	if err != nil {
-		fmt.Printf("Proxy, Error on closing socket. Error message %s\n", err.Error())
+		prx.log.Error("Error on closing socket", logging.Err, err)
 		return err
 	}
 	prx.skt = nil
-	fmt.Println("Proxy, Socket closed!")
+	prx.agreed = socket.Capabilities{}
+	prx.agreedMsgs = 0
+	prx.closeStreams()
+	prx.failPending()
+	prx.log.Info("Socket closed")
 	return nil
 }
 
-// SendID send ID message to server via socket
-func (prx *Proxy) SendID() error {
+// Shutdown write messages that are queued on socket and close it. When ctx is done first, socket is
+// closed at once and messages that are not written are reported as undelivered
+func (prx *Proxy) Shutdown(ctx context.Context) error {
 	prx.mutx.RLock()
-	defer prx.mutx.RUnlock()
-	if prx.skt == nil {
+	skt := prx.skt
+	prx.mutx.RUnlock()
+	if skt == nil {
 		return ErrNotConnected
 	}
-	if prx.skt.ID() > 0 {
-		return errors.New("Id set to socket before")
+	// Lock is not held while socket flushes, so handlers can still report problems of socket
+	err := skt.Shutdown(ctx)
+	prx.mutx.Lock()
+	defer prx.mutx.Unlock()
+	if prx.skt == skt {
+		prx.skt = nil
+		prx.agreed = socket.Capabilities{}
+		prx.agreedMsgs = 0
+		prx.closeStreams()
+		prx.failPending()
 	}
-	prx.skt.Send(message.IDRequestMsg{})
-	fmt.Println("Proxy, Id message pushed in socket send queue")
+	prx.log.Info("Socket shut down", logging.Err, err)
+	return err
+}
+
+// SendHello advertise capabilities of proxy to hub. It must be sent before id message
+// Hubs that do not know hello message drop it, so connection keeps working without optional features
+func (prx *Proxy) SendHello() error {
+	var msg message.HelloMsg
+	skt, err := prx.checkedSocket(func(skt socket.Socket) error {
+		if skt.ID() > 0 {
+			return errors.New("Hello must be sent before identification")
+		}
+		msg = message.HelloMsg{
+			Version:      prx.caps.Version,
+			MaxFrameSize: uint32(prx.caps.MaxFrameSize),
+			Features:     message.JoinFeatures(uint32(prx.caps.Features), prx.msgs),
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := skt.SendContext(context.Background(), msg); err != nil {
+		return err
+	}
+	prx.log.Debug("Hello message pushed in send queue")
+	return nil
+}
+
+// SendID send ID message to server via socket
+func (prx *Proxy) SendID() error {
+	skt, err := prx.checkedSocket(func(skt socket.Socket) error {
+		if skt.ID() > 0 {
+			return errors.New("Id set to socket before")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := skt.SendContext(context.Background(), message.IDRequestMsg{}); err != nil {
+		return err
+	}
+	prx.log.Debug("Id message pushed in send queue")
 	return nil
 }
 
 // SendList send list message to hub via socket
 func (prx *Proxy) SendList() error {
-	prx.mutx.RLock()
-	defer prx.mutx.RUnlock()
-	if prx.skt == nil {
-		return ErrNotConnected
+	skt, err := prx.checkedSocket(func(skt socket.Socket) error {
+		if skt.ID() == 0 {
+			return ErrNotIdentified
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	if prx.skt.ID() == 0 {
-		return ErrNotIdentified
+	if err := skt.SendContext(context.Background(), message.ListRequestMsg{}); err != nil {
+		return err
 	}
-	prx.skt.Send(message.ListRequestMsg{})
-	fmt.Println("Proxy, List message pushed in socket send queue")
+	prx.log.Debug("List message pushed in send queue")
 	return nil
 }
 
 // SendRelay send relay message to hub via socket
 func (prx *Proxy) SendRelay(ids []uint64, bb []byte) error {
-	prx.mutx.RLock()
-	defer prx.mutx.RUnlock()
+	msg := message.RelayRequestMsg{
+		Body: bb,
+		IDs:  ids,
+	}
+	skt, err := prx.checkedSocket(func(skt socket.Socket) error {
+		return prx.checkRelay(msg)
+	})
+	if err != nil {
+		return err
+	}
+	if err := skt.SendContext(context.Background(), msg); err != nil {
+		return err
+	}
+	prx.log.Debug("Relay message pushed in send queue")
+	return nil
+}
+
+// checkRelay validate a relay message before it is sent. Lock of proxy must be held
+func (prx *Proxy) checkRelay(msg message.RelayRequestMsg) error {
 	if prx.skt == nil {
 		return ErrNotConnected
 	}
 	if prx.skt.ID() == 0 {
 		return ErrNotIdentified
 	}
-	if len(ids) > message.RelayMaxReciverCount || len(ids) == 0 {
+	if len(msg.IDs) > message.RelayMaxReciverCount || len(msg.IDs) == 0 {
 		return errors.New("Recievers count is not valid")
 	}
-	if len(bb) > message.RelayMaxBodySize || len(bb) == 0 {
+	if len(msg.Body) == 0 || msg.Len() > prx.maxRelay {
 		return errors.New("Data len is not valid")
 	}
-	msg := message.RelayRequestMsg{
-		Body: bb,
-		IDs:  ids,
+	// With fragmentation, messages larger than a frame are split by socket
+	if maxSize := prx.agreed.MaxFrameSize; maxSize > 0 && msg.Len() > maxSize &&
+		!prx.agreed.Has(socket.FeatureFragmentation) {
+		return ErrFrameTooLarge
 	}
-	prx.skt.Send(msg)
-	fmt.Println("Proxy, Relay message pushed in socket send queue")
 	return nil
 }
 
-func (prx *Proxy) readHandler() {
-	for rData := range prx.readChan {
-		switch rData.Pkt.Type() {
-		case byte(message.IDMgsCode):
-			prx.handleIDReq(rData)
-		case byte(message.ListMgsCode):
-			prx.handleListReq(rData)
-		case byte(message.RelayMgsCode):
-			prx.handleRelayReq(rData)
-		default:
-			fmt.Println("Proxy, Invalid message received from scoket")
-		}
-	}
-}
-
-func (prx *Proxy) handleIDReq(reqData socket.RData) {
-	bb, err := reqData.Pkt.Data()
+func (prx *Proxy) handlePacket(rData socket.RData) {
+	data, err := rData.Pkt.Data()
 	if err != nil {
-		fmt.Println("Proxy, Error on retrieving id message")
+		prx.log.Warn("Error on retrieving message", logging.MsgType, rData.Pkt.Type(), logging.Err, err)
 		return
 	}
-	msg, err := message.DeserializeIDRes(bb)
-	if err != nil {
-		fmt.Println("Proxy, Error on deserializing id message")
+	err = prx.reg.Dispatch(rData, rData.Pkt.Type(), data)
+	if errors.Is(err, message.ErrUnknownType) {
+		prx.log.Warn("Invalid message received", logging.MsgType, rData.Pkt.Type())
+	} else if err != nil {
+		prx.log.Warn("Error on deserializing message", logging.MsgType, rData.Pkt.Type(), logging.Err, err)
+	}
+}
+
+func (prx *Proxy) handleWelcome(reqData socket.RData, msg message.WelcomeMsg) {
+	prx.mutx.Lock()
+	defer prx.mutx.Unlock()
+	if prx.skt == nil {
 		return
 	}
+	// Hub answers with the common features, intersect again so proxy never enables what it did not offer
+	socketFeatures, msgFeatures := message.SplitFeatures(msg.Features)
+	prx.agreed = socket.Negotiate(prx.caps, socket.Capabilities{
+		Version:      msg.Version,
+		MaxFrameSize: int(msg.MaxFrameSize),
+		Features:     socket.Features(socketFeatures),
+	})
+	prx.agreedMsgs = prx.msgs & msgFeatures
+	prx.skt.SetCapabilities(prx.agreed)
+	prx.log.Info("Welcome received", "version", prx.agreed.Version, "max_frame_size", prx.agreed.MaxFrameSize,
+		"features", prx.agreed.Features, "message_features", prx.agreedMsgs)
+}
+
+func (prx *Proxy) handleIDReq(reqData socket.RData, msg message.IDResponseMsg) {
 	prx.mutx.Lock()
 	defer prx.mutx.Unlock()
+	if prx.skt == nil {
+		return
+	}
 	if prx.skt.ID() == 0 {
 		prx.skt.SetID(msg.ID)
-		fmt.Printf("Id response received. Client id: %d\n", msg.ID)
+		prx.log.Info("Id response received", "client_id", msg.ID)
 	} else if prx.skt.ID() != msg.ID {
-		fmt.Println("Another id assigned to client before")
+		prx.log.Warn("Another id assigned to client before", "client_id", msg.ID)
 	}
-
+	prx.resolve(message.IDMgsCode, msg.CorrID, result{msg: msg})
 }
 
-func (prx *Proxy) handleListReq(reqData socket.RData) {
+func (prx *Proxy) handleListReq(reqData socket.RData, msg message.ListResponseMsg) {
+	prx.log.Info("List response received", "ids", msg.IDs)
+	prx.mutx.Lock()
+	defer prx.mutx.Unlock()
+	prx.resolve(message.ListMgsCode, msg.CorrID, result{msg: msg})
+}
 
-	bb, err := reqData.Pkt.Data()
-	if err != nil {
-		fmt.Println("Proxy, Error on retrieving list message")
-		return
+// handleRelay pass relay messages of hub to their handlers, hub sends acks of relay requests with the same type
+func (prx *Proxy) handleRelay(reqData socket.RData, msg any) {
+	switch msg := msg.(type) {
+	case message.RelayAckMsg:
+		prx.handleRelayAck(reqData, msg)
+	case message.RelayResponseMsg:
+		prx.handleRelayReq(reqData, msg)
 	}
-	msg, err := message.DeserializeListRes(bb)
-	if err != nil {
-		fmt.Println("Proxy, Error on deserializing list message")
-		return
+}
+
+func (prx *Proxy) handleRelayReq(reqData socket.RData, msg message.RelayResponseMsg) {
+	prx.log.Info("Relay response received", logging.Bytes, len(msg.Body), "sender_id", msg.SenderID)
+}
+
+func (prx *Proxy) handleRelayAck(reqData socket.RData, msg message.RelayAckMsg) {
+	prx.mutx.Lock()
+	defer prx.mutx.Unlock()
+	if !prx.resolve(message.RelayMgsCode, msg.CorrID, result{msg: msg}) {
+		prx.log.Debug("Ack of relay request that is not waited for", "corr_id", msg.CorrID)
 	}
-	fmt.Printf("List response received: %v\n", msg.IDs)
 }
 
-func (prx *Proxy) handleRelayReq(reqData socket.RData) {
-	bb, err := reqData.Pkt.Data()
-	if err != nil {
-		fmt.Println("Proxy, Error on retrieving relay message")
+// handleProb log problems of socket. Socket closes itself after a problem that is not recoverable,
+// then it is released by releaseSocket
+func (prx *Proxy) handleProb(sig socket.ProbData) {
+	var resyncErr *socket.ResyncError
+	if errors.As(sig.Err, &resyncErr) {
+		prx.log.Warn("Stream resynced", logging.Err, sig.Err)
 		return
 	}
-	msg, err := message.DeserializeRelayRes(bb)
-	if err != nil {
-		fmt.Println("Proxy, Error on deserializing relay message")
+	if socket.Recoverable(sig.Err) {
+		prx.log.Warn("Frame dropped", logging.Err, sig.Err)
+		prx.failRequest(sig.Pkt, sig.Err)
 		return
 	}
-	fmt.Printf("Relay response received. Message length is %d, sender id is %d\n", len(msg.Body), msg.SenderID)
-}
-
-func (prx *Proxy) writeHandler() {
-	for {
-		<-prx.writeChan
+	if errors.Is(sig.Err, socket.ErrUndelivered) {
+		prx.log.Warn("Message not delivered before socket closed", logging.MsgType, sig.Pkt.Type())
+		prx.failRequest(sig.Pkt, sig.Err)
+		return
 	}
+	prx.log.Info("Problem received", logging.Err, sig.Err)
 }
 
-func (prx *Proxy) probHandler() {
-	for sig := range prx.probChan {
-		fmt.Printf("Hub, Problem Recived. Error message is %s", sig.Err.Error())
-		prx.CloseSocket()
+// releaseSocket forget a closed socket, unless another socket is set meanwhile
+func (prx *Proxy) releaseSocket(skt socket.Socket, err error) {
+	prx.mutx.Lock()
+	defer prx.mutx.Unlock()
+	if prx.skt != skt {
+		return
+	}
+	prx.skt = nil
+	prx.agreed = socket.Capabilities{}
+	prx.agreedMsgs = 0
+	prx.closeStreams()
+	prx.failPending()
+	if err != nil {
+		prx.log.Info("Socket closed", logging.Err, err)
 	}
 }
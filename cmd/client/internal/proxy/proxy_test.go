@@ -1,9 +1,13 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"testing"
 	"time"
 
+	"github.com/vajafari/messagehub/pkg/logging"
 	"github.com/vajafari/messagehub/pkg/message"
 
 	"github.com/vajafari/messagehub/pkg/socket"
@@ -24,26 +28,42 @@ func (pkt packetMock) Data() ([]byte, error) {
 
 type socketMock struct {
 	id         uint64
-	readChan   chan<- socket.RData
-	writeChan  chan<- socket.WData
-	probChan   chan<- socket.ProbData
+	handler    socket.Handler
 	msgTypeLen map[byte]int
 	packets    []socket.Packet
 	closed     bool
+	caps       socket.Capabilities
+	sendErr    error // Error of SendContext, packet is not queued when it is set
+
+	manualCredit  bool
+	credit        map[uint32]int // Credit given to streams
+	closedStreams []uint32
 }
 
 func (s *socketMock) Start(writeChan chan<- socket.WData, readChan chan<- socket.RData, probChan chan<- socket.ProbData, msgTypeLen map[byte]int) {
-	s.readChan = readChan
-	s.writeChan = writeChan
-	s.probChan = probChan
 	s.msgTypeLen = msgTypeLen
 	s.packets = make([]socket.Packet, 0)
 }
 
+func (s *socketMock) StartHandler(ctx context.Context, h socket.Handler, msgTypeLen map[byte]int) error {
+	if s.handler != nil {
+		return socket.ErrStarted
+	}
+	s.handler = h
+	s.msgTypeLen = msgTypeLen
+	s.packets = make([]socket.Packet, 0)
+	return nil
+}
+
 func (s *socketMock) Close() error {
 	s.closed = true
 	return nil
 }
+
+func (s *socketMock) Shutdown(ctx context.Context) error {
+	s.closed = true
+	return nil
+}
 func (s *socketMock) ID() uint64 {
 	return s.id
 }
@@ -54,54 +74,95 @@ func (s *socketMock) Send(pkt socket.Packet) {
 	s.packets = append(s.packets, pkt)
 }
 
+func (s *socketMock) TrySend(pkt socket.Packet) error {
+	s.packets = append(s.packets, pkt)
+	return nil
+}
+
+func (s *socketMock) SendContext(ctx context.Context, pkt socket.Packet) error {
+	if s.sendErr != nil {
+		return s.sendErr
+	}
+	s.packets = append(s.packets, pkt)
+	return nil
+}
+
+func (s *socketMock) SetCapabilities(caps socket.Capabilities) {
+	s.caps = caps
+}
+
+func (s *socketMock) Stats() socket.Stats {
+	return socket.Stats{}
+}
+
+func (s *socketMock) SetManualCredit(manual bool) {
+	s.manualCredit = manual
+}
+
+func (s *socketMock) GrantCredit(stream uint32, n int) {
+	if s.credit == nil {
+		s.credit = make(map[uint32]int)
+	}
+	s.credit[stream] += n
+}
+
+func (s *socketMock) CloseStream(stream uint32) {
+	s.closedStreams = append(s.closedStreams, stream)
+}
+
 func (s *socketMock) clearPackets() {
 	s.packets = make([]socket.Packet, 0)
 }
 
+// simulateProbData report a problem like socket does, it closes itself after problems that are not recoverable
 func (s *socketMock) simulateProbData(pkt socket.Packet, err error) {
-	s.probChan <- socket.ProbData{
+	s.handler.OnError(socket.ProbData{
 		Pkt:      pkt,
 		SourceID: s.ID(),
 		Err:      err,
+	})
+	if !socket.Recoverable(err) && !errors.Is(err, socket.ErrUndelivered) {
+		s.closed = true
+		s.handler.OnClose(s.ID(), err)
 	}
 }
 
 func (s *socketMock) simulateReadData(pkt socket.Packet) {
-	s.readChan <- socket.RData{
+	s.handler.OnPacket(socket.RData{
 		Pkt:      pkt,
 		SourceID: s.ID(),
-	}
+	})
 }
 
 func (s *socketMock) simulateReadDataByte(bb []byte) {
 	if len(bb) > 1 {
-		s.readChan <- socket.RData{
+		s.handler.OnPacket(socket.RData{
 			Pkt: packetMock{
 				data: bb[1:],
 				typ:  bb[0],
 			},
 			SourceID: s.ID(),
-		}
+		})
 	} else {
-		s.readChan <- socket.RData{
+		s.handler.OnPacket(socket.RData{
 			Pkt: packetMock{
 				data: nil,
 				typ:  bb[0],
 			},
 			SourceID: s.ID(),
-		}
+		})
 	}
 }
 
 func (s *socketMock) simulateWriteData(pkt socket.Packet) {
-	s.writeChan <- socket.WData{
+	s.handler.OnWritten(socket.WData{
 		Pkt:      pkt,
 		SourceID: s.id,
-	}
+	})
 }
 
 func TestSetSocket(t *testing.T) {
-	prx := NewProxy(100)
+	prx := NewProxy()
 	sMock1 := socketMock{}
 	sMock2 := socketMock{}
 
@@ -121,7 +182,7 @@ func TestSetSocket(t *testing.T) {
 }
 
 func TestCloseSocket(t *testing.T) {
-	prx := NewProxy(100)
+	prx := NewProxy()
 	sMock1 := socketMock{}
 	sMock2 := socketMock{}
 
@@ -136,6 +197,15 @@ func TestCloseSocket(t *testing.T) {
 	if !sMock1.closed {
 		t.Fatalf("Socket close method not called")
 	}
+	// Packets that socket read before it is closed are handled after close
+	for _, pkt := range []socket.Packet{
+		message.WelcomeMsg{Version: socket.ProtocolVersion},
+		message.IDResponseMsg{ID: 12},
+		message.ListResponseMsg{IDs: []uint64{1}},
+		message.ErrorMsg{ReqType: message.ListMgsCode},
+	} {
+		sMock1.simulateReadData(pkt)
+	}
 
 	err = prx.SetSocket(&sMock2)
 	if err != nil {
@@ -143,8 +213,23 @@ func TestCloseSocket(t *testing.T) {
 	}
 }
 
+func TestShutdown(t *testing.T) {
+	prx := NewProxy()
+	if err := prx.Shutdown(context.Background()); err != ErrNotConnected {
+		t.Fatal("Shutdown without socket must fail")
+	}
+	sMock1 := socketMock{}
+	prx.SetSocket(&sMock1)
+	if err := prx.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Error on shutdown. Error message %s", err.Error())
+	}
+	if prx.skt != nil || !sMock1.closed {
+		t.Fatal("Socket not shut down")
+	}
+}
+
 func TestIdentification(t *testing.T) {
-	prx := NewProxy(100)
+	prx := NewProxy()
 	sMock1 := socketMock{}
 	prx.SetSocket(&sMock1)
 
@@ -164,7 +249,7 @@ func TestIdentification(t *testing.T) {
 
 // SendIDReq send ID message to server via socket
 func TestSendIDReq(t *testing.T) {
-	prx := NewProxy(100)
+	prx := NewProxy()
 	sMock1 := socketMock{}
 	err := prx.SendID()
 	if err == nil {
@@ -189,7 +274,7 @@ func TestSendIDReq(t *testing.T) {
 
 // SendListReq send list message to server via socket
 func TestSendListReq(t *testing.T) {
-	prx := NewProxy(100)
+	prx := NewProxy()
 	sMock1 := socketMock{}
 	err := prx.SendList()
 	if err == nil {
@@ -215,17 +300,17 @@ func TestSendListReq(t *testing.T) {
 }
 
 func TestSendRelayRequest(t *testing.T) {
-	prx := NewProxy(100)
+	prx := NewProxy()
 	sMock1 := socketMock{}
 
 	bbOk := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9}
-	bbNotOk := make([]byte, message.RelayMaxBodySize+100)
+	bbNotOk := make([]byte, maxRelayReqLen)
 	IdsOk := []uint64{250, 260, 270}
 	IdsNotOk := make([]uint64, 300)
 	for i := 0; i < 300; i++ {
 		IdsNotOk[i] = uint64(i + 1)
 	}
-	for i := 0; i < message.RelayMaxBodySize+100; i++ {
+	for i := range bbNotOk {
 		bbNotOk[i] = 1
 	}
 
@@ -264,4 +349,609 @@ func TestSendRelayRequest(t *testing.T) {
 		t.Fatal("Cannot send list request when socket not identified")
 	}
 
+	// Without correlation hub sends no ack, so relay returns once it is sent
+	err = prx.Relay(context.Background(), IdsOk, bbOk)
+	if err != nil || len(sMock1.packets) != 2 || sMock1.packets[1].(message.RelayRequestMsg).CorrID != 0 {
+		t.Fatalf("Relay without correlation not sent. Error %v", err)
+	}
+}
+
+func TestSendError(t *testing.T) {
+	prx := NewProxy()
+	prx.SetLogger(logging.Discard)
+	sMock := socketMock{sendErr: socket.ErrQueueFull}
+	prx.SetSocket(&sMock)
+	// Messages that are not queued are not reported as sent
+	if err := prx.SendHello(); err != socket.ErrQueueFull {
+		t.Fatalf("Expected ErrQueueFull on hello, actual %v", err)
+	}
+	if err := prx.SendID(); err != socket.ErrQueueFull {
+		t.Fatalf("Expected ErrQueueFull on id, actual %v", err)
+	}
+	sMock.id = 1
+	if err := prx.SendList(); err != socket.ErrQueueFull {
+		t.Fatalf("Expected ErrQueueFull on list, actual %v", err)
+	}
+	if err := prx.SendRelay([]uint64{2}, []byte{1}); err != socket.ErrQueueFull {
+		t.Fatalf("Expected ErrQueueFull on relay, actual %v", err)
+	}
+	sMock.sendErr = socket.ErrClosed
+	if err := prx.Send(message.ListRequestMsg{}); err != socket.ErrClosed {
+		t.Fatalf("Expected ErrClosed, actual %v", err)
+	}
+	if len(sMock.packets) != 0 {
+		t.Fatalf("Expected no queued packet, actual %d", len(sMock.packets))
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	prx := NewProxy()
+	sMock1 := socketMock{}
+	err := prx.SendHello()
+	if err != ErrNotConnected {
+		t.Fatal("Cannot send hello when no socket set to proxy")
+	}
+	prx.SetFeatures(socket.FeatureChecksum)
+	prx.SetSocket(&sMock1)
+	err = prx.SendHello()
+	if err != nil || len(sMock1.packets) != 1 {
+		t.Fatal("Hello message not sent to socket")
+	}
+	expected := message.HelloMsg{Version: socket.ProtocolVersion, MaxFrameSize: uint32(maxRelayMsgLen), Features: message.JoinFeatures(uint32(socket.FeatureChecksum), message.SupportedFeatures)}
+	if sMock1.packets[0] != expected {
+		t.Fatalf("Invalid hello message. Expected %+v, actual %+v", expected, sMock1.packets[0])
+	}
+
+	// Hub cannot enable a feature that proxy did not offer
+	sMock1.simulateReadData(message.WelcomeMsg{Version: socket.ProtocolVersion, MaxFrameSize: 20, Features: uint32(socket.FeatureChecksum | socket.FeatureHeartbeat)})
+	time.Sleep(20 * time.Millisecond)
+	expectedCaps := socket.Capabilities{Version: socket.ProtocolVersion, MaxFrameSize: 20, Features: socket.FeatureChecksum}
+	if prx.Capabilities() != expectedCaps || sMock1.caps != expectedCaps {
+		t.Fatalf("Agreed capabilities not applied. Expected %+v, actual %+v", expectedCaps, prx.Capabilities())
+	}
+
+	sMock1.id = 12
+	sMock1.clearPackets()
+	err = prx.SendRelay([]uint64{1, 2}, make([]byte, 4))
+	if err != ErrFrameTooLarge || len(sMock1.packets) > 0 {
+		t.Fatal("Relay message larger than max frame size of hub sent")
+	}
+	err = prx.SendRelay([]uint64{1, 2}, make([]byte, 3))
+	if err != nil || len(sMock1.packets) != 1 {
+		t.Fatal("Relay message in max frame size of hub not sent")
+	}
+	err = prx.SendHello()
+	if err == nil {
+		t.Fatal("Send hello for identified socket")
+	}
+
+	// With fragmentation, socket splits relay messages larger than max frame size of hub
+	prx.CloseSocket()
+	sMock2 := socketMock{}
+	prx.SetFeatures(socket.FeatureChecksum | socket.FeatureFragmentation)
+	prx.SetSocket(&sMock2)
+	prx.SendHello()
+	sMock2.simulateReadData(message.WelcomeMsg{Version: socket.ProtocolVersion, MaxFrameSize: 20, Features: uint32(socket.FeatureChecksum | socket.FeatureFragmentation)})
+	time.Sleep(20 * time.Millisecond)
+	sMock2.id = 13
+	sMock2.clearPackets()
+	err = prx.SendRelay([]uint64{1, 2}, make([]byte, 100))
+	if err != nil || len(sMock2.packets) != 1 {
+		t.Fatal("Relay message larger than max frame size not sent with fragmentation")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	prx := NewProxy()
+	var received []byte
+	err := prx.Register(message.MsgType(100), message.Codec[socket.RData]{
+		MaxLen: 4,
+		Handle: func(rData socket.RData, msg any) { received = msg.([]byte) },
+	})
+	if err != nil {
+		t.Fatalf("Message type not registered. Error %v", err)
+	}
+	if err := prx.Send(packetMock{typ: 100}); err != ErrNotConnected {
+		t.Fatal("Message sent without socket")
+	}
+	sMock1 := socketMock{}
+	prx.SetSocket(&sMock1)
+	if sMock1.msgTypeLen[100] != 4 || sMock1.msgTypeLen[byte(message.RelayMgsCode)] != maxRelayMsgLen {
+		t.Fatalf("Unexpected max lengths of socket %v", sMock1.msgTypeLen)
+	}
+	sMock1.simulateReadDataByte([]byte{100, 1, 2})
+	if !bytes.Equal(received, []byte{1, 2}) {
+		t.Fatalf("Application message not handled, received %v", received)
+	}
+	if err := prx.Send(packetMock{typ: 100, data: []byte{3}}); err != nil || len(sMock1.packets) != 1 {
+		t.Fatal("Application message not sent")
+	}
+}
+
+func TestStreams(t *testing.T) {
+	prx := NewProxy()
+	if _, err := prx.OpenStream(1); err != ErrNotConnected {
+		t.Fatal("Stream opened without socket")
+	}
+	sMock1 := socketMock{id: 12}
+	prx.SetSocket(&sMock1)
+	if !sMock1.manualCredit {
+		t.Fatal("Proxy must give credit of streams itself")
+	}
+	if _, err := prx.OpenStream(1); err != ErrStreamsDisabled {
+		t.Fatal("Stream opened before streams agreed with hub")
+	}
+	sMock1.simulateReadData(message.WelcomeMsg{Version: socket.ProtocolVersion, Features: uint32(socket.FeatureStreams)})
+	if _, err := prx.OpenStream(0); err == nil {
+		t.Fatal("Default stream opened")
+	}
+	chat, err := prx.OpenStream(1)
+	if err != nil {
+		t.Fatalf("Stream not opened. Error %v", err)
+	}
+	if _, err := prx.OpenStream(1); err != ErrStreamOpen {
+		t.Fatal("Stream opened twice")
+	}
+	files, _ := prx.OpenStream(2)
+
+	sMock1.clearPackets()
+	if err := chat.SendRelay([]uint64{1}, []byte{1, 2}); err != nil || len(sMock1.packets) != 1 || socket.StreamOf(sMock1.packets[0]) != 1 {
+		t.Fatalf("Relay message not sent on stream. Error %v", err)
+	}
+	if err := chat.SendRelay(nil, []byte{1, 2}); err == nil {
+		t.Fatal("Relay message without receivers sent on stream")
+	}
+
+	// Messages go to their stream and credit is given when they are received
+	relay := func(stream uint32, body byte) {
+		sMock1.handler.OnPacket(socket.RData{Pkt: message.RelayResponseMsg{SenderID: 3, Body: []byte{body}}, SourceID: 12, Stream: stream})
+	}
+	relay(2, 7)
+	relay(1, 8)
+	relay(9, 9)
+	if sMock1.credit[9] != 9 || sMock1.credit[1] != 0 {
+		t.Fatalf("Unexpected credit %v, only stream that is not open gets credit at once", sMock1.credit)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	msg, err := chat.Recv(ctx)
+	if err != nil || msg.Body[0] != 8 || msg.SenderID != 3 || sMock1.credit[1] != 9 {
+		t.Fatalf("Unexpected message %+v of stream. Error %v", msg, err)
+	}
+	msg, err = files.Recv(ctx)
+	if err != nil || msg.Body[0] != 7 {
+		t.Fatalf("Unexpected message %+v of stream. Error %v", msg, err)
+	}
+
+	if err := chat.Close(); err != nil || len(sMock1.closedStreams) != 1 || sMock1.closedStreams[0] != 1 {
+		t.Fatalf("Stream not closed on socket. Error %v", err)
+	}
+	if _, err := chat.Recv(ctx); err != ErrStreamClosed {
+		t.Fatal("Message received from closed stream")
+	}
+	if err := chat.SendRelay([]uint64{1}, []byte{1}); err != ErrStreamClosed {
+		t.Fatal("Message sent on closed stream")
+	}
+	// Streams are closed with their socket
+	sMock1.simulateProbData(nil, errors.New("Connection reset"))
+	if _, err := files.Recv(ctx); err != ErrStreamClosed {
+		t.Fatal("Stream not closed with its socket")
+	}
+}
+
+func TestProxyOverPipe(t *testing.T) {
+	for _, conf := range []socket.PipeConfig{
+		{Latency: time.Millisecond},
+		{Faults: &socket.Faults{Seed: 1, ReadChunk: 1, WriteChunk: 1}},
+		{Faults: &socket.Faults{Seed: 2, ReadChunk: 5, WriteChunk: 3, DelayRate: 0.1, MaxDelay: time.Millisecond}},
+	} {
+		testProxyOverPipe(t, conf)
+	}
+}
+
+func testProxyOverPipe(t *testing.T, conf socket.PipeConfig) {
+	prxSide, hubSide := socket.Pipe(conf)
+	prxSide.SetLogger(logging.Discard)
+	hubSide.SetLogger(logging.Discard)
+	hubRead := make(chan socket.RData, 10)
+	hubSide.Start(make(chan socket.WData, 10), hubRead, make(chan socket.ProbData, 10), map[byte]int{
+		byte(message.HelloMgsCode): message.HelloMaxLen,
+		byte(message.IDMgsCode):    0,
+	})
+	defer hubSide.Close()
+	prx := NewProxy()
+	prx.SetLogger(logging.Discard)
+	if err := prx.SetSocket(prxSide); err != nil {
+		t.Fatalf("Socket not set. Error %v", err)
+	}
+	defer prx.CloseSocket()
+
+	// Hub side answers requests of proxy that it reads from pipe
+	hubAnswer := func(typ message.MsgType, answer socket.Packet) {
+		select {
+		case rData := <-hubRead:
+			if rData.Pkt.Type() != byte(typ) {
+				t.Fatalf("Expected message of type %d, actual %d", typ, rData.Pkt.Type())
+			}
+			hubSide.Send(answer)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Message of type %d not received", typ)
+		}
+	}
+	waitFor := func(what string, done func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !done(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s not received", what)
+			}
+		}
+	}
+
+	// Hello is sent in v1 frame, so hubs that only read v1 frames understand it
+	if prxSide.FrameVersion() != socket.FrameV1 {
+		t.Fatalf("Expected v1 frames before handshake, actual v%d", prxSide.FrameVersion())
+	}
+	prx.SendHello()
+	hubAnswer(message.HelloMgsCode, message.WelcomeMsg{Version: socket.ProtocolVersion, Features: uint32(socket.SupportedFeatures)})
+	waitFor("Welcome", func() bool { return prx.Capabilities().Version == socket.ProtocolVersion })
+	if prxSide.FrameVersion() != socket.FrameV2 {
+		t.Fatalf("Expected v2 frames after checksum is agreed, actual v%d", prxSide.FrameVersion())
+	}
+
+	prx.SendID()
+	hubAnswer(message.IDMgsCode, message.IDResponseMsg{ID: 42})
+	waitFor("Id", func() bool { return prxSide.ID() == 42 })
+	if err := prx.SendList(); err != nil {
+		t.Fatalf("List not sent by identified proxy. Error %v", err)
+	}
+}
+
+func TestSendOnFullQueue(t *testing.T) {
+	prxSide, hubSide := socket.Pipe(socket.PipeConfig{BufferSize: 16, SendQueueSize: 1})
+	prxSide.SetLogger(logging.Discard)
+	hubSide.SetLogger(logging.Discard)
+	prx := NewProxy()
+	prx.SetLogger(logging.Discard)
+	if err := prx.SetSocket(prxSide); err != nil {
+		t.Fatalf("Socket not set. Error %v", err)
+	}
+	defer prx.CloseSocket()
+	// Hub side does not read its first message, so send queue of proxy fills and Send waits for room
+	hubSide.Start(make(chan socket.WData, 10), make(chan socket.RData), make(chan socket.ProbData, 10), map[byte]int{100: 1024})
+	defer hubSide.Close()
+	go func() {
+		for i := 0; i < 100; i++ {
+			if prx.Send(packetMock{typ: 100, data: make([]byte, 1024)}) != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Reader of proxy handles messages of hub while a sender waits
+	hubSide.Send(message.WelcomeMsg{Version: socket.ProtocolVersion, Features: uint32(socket.FeatureChecksum)})
+	handled := make(chan struct{})
+	go func() {
+		for prx.Capabilities().Version != socket.ProtocolVersion {
+			time.Sleep(time.Millisecond)
+		}
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Welcome not handled while send queue is full")
+	}
+}
+
+func TestRequests(t *testing.T) {
+	prx := NewProxy()
+	prx.SetLogger(logging.Discard)
+	if _, err := prx.List(context.Background()); err != ErrNotConnected {
+		t.Fatal("List requested without socket")
+	}
+	prxSide, hubSide := socket.Pipe(socket.PipeConfig{})
+	prxSide.SetLogger(logging.Discard)
+	hubSide.SetLogger(logging.Discard)
+	hubRead := make(chan socket.RData, 10)
+	hubSide.Start(make(chan socket.WData, 10), hubRead, make(chan socket.ProbData, 10), map[byte]int{
+		byte(message.HelloMgsCode): message.HelloMaxLen,
+		byte(message.IDMgsCode):    message.CorrIDLen,
+		byte(message.ListMgsCode):  message.CorrIDLen,
+	})
+	defer hubSide.Close()
+	prx.SetSocket(prxSide)
+	if _, err := prx.List(context.Background()); err != ErrNotIdentified {
+		t.Fatal("List requested by unidentified client")
+	}
+
+	// hubReq return correlation id of the next request that hub reads
+	hubReq := func(typ message.MsgType) uint32 {
+		select {
+		case rData := <-hubRead:
+			if rData.Pkt.Type() != byte(typ) {
+				t.Fatalf("Expected request of type %d, actual %d", typ, rData.Pkt.Type())
+			}
+			if typ == message.HelloMgsCode {
+				return 0
+			}
+			// Id and list requests have the same format
+			data, _ := rData.Pkt.Data()
+			msg, err := message.DeserializeListReq(data)
+			if err != nil {
+				t.Fatalf("Request of type %d not valid. Error %v", typ, err)
+			}
+			return msg.CorrID
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Request of type %d not received", typ)
+		}
+		return 0
+	}
+	prx.SendHello()
+	hubReq(message.HelloMgsCode)
+	hubSide.Send(message.WelcomeMsg{Version: socket.ProtocolVersion, Features: uint32(message.FeatureCorrelation)})
+	for deadline := time.Now().Add(5 * time.Second); !prx.MessageFeatures().Has(message.FeatureCorrelation); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Welcome not received")
+		}
+	}
+
+	type listRes struct {
+		ids []uint64
+		err error
+	}
+	list := func(ctx context.Context) chan listRes {
+		res := make(chan listRes, 1)
+		go func() {
+			ids, err := prx.List(ctx)
+			res <- listRes{ids, err}
+		}()
+		return res
+	}
+	wait := func(res chan listRes) listRes {
+		select {
+		case r := <-res:
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatal("List not returned")
+		}
+		return listRes{}
+	}
+
+	idRes := make(chan uint64, 1)
+	go func() {
+		id, _ := prx.Identify(context.Background())
+		idRes <- id
+	}()
+	hubSide.Send(message.IDResponseMsg{ID: 42, CorrID: hubReq(message.IDMgsCode)})
+	if id := <-idRes; id != 42 || prxSide.ID() != 42 {
+		t.Fatalf("Expected id 42, actual %d", id)
+	}
+
+	// Pipelined requests get their own responses, whatever order hub answers them in
+	first := list(context.Background())
+	corr1 := hubReq(message.ListMgsCode)
+	second := list(context.Background())
+	corr2 := hubReq(message.ListMgsCode)
+	if corr1 == 0 || corr1 == corr2 {
+		t.Fatalf("Expected different correlation ids, actual %d and %d", corr1, corr2)
+	}
+	hubSide.Send(message.ListResponseMsg{IDs: []uint64{2}, CorrID: corr2})
+	hubSide.Send(message.ListResponseMsg{IDs: []uint64{1}, CorrID: corr1})
+	if r := wait(first); r.err != nil || len(r.ids) != 1 || r.ids[0] != 1 {
+		t.Fatalf("Unexpected response %v of first request. Error %v", r.ids, r.err)
+	}
+	if r := wait(second); r.err != nil || len(r.ids) != 1 || r.ids[0] != 2 {
+		t.Fatalf("Unexpected response %v of second request. Error %v", r.ids, r.err)
+	}
+
+	// Late response of a request that timed out is dropped
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	late := list(ctx)
+	corrLate := hubReq(message.ListMgsCode)
+	if r := wait(late); r.err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline error, actual %v", r.err)
+	}
+	next := list(context.Background())
+	corrNext := hubReq(message.ListMgsCode)
+	hubSide.Send(message.ListResponseMsg{IDs: []uint64{3}, CorrID: corrLate})
+	hubSide.Send(message.ListResponseMsg{IDs: []uint64{4}, CorrID: corrNext})
+	if r := wait(next); r.err != nil || len(r.ids) != 1 || r.ids[0] != 4 {
+		t.Fatalf("Unexpected response %v after timed out request. Error %v", r.ids, r.err)
+	}
+
+	// Rejected request returns error of hub
+	rejected := list(context.Background())
+	hubSide.Send(message.ErrorMsg{ReqType: message.ListMgsCode, Code: message.ErrCodeNotIdentified,
+		CorrID: hubReq(message.ListMgsCode), Reason: "not identified"})
+	r := wait(rejected)
+	var hubErr *HubError
+	if !errors.As(r.err, &hubErr) || hubErr.Reason != "not identified" || !errors.Is(r.err, ErrNotIdentified) {
+		t.Fatalf("Expected rejection of hub, actual %v", r.err)
+	}
+
+	// Requests fail when socket is closed
+	closed := list(context.Background())
+	hubReq(message.ListMgsCode)
+	prx.CloseSocket()
+	if r := wait(closed); r.err != ErrClosed {
+		t.Fatalf("Expected ErrClosed, actual %v", r.err)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	prx := NewProxy()
+	prx.SetLogger(logging.Discard)
+	prxSide, hubSide := socket.Pipe(socket.PipeConfig{})
+	prxSide.SetLogger(logging.Discard)
+	hubSide.SetLogger(logging.Discard)
+	hubRead := make(chan socket.RData, 10)
+	hubSide.Start(make(chan socket.WData, 10), hubRead, make(chan socket.ProbData, 10), map[byte]int{
+		byte(message.HelloMgsCode): message.HelloMaxLen,
+		byte(message.RelayMgsCode): 100,
+	})
+	defer hubSide.Close()
+	prx.SetSocket(prxSide)
+	prx.SendHello()
+	<-hubRead
+	hubSide.Send(message.WelcomeMsg{Version: socket.ProtocolVersion, Features: uint32(message.FeatureCorrelation)})
+	for deadline := time.Now().Add(5 * time.Second); !prx.MessageFeatures().Has(message.FeatureCorrelation); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Welcome not received")
+		}
+	}
+	prxSide.SetID(1)
+
+	relay := func() (chan error, message.RelayRequestMsg) {
+		res := make(chan error, 1)
+		go func() {
+			res <- prx.Relay(context.Background(), []uint64{2, 3}, []byte{7})
+		}()
+		select {
+		case rData := <-hubRead:
+			data, _ := rData.Pkt.Data()
+			msg, err := message.DeserializeRelayReq(data)
+			if err != nil || msg.CorrID == 0 {
+				t.Fatalf("Relay request without correlation id. Error %v", err)
+			}
+			return res, msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("Relay request not received")
+		}
+		return nil, message.RelayRequestMsg{}
+	}
+	wait := func(res chan error) error {
+		select {
+		case err := <-res:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("Relay not returned")
+		}
+		return nil
+	}
+
+	res, msg := relay()
+	hubSide.Send(message.RelayAckMsg{CorrID: msg.CorrID})
+	if err := wait(res); err != nil {
+		t.Fatalf("Acknowledged relay returned error %v", err)
+	}
+
+	res, msg = relay()
+	hubSide.Send(message.ErrorMsg{ReqType: message.RelayMgsCode, Code: message.ErrCodeQueueFull, CorrID: msg.CorrID,
+		IDs: []uint64{3}})
+	var hubErr *HubError
+	if err := wait(res); !errors.As(err, &hubErr) || hubErr.Code != message.ErrCodeQueueFull || len(hubErr.IDs) != 1 ||
+		hubErr.IDs[0] != 3 {
+		t.Fatalf("Expected recipients that did not get relay, actual %v", err)
+	}
+}
+
+func TestRelayLargeBody(t *testing.T) {
+	prx := NewProxy()
+	prx.SetLogger(logging.Discard)
+	limits := map[byte]int{byte(message.RelayMgsCode): 4 * message.RelayMaxBodySize}
+	prx.SetReassemblyLimits(limits)
+	prxSide, hubSide := socket.Pipe(socket.PipeConfig{})
+	prxSide.SetLogger(logging.Discard)
+	hubSide.SetLogger(logging.Discard)
+	prxSide.SetReassemblyLimits(limits)
+	hubSide.SetReassemblyLimits(limits)
+	hubRead := make(chan socket.RData, 10)
+	hubSide.Start(make(chan socket.WData, 10), hubRead, make(chan socket.ProbData, 10), map[byte]int{
+		byte(message.HelloMgsCode): message.HelloMaxLen,
+		byte(message.RelayMgsCode): maxRelayReqLen,
+	})
+	defer hubSide.Close()
+	prx.SetSocket(prxSide)
+	prx.SendHello()
+	<-hubRead
+	caps := socket.Capabilities{Version: socket.ProtocolVersion, MaxFrameSize: maxRelayReqLen, Features: socket.FeatureFragmentation}
+	hubSide.SetCapabilities(caps)
+	hubSide.Send(message.WelcomeMsg{Version: caps.Version, MaxFrameSize: uint32(caps.MaxFrameSize),
+		Features: message.JoinFeatures(uint32(caps.Features), message.FeatureCorrelation)})
+	for deadline := time.Now().Add(5 * time.Second); !prx.MessageFeatures().Has(message.FeatureCorrelation); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Welcome not received")
+		}
+	}
+	prxSide.SetID(1)
+
+	if err := prx.Relay(context.Background(), []uint64{2}, make([]byte, 4*message.RelayMaxBodySize)); err == nil {
+		t.Fatal("Relay message larger than reassembly limit sent")
+	}
+	body := make([]byte, 3*message.RelayMaxBodySize)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	res := make(chan error, 1)
+	go func() {
+		res <- prx.Relay(context.Background(), []uint64{2}, body)
+	}()
+	select {
+	case rData := <-hubRead:
+		data, _ := rData.Pkt.Data()
+		msg, err := message.DeserializeRelayReq(data)
+		if err != nil || !bytes.Equal(msg.Body, body) {
+			t.Fatalf("Large relay message not received. Error %v", err)
+		}
+		hubSide.Send(message.RelayAckMsg{CorrID: msg.CorrID})
+	case err := <-res:
+		t.Fatalf("Relay returned before hub received it. Error %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Large relay message not received")
+	}
+	select {
+	case err := <-res:
+		if err != nil {
+			t.Fatalf("Acknowledged relay returned error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Relay not returned")
+	}
+}
+
+func TestHubError(t *testing.T) {
+	prx := NewProxy()
+	prx.SetLogger(logging.Discard)
+	sMock := socketMock{id: 1}
+	prx.SetSocket(&sMock)
+	var errs []error
+	prx.SetErrorHandler(func(err error) {
+		errs = append(errs, err)
+	})
+	// Rejected relay does not belong to a request, so it goes to error handler
+	sMock.simulateReadData(message.ErrorMsg{ReqType: message.RelayMgsCode, Code: message.ErrCodeUnknownRecipient,
+		Reason: "Recipient 2 is not connected"})
+	if len(errs) != 1 {
+		t.Fatalf("Expected one error in handler, actual %d", len(errs))
+	}
+	var hubErr *HubError
+	if !errors.As(errs[0], &hubErr) || hubErr.ReqType != message.RelayMgsCode || hubErr.Code != message.ErrCodeUnknownRecipient {
+		t.Fatalf("Unexpected error %v", errs[0])
+	}
+	if errors.Is(errs[0], ErrNotIdentified) {
+		t.Fatal("Unknown recipient reported as not identified")
+	}
+}
+
+func TestDroppedRelay(t *testing.T) {
+	prx := NewProxy()
+	prx.SetLogger(logging.Discard)
+	sMock := socketMock{id: 1}
+	prx.SetSocket(&sMock)
+	var errs []error
+	prx.SetErrorHandler(func(err error) {
+		errs = append(errs, err)
+	})
+	// Relay message of a stream that socket dropped belongs to no request, so it goes to error handler
+	blocked := &socket.FrameError{Type: byte(message.RelayMgsCode), Err: socket.ErrStreamBlocked}
+	sMock.simulateProbData(socket.OnStream(5, message.RelayRequestMsg{IDs: []uint64{2}, Body: []byte{1}}), blocked)
+	if len(errs) != 1 || !errors.Is(errs[0], socket.ErrStreamBlocked) {
+		t.Fatalf("Expected dropped relay message in error handler, actual %v", errs)
+	}
+	// Other dropped messages are only logged
+	sMock.simulateProbData(message.ListRequestMsg{}, &socket.FrameError{Type: byte(message.ListMgsCode), Err: socket.ErrQueueFull})
+	if len(errs) != 1 {
+		t.Fatalf("Expected one error in handler, actual %d", len(errs))
+	}
 }
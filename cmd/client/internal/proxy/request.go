@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math"
+
+	"github.com/vajafari/messagehub/pkg/message"
+	"github.com/vajafari/messagehub/pkg/socket"
+)
+
+// ErrClosed happen when socket is closed before response of a request is received
+var ErrClosed = errors.New("Socket closed before response received")
+
+// pending is a request that waits for its response
+type pending struct {
+	typ    message.MsgType
+	corrID uint32 // Zero when correlation is not agreed, then responses resolve requests in order
+	done   chan result
+}
+
+// result is response of a request or the reason that it is not received
+type result struct {
+	msg any
+	err error
+}
+
+// Identify ask hub for id of client and wait for it. Id is returned at once when client is identified before
+func (prx *Proxy) Identify(ctx context.Context) (uint64, error) {
+	prx.mutx.RLock()
+	if prx.skt != nil && prx.skt.ID() > 0 {
+		defer prx.mutx.RUnlock()
+		return prx.skt.ID(), nil
+	}
+	prx.mutx.RUnlock()
+	res, err := prx.request(ctx, message.IDMgsCode, nil, func(corrID uint32) socket.Packet {
+		return message.IDRequestMsg{CorrID: corrID}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.(message.IDResponseMsg).ID, nil
+}
+
+// List ask hub for ids of other identified clients and wait for them
+func (prx *Proxy) List(ctx context.Context) ([]uint64, error) {
+	res, err := prx.request(ctx, message.ListMgsCode, func(skt socket.Socket) error {
+		if skt.ID() == 0 {
+			return ErrNotIdentified
+		}
+		return nil
+	}, func(corrID uint32) socket.Packet {
+		return message.ListRequestMsg{CorrID: corrID}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(message.ListResponseMsg).IDs, nil
+}
+
+// Relay send relay message to hub and wait until hub pushes it to send queue of all the recipients. When some
+// recipients do not get it, a *HubError lists them in IDs. Hubs that did not agree correlation send no ack,
+// then Relay returns once message is sent, like SendRelay
+func (prx *Proxy) Relay(ctx context.Context, ids []uint64, bb []byte) error {
+	_, err := prx.request(ctx, message.RelayMgsCode, func(skt socket.Socket) error {
+		msg := message.RelayRequestMsg{IDs: ids, Body: bb}
+		// Correlation id is set after check, but it counts in frame size
+		if prx.agreedMsgs.Has(message.FeatureCorrelation) {
+			msg.CorrID = math.MaxUint32
+		}
+		return prx.checkRelay(msg)
+	}, func(corrID uint32) socket.Packet {
+		return message.RelayRequestMsg{IDs: ids, Body: bb, CorrID: corrID}
+	})
+	return err
+}
+
+// request send a request and wait for its response until ctx is done. Check tells whether request can be
+// sent on socket. Requests carry a correlation id when it is agreed with hub, so pipelined requests get
+// their own responses
+func (prx *Proxy) request(ctx context.Context, typ message.MsgType, check func(skt socket.Socket) error,
+	build func(corrID uint32) socket.Packet) (any, error) {
+	prx.mutx.Lock()
+	if prx.skt == nil {
+		prx.mutx.Unlock()
+		return nil, ErrNotConnected
+	}
+	if check != nil {
+		if err := check(prx.skt); err != nil {
+			prx.mutx.Unlock()
+			return nil, err
+		}
+	}
+	p := &pending{typ: typ, done: make(chan result, 1)}
+	if prx.agreedMsgs.Has(message.FeatureCorrelation) {
+		// Zero means no correlation id, so it is skipped when counter wraps
+		if prx.corrID++; prx.corrID == 0 {
+			prx.corrID++
+		}
+		p.corrID = prx.corrID
+	}
+	// Hub acknowledges relay requests only by correlation id, so without it relay is done once it is sent
+	oneWay := typ == message.RelayMgsCode && p.corrID == 0
+	if !oneWay {
+		prx.pending = append(prx.pending, p)
+	}
+	skt := prx.skt
+	prx.mutx.Unlock()
+
+	if err := skt.SendContext(ctx, build(p.corrID)); err != nil {
+		prx.dropPending(p)
+		return nil, err
+	}
+	if oneWay {
+		return nil, nil
+	}
+	select {
+	case res := <-p.done:
+		return res.msg, res.err
+	case <-ctx.Done():
+		// Response that is received later is dropped by resolve
+		prx.dropPending(p)
+		return nil, ctx.Err()
+	}
+}
+
+// dropPending forget a request that is not waited for anymore
+func (prx *Proxy) dropPending(p *pending) {
+	prx.mutx.Lock()
+	defer prx.mutx.Unlock()
+	for i, q := range prx.pending {
+		if q == p {
+			prx.pending = append(prx.pending[:i], prx.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// resolve pass response to the request with the same type and correlation id. Without correlation id
+// the oldest request of type gets it. Lock of proxy must be held
+func (prx *Proxy) resolve(typ message.MsgType, corrID uint32, res result) bool {
+	for i, p := range prx.pending {
+		if p.typ == typ && p.corrID == corrID {
+			prx.pending = append(prx.pending[:i], prx.pending[i+1:]...)
+			p.done <- res
+			return true
+		}
+	}
+	return false
+}
+
+// failRequest fail the request that is not delivered to hub. Only requests with correlation id are known.
+// Relay messages that no request waits for go to error handler, so messages of SendRelay are not lost silently
+func (prx *Proxy) failRequest(pkt socket.Packet, err error) {
+	var typ message.MsgType
+	var corrID uint32
+	// Messages of streams are wrapped by socket.OnStream
+	switch msg := socket.PacketOf(pkt).(type) {
+	case message.IDRequestMsg:
+		typ, corrID = message.IDMgsCode, msg.CorrID
+	case message.ListRequestMsg:
+		typ, corrID = message.ListMgsCode, msg.CorrID
+	case message.RelayRequestMsg:
+		typ, corrID = message.RelayMgsCode, msg.CorrID
+	}
+	prx.mutx.Lock()
+	resolved := corrID != 0 && prx.resolve(typ, corrID, result{err: err})
+	handler := prx.errHandler
+	prx.mutx.Unlock()
+	if !resolved && typ == message.RelayMgsCode && handler != nil {
+		handler(err)
+	}
+}
+
+// failPending fail all the requests when socket is released. Lock of proxy must be held
+func (prx *Proxy) failPending() {
+	for _, p := range prx.pending {
+		p.done <- result{err: ErrClosed}
+	}
+	prx.pending = nil
+}
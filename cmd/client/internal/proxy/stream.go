@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/vajafari/messagehub/pkg/logging"
+	"github.com/vajafari/messagehub/pkg/message"
+	"github.com/vajafari/messagehub/pkg/socket"
+)
+
+var (
+	// ErrStreamsDisabled happen when streams are not agreed with hub in handshake
+	ErrStreamsDisabled = errors.New("Streams are not agreed with hub")
+	// ErrStreamOpen happen when a stream with the same id is already open
+	ErrStreamOpen = errors.New("Stream is already open")
+	// ErrStreamClosed happen when stream is closed by owner or its socket is closed
+	ErrStreamClosed = errors.New("Stream is closed")
+)
+
+// Stream is a logical stream of relay messages over socket of proxy. Streams share identity and connection
+// of proxy, but each keeps its own order and flow control, so a stream that is not read does not hold back
+// others. Hub relays messages on the stream they are sent on, so both clients must use the same stream id
+type Stream struct {
+	id     uint32
+	prx    *Proxy
+	skt    socket.Socket
+	mutx   sync.Mutex
+	msgs   []streamMsg
+	signal chan struct{} // Closed and replaced when a message is queued or stream is closed
+	closed bool
+}
+
+// streamMsg is a received message and its size that is given back as credit when it is consumed
+type streamMsg struct {
+	msg  message.RelayResponseMsg
+	size int
+}
+
+// OpenStream open a stream of relay messages with id. Id zero is the default stream of proxy. Streams
+// must be agreed with hub, see socket.FeatureStreams
+func (prx *Proxy) OpenStream(id uint32) (*Stream, error) {
+	prx.mutx.Lock()
+	defer prx.mutx.Unlock()
+	if prx.skt == nil {
+		return nil, ErrNotConnected
+	}
+	if id == 0 {
+		return nil, errors.New("Stream id must not be zero")
+	}
+	if !prx.agreed.Has(socket.FeatureStreams) {
+		return nil, ErrStreamsDisabled
+	}
+	if _, ok := prx.streams[id]; ok {
+		return nil, ErrStreamOpen
+	}
+	st := &Stream{
+		id:     id,
+		prx:    prx,
+		skt:    prx.skt,
+		signal: make(chan struct{}),
+	}
+	prx.streams[id] = st
+	prx.log.Debug("Stream opened", logging.Stream, id)
+	return st, nil
+}
+
+// ID return id of stream
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// SendRelay send relay message to hub on stream
+func (st *Stream) SendRelay(ids []uint64, bb []byte) error {
+	prx := st.prx
+	msg := message.RelayRequestMsg{
+		Body: bb,
+		IDs:  ids,
+	}
+	skt, err := prx.checkedSocket(func(skt socket.Socket) error {
+		if st.isClosed() {
+			return ErrStreamClosed
+		}
+		return prx.checkRelay(msg)
+	})
+	if err != nil {
+		return err
+	}
+	// Hub gives credit of stream back when recipients took message, so socket holds stream back while the
+	// slowest recipient does not read. Messages that do not fit in its queue go to error handler, see SetErrorHandler
+	if err := skt.SendContext(context.Background(), socket.OnStream(st.id, msg)); err != nil {
+		return err
+	}
+	prx.log.Debug("Relay message pushed in send queue", logging.Stream, st.id)
+	return nil
+}
+
+// Recv wait for the next relay message of stream. Hub sends more messages of stream as they are received
+func (st *Stream) Recv(ctx context.Context) (message.RelayResponseMsg, error) {
+	for {
+		st.mutx.Lock()
+		if len(st.msgs) > 0 {
+			m := st.msgs[0]
+			st.msgs[0] = streamMsg{}
+			st.msgs = st.msgs[1:]
+			st.mutx.Unlock()
+			st.skt.GrantCredit(st.id, m.size)
+			return m.msg, nil
+		}
+		if st.closed {
+			st.mutx.Unlock()
+			return message.RelayResponseMsg{}, ErrStreamClosed
+		}
+		signal := st.signal
+		st.mutx.Unlock()
+		select {
+		case <-signal:
+		case <-ctx.Done():
+			return message.RelayResponseMsg{}, ctx.Err()
+		}
+	}
+}
+
+// Close close stream on both sides. Messages of stream that are not received yet are dropped
+func (st *Stream) Close() error {
+	prx := st.prx
+	prx.mutx.Lock()
+	defer prx.mutx.Unlock()
+	if st.isClosed() {
+		return ErrStreamClosed
+	}
+	delete(prx.streams, st.id)
+	st.close()
+	st.skt.CloseStream(st.id)
+	prx.log.Debug("Stream closed", logging.Stream, st.id)
+	return nil
+}
+
+func (st *Stream) isClosed() bool {
+	st.mutx.Lock()
+	defer st.mutx.Unlock()
+	return st.closed
+}
+
+// push queue a received message. Queue needs no limit, hub sends no more than credit of stream
+func (st *Stream) push(msg message.RelayResponseMsg, size int) bool {
+	st.mutx.Lock()
+	defer st.mutx.Unlock()
+	if st.closed {
+		return false
+	}
+	st.msgs = append(st.msgs, streamMsg{msg: msg, size: size})
+	close(st.signal)
+	st.signal = make(chan struct{})
+	return true
+}
+
+// close drop messages of stream that are queued and wake its receivers with ErrStreamClosed
+func (st *Stream) close() {
+	st.mutx.Lock()
+	defer st.mutx.Unlock()
+	if st.closed {
+		return
+	}
+	st.closed = true
+	st.msgs = nil
+	close(st.signal)
+}
+
+// closeStreams close all the streams of proxy when its socket is released. Lock of proxy must be held
+func (prx *Proxy) closeStreams() {
+	for id, st := range prx.streams {
+		st.close()
+		delete(prx.streams, id)
+	}
+}
+
+// handleStreamPacket pass a relay message to its stream. Credit of packets that no stream receives is
+// given back at once, so hub is not blocked by them
+func (prx *Proxy) handleStreamPacket(rData socket.RData) {
+	bb, err := rData.Pkt.Data()
+	prx.mutx.RLock()
+	st := prx.streams[rData.Stream]
+	skt := prx.skt
+	prx.mutx.RUnlock()
+	if st == nil || rData.Pkt.Type() != byte(message.RelayMgsCode) || err != nil {
+		if skt != nil {
+			skt.GrantCredit(rData.Stream, len(bb))
+		}
+		prx.handlePacket(rData)
+		return
+	}
+	msg, err := message.DeserializeRelayRes(bb)
+	if err != nil {
+		st.skt.GrantCredit(rData.Stream, len(bb))
+		prx.log.Warn("Error on deserializing relay message", logging.Stream, rData.Stream, logging.Err, err)
+		return
+	}
+	if !st.push(msg, len(bb)) {
+		st.skt.GrantCredit(rData.Stream, len(bb))
+	}
+}
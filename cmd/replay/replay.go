@@ -0,0 +1,295 @@
+// Replay read a capture of hub (see captureFile of server config) and print its packets as messages,
+// or send packets that clients wrote to a running hub again.
+//
+//	replay capture.bin                                print packets of capture
+//	replay -host localhost:31549 capture.bin          replay capture at original speed
+//	replay -host localhost:31549 -speed 10 capture.bin replay capture 10 times faster
+//
+// Each captured client gets its own connection. Packets are sent with the same gaps as in capture,
+// divided by speed. Hub gives new ids to replayed clients, so ids of relay requests are replaced
+// by the new ids of captured clients once they are known.
+//
+// A capture file that hub wrote in several runs, e.g. before and after a restart, is replayed one run
+// after the other, without the gap between them. Socket ids are only unique in a run
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vajafari/messagehub/pkg/logging"
+	"github.com/vajafari/messagehub/pkg/message"
+	"github.com/vajafari/messagehub/pkg/socket"
+)
+
+const (
+	maxIDMsgLen    int = 8 + message.CorrIDLen
+	maxListMsgLen  int = message.ListMaxLen
+	maxRelayMsgLen int = message.RelayMaxBodySize + 8
+)
+
+func main() {
+	host := flag.String("host", "", "Address of hub to replay capture against. Capture is only printed when it is empty")
+	network := flag.String("net", "tcp", "Network type of hub address (tcp or unix)")
+	speed := flag.Float64("speed", 1, "Speed of replay, 2 sends packets twice as fast as they are captured")
+	wait := flag.Duration("wait", time.Second, "How long replayed connections wait for responses after the last packet")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] capture-file\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || *speed <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	records, err := readCapture(flag.Arg(0))
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	if *host == "" {
+		runs := splitRuns(records)
+		for i, run := range runs {
+			if len(runs) > 1 {
+				fmt.Printf("Run %d\n", i+1)
+			}
+			for _, rec := range run {
+				printRecord(os.Stdout, run[0].Time, rec)
+			}
+		}
+		return
+	}
+	if err := replay(records, *network, *host, *speed, *wait); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+}
+
+// readCapture read all the records of capture file
+func readCapture(path string) ([]socket.CaptureRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := socket.NewCaptureReader(f)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]socket.CaptureRecord, 0)
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, fmt.Errorf("Record %d: %w", len(records)+1, err)
+		}
+		records = append(records, rec)
+	}
+}
+
+// decode convert data of record to message. Hub reads requests and writes responses, so direction
+// of record tells which message it is
+func decode(dir socket.Direction, typ byte, bb []byte) (interface{}, error) {
+	switch message.MsgType(typ) {
+	case message.IDMgsCode:
+		if dir == socket.DirIn {
+			return message.IDRequestMsg{}, nil
+		}
+		return message.DeserializeIDRes(bb)
+	case message.ListMgsCode:
+		if dir == socket.DirIn {
+			return message.ListRequestMsg{}, nil
+		}
+		return message.DeserializeListRes(bb)
+	case message.RelayMgsCode:
+		if dir == socket.DirIn {
+			return message.DeserializeRelayReq(bb)
+		}
+		return message.DeserializeRelayFromHub(bb)
+	case message.HelloMgsCode:
+		if dir == socket.DirIn {
+			return message.DeserializeHello(bb)
+		}
+		return message.DeserializeWelcome(bb)
+	case message.ErrorMgsCode:
+		if dir == socket.DirOut {
+			return message.DeserializeError(bb)
+		}
+	}
+	return nil, fmt.Errorf("Unknown message type %d", typ)
+}
+
+// printRecord write record as a line with time since start of capture
+func printRecord(w io.Writer, start time.Time, rec socket.CaptureRecord) {
+	msg, err := decode(rec.Dir, rec.Type, rec.Data)
+	if err != nil {
+		fmt.Fprintf(w, "%10.3fs %-3s socket %d type %d (%d bytes): %v\n", rec.Time.Sub(start).Seconds(), rec.Dir, rec.SocketID,
+			rec.Type, len(rec.Data), err)
+		return
+	}
+	fmt.Fprintf(w, "%10.3fs %-3s socket %d %T %+v\n", rec.Time.Sub(start).Seconds(), rec.Dir, rec.SocketID, msg, msg)
+}
+
+// rawPacket is a captured packet that is sent as it is
+type rawPacket struct {
+	typ  byte
+	data []byte
+}
+
+func (p rawPacket) Type() byte            { return p.typ }
+func (p rawPacket) Data() ([]byte, error) { return p.data, nil }
+
+// idMap map ids of captured clients to ids that hub gave to replayed clients
+type idMap struct {
+	mutx sync.Mutex
+	ids  map[uint64]uint64
+}
+
+func (m *idMap) set(old uint64, id uint64) {
+	m.mutx.Lock()
+	defer m.mutx.Unlock()
+	m.ids[old] = id
+}
+
+// get return new id of a captured client, or the old id when it is not known yet
+func (m *idMap) get(old uint64) uint64 {
+	m.mutx.Lock()
+	defer m.mutx.Unlock()
+	if id, ok := m.ids[old]; ok {
+		return id
+	}
+	return old
+}
+
+// session is connection of one captured client
+type session struct {
+	oldID uint64
+	skt   *socket.TCPSocket
+	ids   *idMap
+	start time.Time
+}
+
+func (s *session) OnPacket(rData socket.RData) {
+	bb, err := rData.Pkt.Data()
+	if err != nil {
+		return
+	}
+	typ := rData.Pkt.Type()
+	switch message.MsgType(typ) {
+	case message.IDMgsCode:
+		if msg, err := message.DeserializeIDRes(bb); err == nil {
+			s.ids.set(s.oldID, msg.ID)
+		}
+	case message.HelloMgsCode:
+		if msg, err := message.DeserializeWelcome(bb); err == nil {
+			s.skt.SetCapabilities(socket.Negotiate(socket.LocalCapabilities(maxRelayMsgLen, socket.SupportedFeatures),
+				socket.Capabilities{Version: msg.Version, MaxFrameSize: int(msg.MaxFrameSize), Features: socket.Features(msg.Features)}))
+		}
+	}
+	printRecord(os.Stdout, s.start, socket.CaptureRecord{Dir: socket.DirOut, Time: time.Now(), SocketID: s.oldID, Type: typ, Data: bb})
+}
+
+func (s *session) OnWritten(socket.WData) {}
+
+func (s *session) OnError(prob socket.ProbData) {
+	fmt.Printf("Socket %d: %v\n", s.oldID, prob.Err)
+}
+
+func (s *session) OnClose(id uint64, err error) {}
+
+// send send a captured request, ids of relay requests are replaced by ids of replayed clients
+func (s *session) send(rec socket.CaptureRecord) {
+	if message.MsgType(rec.Type) == message.RelayMgsCode {
+		if msg, err := message.DeserializeRelayReq(rec.Data); err == nil {
+			for i, id := range msg.IDs {
+				msg.IDs[i] = s.ids.get(id)
+			}
+			s.skt.Send(msg)
+			return
+		}
+	}
+	s.skt.Send(rawPacket{typ: rec.Type, data: rec.Data})
+}
+
+// splitRuns split records of capture by the run that wrote them
+func splitRuns(records []socket.CaptureRecord) [][]socket.CaptureRecord {
+	var runs [][]socket.CaptureRecord
+	for i, rec := range records {
+		if i == 0 || rec.Run != records[i-1].Run {
+			runs = append(runs, nil)
+		}
+		runs[len(runs)-1] = append(runs[len(runs)-1], rec)
+	}
+	return runs
+}
+
+// replay send requests of captured clients to hub, run by run. Clients of a run are disconnected
+// before the next run starts, like they were when hub stopped
+func replay(records []socket.CaptureRecord, network string, host string, speed float64, wait time.Duration) error {
+	for _, run := range splitRuns(records) {
+		if err := replayRun(run, network, host, speed, wait); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayRun send requests of captured clients of a run to hub, each client on its own connection
+func replayRun(records []socket.CaptureRecord, network string, host string, speed float64, wait time.Duration) error {
+	if len(records) == 0 {
+		return nil
+	}
+	msgTypeLen := map[byte]int{
+		byte(message.IDMgsCode):    maxIDMsgLen,
+		byte(message.ListMgsCode):  maxListMsgLen,
+		byte(message.RelayMgsCode): maxRelayMsgLen,
+		byte(message.HelloMgsCode): message.HelloMaxLen,
+		byte(message.ErrorMgsCode): message.ErrorMaxLen,
+	}
+	ids := &idMap{ids: make(map[uint64]uint64)}
+	sessions := make(map[uint64]*session)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), wait)
+		defer cancel()
+		for _, s := range sessions {
+			s.skt.Shutdown(ctx)
+		}
+	}()
+	first, start := records[0].Time, time.Now()
+	for _, rec := range records {
+		if rec.Dir != socket.DirIn {
+			continue
+		}
+		at := start.Add(time.Duration(float64(rec.Time.Sub(first)) / speed))
+		time.Sleep(time.Until(at))
+		s, ok := sessions[rec.SocketID]
+		if !ok {
+			conn, err := net.Dial(network, host)
+			if err != nil {
+				return err
+			}
+			s = &session{
+				oldID: rec.SocketID,
+				skt:   socket.NewConnSocket(conn, rec.SocketID, 32, 8192, 8192),
+				ids:   ids,
+				start: start,
+			}
+			s.skt.SetLogger(logging.Discard)
+			s.skt.StartHandler(context.Background(), s, msgTypeLen)
+			sessions[rec.SocketID] = s
+		}
+		printRecord(os.Stdout, start, socket.CaptureRecord{Dir: rec.Dir, Time: time.Now(), SocketID: rec.SocketID, Type: rec.Type, Data: rec.Data})
+		s.send(rec)
+	}
+	// Give hub time to answer the last requests
+	time.Sleep(wait)
+	return nil
+}
@@ -0,0 +1,128 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/vajafari/messagehub/pkg/message"
+	"github.com/vajafari/messagehub/pkg/socket"
+)
+
+// relayDelivery follow a relay request until sender can be answered. Messages of streams are followed until
+// every recipient socket writes or drops them, then hub gives their credit back to sender. So a stream is not
+// sent faster than its slowest recipient reads, and it is acknowledged only when recipients took the message.
+// Messages of the default stream are answered once they are pushed to send queues of recipients
+type relayDelivery struct {
+	sender  *socketInfo
+	reqData socket.RData
+	size    int   // Credit that sender used for request, zero on the default stream
+	pending int32 // Recipients that did not write or drop message yet, and one for handler of request
+	count   int   // Recipients of request
+	mutx    sync.Mutex
+	// Recipients that message is not delivered to, with code of the first one
+	rejection message.ErrorMsg
+}
+
+// relayPacket is relay message of a stream that hub follows until its recipients take it
+type relayPacket struct {
+	message.RelayResponseMsg
+	dlv *relayDelivery
+}
+
+func newRelayDelivery(sender *socketInfo, reqData socket.RData, msg message.RelayRequestMsg) *relayDelivery {
+	dlv := &relayDelivery{
+		sender:    sender,
+		reqData:   reqData,
+		pending:   1,
+		rejection: message.ErrorMsg{CorrID: msg.CorrID},
+		count:     len(msg.IDs),
+	}
+	if reqData.Stream != 0 {
+		data, _ := reqData.Pkt.Data()
+		dlv.size = len(data)
+	}
+	return dlv
+}
+
+// followed report whether recipients are followed until they take message
+func (dlv *relayDelivery) followed() bool {
+	return dlv.reqData.Stream != 0
+}
+
+// packet return message that is sent to recipients
+func (dlv *relayDelivery) packet(msg message.RelayResponseMsg) socket.Packet {
+	if !dlv.followed() {
+		return msg
+	}
+	return relayPacket{RelayResponseMsg: msg, dlv: dlv}
+}
+
+// send push message to send queue of a recipient. Followed message is done when recipient writes or drops it
+func (dlv *relayDelivery) send(recipient *socketInfo, pkt socket.Packet) bool {
+	if !dlv.followed() {
+		return recipient.send(pkt)
+	}
+	atomic.AddInt32(&dlv.pending, 1)
+	if recipient.send(pkt) {
+		return true
+	}
+	// Handler holds its part until all the recipients are tried, so this is never the last part
+	atomic.AddInt32(&dlv.pending, -1)
+	return false
+}
+
+// fail add a recipient that message is not delivered to
+func (dlv *relayDelivery) fail(id uint64, code message.ErrorCode) {
+	dlv.mutx.Lock()
+	defer dlv.mutx.Unlock()
+	if dlv.rejection.Code == 0 {
+		dlv.rejection.Code = code
+	}
+	dlv.rejection.IDs = append(dlv.rejection.IDs, id)
+}
+
+// reject reject the whole request, it is sent to no recipient
+func (dlv *relayDelivery) reject(code message.ErrorCode, reason string) {
+	dlv.mutx.Lock()
+	defer dlv.mutx.Unlock()
+	dlv.rejection.Code = code
+	dlv.rejection.Reason = reason
+}
+
+// done release a part of delivery. The last part gives credit of request back and answers sender
+// with one error for all the recipients that did not get message, or with ack when it has correlation id
+func (dlv *relayDelivery) done() {
+	if atomic.AddInt32(&dlv.pending, -1) > 0 {
+		return
+	}
+	sender := dlv.sender
+	sender.Skt.GrantCredit(dlv.reqData.Stream, dlv.size)
+	dlv.mutx.Lock()
+	rejection := dlv.rejection
+	dlv.mutx.Unlock()
+	if len(rejection.IDs) > 0 {
+		rejection.Reason = fmt.Sprintf("Relay message not delivered to %d of %d recipients", len(rejection.IDs), dlv.count)
+		sender.log.Warn("Relay message not delivered", "ids", rejection.IDs, "code", rejection.Code)
+	}
+	if rejection.Code != 0 {
+		sender.sendError(dlv.reqData, rejection)
+		return
+	}
+	// Only requests with correlation id are acknowledged, clients that did not agree correlation send none
+	if rejection.CorrID != 0 {
+		sender.send(socket.OnStream(dlv.reqData.Stream, message.RelayAckMsg{CorrID: rejection.CorrID}))
+	}
+}
+
+// relayErrCode return code that tells sender why a recipient socket dropped a relay message
+func relayErrCode(err error) message.ErrorCode {
+	switch {
+	case errors.Is(err, socket.ErrUndelivered):
+		return message.ErrCodeUnknownRecipient
+	case errors.Is(err, socket.ErrFrameTooLarge):
+		return message.ErrCodeTooLarge
+	}
+	return message.ErrCodeQueueFull
+}
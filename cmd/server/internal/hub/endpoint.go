@@ -1,11 +1,20 @@
 package hub
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/vajafari/messagehub/pkg/logging"
+	"github.com/vajafari/messagehub/pkg/message"
 	"github.com/vajafari/messagehub/pkg/socket"
 )
 
@@ -17,67 +26,426 @@ type EndpointConfing struct {
 	SendQueueSize int
 	ReadBufSize   int
 	WriteBufSize  int
-	HubQueueSize  int
+	// File mode of socket file when NetType is unix or unixpacket. Zero keeps the default mode
+	UnixSocketMode os.FileMode
+	// TLS settings. When TLSCertFile and TLSKeyFile are empty the endpoint serves plain TCP
+	TLSCertFile string
+	TLSKeyFile  string
+	// If set, clients must present a certificate signed by one of the CAs in this file (mutual TLS)
+	TLSClientCAFile string
+	// WebSocket settings. WebSocket endpoint listens on Host:WSPort when WSPort is set
+	WSPort int
+	WSPath string
+	// Origins that browsers may connect from. Empty means only same origin requests, "*" allows all
+	WSAllowedOrigins []string
+	// Names of optional features (checksum, compression, heartbeat, fragmentation, streams, correlation, errors) that hub offers in handshake.
+	// Empty offers all the supported features
+	Features []string
+	// Packets with smaller data are not compressed. Zero uses socket default
+	CompressMinSize int
+	// Max data of one fragment when fragmentation is agreed. Zero uses socket default
+	FragmentSize int
+	// Max length of fragmented message that hub reassembles, by name of message type.
+	// Types that are not set are limited to their max length in one frame
+	ReassemblyLimits map[string]int
+	// What sockets do with messages when their send queue is full: block, drop-newest, drop-oldest
+	// or disconnect. Hub never waits for a full queue, so block drops the newest message too
+	OverflowPolicy string
+	// Seconds that socket waits for data of peer and for each write. Zero uses socket default
+	ReadTimeout  int
+	WriteTimeout int
+	// Seconds between pings when heartbeat is agreed and how many pings may stay unanswered
+	// before connection is closed. Zero uses socket default
+	HeartbeatInterval int
+	MaxMissedPongs    int
+	// Send lane (control, interactive or bulk) of message types, by name of message type.
+	// Types that are not set keep their default lane
+	Lanes map[string]string
+	// Depth and weight of each lane, by name of lane. Depth of lanes that are not set is SendQueueSize
+	LaneDepths  map[string]int
+	LaneWeights map[string]int
+	// Max bytes and frames of queued messages that are written together. Zero uses socket default
+	WriteBatchBytes  int
+	WriteBatchFrames int
+	// Bytes that client may send without a valid frame before it is disconnected. Zero is not limited
+	GarbageLimit int
+	// Rate limits of each client. Clients in RateLimitOverrides get their own limits instead,
+	// key is identity of client (see ClientIdentity) in lower case
+	RateLimits         RateLimitConfig
+	RateLimitOverrides map[string]RateLimitConfig
+	// Level (debug, info, warn, error or off) and format (text or json) of logs. Empty is info and text
+	LogLevel  string
+	LogFormat string
+	// File that every packet of clients is appended to, see socket.CaptureWriter. Empty disables capture
+	CaptureFile string
 }
 
+// RateLimitConfig contain rate limits of a client in both directions. Zero rates are not limited
+type RateLimitConfig struct {
+	InBytesPerSec   int
+	InFramesPerSec  int
+	OutBytesPerSec  int
+	OutFramesPerSec int
+	// What socket does with messages over limit: delay, drop or disconnect. Empty is delay
+	Action string
+}
+
+// handshakeTimeout is how long endpoint waits for TLS handshake of a new connection
+const handshakeTimeout = 30 * time.Second
+
 // GetHostAddress Apprend host address and port number together and return  full address of the site
+// For unix domain sockets Host is path of the socket file and port is ignored
 func (conf *EndpointConfing) GetHostAddress() string {
+	if IsUnixNetwork(conf.NetType) {
+		return conf.Host
+	}
 	return conf.Host + ":" + strconv.Itoa(conf.Port)
 }
 
+// IsUnixNetwork report whether network type is a unix domain socket network
+func IsUnixNetwork(netType string) bool {
+	return netType == "unix" || netType == "unixpacket"
+}
+
+// TLSEnabled report whether endpoint must serve connections over TLS
+func (conf *EndpointConfing) TLSEnabled() bool {
+	return conf.TLSCertFile != "" || conf.TLSKeyFile != ""
+}
+
+// GetTLSConfig build server side tls configuration. It returns nil when TLS is not enabled
+func (conf *EndpointConfing) GetTLSConfig() (*tls.Config, error) {
+	if !conf.TLSEnabled() {
+		return nil, nil
+	}
+	if conf.TLSCertFile == "" || conf.TLSKeyFile == "" {
+		return nil, errors.New("Both TLS certificate and key file must be set")
+	}
+	cert, err := tls.LoadX509KeyPair(conf.TLSCertFile, conf.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if conf.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(conf.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No valid certificate found in client CA file")
+		}
+		tlsConf.ClientCAs = pool
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConf, nil
+}
+
+// GetFeatures return features that hub offers in handshake
+func (conf *EndpointConfing) GetFeatures() (socket.Features, message.Features, error) {
+	if len(conf.Features) == 0 {
+		return socket.SupportedFeatures, message.SupportedFeatures, nil
+	}
+	// One list holds features of socket and features of messages
+	var socketNames, messageNames []string
+	for _, name := range conf.Features {
+		if message.IsFeature(name) {
+			messageNames = append(messageNames, name)
+		} else {
+			socketNames = append(socketNames, name)
+		}
+	}
+	socketFeatures, err := socket.ParseFeatures(socketNames)
+	if err != nil {
+		return 0, 0, err
+	}
+	messageFeatures, err := message.ParseFeatures(messageNames)
+	return socketFeatures, messageFeatures, err
+}
+
+// GetReassemblyLimits return max length of reassembled message of each message type
+func (conf *EndpointConfing) GetReassemblyLimits() (map[byte]int, error) {
+	limits := make(map[byte]int)
+	for name, limit := range conf.ReassemblyLimits {
+		typ, err := message.ParseMsgType(name)
+		if err != nil {
+			return nil, err
+		}
+		limits[byte(typ)] = limit
+	}
+	return limits, nil
+}
+
+// GetLanes return send lane of each message type. Handshake is sent in control lane and relay
+// messages in bulk lane, unless config sets another lane for them
+func (conf *EndpointConfing) GetLanes() (map[byte]socket.Lane, error) {
+	lanes := map[byte]socket.Lane{
+		byte(message.HelloMgsCode): socket.LaneControl,
+		byte(message.RelayMgsCode): socket.LaneBulk,
+	}
+	for name, laneName := range conf.Lanes {
+		typ, err := message.ParseMsgType(name)
+		if err != nil {
+			return nil, err
+		}
+		lane, err := socket.ParseLane(laneName)
+		if err != nil {
+			return nil, err
+		}
+		lanes[byte(typ)] = lane
+	}
+	return lanes, nil
+}
+
+// validateLanes check lane settings of config
+func (conf *EndpointConfing) validateLanes() error {
+	if _, err := conf.GetLanes(); err != nil {
+		return err
+	}
+	if _, err := socket.ParseLaneMap(conf.LaneDepths); err != nil {
+		return err
+	}
+	_, err := socket.ParseLaneMap(conf.LaneWeights)
+	return err
+}
+
+// GetRateLimits return rate limits of client with identity
+func (conf *EndpointConfing) GetRateLimits(identity string) RateLimitConfig {
+	if limits, ok := conf.RateLimitOverrides[strings.ToLower(identity)]; ok {
+		return limits
+	}
+	return conf.RateLimits
+}
+
+// validateRateLimits check actions of rate limits
+func (conf *EndpointConfing) validateRateLimits() error {
+	if _, err := socket.ParseRateLimitAction(conf.RateLimits.Action); err != nil {
+		return err
+	}
+	for identity, limits := range conf.RateLimitOverrides {
+		if _, err := socket.ParseRateLimitAction(limits.Action); err != nil {
+			return fmt.Errorf("Rate limits of %s: %w", identity, err)
+		}
+	}
+	return nil
+}
+
+// ClientIdentity return identity of client that rate limit overrides refer to. It is common name of
+// client certificate when client presented one in TLS handshake, otherwise host of remote address
+func ClientIdentity(state *tls.ConnectionState, remoteAddr string) string {
+	if state != nil && len(state.PeerCertificates) > 0 {
+		return state.PeerCertificates[0].Subject.CommonName
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// configSocket apply socket settings of endpoint to a new socket of client with identity
+func (conf *EndpointConfing) configSocket(skt *socket.TCPSocket, identity string) {
+	if conf.CompressMinSize > 0 {
+		skt.SetCompressMinSize(conf.CompressMinSize)
+	}
+	if conf.FragmentSize > 0 {
+		skt.SetFragmentSize(conf.FragmentSize)
+	}
+	// Limits, policy and lanes are validated when endpoint starts
+	if limits, err := conf.GetReassemblyLimits(); err == nil {
+		skt.SetReassemblyLimits(limits)
+	}
+	if policy, err := socket.ParseOverflowPolicy(conf.OverflowPolicy); err == nil {
+		skt.SetOverflowPolicy(policy)
+	}
+	skt.SetTimeouts(time.Duration(conf.ReadTimeout)*time.Second, time.Duration(conf.WriteTimeout)*time.Second)
+	interval := socket.DefaultHeartbeatInterval
+	if conf.HeartbeatInterval > 0 {
+		interval = time.Duration(conf.HeartbeatInterval) * time.Second
+	}
+	skt.SetHeartbeat(interval, conf.MaxMissedPongs)
+	if lanes, err := conf.GetLanes(); err == nil {
+		skt.SetLanes(lanes)
+	}
+	if depths, err := socket.ParseLaneMap(conf.LaneDepths); err == nil {
+		skt.SetLaneDepths(depths)
+	}
+	if weights, err := socket.ParseLaneMap(conf.LaneWeights); err == nil {
+		skt.SetLaneWeights(weights)
+	}
+	skt.SetWriteBatch(conf.WriteBatchBytes, conf.WriteBatchFrames)
+	skt.SetGarbageLimit(conf.GarbageLimit)
+	limits := conf.GetRateLimits(identity)
+	if action, err := socket.ParseRateLimitAction(limits.Action); err == nil {
+		skt.SetRateLimits(socket.RateLimit{BytesPerSec: limits.InBytesPerSec, FramesPerSec: limits.InFramesPerSec},
+			socket.RateLimit{BytesPerSec: limits.OutBytesPerSec, FramesPerSec: limits.OutFramesPerSec}, action)
+	}
+}
+
 // Endpoint is tcp endpint that handle input connections
 type Endpoint struct {
-	config   EndpointConfing  // Server configuration
-	listener *net.TCPListener // Reference to listener
+	config   EndpointConfing // Server configuration
+	listener net.Listener    // Reference to listener
 	// In this project, we create a hub for each endpoint
 	// There is another option, we can create a single instance of hub and
 	// and all endpoints (if we have multiple endpoints) use that centralized hub
-	hub *Hub // Each endpoint must associated with a hub to manage the connections
-
+	hub     *Hub // Each endpoint must associated with a hub to manage the connections
+	log     logging.Logger
+	capture *socket.CaptureWriter
 }
 
 // NewEndpoint creates an endpoint for handle configurations
 func NewEndpoint(config EndpointConfing) *Endpoint {
 	return &Endpoint{
 		config: config,
-		hub:    NewHub(config.HubQueueSize),
+		hub:    NewHub(),
+		log:    logging.Default(),
 	}
 }
 
+// SetLogger set logger of endpoint, its hub and sockets. It must be called before Start
+func (e *Endpoint) SetLogger(l logging.Logger) {
+	e.log = l
+	e.hub.SetLogger(l)
+}
+
+// SetCapture set writer that captures packets of sockets. It must be called before Start
+func (e *Endpoint) SetCapture(c *socket.CaptureWriter) {
+	e.capture = c
+}
+
+// Hub return the hub that manages connections of this endpoint
+func (e *Endpoint) Hub() *Hub {
+	return e.hub
+}
+
 // Start listening to the port and reporting new connection
 func (e *Endpoint) Start() error {
-	addr, errAddr := net.ResolveTCPAddr(e.config.NetType, e.config.GetHostAddress())
-	if errAddr != nil {
-		fmt.Printf("Endpoint, Address is not valid %s. Error message %s\n",
-			e.config.GetHostAddress(), errAddr.Error())
-		return errAddr
+	tlsConf, errTLS := e.config.GetTLSConfig()
+	if errTLS != nil {
+		e.log.Error("TLS configuration is not valid", logging.Err, errTLS)
+		return errTLS
+	}
+	features, msgFeatures, errFeatures := e.config.GetFeatures()
+	if errFeatures != nil {
+		e.log.Error("Features configuration is not valid", logging.Err, errFeatures)
+		return errFeatures
+	}
+	e.hub.SetFeatures(features)
+	e.hub.SetMessageFeatures(msgFeatures)
+	if _, errLimits := e.config.GetReassemblyLimits(); errLimits != nil {
+		e.log.Error("Reassembly limits configuration is not valid", logging.Err, errLimits)
+		return errLimits
+	}
+	if _, errPolicy := socket.ParseOverflowPolicy(e.config.OverflowPolicy); errPolicy != nil {
+		e.log.Error("Overflow policy configuration is not valid", logging.Err, errPolicy)
+		return errPolicy
+	}
+	if errLanes := e.config.validateLanes(); errLanes != nil {
+		e.log.Error("Lanes configuration is not valid", logging.Err, errLanes)
+		return errLanes
+	}
+	if errRate := e.config.validateRateLimits(); errRate != nil {
+		e.log.Error("Rate limits configuration is not valid", logging.Err, errRate)
+		return errRate
 	}
 
-	listener, errListen := net.ListenTCP(e.config.NetType, addr)
+	listener, errListen := e.listen()
 	if errListen != nil {
-		fmt.Printf("Endpoint, Unable to listen on host address %s. Error message %s\n",
-			e.config.GetHostAddress(), errListen.Error())
+		e.log.Error("Unable to listen on host address", "address", e.config.GetHostAddress(), logging.Err, errListen)
 		return errListen
 	}
 
 	defer listener.Close()
 	e.listener = listener
 
-	fmt.Printf("Endpoint, Listening on %s\n", e.config.GetHostAddress())
+	if tlsConf != nil {
+		e.log.Info("Listening", "address", e.config.GetHostAddress(), "tls", true)
+	} else {
+		e.log.Info("Listening", "address", e.config.GetHostAddress(), "tls", false)
+	}
 	for {
-
-		fmt.Println("Endpoint, Accept a connection request...")
-		conn, err := listener.AcceptTCP()
+		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Printf("Endpoint, Failed accepting a connection request. Error message=%s\n", err.Error())
+			e.log.Warn("Failed accepting a connection request", logging.Err, err)
+			continue
+		}
+		e.log.Debug("Connection accepted", logging.RemoteAddr, conn.RemoteAddr().String())
+
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			//On OSX and SetKeepAlive this will cause up to 8 TCP keepalive probes to be sent at an
+			//interval of 75 seconds after a connection has been idle for 2 hours.
+			//In other words, Read will return an io.EOF error after 2 hours and 10 minutes (7200 + 8 * 75)
+			tcpConn.SetKeepAlive(true)
+		}
+		if tlsConf != nil {
+			// Identity of client is known after handshake, so it is done in background to keep accepting
+			go e.addTLS(tls.Server(conn, tlsConf))
 			continue
 		}
+		skt := socket.NewConnSocket(conn, rand.Uint64(), e.config.SendQueueSize, e.config.ReadBufSize, e.config.WriteBufSize)
+		e.config.configSocket(skt, ClientIdentity(nil, conn.RemoteAddr().String()))
+		skt.SetLogger(e.log)
+		skt.SetCapture(e.capture)
+		e.add(skt, conn)
+	}
+}
+
+// addTLS complete TLS handshake of a new connection and add it to hub
+func (e *Endpoint) addTLS(conn *tls.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		e.log.Warn("TLS handshake failed", logging.RemoteAddr, conn.RemoteAddr().String(), logging.Err, err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	state := conn.ConnectionState()
+	skt := socket.NewTLSSocket(conn, rand.Uint64(), e.config.SendQueueSize, e.config.ReadBufSize, e.config.WriteBufSize)
+	e.config.configSocket(skt, ClientIdentity(&state, conn.RemoteAddr().String()))
+	skt.SetLogger(e.log)
+	skt.SetCapture(e.capture)
+	e.add(skt, conn)
+}
+
+// add add socket of connection to hub, connection is closed when hub does not accept it
+func (e *Endpoint) add(skt socket.Socket, conn net.Conn) {
+	if err := e.hub.Add(skt); err != nil {
+		e.log.Warn("Failed adding connection to hub", logging.RemoteAddr, conn.RemoteAddr().String(), logging.Err, err)
+		conn.Close()
+	}
+}
+
+// listen create listener based on network type of configuration
+func (e *Endpoint) listen() (net.Listener, error) {
+	if !IsUnixNetwork(e.config.NetType) {
+		addr, err := net.ResolveTCPAddr(e.config.NetType, e.config.GetHostAddress())
+		if err != nil {
+			return nil, err
+		}
+		return net.ListenTCP(e.config.NetType, addr)
+	}
 
-		//On OSX and SetKeepAlive this will cause up to 8 TCP keepalive probes to be sent at an
-		//interval of 75 seconds after a connection has been idle for 2 hours.
-		//In other words, Read will return an io.EOF error after 2 hours and 10 minutes (7200 + 8 * 75)
-		conn.SetKeepAlive(true)
-		skt := socket.NewTCPSocket(conn, rand.Uint64(), e.config.SendQueueSize, e.config.ReadBufSize, e.config.WriteBufSize)
-		e.hub.Add(skt)
+	addr, err := net.ResolveUnixAddr(e.config.NetType, e.config.GetHostAddress())
+	if err != nil {
+		return nil, err
+	}
+	// Socket file of previous run prevents listening, remove it only if it is really a socket
+	if fi, err := os.Lstat(addr.Name); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(addr.Name)
+	}
+	listener, err := net.ListenUnix(e.config.NetType, addr)
+	if err != nil {
+		return nil, err
+	}
+	if e.config.UnixSocketMode != 0 {
+		err = os.Chmod(addr.Name, e.config.UnixSocketMode)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
 	}
+	return listener, nil
 }
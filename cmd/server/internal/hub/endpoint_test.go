@@ -0,0 +1,124 @@
+package hub
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/vajafari/messagehub/pkg/socket"
+)
+
+func TestGetTLSConfig(t *testing.T) {
+	var tests = []struct {
+		conf      EndpointConfing
+		enabled   bool
+		expectErr bool
+	}{
+		{EndpointConfing{}, false, false},
+		{EndpointConfing{TLSCertFile: "cert.pem"}, true, true},
+		{EndpointConfing{TLSKeyFile: "key.pem"}, true, true},
+		{EndpointConfing{TLSCertFile: "notexist.pem", TLSKeyFile: "notexist.pem"}, true, true},
+	}
+	for _, tt := range tests {
+		if tt.conf.TLSEnabled() != tt.enabled {
+			t.Errorf("TLSEnabled: expected %t, actual %t", tt.enabled, tt.conf.TLSEnabled())
+		}
+		tlsConf, err := tt.conf.GetTLSConfig()
+		if (err != nil) != tt.expectErr {
+			t.Errorf("GetTLSConfig: expected error %t, actual %v", tt.expectErr, err)
+		}
+		if !tt.enabled && tlsConf != nil {
+			t.Error("GetTLSConfig: TLS config created for plain endpoint")
+		}
+	}
+}
+
+func TestGetHostAddress(t *testing.T) {
+	var tests = []struct {
+		conf     EndpointConfing
+		expected string
+	}{
+		{EndpointConfing{Host: "localhost", Port: 31549, NetType: "tcp"}, "localhost:31549"},
+		{EndpointConfing{Host: "127.0.0.1", Port: 80, NetType: "tcp4"}, "127.0.0.1:80"},
+		{EndpointConfing{Host: "/tmp/hub.sock", Port: 31549, NetType: "unix"}, "/tmp/hub.sock"},
+		{EndpointConfing{Host: "/tmp/hub.sock", NetType: "unixpacket"}, "/tmp/hub.sock"},
+	}
+	for _, tt := range tests {
+		actual := tt.conf.GetHostAddress()
+		if actual != tt.expected {
+			t.Errorf("GetHostAddress: expected %s, actual %s", tt.expected, actual)
+		}
+	}
+}
+
+func TestGetReassemblyLimits(t *testing.T) {
+	conf := EndpointConfing{ReassemblyLimits: map[string]int{"relay": 50 * 1024 * 1024, "list": 1024}}
+	limits, err := conf.GetReassemblyLimits()
+	if err != nil || len(limits) != 2 || limits[3] != 50*1024*1024 || limits[2] != 1024 {
+		t.Errorf("GetReassemblyLimits: unexpected limits %v-%v", limits, err)
+	}
+	conf = EndpointConfing{ReassemblyLimits: map[string]int{"snapshot": 1024}}
+	if _, err := conf.GetReassemblyLimits(); err == nil {
+		t.Error("GetReassemblyLimits: unknown message type accepted")
+	}
+}
+
+func TestGetLanes(t *testing.T) {
+	conf := EndpointConfing{Lanes: map[string]string{"id": "control"}}
+	lanes, err := conf.GetLanes()
+	if err != nil || lanes[1] != socket.LaneControl || lanes[3] != socket.LaneBulk || lanes[4] != socket.LaneControl {
+		t.Errorf("GetLanes: unexpected lanes %v-%v", lanes, err)
+	}
+	conf = EndpointConfing{Lanes: map[string]string{"relay": "urgent"}}
+	if err := conf.validateLanes(); err == nil {
+		t.Error("GetLanes: unknown lane accepted")
+	}
+	conf = EndpointConfing{LaneWeights: map[string]int{"slow": 1}}
+	if err := conf.validateLanes(); err == nil {
+		t.Error("validateLanes: unknown lane accepted")
+	}
+}
+
+func TestGetRateLimits(t *testing.T) {
+	conf := EndpointConfing{
+		RateLimits:         RateLimitConfig{InFramesPerSec: 100},
+		RateLimitOverrides: map[string]RateLimitConfig{"10.0.0.5": {InFramesPerSec: 1000, Action: "drop"}, "backup": {Action: "disconnect"}},
+	}
+	if err := conf.validateRateLimits(); err != nil {
+		t.Fatalf("validateRateLimits: unexpected error %v", err)
+	}
+	if limits := conf.GetRateLimits("10.0.0.6"); limits.InFramesPerSec != 100 {
+		t.Errorf("GetRateLimits: endpoint limits not used %+v", limits)
+	}
+	if limits := conf.GetRateLimits("10.0.0.5"); limits.InFramesPerSec != 1000 || limits.Action != "drop" {
+		t.Errorf("GetRateLimits: override not used %+v", limits)
+	}
+	if limits := conf.GetRateLimits("Backup"); limits.Action != "disconnect" {
+		t.Errorf("GetRateLimits: identity must be case insensitive %+v", limits)
+	}
+	conf.RateLimitOverrides["slow"] = RateLimitConfig{Action: "block"}
+	if err := conf.validateRateLimits(); err == nil {
+		t.Error("validateRateLimits: unknown action accepted")
+	}
+}
+
+func TestClientIdentity(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "backup"}}
+	var tests = []struct {
+		state    *tls.ConnectionState
+		remote   string
+		expected string
+	}{
+		{nil, "10.0.0.5:4312", "10.0.0.5"},
+		{nil, "[::1]:4312", "::1"},
+		{nil, "@", "@"},
+		{&tls.ConnectionState{}, "10.0.0.5:4312", "10.0.0.5"},
+		{&tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, "10.0.0.5:4312", "backup"},
+	}
+	for _, tt := range tests {
+		if actual := ClientIdentity(tt.state, tt.remote); actual != tt.expected {
+			t.Errorf("ClientIdentity: expected %s, actual %s", tt.expected, actual)
+		}
+	}
+}
@@ -1,20 +1,23 @@
 package hub
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
 
+	"github.com/vajafari/messagehub/pkg/logging"
 	"github.com/vajafari/messagehub/pkg/message"
 
 	"github.com/vajafari/messagehub/pkg/socket"
 )
 
 const (
-	maxIDMsgLen   int = 0 // Max length for id message in hub
-	maxListMsgLen int = 0 // Max length for list message in hub
-	// Max length for relay message (1024 * 1024) + (255 * 8) + 1
-	maxRelayMsgLen int = int(message.RelayMaxBodySize + (message.RelayMaxReciverCount * 8) + 1)
+	maxIDMsgLen   int = message.CorrIDLen // Max length for id message in hub, it has only correlation id
+	maxListMsgLen int = message.CorrIDLen // Max length for list message in hub, it has only correlation id
+	// Max length for relay message in one frame (1024 * 1024) + (255 * 8) + 1 and 5 bytes for optional correlation id.
+	// Larger relay messages are received in fragments, up to reassembly limit of relay messages of socket
+	maxRelayMsgLen int = int(message.RelayMaxBodySize + (message.RelayMaxReciverCount * 8) + 1 + 1 + message.CorrIDLen)
 )
 
 // Hub is connection manager of a specific server
@@ -22,34 +25,102 @@ const (
 // we can create different hubs for each type of messages
 // and assign them to the different endpoint
 type Hub struct {
-	sktRepo    map[uint64]*socketInfo
-	mutx       sync.RWMutex
-	readChan   chan socket.RData
-	writeChan  chan socket.WData
-	probChan   chan socket.ProbData
-	msgTypeLen map[byte]int
+	sktRepo map[uint64]*socketInfo
+	mutx    sync.RWMutex
+	reg     *message.Registry[socket.RData] // Message types that hub reads and their handlers
+	caps    socket.Capabilities             // Capabilities that hub advertise in handshake
+	msgs    message.Features                // Features of messages that hub advertise in handshake
+	log     logging.Logger
+	// Handlers that async runs in their own go routines
+	handlers sync.WaitGroup
 }
 
-// NewHub Create new instance and initialize properties of hub struct
-func NewHub(queueSize int) *Hub {
+// NewHub Create new instance and initialize properties of hub struct. Sockets call handlers of hub
+// directly, so unlike older versions it has no queue and takes no queue size
+func NewHub() *Hub {
 
 	hub := Hub{
-		sktRepo:    make(map[uint64]*socketInfo),
-		readChan:   make(chan socket.RData, queueSize),
-		writeChan:  make(chan socket.WData, queueSize),
-		probChan:   make(chan socket.ProbData, queueSize),
-		msgTypeLen: make(map[byte]int),
-	}
-	hub.msgTypeLen[byte(message.IDMgsCode)] = maxIDMsgLen
-	hub.msgTypeLen[byte(message.ListMgsCode)] = maxListMsgLen
-	hub.msgTypeLen[byte(message.RelayMgsCode)] = maxRelayMsgLen
-
-	go hub.probHandler()
-	go hub.readHandler()
-	go hub.writeHandler()
+		sktRepo: make(map[uint64]*socketInfo),
+		reg:     message.NewRegistry[socket.RData](),
+		caps:    socket.LocalCapabilities(maxRelayMsgLen, socket.SupportedFeatures),
+		msgs:    message.SupportedFeatures,
+		log:     logging.Default(),
+	}
+	// Hello is handled in order, so capabilities are applied before next messages of socket
+	hub.reg.Register(message.HelloMgsCode, message.Codec[socket.RData]{
+		MaxLen: message.HelloMaxLen,
+		Decode: message.Decode(message.DeserializeHello),
+		Handle: message.Handle(hub.handleHelloReq),
+	})
+	hub.reg.Register(message.IDMgsCode, message.Codec[socket.RData]{
+		MaxLen: maxIDMsgLen,
+		Decode: message.Decode(message.DeserializeIDReq),
+		Handle: hub.async(message.Handle(hub.handleIDReq)),
+	})
+	hub.reg.Register(message.ListMgsCode, message.Codec[socket.RData]{
+		MaxLen: maxListMsgLen,
+		Decode: message.Decode(message.DeserializeListReq),
+		Handle: hub.async(message.Handle(hub.handleListReq)),
+	})
+	hub.reg.Register(message.RelayMgsCode, message.Codec[socket.RData]{
+		MaxLen: maxRelayMsgLen,
+		Decode: message.Decode(message.DeserializeRelayReq),
+		Handle: hub.async(message.Handle(hub.handleRelayReq)),
+	})
 	return &hub
 }
 
+// Register add a message type that hub reads from clients, e.g. a message type of application.
+// It must be called before adding sockets. Handlers are called by reader of socket, see async
+func (h *Hub) Register(typ message.MsgType, codec message.Codec[socket.RData]) error {
+	return h.reg.Register(typ, codec)
+}
+
+// Send push packet to send queue of an identified socket without waiting. It lets handlers of
+// registered message types answer clients
+func (h *Hub) Send(id uint64, pkt socket.Packet) error {
+	h.mutx.RLock()
+	defer h.mutx.RUnlock()
+	sktInfo, ok := h.sktRepo[id]
+	if !ok || !sktInfo.IsIdentified {
+		return fmt.Errorf("No identified socket with id %d", id)
+	}
+	return sktInfo.Skt.TrySend(pkt)
+}
+
+// async run handler in its own go routine, so handlers that wait for lock of hub do not hold back
+// reader of socket. Messages of a stream are handled in order, so stream keeps its order through hub
+func (h *Hub) async(handle message.Handler[socket.RData]) message.Handler[socket.RData] {
+	return func(rData socket.RData, msg any) {
+		if rData.Stream != 0 {
+			handle(rData, msg)
+			return
+		}
+		h.handlers.Add(1)
+		go func() {
+			defer h.handlers.Done()
+			handle(rData, msg)
+		}()
+	}
+}
+
+// SetFeatures limit features that hub offers to clients in handshake
+// It must be called before adding sockets
+func (h *Hub) SetFeatures(features socket.Features) {
+	h.caps = socket.LocalCapabilities(h.caps.MaxFrameSize, features)
+}
+
+// SetMessageFeatures limit features of messages that hub offers to clients in handshake
+// It must be called before adding sockets
+func (h *Hub) SetMessageFeatures(features message.Features) {
+	h.msgs = features & message.SupportedFeatures
+}
+
+// SetLogger set logger of hub events. It must be called before adding sockets
+func (h *Hub) SetLogger(l logging.Logger) {
+	h.log = l
+}
+
 // Add new connection to socket pool
 func (h *Hub) Add(skt socket.Socket) error {
 	if skt == nil {
@@ -62,6 +133,7 @@ func (h *Hub) Add(skt socket.Socket) error {
 	info := socketInfo{
 		Skt:          skt,
 		IsIdentified: false,
+		log:          logging.With(h.log, logging.SocketID, skt.ID()),
 	}
 	h.mutx.Lock()
 	defer h.mutx.Unlock()
@@ -69,46 +141,138 @@ func (h *Hub) Add(skt socket.Socket) error {
 		return errors.New("Socket with same ID already exist in hub. Please release all the resources of socket")
 	}
 
+	// Hub gives credit of streams back itself, so clients send relay messages of a stream no faster than
+	// their recipients read them
+	skt.SetManualCredit(true)
+	// Hub has no lifetime of its own, sockets are closed by CloseSocket or by their problems
+	if err := skt.StartHandler(context.Background(), sktHandler{hub: h}, h.reg.MsgTypeLen()); err != nil {
+		return err
+	}
 	h.sktRepo[skt.ID()] = &info
-	skt.Start(h.writeChan, h.readChan, h.probChan, h.msgTypeLen)
-	fmt.Printf("Hub, Item add to map. Current connection count: %d\n", len(h.sktRepo))
+	info.log.Info("Socket added", "count", len(h.sktRepo))
 	return nil
 }
 
-func (h *Hub) readHandler() {
-	for rData := range h.readChan {
+// sktHandler pass events of sockets to hub, see socket.Handler
+type sktHandler struct {
+	hub *Hub
+}
+
+func (sh sktHandler) OnPacket(rData socket.RData) {
+	sh.hub.handlePacket(rData)
+}
 
-		switch rData.Pkt.Type() {
-		case byte(message.IDMgsCode):
-			go h.handleIDReq(rData)
-		case byte(message.ListMgsCode):
-			go h.handleListReq(rData)
-		case byte(message.RelayMgsCode):
-			go h.handleRelayReq(rData)
-		default:
-			fmt.Printf("Hub, Invalid message recieved from scoket %d\n", rData.SourceID)
-		}
+func (sh sktHandler) OnWritten(wData socket.WData) {
+	sh.hub.handleWritten(wData)
+}
+
+func (sh sktHandler) OnError(sig socket.ProbData) {
+	sh.hub.handleProb(sig)
+}
+
+func (sh sktHandler) OnClose(id uint64, err error) {
+	sh.hub.removeSocket(id, err)
+}
+
+func (h *Hub) handlePacket(rData socket.RData) {
+	data, err := rData.Pkt.Data()
+	if err != nil {
+		h.log.Warn("Error on retrieving message", logging.SocketID, rData.SourceID, logging.MsgType, rData.Pkt.Type(),
+			logging.Err, err)
+		return
+	}
+	err = h.reg.Dispatch(rData, rData.Pkt.Type(), data)
+	// Relay requests give credit of their stream back when recipients take them, see relayDelivery
+	if rData.Stream != 0 && (err != nil || rData.Pkt.Type() != byte(message.RelayMgsCode)) {
+		h.grant(rData, len(data))
+	}
+	if errors.Is(err, message.ErrUnknownType) {
+		h.log.Warn("Invalid message received", logging.SocketID, rData.SourceID, logging.MsgType, rData.Pkt.Type())
+		h.reject(rData, message.ErrCodeInvalid, 0, "Unknown message type")
+	} else if err != nil {
+		h.log.Warn("Error on deserializing message", logging.SocketID, rData.SourceID, logging.MsgType, rData.Pkt.Type(),
+			logging.Err, err)
+		h.reject(rData, message.ErrCodeInvalid, 0, "Message is not valid")
 	}
 }
 
-func (h *Hub) handleIDReq(reqData socket.RData) {
+// grant give credit of a stream packet back to client once hub handled it, see Add
+func (h *Hub) grant(rData socket.RData, n int) {
 	h.mutx.RLock()
 	defer h.mutx.RUnlock()
+	if sktInfo, ok := h.sktRepo[rData.SourceID]; ok {
+		sktInfo.Skt.GrantCredit(rData.Stream, n)
+	}
+}
+
+// reject tell a client that hub rejected its message, see socketInfo.reject
+func (h *Hub) reject(reqData socket.RData, code message.ErrorCode, corrID uint32, reason string) {
+	h.mutx.RLock()
+	defer h.mutx.RUnlock()
+	if sktInfo, ok := h.sktRepo[reqData.SourceID]; ok {
+		sktInfo.reject(reqData, code, corrID, reason)
+	}
+}
+
+// handleHelloReq negotiate capabilities with client and answer with welcome message
+// Clients that never send hello keep working with v1 frames and no optional feature
+func (h *Hub) handleHelloReq(reqData socket.RData, msg message.HelloMsg) {
+	h.mutx.Lock()
+	defer h.mutx.Unlock()
 	sktInfo, ok := h.sktRepo[reqData.SourceID]
 	if !ok {
-		fmt.Printf("Hub, Reject id message from unknown Socket %d", reqData.SourceID)
+		h.log.Warn("Reject hello message from unknown socket", logging.SocketID, reqData.SourceID)
 		return
 	}
-	sktInfo.Skt.Send(message.IDResponseMsg{ID: reqData.SourceID})
-	fmt.Printf("Hub, Id message pushed in socket %d send queue\n", reqData.SourceID)
+	if sktInfo.IsIdentified {
+		sktInfo.log.Warn("Reject hello message from identified socket")
+		sktInfo.reject(reqData, message.ErrCodeInvalid, 0, "Hello must be sent before identification")
+		return
+	}
+	socketFeatures, msgFeatures := message.SplitFeatures(msg.Features)
+	caps := socket.Negotiate(h.caps, socket.Capabilities{
+		Version:      msg.Version,
+		MaxFrameSize: int(msg.MaxFrameSize),
+		Features:     socket.Features(socketFeatures),
+	})
+	sktInfo.Caps = caps
+	sktInfo.Features = h.msgs & msgFeatures
+	// Welcome carries max frame size of hub itself, client must respect it in its requests
+	if !sktInfo.send(message.WelcomeMsg{
+		Version:      caps.Version,
+		MaxFrameSize: uint32(h.caps.MaxFrameSize),
+		Features:     message.JoinFeatures(uint32(caps.Features), sktInfo.Features),
+	}) {
+		return
+	}
+	sktInfo.Skt.SetCapabilities(caps)
+	sktInfo.log.Info("Welcome message pushed in send queue", "version", caps.Version, "features", caps.Features,
+		"message_features", sktInfo.Features)
 }
 
-func (h *Hub) handleListReq(reqData socket.RData) {
+func (h *Hub) handleIDReq(reqData socket.RData, msg message.IDRequestMsg) {
+	h.mutx.RLock()
+	defer h.mutx.RUnlock()
+	sktInfo, ok := h.sktRepo[reqData.SourceID]
+	if !ok {
+		// Socket that is not in hub cannot be answered
+		h.log.Warn("Reject id message from unknown socket", logging.SocketID, reqData.SourceID)
+		return
+	}
+	// Responses are sent on the stream of their request
+	if !sktInfo.send(socket.OnStream(reqData.Stream, message.IDResponseMsg{ID: reqData.SourceID, CorrID: msg.CorrID})) {
+		return
+	}
+	sktInfo.log.Debug("Id message pushed in send queue")
+}
+
+func (h *Hub) handleListReq(reqData socket.RData, msg message.ListRequestMsg) {
 	h.mutx.RLock()
 	defer h.mutx.RUnlock()
 	if sktInfo, ok := h.sktRepo[reqData.SourceID]; ok {
 		if !sktInfo.IsIdentified {
-			fmt.Printf("Hub, reject list message from unidentified socket %d\n", reqData.SourceID)
+			sktInfo.log.Warn("Reject list message from unidentified socket")
+			sktInfo.reject(reqData, message.ErrCodeNotIdentified, msg.CorrID, "List request from unidentified client")
 			return
 		}
 
@@ -121,75 +285,114 @@ func (h *Hub) handleListReq(reqData socket.RData) {
 				connList = append(connList, v.Skt.ID())
 			}
 		}
-		if len(connList) > message.ListMaxItems {
-			sktInfo.Skt.Send(message.ListResponseMsg{IDs: connList[0:message.ListMaxItems]})
-			fmt.Printf("Hub, List message pushed in socket %d send queue. Count of connected %d\n",
-				sktInfo.Skt.ID(), len(connList[0:message.ListMaxItems]))
-		} else {
-			sktInfo.Skt.Send(message.ListResponseMsg{IDs: connList})
-			fmt.Printf("Hub, List message pushed in socket %d send queue. Count of connected %d\n",
-				sktInfo.Skt.ID(), len(connList))
+		// Long lists are sent in fragments, client that cannot receive them gets an error instead of a part of list
+		if !sktInfo.accepts(len(connList)*8 + message.CorrIDLen) {
+			sktInfo.log.Warn("List message is larger than max frame size of socket", "count", len(connList))
+			sktInfo.reject(reqData, message.ErrCodeTooLarge, msg.CorrID, "List is larger than client accepts")
+			return
+		}
+		if sktInfo.send(socket.OnStream(reqData.Stream, message.ListResponseMsg{IDs: connList, CorrID: msg.CorrID})) {
+			sktInfo.log.Debug("List message pushed in send queue", "count", len(connList))
 		}
 
 	} else {
-		fmt.Printf("Hub, Reject list message from unknown Socket %d", reqData.SourceID)
+		h.log.Warn("Reject list message from unknown socket", logging.SocketID, reqData.SourceID)
 	}
 }
 
-func (h *Hub) handleRelayReq(reqData socket.RData) {
+func (h *Hub) handleRelayReq(reqData socket.RData, msg message.RelayRequestMsg) {
 	h.mutx.RLock()
 	defer h.mutx.RUnlock()
-	if sktInfo, ok := h.sktRepo[reqData.SourceID]; ok {
-		if !sktInfo.IsIdentified {
-			fmt.Printf("Hub, reject relay message from unidentified socket %d\n", reqData.SourceID)
-			return
-		}
-	} else {
-		fmt.Printf("Hub, Reject relay message from unknown Socket %d", reqData.SourceID)
+	sender, ok := h.sktRepo[reqData.SourceID]
+	if !ok {
+		h.log.Warn("Reject relay message from unknown socket", logging.SocketID, reqData.SourceID)
 		return
 	}
-	data, err := reqData.Pkt.Data()
-	if err != nil {
-		fmt.Printf("Hub, Error on deserializing relay message from socket {%d}\n", reqData.SourceID)
+	dlv := newRelayDelivery(sender, reqData, msg)
+	// Handler holds its own part of delivery, so sender is answered only after all the recipients are tried
+	defer dlv.done()
+	if !sender.IsIdentified {
+		sender.log.Warn("Reject relay message from unidentified socket")
+		dlv.reject(message.ErrCodeNotIdentified, "Relay request from unidentified client")
 		return
 	}
-	msg, err := message.DeserializeRelayReq(data)
-	if err == nil {
-		rspMsg := message.RelayResponseMsg{
-			Body:     msg.Body,
-			SenderID: reqData.SourceID,
-		}
-		for _, id := range msg.IDs {
-			if sktInfo, ok := h.sktRepo[id]; ok {
-				if sktInfo.IsIdentified {
-					sktInfo.Skt.Send(rspMsg)
-					fmt.Printf("Hub, Relay message pushed in socket %d send queue. Message len %d\n", id, len(msg.Body))
-				}
-			}
+	// Recipients get message on the same stream, recipients that did not agree streams get it on the default stream
+	rspMsg := socket.OnStream(reqData.Stream, dlv.packet(message.RelayResponseMsg{
+		Body:     msg.Body,
+		SenderID: reqData.SourceID,
+	}))
+	for _, id := range msg.IDs {
+		sktInfo, ok := h.sktRepo[id]
+		switch {
+		case !ok || !sktInfo.IsIdentified:
+			dlv.fail(id, message.ErrCodeUnknownRecipient)
+		case !sktInfo.accepts(len(msg.Body) + 8):
+			sktInfo.log.Warn("Relay message is larger than max frame size of socket", logging.Bytes, len(msg.Body))
+			dlv.fail(id, message.ErrCodeTooLarge)
+		// A recipient with full queue loses the message, so it never holds back the others
+		case !dlv.send(sktInfo, rspMsg):
+			dlv.fail(id, message.ErrCodeQueueFull)
+		default:
+			sktInfo.log.Debug("Relay message pushed in send queue", logging.Bytes, len(msg.Body))
 		}
-	} else {
-		fmt.Printf("Hub, Error on deserializing relay message from socket {%d}\n", reqData.SourceID)
 	}
 }
 
-func (h *Hub) writeHandler() {
-	for wData := range h.writeChan {
-		if wData.Pkt.Type() == byte(message.IDMgsCode) {
-			h.mutx.Lock()
-			if sktInfo, ok := h.sktRepo[wData.SourceID]; ok {
-				sktInfo.IsIdentified = true
-			}
-			h.mutx.Unlock()
-			fmt.Printf("Socket %d is identified now\n", wData.SourceID)
+func (h *Hub) handleWritten(wData socket.WData) {
+	if pkt, ok := socket.PacketOf(wData.Pkt).(relayPacket); ok {
+		pkt.dlv.done()
+		return
+	}
+	if wData.Pkt.Type() == byte(message.IDMgsCode) {
+		h.mutx.Lock()
+		if sktInfo, ok := h.sktRepo[wData.SourceID]; ok {
+			sktInfo.IsIdentified = true
 		}
+		h.mutx.Unlock()
+		h.log.Info("Socket is identified", logging.SocketID, wData.SourceID)
+	}
+}
+
+// handleProb log problems of sockets. Socket closes itself after a problem that is not recoverable,
+// then it is removed from hub by removeSocket
+func (h *Hub) handleProb(sig socket.ProbData) {
+	if pkt, ok := socket.PacketOf(sig.Pkt).(relayPacket); ok {
+		// Sender learns recipients that lost its message of stream
+		pkt.dlv.fail(sig.SourceID, relayErrCode(sig.Err))
+		pkt.dlv.done()
+	}
+	var resyncErr *socket.ResyncError
+	if errors.As(sig.Err, &resyncErr) {
+		// Client may run another protocol version, it is closed when it reaches garbage limit
+		h.log.Warn("Socket resynced", logging.SocketID, sig.SourceID, logging.Err, sig.Err)
+		return
+	}
+	if socket.Recoverable(sig.Err) {
+		h.log.Warn("Frame dropped", logging.SocketID, sig.SourceID, logging.Err, sig.Err)
+		return
+	}
+	if errors.Is(sig.Err, socket.ErrUndelivered) {
+		// Socket is already closed, only the message is lost
+		h.log.Warn("Message not delivered", logging.SocketID, sig.SourceID, logging.MsgType, sig.Pkt.Type())
+		return
 	}
+	if errors.Is(sig.Err, socket.ErrRateLimited) || errors.Is(sig.Err, socket.ErrGarbageLimit) {
+		h.log.Warn("Socket disconnected", logging.SocketID, sig.SourceID, logging.Err, sig.Err)
+		return
+	}
+	h.log.Info("Problem received on socket", logging.SocketID, sig.SourceID, logging.Err, sig.Err)
 }
 
-func (h *Hub) probHandler() {
-	for sig := range h.probChan {
-		fmt.Println("Hub, Problem Recived")
-		h.CloseSocket(sig.SourceID)
+// removeSocket remove a closed socket from hub. Sockets that are closed by CloseSocket are already removed
+func (h *Hub) removeSocket(id uint64, err error) {
+	h.mutx.Lock()
+	defer h.mutx.Unlock()
+	sktInfo, ok := h.sktRepo[id]
+	if !ok {
+		return
 	}
+	delete(h.sktRepo, id)
+	sktInfo.log.Info("Socket closed", "count", len(h.sktRepo), logging.Err, err)
 }
 
 // CloseSocket find specific socket by id and close it
@@ -199,18 +402,71 @@ func (h *Hub) CloseSocket(id uint64) {
 	if sktInfo, ok := h.sktRepo[id]; ok {
 		err := sktInfo.Skt.Close()
 		if err != nil {
-			fmt.Printf("Hub, Error on closing socket %d. Error messag is %s\n", sktInfo.Skt.ID(), err.Error())
+			sktInfo.log.Error("Error on closing socket", logging.Err, err)
 			return
 		}
 		delete(h.sktRepo, id)
-		fmt.Printf("Hub, Successfully remove socket %d, Current socket count %d\n", id, len(h.sktRepo))
+		sktInfo.log.Info("Socket removed", "count", len(h.sktRepo))
 	} else {
-		fmt.Printf("Hub, No socket found for close process!!! Socket id %d - Current socket count %d\n", id, len(h.sktRepo))
+		h.log.Warn("No socket found to close", logging.SocketID, id, "count", len(h.sktRepo))
 	}
 }
 
+// Stats is statistics of sockets of hub
+type Stats struct {
+	Total   socket.Stats            // Sum of statistics of all sockets, see socket.Stats.Add
+	Sockets map[uint64]socket.Stats // Statistics of each socket by its ID
+}
+
+// Stats collect statistics of connected sockets and their sum
+func (h *Hub) Stats() Stats {
+	h.mutx.RLock()
+	defer h.mutx.RUnlock()
+	res := Stats{Sockets: make(map[uint64]socket.Stats, len(h.sktRepo))}
+	for id, sktInfo := range h.sktRepo {
+		st := sktInfo.Skt.Stats()
+		res.Sockets[id] = st
+		res.Total.Add(st)
+	}
+	return res
+}
+
 // Connected sockets info
 type socketInfo struct {
 	Skt          socket.Socket
 	IsIdentified bool
+	Caps         socket.Capabilities // Capabilities agreed in handshake. Zero value when client sent no hello
+	Features     message.Features    // Features of messages agreed in handshake
+	log          logging.Logger      // Logger of hub with id of socket
+}
+
+// send push packet to send queue of socket without waiting. Hub handlers hold the lock of hub,
+// so a socket that does not keep up must not block them
+func (info *socketInfo) send(pkt socket.Packet) bool {
+	if err := info.Skt.TrySend(pkt); err != nil {
+		info.log.Warn("Message not pushed in send queue", logging.MsgType, pkt.Type(), logging.Err, err)
+		return false
+	}
+	return true
+}
+
+// reject tell client that its message is rejected, on the stream of the message. Clients that did not
+// agree errors in handshake do not know error message, so rejection is only logged for them
+func (info *socketInfo) reject(reqData socket.RData, code message.ErrorCode, corrID uint32, reason string) {
+	info.sendError(reqData, message.ErrorMsg{Code: code, CorrID: corrID, Reason: reason})
+}
+
+// sendError send error message of a rejected message, type of message is filled from reqData. See reject
+func (info *socketInfo) sendError(reqData socket.RData, msg message.ErrorMsg) {
+	if !info.Features.Has(message.FeatureErrors) {
+		return
+	}
+	msg.ReqType = message.MsgType(reqData.Pkt.Type())
+	info.send(socket.OnStream(reqData.Stream, msg))
+}
+
+// accepts report whether socket can receive a message with n bytes of data.
+// Socket that agreed fragmentation receives larger messages in fragments
+func (info *socketInfo) accepts(n int) bool {
+	return info.Caps.MaxFrameSize == 0 || n <= info.Caps.MaxFrameSize || info.Caps.Has(socket.FeatureFragmentation)
 }
@@ -1,10 +1,14 @@
 package hub
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/vajafari/messagehub/pkg/logging"
 	"github.com/vajafari/messagehub/pkg/message"
 
 	"github.com/vajafari/messagehub/pkg/socket"
@@ -25,26 +29,43 @@ func (pkt packetMock) Data() ([]byte, error) {
 
 type socketMock struct {
 	id         uint64
-	readChan   chan<- socket.RData
-	writeChan  chan<- socket.WData
-	probChan   chan<- socket.ProbData
+	handler    socket.Handler
 	msgTypeLen map[byte]int
+	mutx       sync.Mutex // Handlers of hub send packets in their own go routines
 	packets    []socket.Packet
 	closed     bool
+	caps       socket.Capabilities
+	full       bool // Send queue is full, TrySend fails
+	stats      socket.Stats
+	manual     bool           // Owner gives credit of streams, see SetManualCredit
+	credit     map[uint32]int // Credit that owner gave back by stream
 }
 
 func (s *socketMock) Start(writeChan chan<- socket.WData, readChan chan<- socket.RData, probChan chan<- socket.ProbData, msgTypeLen map[byte]int) {
-	s.readChan = readChan
-	s.writeChan = writeChan
-	s.probChan = probChan
 	s.msgTypeLen = msgTypeLen
-	s.packets = make([]socket.Packet, 0)
+	s.clearPackets()
+}
+
+func (s *socketMock) StartHandler(ctx context.Context, h socket.Handler, msgTypeLen map[byte]int) error {
+	if s.handler != nil {
+		return socket.ErrStarted
+	}
+	s.handler = h
+	s.msgTypeLen = msgTypeLen
+	s.clearPackets()
+	return nil
 }
 
 func (s *socketMock) Close() error {
+	s.mutx.Lock()
+	defer s.mutx.Unlock()
 	s.closed = true
 	return nil
 }
+
+func (s *socketMock) Shutdown(ctx context.Context) error {
+	return s.Close()
+}
 func (s *socketMock) ID() uint64 {
 	return s.id
 }
@@ -52,57 +73,141 @@ func (s *socketMock) SetID(id uint64) {
 	s.id = id
 }
 func (s *socketMock) Send(pkt socket.Packet) {
+	s.mutx.Lock()
+	defer s.mutx.Unlock()
 	s.packets = append(s.packets, pkt)
 }
 
+func (s *socketMock) TrySend(pkt socket.Packet) error {
+	if s.full {
+		return socket.ErrQueueFull
+	}
+	s.Send(pkt)
+	return nil
+}
+
+func (s *socketMock) SendContext(ctx context.Context, pkt socket.Packet) error {
+	return s.TrySend(pkt)
+}
+
+func (s *socketMock) SetCapabilities(caps socket.Capabilities) {
+	s.mutx.Lock()
+	defer s.mutx.Unlock()
+	s.caps = caps
+}
+
+func (s *socketMock) Stats() socket.Stats {
+	return s.stats
+}
+
+func (s *socketMock) SetManualCredit(manual bool) {
+	s.manual = manual
+}
+
+func (s *socketMock) GrantCredit(stream uint32, n int) {
+	s.mutx.Lock()
+	defer s.mutx.Unlock()
+	if s.credit == nil {
+		s.credit = make(map[uint32]int)
+	}
+	s.credit[stream] += n
+}
+
+// granted return credit that owner gave back on stream
+func (s *socketMock) granted(stream uint32) int {
+	s.mutx.Lock()
+	defer s.mutx.Unlock()
+	return s.credit[stream]
+}
+
+func (s *socketMock) CloseStream(stream uint32) {}
+
 func (s *socketMock) clearPackets() {
+	s.mutx.Lock()
+	defer s.mutx.Unlock()
 	s.packets = make([]socket.Packet, 0)
 }
 
+// sent return packets that are sent to socket
+func (s *socketMock) sent() []socket.Packet {
+	s.mutx.Lock()
+	defer s.mutx.Unlock()
+	return append([]socket.Packet(nil), s.packets...)
+}
+
+func (s *socketMock) isClosed() bool {
+	s.mutx.Lock()
+	defer s.mutx.Unlock()
+	return s.closed
+}
+
+func (s *socketMock) capabilities() socket.Capabilities {
+	s.mutx.Lock()
+	defer s.mutx.Unlock()
+	return s.caps
+}
+
+// settle wait for handlers that hub runs in their own go routines, so packets they send are in sockets
+func settle(h *Hub) {
+	h.handlers.Wait()
+}
+
+// setIdentified change state of socket like hub does when id response is written
+func setIdentified(h *Hub, id uint64, identified bool) {
+	h.mutx.Lock()
+	defer h.mutx.Unlock()
+	h.sktRepo[id].IsIdentified = identified
+}
+
+// simulateProbData report a problem like socket does, it closes itself after problems that are not recoverable
 func (s *socketMock) simulateProbData(pkt socket.Packet, err error) {
-	s.probChan <- socket.ProbData{
+	s.handler.OnError(socket.ProbData{
 		Pkt:      pkt,
 		SourceID: s.ID(),
 		Err:      err,
+	})
+	if !socket.Recoverable(err) && !errors.Is(err, socket.ErrUndelivered) {
+		s.Close()
+		s.handler.OnClose(s.ID(), err)
 	}
 }
 
 func (s *socketMock) simulateReadData(pkt socket.Packet) {
-	s.readChan <- socket.RData{
+	s.handler.OnPacket(socket.RData{
 		Pkt:      pkt,
 		SourceID: s.ID(),
-	}
+	})
 }
 
 func (s *socketMock) simulateReadDataByte(bb []byte) {
 	if len(bb) > 1 {
-		s.readChan <- socket.RData{
+		s.handler.OnPacket(socket.RData{
 			Pkt: packetMock{
 				data: bb[1:],
 				typ:  bb[0],
 			},
 			SourceID: s.ID(),
-		}
+		})
 	} else {
-		s.readChan <- socket.RData{
+		s.handler.OnPacket(socket.RData{
 			Pkt: packetMock{
 				data: nil,
 				typ:  bb[0],
 			},
 			SourceID: s.ID(),
-		}
+		})
 	}
 }
 
 func (s *socketMock) simulateWriteData(pkt socket.Packet) {
-	s.writeChan <- socket.WData{
+	s.handler.OnWritten(socket.WData{
 		Pkt:      pkt,
 		SourceID: s.id,
-	}
+	})
 }
 
 func TestReadHandler(t *testing.T) {
-	h := NewHub(100)
+	h := NewHub()
 	sMock1 := socketMock{id: 1}
 	h.Add(&sMock1)
 	sMock2 := socketMock{id: 2}
@@ -116,19 +221,19 @@ func TestReadHandler(t *testing.T) {
 	// Simulate message Id
 	//sMock1.simulateReadData(  []byte{byte(message.IDMgsCode)})
 	sMock1.simulateReadData(message.IDRequestMsg{})
-	time.Sleep(20 * time.Millisecond)
-	if len(sMock1.packets) != 1 {
+	settle(h)
+	if len(sMock1.sent()) != 1 {
 		t.Fatal("Error on response to IDRequestMsg")
 	}
-	if len(sMock2.packets) > 0 || len(sMock3.packets) > 0 || len(sMock4.packets) > 0 {
+	if len(sMock2.sent()) > 0 || len(sMock3.sent()) > 0 || len(sMock4.sent()) > 0 {
 		t.Fatal("Error on response to IDRequestMsg. Id message response sent to wrong clients")
 	}
 
-	if sMock1.packets[0].Type() != byte(message.IDMgsCode) {
+	if sMock1.sent()[0].Type() != byte(message.IDMgsCode) {
 		t.Fatal("Error on response to IDRequestMsg. Response message code is not valid")
 	}
 
-	dataSMock, err := sMock1.packets[0].Data()
+	dataSMock, err := sMock1.sent()[0].Data()
 	if err != nil {
 		t.Fatal("Error on response to IDRequestMsg. Cannot deserialize message on client")
 	}
@@ -142,8 +247,8 @@ func TestReadHandler(t *testing.T) {
 	sMock1.clearPackets()
 	//sMock1.simulateReadData([]byte{byte(message.IDMgsCode), 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
 	sMock1.simulateReadData(message.IDRequestMsg{})
-	time.Sleep(20 * time.Millisecond)
-	if len(sMock1.packets) != 1 {
+	settle(h)
+	if len(sMock1.sent()) != 1 {
 		t.Fatal("Error on response to IDRequestMsg")
 	}
 
@@ -152,27 +257,27 @@ func TestReadHandler(t *testing.T) {
 	//Request from unidentified socket
 	//sMock1.simulateReadData([]byte{byte(message.ListMgsCode)})
 	sMock1.simulateReadData(message.ListRequestMsg{})
-	time.Sleep(20 * time.Millisecond)
+	settle(h)
 
-	if len(sMock1.packets) > 0 || len(sMock2.packets) > 0 || len(sMock3.packets) > 0 || len(sMock4.packets) > 0 {
+	if len(sMock1.sent()) > 0 || len(sMock2.sent()) > 0 || len(sMock3.sent()) > 0 || len(sMock4.sent()) > 0 {
 		t.Fatal("Error on response to ListRequestMsg. Generate list response based on request from unindentified socket")
 	}
 
 	//Request recieved from identified socket, but no identifed channel exist
-	h.sktRepo[1].IsIdentified = true
+	setIdentified(h, 1, true)
 	//sMock1.simulateReadData([]byte{byte(message.ListMgsCode)})
 	sMock1.simulateReadData(message.ListRequestMsg{})
-	time.Sleep(20 * time.Millisecond)
-	if len(sMock1.packets) != 1 {
+	settle(h)
+	if len(sMock1.sent()) != 1 {
 		t.Fatal("Error on response to List request")
 	}
-	if sMock1.packets[0].Type() != byte(message.ListMgsCode) {
+	if sMock1.sent()[0].Type() != byte(message.ListMgsCode) {
 		t.Fatal("Error on response to ListRequestMsg. Response message code is not valid")
 	}
-	if len(sMock2.packets) > 0 || len(sMock3.packets) > 0 || len(sMock4.packets) > 0 {
+	if len(sMock2.sent()) > 0 || len(sMock3.sent()) > 0 || len(sMock4.sent()) > 0 {
 		t.Fatal("Error on response to ListRequestMsg. List message response sent to wrong clients")
 	}
-	dataSMock, err = sMock1.packets[0].Data()
+	dataSMock, err = sMock1.sent()[0].Data()
 	if err != nil {
 		t.Fatal("Error on response to ListRequestMsg. Cannot deserialize message on client")
 	}
@@ -185,19 +290,19 @@ func TestReadHandler(t *testing.T) {
 	}
 
 	sMock1.clearPackets()
-	h.sktRepo[3].IsIdentified = true
+	setIdentified(h, 3, true)
 	sMock1.simulateReadData(message.ListRequestMsg{})
-	time.Sleep(20 * time.Millisecond)
-	if len(sMock1.packets) != 1 {
+	settle(h)
+	if len(sMock1.sent()) != 1 {
 		t.Fatal("Error on response to List request")
 	}
-	if sMock1.packets[0].Type() != byte(message.ListMgsCode) {
+	if sMock1.sent()[0].Type() != byte(message.ListMgsCode) {
 		t.Fatal("Error on response to ListRequestMsg. Response message code is not valid")
 	}
-	if len(sMock2.packets) > 0 || len(sMock3.packets) > 0 || len(sMock4.packets) > 0 {
+	if len(sMock2.sent()) > 0 || len(sMock3.sent()) > 0 || len(sMock4.sent()) > 0 {
 		t.Fatal("Error on response to ListRequestMsg. List message response sent to wrong clients")
 	}
-	dataSMock, err = sMock1.packets[0].Data()
+	dataSMock, err = sMock1.sent()[0].Data()
 	if err != nil {
 		t.Fatal("Error on response to ListRequestMsg. Cannot deserialize message on client")
 	}
@@ -214,24 +319,24 @@ func TestReadHandler(t *testing.T) {
 	sMock2.clearPackets()
 	sMock3.clearPackets()
 	sMock4.clearPackets()
-	h.sktRepo[1].IsIdentified = false
-	h.sktRepo[2].IsIdentified = false
-	h.sktRepo[3].IsIdentified = false
-	h.sktRepo[4].IsIdentified = false
+	setIdentified(h, 1, false)
+	setIdentified(h, 2, false)
+	setIdentified(h, 3, false)
+	setIdentified(h, 4, false)
 
 	sMock1.simulateReadData(message.RelayRequestMsg{IDs: []uint64{2, 4}, Body: []byte{1, 2, 3, 4, 5, 6, 7}})
-	time.Sleep(20 * time.Millisecond)
+	settle(h)
 
-	if len(sMock1.packets) > 0 || len(sMock2.packets) > 0 || len(sMock3.packets) > 0 || len(sMock4.packets) > 0 {
+	if len(sMock1.sent()) > 0 || len(sMock2.sent()) > 0 || len(sMock3.sent()) > 0 || len(sMock4.sent()) > 0 {
 		t.Fatal("Error on response to RelayRequestMsg. Generate relay response based on request from unindentified socket")
 	}
 
-	h.sktRepo[1].IsIdentified = true
+	setIdentified(h, 1, true)
 	sMock1.clearPackets()
 	sMock1.simulateReadData(message.RelayRequestMsg{IDs: []uint64{2, 4}, Body: []byte{1, 2, 3, 4, 5, 6, 7}})
 	//sMock1.simulateReadData([]byte{byte(message.RelayMgsCode), 2, 2, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7})
-	time.Sleep(20 * time.Millisecond)
-	if len(sMock1.packets) > 0 || len(sMock2.packets) > 0 || len(sMock3.packets) > 0 || len(sMock4.packets) > 0 {
+	settle(h)
+	if len(sMock1.sent()) > 0 || len(sMock2.sent()) > 0 || len(sMock3.sent()) > 0 || len(sMock4.sent()) > 0 {
 		t.Fatal("Error on response to ListRequestMsg. List message response sent to wrong clients")
 	}
 
@@ -239,25 +344,25 @@ func TestReadHandler(t *testing.T) {
 	sMock2.clearPackets()
 	sMock3.clearPackets()
 	sMock4.clearPackets()
-	h.sktRepo[3].IsIdentified = true
-	h.sktRepo[4].IsIdentified = true
+	setIdentified(h, 3, true)
+	setIdentified(h, 4, true)
 	sMock1.simulateReadData(message.RelayRequestMsg{IDs: []uint64{2, 3, 4}, Body: []byte{1, 2, 3, 4, 5, 6, 7}})
 	//sMock1.simulateReadData([]byte{byte(message.RelayMgsCode), 3, 2, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7})
 
-	time.Sleep(20 * time.Millisecond)
-	if len(sMock1.packets) > 0 || len(sMock2.packets) > 0 {
+	settle(h)
+	if len(sMock1.sent()) > 0 || len(sMock2.sent()) > 0 {
 		t.Fatal("Error on response to RelayRequestMsg. Id message response sent to wrong clients")
 	}
-	if len(sMock3.packets) == 0 || len(sMock4.packets) == 0 {
+	if len(sMock3.sent()) == 0 || len(sMock4.sent()) == 0 {
 		t.Fatal("Error on response to RelayRequestMsg")
 	}
-	if sMock3.packets[0].Type() != byte(message.RelayMgsCode) {
+	if sMock3.sent()[0].Type() != byte(message.RelayMgsCode) {
 		t.Fatal("Error on response to RelayRequestMsg. Response message code is not valid")
 	}
-	if sMock4.packets[0].Type() != byte(message.RelayMgsCode) {
+	if sMock4.sent()[0].Type() != byte(message.RelayMgsCode) {
 		t.Fatal("Error on response to RelayRequestMsg. Response message code is not valid")
 	}
-	dataSMock, err = sMock3.packets[0].Data()
+	dataSMock, err = sMock3.sent()[0].Data()
 	if err != nil {
 		t.Fatal("Error on response to RelayRequestMsg. Cannot deserialize message on client")
 	}
@@ -268,7 +373,7 @@ func TestReadHandler(t *testing.T) {
 	if !message.ChkRelayResponseMsgEq(relayRespMsg, message.RelayResponseMsg{SenderID: 1, Body: []byte{1, 2, 3, 4, 5, 6, 7}}) {
 		t.Fatal("Error on response to ListRequestMsg. Cannot deserialize message on client")
 	}
-	dataSMock, err = sMock4.packets[0].Data()
+	dataSMock, err = sMock4.sent()[0].Data()
 	if err != nil {
 		t.Fatal("Error on response to RelayRequestMsg. Cannot deserialize message on client")
 	}
@@ -287,14 +392,233 @@ func TestReadHandler(t *testing.T) {
 	sMock4.clearPackets()
 	sMock1.simulateReadDataByte([]byte{byte(message.RelayMgsCode), 10, 2, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7})
 
-	time.Sleep(20 * time.Millisecond)
-	if len(sMock1.packets) > 0 || len(sMock2.packets) > 0 || len(sMock3.packets) > 0 || len(sMock4.packets) > 0 {
+	settle(h)
+	if len(sMock1.sent()) > 0 || len(sMock2.sent()) > 0 || len(sMock3.sent()) > 0 || len(sMock4.sent()) > 0 {
 		t.Fatal("Error on response to RelayRequestMsg. Shouldnot reponse to invalid message")
 	}
 }
 
+func TestRelayToFullQueue(t *testing.T) {
+	h := NewHub()
+	sMock1 := socketMock{id: 1}
+	sMock2 := socketMock{id: 2, full: true}
+	sMock3 := socketMock{id: 3}
+	for _, sMock := range []*socketMock{&sMock1, &sMock2, &sMock3} {
+		h.Add(sMock)
+		setIdentified(h, sMock.id, true)
+	}
+	sMock1.simulateReadData(message.RelayRequestMsg{IDs: []uint64{2, 3}, Body: []byte{1, 2, 3}})
+	settle(h)
+	if len(sMock2.sent()) != 0 {
+		t.Fatal("Relay message pushed in full send queue")
+	}
+	if len(sMock3.sent()) != 1 {
+		t.Fatal("Socket with full send queue held back relay to other sockets")
+	}
+}
+
+func TestRelayOnStream(t *testing.T) {
+	h := NewHub()
+	sMock1 := socketMock{id: 1}
+	sMock2 := socketMock{id: 2}
+	for _, sMock := range []*socketMock{&sMock1, &sMock2} {
+		h.Add(sMock)
+		setIdentified(h, sMock.id, true)
+	}
+	// Messages of a stream are relayed in order, on the same stream
+	for i := byte(0); i < 10; i++ {
+		sMock1.handler.OnPacket(socket.RData{
+			Pkt:      message.RelayRequestMsg{IDs: []uint64{2}, Body: []byte{i}},
+			SourceID: 1,
+			Stream:   5,
+		})
+	}
+	if len(sMock2.sent()) != 10 {
+		t.Fatalf("Expected 10 relay messages, actual %d", len(sMock2.sent()))
+	}
+	for i, pkt := range sMock2.sent() {
+		data, _ := pkt.Data()
+		msg, err := message.DeserializeRelayRes(data)
+		if socket.StreamOf(pkt) != 5 || err != nil || msg.Body[0] != byte(i) || msg.SenderID != 1 {
+			t.Fatalf("Message %d: unexpected relay %+v on stream %d", i, msg, socket.StreamOf(pkt))
+		}
+	}
+
+	sMock1.handler.OnPacket(socket.RData{Pkt: message.ListRequestMsg{}, SourceID: 1, Stream: 7})
+	settle(h)
+	if len(sMock1.sent()) != 1 || socket.StreamOf(sMock1.sent()[0]) != 7 {
+		t.Fatal("List response not sent on stream of its request")
+	}
+}
+
+func TestRelayCredit(t *testing.T) {
+	h := NewHub()
+	h.SetLogger(logging.Discard)
+	sMock1 := socketMock{id: 1}
+	sMock2 := socketMock{id: 2}
+	sMock3 := socketMock{id: 3}
+	for _, sMock := range []*socketMock{&sMock1, &sMock2, &sMock3} {
+		h.Add(sMock)
+	}
+	if !sMock1.manual {
+		t.Fatal("Hub does not give credit of streams itself")
+	}
+	features := message.FeatureCorrelation | message.FeatureErrors
+	sMock1.simulateReadData(message.HelloMsg{Version: socket.ProtocolVersion, Features: uint32(features)})
+	for _, sMock := range []*socketMock{&sMock1, &sMock2, &sMock3} {
+		setIdentified(h, sMock.id, true)
+	}
+	sMock1.clearPackets()
+
+	// Credit of other messages is given back once they are handled
+	list := message.ListRequestMsg{CorrID: 1}
+	sMock1.handler.OnPacket(socket.RData{Pkt: list, SourceID: 1, Stream: 7})
+	if data, _ := list.Data(); sMock1.granted(7) != len(data) {
+		t.Fatalf("Expected credit %d of list request, actual %d", len(data), sMock1.granted(7))
+	}
+	sMock1.clearPackets()
+
+	// Sender is answered and gets credit of relay message only when all the recipients took it
+	relay := message.RelayRequestMsg{IDs: []uint64{2, 3}, Body: []byte{1, 2, 3}, CorrID: 9}
+	size := relay.Len()
+	sMock1.handler.OnPacket(socket.RData{Pkt: relay, SourceID: 1, Stream: 5})
+	sMock2.simulateWriteData(sMock2.sent()[0])
+	if len(sMock1.sent()) != 0 || sMock1.granted(5) != 0 {
+		t.Fatal("Relay message answered before all the recipients took it")
+	}
+	sMock3.simulateProbData(sMock3.sent()[0], &socket.FrameError{Type: byte(message.RelayMgsCode), Err: socket.ErrStreamBlocked})
+	if sMock1.granted(5) != size {
+		t.Fatalf("Expected credit %d of relay message, actual %d", size, sMock1.granted(5))
+	}
+	if len(sMock1.sent()) != 1 || socket.StreamOf(sMock1.sent()[0]) != 5 {
+		t.Fatal("Dropped relay message not reported on its stream")
+	}
+	data, _ := sMock1.sent()[0].Data()
+	msg, err := message.DeserializeError(data)
+	expected := message.ErrorMsg{ReqType: message.RelayMgsCode, Code: message.ErrCodeQueueFull, CorrID: 9, IDs: []uint64{3}}
+	expected.Reason = msg.Reason
+	if err != nil || !message.ChkErrorMsgEq(msg, expected) {
+		t.Fatalf("Invalid error message. Expected %+v, actual %+v", expected, msg)
+	}
+	sMock1.clearPackets()
+	sMock2.clearPackets()
+
+	relay.IDs = []uint64{2}
+	sMock1.handler.OnPacket(socket.RData{Pkt: relay, SourceID: 1, Stream: 5})
+	sMock2.simulateWriteData(sMock2.sent()[0])
+	if len(sMock1.sent()) != 1 || sMock1.sent()[0].Type() != byte(message.RelayMgsCode) || sMock1.granted(5) != size+relay.Len() {
+		t.Fatal("Relay message not acknowledged when recipient took it")
+	}
+}
+
+func TestReject(t *testing.T) {
+	h := NewHub()
+	sMock1 := socketMock{id: 1}
+	sMock2 := socketMock{id: 2, full: true}
+	sMock3 := socketMock{id: 3}
+	sMock4 := socketMock{id: 4}
+	for _, sMock := range []*socketMock{&sMock1, &sMock2, &sMock3, &sMock4} {
+		h.Add(sMock)
+	}
+	features := message.FeatureCorrelation | message.FeatureErrors
+	sMock1.simulateReadData(message.HelloMsg{Version: socket.ProtocolVersion, MaxFrameSize: 100, Features: uint32(features)})
+	settle(h)
+	sMock1.clearPackets()
+
+	expectError := func(expected message.ErrorMsg) {
+		t.Helper()
+		settle(h)
+		if len(sMock1.sent()) != 1 || sMock1.sent()[0].Type() != byte(message.ErrorMgsCode) {
+			t.Fatalf("Expected one error message, actual %d packets", len(sMock1.sent()))
+		}
+		data, _ := sMock1.sent()[0].Data()
+		msg, err := message.DeserializeError(data)
+		// Reason is only for humans
+		expected.Reason = msg.Reason
+		if err != nil || !message.ChkErrorMsgEq(msg, expected) {
+			t.Fatalf("Invalid error message. Expected %+v, actual %+v", expected, msg)
+		}
+		sMock1.clearPackets()
+	}
+	sMock1.simulateReadData(message.ListRequestMsg{CorrID: 9})
+	expectError(message.ErrorMsg{ReqType: message.ListMgsCode, Code: message.ErrCodeNotIdentified, CorrID: 9})
+	sMock1.simulateReadData(message.RelayRequestMsg{IDs: []uint64{3}, Body: []byte{1}, CorrID: 10})
+	expectError(message.ErrorMsg{ReqType: message.RelayMgsCode, Code: message.ErrCodeNotIdentified, CorrID: 10})
+	sMock1.simulateReadDataByte([]byte{1, 2, 3})
+	expectError(message.ErrorMsg{ReqType: message.IDMgsCode, Code: message.ErrCodeInvalid})
+
+	for _, id := range []uint64{1, 2, 4} {
+		setIdentified(h, id, true)
+	}
+	sMock1.simulateReadData(message.RelayRequestMsg{IDs: []uint64{3}, Body: []byte{1}})
+	expectError(message.ErrorMsg{ReqType: message.RelayMgsCode, Code: message.ErrCodeUnknownRecipient, IDs: []uint64{3}})
+	sMock1.simulateReadData(message.RelayRequestMsg{IDs: []uint64{2}, Body: []byte{1}})
+	expectError(message.ErrorMsg{ReqType: message.RelayMgsCode, Code: message.ErrCodeQueueFull, IDs: []uint64{2}})
+
+	// One error lists all the recipients that relay message is not delivered to, others still get it
+	sMock1.simulateReadData(message.RelayRequestMsg{IDs: []uint64{3, 4, 2}, Body: []byte{1}, CorrID: 11})
+	expectError(message.ErrorMsg{ReqType: message.RelayMgsCode, Code: message.ErrCodeUnknownRecipient, CorrID: 11, IDs: []uint64{3, 2}})
+	if len(sMock4.sent()) != 1 {
+		t.Fatal("Relay message not sent to recipient that accepts it")
+	}
+
+	// Relay request with correlation id is acknowledged when all the recipients get it
+	sMock1.simulateReadData(message.RelayRequestMsg{IDs: []uint64{4}, Body: []byte{1}, CorrID: 12})
+	settle(h)
+	if len(sMock1.sent()) != 1 || sMock1.sent()[0] != (message.RelayAckMsg{CorrID: 12}) {
+		t.Fatalf("Relay request not acknowledged, actual %v", sMock1.sent())
+	}
+	sMock1.clearPackets()
+	sMock1.simulateReadData(message.RelayRequestMsg{IDs: []uint64{4}, Body: []byte{1}})
+	settle(h)
+	if len(sMock1.sent()) != 0 {
+		t.Fatal("Relay request without correlation id acknowledged")
+	}
+	sMock1.simulateReadData(message.HelloMsg{Version: socket.ProtocolVersion})
+	expectError(message.ErrorMsg{ReqType: message.HelloMgsCode, Code: message.ErrCodeInvalid})
+
+	// Client that did not agree errors does not know error message
+	sMock3.simulateReadData(message.ListRequestMsg{})
+	sMock3.simulateReadData(message.RelayRequestMsg{IDs: []uint64{1}, Body: []byte{1}})
+	settle(h)
+	if len(sMock3.sent()) != 0 {
+		t.Fatal("Error message sent to client that did not agree errors")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	h := NewHub()
+	// Application message that hub echoes back to its sender
+	err := h.Register(message.MsgType(100), message.Codec[socket.RData]{
+		MaxLen: 4,
+		Handle: func(rData socket.RData, msg any) {
+			h.Send(rData.SourceID, packetMock{typ: 100, data: msg.([]byte)})
+		},
+	})
+	if err != nil {
+		t.Fatalf("Message type not registered. Error %v", err)
+	}
+	if err := h.Register(message.RelayMgsCode, message.Codec[socket.RData]{Handle: func(socket.RData, any) {}}); err == nil {
+		t.Fatal("Relay message registered twice")
+	}
+	sMock1 := socketMock{id: 1}
+	h.Add(&sMock1)
+	if sMock1.msgTypeLen[100] != 4 || sMock1.msgTypeLen[byte(message.RelayMgsCode)] != maxRelayMsgLen {
+		t.Fatalf("Unexpected max lengths of socket %v", sMock1.msgTypeLen)
+	}
+	sMock1.simulateReadDataByte([]byte{100, 1, 2})
+	if len(sMock1.sent()) != 0 {
+		t.Fatal("Message sent to unidentified socket")
+	}
+	setIdentified(h, 1, true)
+	sMock1.simulateReadDataByte([]byte{100, 1, 2})
+	if len(sMock1.sent()) != 1 || sMock1.sent()[0].Type() != 100 {
+		t.Fatal("Application message not handled")
+	}
+}
+
 func TestAdd(t *testing.T) {
-	h := NewHub(100)
+	h := NewHub()
 	if len(h.sktRepo) > 0 {
 		t.Fatalf("New hub cannot have socket. Socket len %d", len(h.sktRepo))
 	}
@@ -308,25 +632,25 @@ func TestAdd(t *testing.T) {
 	}
 	//sMock1.simulateReadData([]byte{byte(message.IDMgsCode)})
 	sMock1.simulateReadData(message.IDRequestMsg{})
-	time.Sleep(20 * time.Millisecond)
-	if len(sMock1.packets) != 1 {
+	settle(h)
+	if len(sMock1.sent()) != 1 {
 		t.Error("Channels not set to socket correctly")
 	}
 }
 
 func TestWriteHandler(t *testing.T) {
-	h := NewHub(100)
+	h := NewHub()
 	sMock1 := socketMock{id: 1}
 	h.Add(&sMock1)
 	sMock1.simulateWriteData(message.IDRequestMsg{})
-	time.Sleep(20 * time.Millisecond)
+	settle(h)
 	if !h.sktRepo[1].IsIdentified {
 		t.Fatal("Send to socket not reported to hub")
 	}
 }
 
 func TestCloseSocket(t *testing.T) {
-	h := NewHub(100)
+	h := NewHub()
 	sMock1 := socketMock{id: 1}
 	h.Add(&sMock1)
 	sMock2 := socketMock{id: 2}
@@ -335,14 +659,299 @@ func TestCloseSocket(t *testing.T) {
 	h.Add(&sMock3)
 
 	sMock1.simulateProbData(message.IDRequestMsg{}, errors.New("Error on send"))
-	time.Sleep(20 * time.Millisecond)
+	settle(h)
 	if _, ok := h.sktRepo[1]; ok {
 		t.Fatalf("Error does not close channel")
 	}
 	if len(h.sktRepo) != 2 {
 		t.Fatalf("Error does not close channel")
 	}
-	if !sMock1.closed {
+	if !sMock1.isClosed() {
 		t.Fatalf("Close methods of socket not called")
 	}
 }
+
+func TestStats(t *testing.T) {
+	h := NewHub()
+	start := time.Now()
+	sMock1 := socketMock{id: 1, stats: socket.Stats{
+		ConnectedAt:    start,
+		In:             socket.TrafficStats{Bytes: 10, Frames: 2},
+		InByType:       map[byte]socket.TrafficStats{byte(message.IDMgsCode): {Bytes: 10, Frames: 2}},
+		QueueHighWater: 5,
+		Errors:         1,
+	}}
+	sMock2 := socketMock{id: 2, stats: socket.Stats{
+		ConnectedAt:    start.Add(time.Second),
+		LastRead:       start.Add(2 * time.Second),
+		In:             socket.TrafficStats{Bytes: 5, Frames: 1},
+		InByType:       map[byte]socket.TrafficStats{byte(message.IDMgsCode): {Bytes: 5, Frames: 1}},
+		QueueHighWater: 3,
+		DiscardedBytes: 7,
+	}}
+	h.Add(&sMock1)
+	h.Add(&sMock2)
+	stats := h.Stats()
+	if len(stats.Sockets) != 2 || stats.Sockets[2].DiscardedBytes != 7 {
+		t.Fatalf("Unexpected stats of sockets %v", stats.Sockets)
+	}
+	total := stats.Total
+	if total.In.Frames != 3 || total.InByType[byte(message.IDMgsCode)].Bytes != 15 {
+		t.Fatalf("Traffic not summed %v - %v", total.In, total.InByType)
+	}
+	if total.QueueHighWater != 5 || total.Errors != 1 || total.DiscardedBytes != 7 {
+		t.Fatalf("Counters not aggregated %+v", total)
+	}
+	if !total.ConnectedAt.Equal(start) || !total.LastRead.Equal(start.Add(2*time.Second)) {
+		t.Fatalf("Unexpected times %v - %v", total.ConnectedAt, total.LastRead)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	h := NewHub()
+	// Hub does not offer heartbeat, so it is not agreed even though client offers it
+	h.SetFeatures(socket.FeatureChecksum | socket.FeatureFragmentation)
+	sMock1 := socketMock{id: 1}
+	h.Add(&sMock1)
+	sMock2 := socketMock{id: 2}
+	h.Add(&sMock2)
+
+	features := socket.FeatureChecksum | socket.FeatureHeartbeat
+	sMock1.simulateReadData(message.HelloMsg{Version: socket.ProtocolVersion + 1, MaxFrameSize: 100, Features: uint32(features)})
+	settle(h)
+	if len(sMock1.sent()) != 1 || sMock1.sent()[0].Type() != byte(message.HelloMgsCode) {
+		t.Fatal("Welcome message not sent in response to hello")
+	}
+	data, _ := sMock1.sent()[0].Data()
+	welcome, err := message.DeserializeWelcome(data)
+	if err != nil {
+		t.Fatalf("Error on deserializing welcome message %s", err)
+	}
+	expected := message.WelcomeMsg{Version: socket.ProtocolVersion, MaxFrameSize: uint32(maxRelayMsgLen), Features: uint32(socket.FeatureChecksum)}
+	if welcome != expected {
+		t.Fatalf("Invalid welcome message. Expected %+v, actual %+v", expected, welcome)
+	}
+	expectedCaps := socket.Capabilities{Version: socket.ProtocolVersion, MaxFrameSize: 100, Features: socket.FeatureChecksum}
+	if sMock1.capabilities() != expectedCaps {
+		t.Fatalf("Agreed capabilities not applied to socket. Expected %+v, actual %+v", expectedCaps, sMock1.capabilities())
+	}
+
+	// Socket 2 never sends hello, relay larger than max frame size of socket 1 must not be delivered to it
+	sMock1.simulateWriteData(message.IDResponseMsg{ID: 1})
+	sMock2.simulateWriteData(message.IDResponseMsg{ID: 2})
+	settle(h)
+	sMock1.clearPackets()
+	sMock2.simulateReadData(message.RelayRequestMsg{IDs: []uint64{1}, Body: make([]byte, 93)})
+	settle(h)
+	if len(sMock1.sent()) != 0 {
+		t.Fatal("Relay message larger than max frame size delivered to socket")
+	}
+	sMock2.simulateReadData(message.RelayRequestMsg{IDs: []uint64{1}, Body: make([]byte, 92)})
+	settle(h)
+	if len(sMock1.sent()) != 1 {
+		t.Fatal("Relay message in max frame size not delivered to socket")
+	}
+
+	// Hello after identification is rejected
+	sMock1.clearPackets()
+	sMock1.simulateReadData(message.HelloMsg{Version: socket.ProtocolVersion})
+	settle(h)
+	if len(sMock1.sent()) != 0 || sMock1.capabilities() != expectedCaps {
+		t.Fatal("Hello message accepted from identified socket")
+	}
+
+	// Socket that agreed fragmentation receives relay larger than its max frame size in fragments
+	sMock3 := socketMock{id: 3}
+	h.Add(&sMock3)
+	features = socket.FeatureChecksum | socket.FeatureFragmentation
+	sMock3.simulateReadData(message.HelloMsg{Version: socket.ProtocolVersion, MaxFrameSize: 100, Features: uint32(features)})
+	sMock3.simulateWriteData(message.IDResponseMsg{ID: 3})
+	settle(h)
+	sMock3.clearPackets()
+	sMock2.simulateReadData(message.RelayRequestMsg{IDs: []uint64{3}, Body: make([]byte, 1000)})
+	settle(h)
+	if len(sMock3.sent()) != 1 {
+		t.Fatal("Relay message not delivered to socket that agreed fragmentation")
+	}
+}
+
+// pipeClient connect a client to hub through an in memory socket pair and identify it
+func pipeClient(t *testing.T, h *Hub, id uint64, conf socket.PipeConfig) (*socket.TCPSocket, chan socket.RData) {
+	return pipeClientWith(t, h, id, conf, nil, 0, false)
+}
+
+// pipeClientWith connect a client like pipeClient. Both sockets reassemble packets up to limits, and client
+// agrees features with hub in handshake before it is identified, unless features is zero. Client with
+// manual credit gives credit of streams itself, see socket.TCPSocket.SetManualCredit
+func pipeClientWith(t *testing.T, h *Hub, id uint64, conf socket.PipeConfig, limits map[byte]int,
+	features socket.Features, manualCredit bool) (*socket.TCPSocket, chan socket.RData) {
+	hubSide, cliSide := socket.Pipe(conf)
+	hubSide.SetID(id)
+	hubSide.SetLogger(logging.Discard)
+	cliSide.SetLogger(logging.Discard)
+	hubSide.SetReassemblyLimits(limits)
+	cliSide.SetReassemblyLimits(limits)
+	cliSide.SetManualCredit(manualCredit)
+	if err := h.Add(hubSide); err != nil {
+		t.Fatalf("Socket not added. Error %v", err)
+	}
+	read := make(chan socket.RData, 10)
+	cliSide.Start(make(chan socket.WData, 10), read, make(chan socket.ProbData, 10), map[byte]int{
+		byte(message.HelloMgsCode): message.HelloMaxLen,
+		byte(message.IDMgsCode):    8,
+		byte(message.ListMgsCode):  message.ListMaxItems * 8,
+		byte(message.RelayMgsCode): message.RelayMaxBodySize + 8,
+	})
+	if features != 0 {
+		caps := socket.LocalCapabilities(message.RelayMaxBodySize+8, features)
+		cliSide.Send(message.HelloMsg{Version: caps.Version, MaxFrameSize: uint32(caps.MaxFrameSize), Features: uint32(caps.Features)})
+		welcome, err := message.DeserializeWelcome(pipeRead(t, read))
+		if err != nil {
+			t.Fatalf("Welcome not valid. Error %v", err)
+		}
+		socketFeatures, _ := message.SplitFeatures(welcome.Features)
+		cliSide.SetCapabilities(socket.Negotiate(caps, socket.Capabilities{Version: welcome.Version,
+			MaxFrameSize: int(welcome.MaxFrameSize), Features: socket.Features(socketFeatures)}))
+	}
+	cliSide.Send(message.IDRequestMsg{})
+	msg, err := message.DeserializeIDRes(pipeRead(t, read))
+	if err != nil || msg.ID != id {
+		t.Fatalf("Expected id %d, actual %d. Error %v", id, msg.ID, err)
+	}
+	// Socket is identified when hub knows id response is written
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		h.mutx.RLock()
+		identified := h.sktRepo[id].IsIdentified
+		h.mutx.RUnlock()
+		if identified {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Socket %d not identified", id)
+		}
+	}
+	return cliSide, read
+}
+
+func pipeRead(t *testing.T, read chan socket.RData) []byte {
+	select {
+	case rData := <-read:
+		data, _ := rData.Pkt.Data()
+		return data
+	case <-time.After(5 * time.Second):
+		t.Fatal("Response not received")
+	}
+	return nil
+}
+
+// pipeConfigs are connections that hub scenarios run through
+var pipeConfigs = []socket.PipeConfig{
+	{Latency: time.Millisecond},
+	{Faults: &socket.Faults{Seed: 1, ReadChunk: 1, WriteChunk: 1}},
+	{Faults: &socket.Faults{Seed: 2, ReadChunk: 5, WriteChunk: 3, DelayRate: 0.1, MaxDelay: time.Millisecond}},
+	{BufferSize: 16, Faults: &socket.Faults{Seed: 3, ReadChunk: 7, DelayRate: 0.5, MaxDelay: time.Millisecond}},
+}
+
+func TestRelayLargeBody(t *testing.T) {
+	h := NewHub()
+	h.SetLogger(logging.Discard)
+	limits := map[byte]int{byte(message.RelayMgsCode): 4 * message.RelayMaxBodySize}
+	cli1, read1 := pipeClientWith(t, h, 1, socket.PipeConfig{}, limits, socket.FeatureFragmentation, false)
+	cli2, _ := pipeClientWith(t, h, 2, socket.PipeConfig{}, limits, socket.FeatureFragmentation, false)
+	defer cli1.Close()
+	defer cli2.Close()
+
+	// Body larger than one frame goes through hub in fragments
+	body := make([]byte, 3*message.RelayMaxBodySize)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	cli2.Send(message.RelayRequestMsg{IDs: []uint64{1}, Body: body})
+	relay, err := message.DeserializeRelayRes(pipeRead(t, read1))
+	if err != nil || relay.SenderID != 2 || !bytes.Equal(relay.Body, body) {
+		t.Fatalf("Large relay message not received. Error %v", err)
+	}
+}
+
+func TestRelayStreamOverPipe(t *testing.T) {
+	h := NewHub()
+	h.SetLogger(logging.Discard)
+	cli1, _ := pipeClientWith(t, h, 1, socket.PipeConfig{}, nil, socket.FeatureStreams, false)
+	cli2, read2 := pipeClientWith(t, h, 2, socket.PipeConfig{}, nil, socket.FeatureStreams, true)
+	defer cli1.Close()
+	defer cli2.Close()
+
+	// Four messages fill a window. Hub writes four to recipient, and sender gets credit of only those back
+	const count = 10
+	for i := 0; i < count; i++ {
+		body := make([]byte, socket.StreamWindow/4)
+		body[0] = byte(i)
+		cli1.Send(socket.OnStream(1, message.RelayRequestMsg{IDs: []uint64{2}, Body: body}))
+	}
+	received := func() uint64 {
+		return h.Stats().Sockets[1].InByType[byte(message.RelayMgsCode)].Frames
+	}
+	for deadline := time.Now().Add(5 * time.Second); received() < 8; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 8 relay messages in hub, actual %d", received())
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if received() != 8 {
+		t.Fatalf("Sender is not held back by recipient that does not read, hub received %d", received())
+	}
+
+	// Recipient reads and gives credit back, so the rest of stream goes through hub
+	for i := 0; i < count; i++ {
+		data := pipeRead(t, read2)
+		relay, err := message.DeserializeRelayRes(data)
+		if err != nil || relay.Body[0] != byte(i) {
+			t.Fatalf("Message %d: unexpected relay message. Error %v", i, err)
+		}
+		cli2.GrantCredit(1, len(data))
+	}
+}
+
+func TestHubOverPipe(t *testing.T) {
+	for _, conf := range pipeConfigs {
+		testHubOverPipe(t, conf)
+	}
+}
+
+func testHubOverPipe(t *testing.T, conf socket.PipeConfig) {
+	h := NewHub()
+	h.SetLogger(logging.Discard)
+	cli1, read1 := pipeClient(t, h, 1, conf)
+	cli2, read2 := pipeClient(t, h, 2, conf)
+	defer cli1.Close()
+	defer cli2.Close()
+
+	cli1.Send(message.ListRequestMsg{})
+	list, err := message.DeserializeListRes(pipeRead(t, read1))
+	if err != nil || len(list.IDs) != 1 || list.IDs[0] != 2 {
+		t.Fatalf("Unexpected list %v. Error %v", list.IDs, err)
+	}
+	// Correlation id of request is copied to response
+	cli1.Send(message.ListRequestMsg{CorrID: 9})
+	list, err = message.DeserializeListRes(pipeRead(t, read1))
+	if err != nil || len(list.IDs) != 1 || list.CorrID != 9 {
+		t.Fatalf("Unexpected list %v with correlation id %d. Error %v", list.IDs, list.CorrID, err)
+	}
+
+	cli2.Send(message.RelayRequestMsg{IDs: []uint64{1}, Body: []byte("hello")})
+	relay, err := message.DeserializeRelayRes(pipeRead(t, read1))
+	if err != nil || relay.SenderID != 2 || string(relay.Body) != "hello" {
+		t.Fatalf("Unexpected relay %v. Error %v", relay, err)
+	}
+	if len(read2) != 0 {
+		t.Fatal("Relay message sent back to sender")
+	}
+
+	// Hub removes socket when client disconnects
+	cli2.Close()
+	for deadline := time.Now().Add(5 * time.Second); len(h.Stats().Sockets) != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Disconnected socket not removed from hub")
+		}
+	}
+}
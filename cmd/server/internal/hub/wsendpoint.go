@@ -0,0 +1,117 @@
+package hub
+
+import (
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+	"github.com/vajafari/messagehub/pkg/logging"
+	"github.com/vajafari/messagehub/pkg/socket"
+)
+
+// WSEndpoint is WebSocket endpoint that let browsers join the hub
+// Connections are registered in the same hub as tcp endpoint, so all the peers can see each other
+type WSEndpoint struct {
+	config   EndpointConfing
+	hub      *Hub
+	upgrader websocket.Upgrader
+	log      logging.Logger
+	capture  *socket.CaptureWriter
+}
+
+// NewWSEndpoint creates WebSocket endpoint for an existing hub
+func NewWSEndpoint(config EndpointConfing, hub *Hub) *WSEndpoint {
+	e := &WSEndpoint{
+		config: config,
+		hub:    hub,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  config.ReadBufSize,
+			WriteBufferSize: config.WriteBufSize,
+		},
+		log: logging.Default(),
+	}
+	if len(config.WSAllowedOrigins) > 0 {
+		e.upgrader.CheckOrigin = e.checkOrigin
+	}
+	return e
+}
+
+// SetLogger set logger of endpoint and its sockets. It must be called before Start
+func (e *WSEndpoint) SetLogger(l logging.Logger) {
+	e.log = l
+}
+
+// SetCapture set writer that captures packets of sockets. It must be called before Start
+func (e *WSEndpoint) SetCapture(c *socket.CaptureWriter) {
+	e.capture = c
+}
+
+// GetWSAddress return address that WebSocket endpoint listens on
+func (conf *EndpointConfing) GetWSAddress() string {
+	return conf.Host + ":" + strconv.Itoa(conf.WSPort)
+}
+
+// Start listening for WebSocket connections. When TLS is configured for endpoint, it serves wss
+func (e *WSEndpoint) Start() error {
+	mux := http.NewServeMux()
+	mux.Handle(e.path(), e)
+	server := &http.Server{Addr: e.config.GetWSAddress(), Handler: mux}
+	tlsConf, errTLS := e.config.GetTLSConfig()
+	if errTLS != nil {
+		e.log.Error("TLS configuration is not valid", logging.Err, errTLS)
+		return errTLS
+	}
+	listener, errListen := net.Listen("tcp", e.config.GetWSAddress())
+	if errListen != nil {
+		e.log.Error("Unable to listen on host address", "address", e.config.GetWSAddress(), logging.Err, errListen)
+		return errListen
+	}
+	var err error
+	if tlsConf != nil {
+		server.TLSConfig = tlsConf
+		e.log.Info("Listening", "address", "wss://"+e.config.GetWSAddress()+e.path())
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		e.log.Info("Listening", "address", "ws://"+e.config.GetWSAddress()+e.path())
+		err = server.Serve(listener)
+	}
+	e.log.Error("Stop serving", logging.Err, err)
+	return err
+}
+
+// ServeHTTP upgrade request to WebSocket and add connection to hub
+func (e *WSEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := e.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		e.log.Warn("Failed upgrading connection", logging.RemoteAddr, r.RemoteAddr, logging.Err, err)
+		return
+	}
+	skt := socket.NewWSSocket(conn, rand.Uint64(), e.config.SendQueueSize, e.config.ReadBufSize, e.config.WriteBufSize)
+	e.config.configSocket(skt, ClientIdentity(r.TLS, r.RemoteAddr))
+	skt.SetLogger(e.log)
+	skt.SetCapture(e.capture)
+	err = e.hub.Add(skt)
+	if err != nil {
+		e.log.Warn("Failed adding connection to hub", logging.RemoteAddr, r.RemoteAddr, logging.Err, err)
+		conn.Close()
+	}
+}
+
+func (e *WSEndpoint) path() string {
+	if e.config.WSPath == "" {
+		return "/"
+	}
+	return e.config.WSPath
+}
+
+func (e *WSEndpoint) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	for _, o := range e.config.WSAllowedOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package hub
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vajafari/messagehub/pkg/message"
+	"github.com/vajafari/messagehub/pkg/socket"
+)
+
+// testPeer is a client side socket that talks to hub in tests
+type testPeer struct {
+	skt      *socket.TCPSocket
+	readChan chan socket.RData
+}
+
+func newTestPeer(skt *socket.TCPSocket) *testPeer {
+	p := &testPeer{skt: skt, readChan: make(chan socket.RData, 10)}
+	msgTypeLen := map[byte]int{
+		byte(message.IDMgsCode):    8,
+		byte(message.ListMgsCode):  message.ListMaxItems * 8,
+		byte(message.RelayMgsCode): message.RelayMaxBodySize + 8,
+	}
+	skt.Start(make(chan socket.WData, 10), p.readChan, make(chan socket.ProbData, 10), msgTypeLen)
+	return p
+}
+
+func (p *testPeer) receive(t *testing.T) []byte {
+	select {
+	case rData := <-p.readChan:
+		data, _ := rData.Pkt.Data()
+		return data
+	case <-time.After(5 * time.Second):
+		t.Fatal("No response received from hub")
+	}
+	return nil
+}
+
+func (p *testPeer) identify(t *testing.T) uint64 {
+	p.skt.Send(message.IDRequestMsg{})
+	msg, err := message.DeserializeIDRes(p.receive(t))
+	if err != nil {
+		t.Fatalf("Error on deserializing id response %s", err)
+	}
+	// Give hub the time to mark socket as identified
+	time.Sleep(20 * time.Millisecond)
+	return msg.ID
+}
+
+func TestWSEndpoint(t *testing.T) {
+	h := NewHub()
+	conf := EndpointConfing{SendQueueSize: 10, ReadBufSize: 4096, WriteBufSize: 4096}
+	srv := httptest.NewServer(NewWSEndpoint(conf, h))
+	defer srv.Close()
+
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsPeer := newTestPeer(socket.NewWSSocket(wsConn, 0, 10, 4096, 4096))
+
+	// TCP peer joins the same hub
+	cliConn, srvConn := net.Pipe()
+	h.Add(socket.NewConnSocket(srvConn, 12345, 10, 4096, 4096))
+	tcpPeer := newTestPeer(socket.NewConnSocket(cliConn, 0, 10, 4096, 4096))
+
+	wsID := wsPeer.identify(t)
+	tcpID := tcpPeer.identify(t)
+
+	wsPeer.skt.Send(message.ListRequestMsg{})
+	list, err := message.DeserializeListRes(wsPeer.receive(t))
+	if err != nil || !message.ChkListResponseMsgEq(list, message.ListResponseMsg{IDs: []uint64{tcpID}}) {
+		t.Fatalf("WebSocket peer cannot see tcp peer. List %v", list.IDs)
+	}
+
+	wsPeer.skt.Send(message.RelayRequestMsg{IDs: []uint64{tcpID}, Body: []byte{1, 2, 3}})
+	relay, err := message.DeserializeRelayRes(tcpPeer.receive(t))
+	if err != nil || !message.ChkRelayResponseMsgEq(relay, message.RelayResponseMsg{SenderID: wsID, Body: []byte{1, 2, 3}}) {
+		t.Fatal("Relay from WebSocket peer not received by tcp peer")
+	}
+
+	tcpPeer.skt.Send(message.RelayRequestMsg{IDs: []uint64{wsID}, Body: []byte{4, 5}})
+	relay, err = message.DeserializeRelayRes(wsPeer.receive(t))
+	if err != nil || !message.ChkRelayResponseMsgEq(relay, message.RelayResponseMsg{SenderID: tcpID, Body: []byte{4, 5}}) {
+		t.Fatal("Relay from tcp peer not received by WebSocket peer")
+	}
+}
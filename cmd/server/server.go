@@ -3,10 +3,14 @@ package main
 import (
 	"fmt"
 	"math/rand"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/spf13/viper"
 	"github.com/vajafari/messagehub/cmd/server/internal/hub"
+	"github.com/vajafari/messagehub/pkg/logging"
+	"github.com/vajafari/messagehub/pkg/socket"
 )
 
 func main() {
@@ -16,10 +20,45 @@ func main() {
 		return
 	}
 
+	warnRemovedKeys()
 	rand.Seed(time.Now().UTC().UnixNano())
 
-	h := hub.NewEndpoint(getEndpointConf())
-	h.Start()
+	conf := getEndpointConf()
+	logger, err := logging.New(os.Stdout, conf.LogLevel, conf.LogFormat)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	var capture *socket.CaptureWriter
+	if conf.CaptureFile != "" {
+		// One capture for all endpoints, so traffic of every client is in a single file
+		capture, err = socket.OpenCapture(conf.CaptureFile)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		defer capture.Close()
+	}
+	h := hub.NewEndpoint(conf)
+	h.SetLogger(logger)
+	h.SetCapture(capture)
+	// Endpoints only return when they cannot serve, e.g. port is in use, then server stops
+	errs := make(chan error, 2)
+	if conf.WSPort > 0 {
+		// WebSocket endpoint shares the hub, so browsers and tcp clients see each other
+		ws := hub.NewWSEndpoint(conf, h.Hub())
+		ws.SetLogger(logger)
+		ws.SetCapture(capture)
+		go func() {
+			errs <- ws.Start()
+		}()
+	}
+	go func() {
+		errs <- h.Start()
+	}()
+	if err = <-errs; err != nil {
+		fmt.Println(err.Error())
+	}
 
 	//fmt.Printf("Starting end point")
 	//err = tcp.NewEndpoint(getEndpointConf(), nil).Start()
@@ -36,6 +75,16 @@ func configViper() error {
 	return viper.ReadInConfig()
 }
 
+// warnRemovedKeys report keys of old config files that are ignored. Sockets call handlers of hub
+// directly, so hub has no queue of its own and hubQueueSize is not used anymore
+func warnRemovedKeys() {
+	for _, key := range []string{"hubQueueSize"} {
+		if viper.IsSet(key) {
+			fmt.Printf("Configuration %s is not used anymore and is ignored, please remove it\n", key)
+		}
+	}
+}
+
 func getEndpointConf() hub.EndpointConfing {
 	return hub.EndpointConfing{
 		Host:          viper.GetString("host"),
@@ -44,6 +93,83 @@ func getEndpointConf() hub.EndpointConfing {
 		SendQueueSize: viper.GetInt("sendQueueSize"),
 		ReadBufSize:   viper.GetInt("readBufSize"),
 		WriteBufSize:  viper.GetInt("writeBufSize"),
-		HubQueueSize:  viper.GetInt("hubQueueSize"),
+
+		UnixSocketMode: getFileMode("unixSocketMode"),
+
+		TLSCertFile:     viper.GetString("tlsCertFile"),
+		TLSKeyFile:      viper.GetString("tlsKeyFile"),
+		TLSClientCAFile: viper.GetString("tlsClientCAFile"),
+
+		WSPort:           viper.GetInt("wsPort"),
+		WSPath:           viper.GetString("wsPath"),
+		WSAllowedOrigins: viper.GetStringSlice("wsAllowedOrigins"),
+
+		Features:        viper.GetStringSlice("features"),
+		CompressMinSize: viper.GetInt("compressMinSize"),
+
+		FragmentSize:     viper.GetInt("fragmentSize"),
+		ReassemblyLimits: getIntMap("reassemblyLimits"),
+		OverflowPolicy:   viper.GetString("overflowPolicy"),
+
+		ReadTimeout:       viper.GetInt("readTimeout"),
+		WriteTimeout:      viper.GetInt("writeTimeout"),
+		HeartbeatInterval: viper.GetInt("heartbeatInterval"),
+		MaxMissedPongs:    viper.GetInt("maxMissedPongs"),
+
+		Lanes:       viper.GetStringMapString("lanes"),
+		LaneDepths:  getIntMap("laneDepths"),
+		LaneWeights: getIntMap("laneWeights"),
+
+		WriteBatchBytes:  viper.GetInt("writeBatchBytes"),
+		WriteBatchFrames: viper.GetInt("writeBatchFrames"),
+		GarbageLimit:     viper.GetInt("garbageLimit"),
+
+		RateLimits:         getRateLimits("rateLimits"),
+		RateLimitOverrides: getRateLimitOverrides("rateLimitOverrides"),
+
+		LogLevel:  viper.GetString("logLevel"),
+		LogFormat: viper.GetString("logFormat"),
+
+		CaptureFile: viper.GetString("captureFile"),
+	}
+}
+
+// getRateLimits read rate limits like {"inFramesPerSec": 100, "action": "drop"} from config
+func getRateLimits(key string) hub.RateLimitConfig {
+	var limits hub.RateLimitConfig
+	if err := viper.UnmarshalKey(key, &limits); err != nil {
+		fmt.Printf("Invalid %s configuration. Error message %s\n", key, err.Error())
+	}
+	return limits
+}
+
+// getRateLimitOverrides read rate limits of each client identity from config
+func getRateLimitOverrides(key string) map[string]hub.RateLimitConfig {
+	overrides := make(map[string]hub.RateLimitConfig)
+	if err := viper.UnmarshalKey(key, &overrides); err != nil {
+		fmt.Printf("Invalid %s configuration. Error message %s\n", key, err.Error())
+	}
+	return overrides
+}
+
+// getIntMap read a map of integers like {"relay": 52428800} from config. Invalid values are ignored
+func getIntMap(key string) map[string]int {
+	res := make(map[string]int)
+	for name, value := range viper.GetStringMapString(key) {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+		res[name] = n
+	}
+	return res
+}
+
+// getFileMode read an octal file mode like "0660" from config. Invalid or empty values are ignored
+func getFileMode(key string) os.FileMode {
+	mode, err := strconv.ParseUint(viper.GetString(key), 8, 32)
+	if err != nil {
+		return 0
 	}
+	return os.FileMode(mode)
 }
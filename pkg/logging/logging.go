@@ -0,0 +1,108 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Logger is used by socket, hub and proxy to log their events. Args are key value pairs of fields,
+// like log/slog. *slog.Logger implements it
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// Keys of common fields
+const (
+	SocketID   = "socket_id"
+	MsgType    = "msg_type"
+	RemoteAddr = "remote_addr"
+	Bytes      = "bytes"
+	Err        = "error"
+	Stream     = "stream"
+)
+
+// Names of log formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// LevelOff is a level above all records, a logger with this level logs nothing
+const LevelOff = slog.Level(100)
+
+// Discard is a logger that logs nothing
+var Discard Logger = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: LevelOff}))
+
+// Default return a logger that passes records to the default logger of log/slog
+func Default() Logger {
+	return defaultLogger{}
+}
+
+// ParseLevel convert name of level (debug, info, warn, error or off) to slog level. Empty is info
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	case "off":
+		return LevelOff, nil
+	}
+	return 0, fmt.Errorf("Unknown log level %s", name)
+}
+
+// New create a logger that writes records of level and above to w, in text or json format. Empty format is text
+func New(w io.Writer, level string, format string) (*slog.Logger, error) {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "", FormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("Unknown log format %s", format)
+}
+
+// With return a logger that adds args to each record of l
+func With(l Logger, args ...any) Logger {
+	if sl, ok := l.(*slog.Logger); ok {
+		return sl.With(args...)
+	}
+	return withLogger{l: l, args: args}
+}
+
+type defaultLogger struct{}
+
+func (defaultLogger) Debug(msg string, args ...any) { slog.Default().Debug(msg, args...) }
+func (defaultLogger) Info(msg string, args ...any)  { slog.Default().Info(msg, args...) }
+func (defaultLogger) Warn(msg string, args ...any)  { slog.Default().Warn(msg, args...) }
+func (defaultLogger) Error(msg string, args ...any) { slog.Default().Error(msg, args...) }
+
+// withLogger add fields to records of a logger that is not a slog logger
+type withLogger struct {
+	l    Logger
+	args []any
+}
+
+func (w withLogger) Debug(msg string, args ...any) { w.l.Debug(msg, w.join(args)...) }
+func (w withLogger) Info(msg string, args ...any)  { w.l.Info(msg, w.join(args)...) }
+func (w withLogger) Warn(msg string, args ...any)  { w.l.Warn(msg, w.join(args)...) }
+func (w withLogger) Error(msg string, args ...any) { w.l.Error(msg, w.join(args)...) }
+
+func (w withLogger) join(args []any) []any {
+	res := make([]any, 0, len(w.args)+len(args))
+	return append(append(res, w.args...), args...)
+}
@@ -0,0 +1,64 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, "warn", "json")
+	if err != nil {
+		t.Fatalf("Logger not created. Error %v", err)
+	}
+	l.Info("Hidden", SocketID, 1)
+	l.Warn("Shown", SocketID, 2, Bytes, 10)
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected one json record, actual %s", buf.String())
+	}
+	if record["msg"] != "Shown" || record[SocketID] != float64(2) || record[Bytes] != float64(10) {
+		t.Fatalf("Unexpected record %v", record)
+	}
+
+	buf.Reset()
+	l, _ = New(&buf, "off", "")
+	l.Error("Hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("Logger with level off logged %s", buf.String())
+	}
+
+	if _, err := New(&buf, "verbose", "text"); err == nil {
+		t.Fatal("Unknown level accepted")
+	}
+	if _, err := New(&buf, "info", "xml"); err == nil {
+		t.Fatal("Unknown format accepted")
+	}
+}
+
+// recordLogger keep args of the last record
+type recordLogger struct {
+	args []any
+}
+
+func (r *recordLogger) Debug(msg string, args ...any) { r.args = args }
+func (r *recordLogger) Info(msg string, args ...any)  { r.args = args }
+func (r *recordLogger) Warn(msg string, args ...any)  { r.args = args }
+func (r *recordLogger) Error(msg string, args ...any) { r.args = args }
+
+func TestWith(t *testing.T) {
+	r := &recordLogger{}
+	With(r, SocketID, 1).Warn("Message", Bytes, 5)
+	if len(r.args) != 4 || r.args[0] != SocketID || r.args[3] != 5 {
+		t.Fatalf("Unexpected fields %v", r.args)
+	}
+
+	var buf bytes.Buffer
+	l, _ := New(&buf, "", "")
+	With(l, SocketID, 7).Info("Message")
+	if !strings.Contains(buf.String(), "socket_id=7") {
+		t.Fatalf("Field not added to record %s", buf.String())
+	}
+}
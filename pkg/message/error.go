@@ -0,0 +1,86 @@
+package message
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// ErrorMaxReasonLen is max length of reason of error message
+	ErrorMaxReasonLen int = 255
+	// errorHeaderLen is 1 byte for type of request, 1 byte for code, 4 bytes for correlation id and 1 byte for
+	// count of failed recipients
+	errorHeaderLen int = 7
+	// ErrorMaxLen is max length of error message
+	ErrorMaxLen int = errorHeaderLen + RelayMaxReciverCount*8 + ErrorMaxReasonLen
+)
+
+// ErrorCode tell why hub rejected a message
+type ErrorCode byte
+
+const (
+	// ErrCodeInvalid means message is not valid or its type is not known
+	ErrCodeInvalid ErrorCode = 1 + iota
+	// ErrCodeNotIdentified means client must be identified before it sends the message
+	ErrCodeNotIdentified
+	// ErrCodeUnknownRecipient means recipient of relay message is not connected or not identified
+	ErrCodeUnknownRecipient
+	// ErrCodeTooLarge means relay message or list response is larger than recipient accepts
+	ErrCodeTooLarge
+	// ErrCodeQueueFull means send queue or stream of recipient is full and relay message is dropped
+	ErrCodeQueueFull
+)
+
+// ErrorMsg represent message from hub to client that tells a message of client is rejected
+type ErrorMsg struct {
+	ReqType MsgType   // Type of message that is rejected
+	Code    ErrorCode // Why message is rejected
+	CorrID  uint32    // Correlation id of request, zero when request has none
+	Reason  string    // Human readable reason
+	IDs     []uint64  // Recipients of relay request that message is not delivered to
+}
+
+// Type get type of error message
+func (msg ErrorMsg) Type() byte {
+	return byte(ErrorMgsCode)
+}
+
+// Data get frame bytes of ErrorMsg
+// Failed recipients are written between header and reason
+func (msg ErrorMsg) Data() ([]byte, error) {
+	if len(msg.Reason) > ErrorMaxReasonLen || len(msg.IDs) > RelayMaxReciverCount {
+		return nil, ErrInvalidData
+	}
+	data := make([]byte, errorHeaderLen+len(msg.IDs)*8+len(msg.Reason))
+	data[0] = byte(msg.ReqType)
+	data[1] = byte(msg.Code)
+	binary.LittleEndian.PutUint32(data[2:6], msg.CorrID)
+	data[6] = byte(len(msg.IDs))
+	copy(data[errorHeaderLen:], getUnit64Bytes(msg.IDs))
+	copy(data[errorHeaderLen+len(msg.IDs)*8:], msg.Reason)
+	return data, nil
+}
+
+// DeserializeError convert stream of bytes to ErrorMsg
+func DeserializeError(bb []byte) (ErrorMsg, error) {
+	if len(bb) < errorHeaderLen || len(bb) > ErrorMaxLen {
+		return ErrorMsg{}, ErrParsStream
+	}
+	cnt := int(bb[6])
+	if len(bb) < errorHeaderLen+cnt*8 || len(bb)-errorHeaderLen-cnt*8 > ErrorMaxReasonLen {
+		return ErrorMsg{}, ErrParsStream
+	}
+	var ids []uint64
+	if cnt > 0 {
+		ids = make([]uint64, cnt)
+		for i := range ids {
+			ids[i] = binary.LittleEndian.Uint64(bb[errorHeaderLen+i*8:])
+		}
+	}
+	return ErrorMsg{
+		ReqType: MsgType(bb[0]),
+		Code:    ErrorCode(bb[1]),
+		CorrID:  binary.LittleEndian.Uint32(bb[2:6]),
+		Reason:  string(bb[errorHeaderLen+cnt*8:]),
+		IDs:     ids,
+	}, nil
+}
@@ -0,0 +1,62 @@
+package message
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Features is bitmask of optional features of messages. Hello and welcome messages carry them in the
+// upper 16 bits of their features, the lower 16 bits are features of socket
+type Features uint32
+
+const (
+	// FeatureCorrelation means peer accepts correlation ids in requests and copies them to responses
+	FeatureCorrelation Features = 1 << (16 + iota)
+	// FeatureErrors means peer accepts error messages for its messages that are rejected
+	FeatureErrors
+)
+
+// SupportedFeatures is set of features that hub and proxy implement
+const SupportedFeatures = FeatureCorrelation | FeatureErrors
+
+// socketFeaturesMask is the bits of features of hello message that belong to socket
+const socketFeaturesMask uint32 = 1<<16 - 1
+
+var featureNames = map[string]Features{
+	"correlation": FeatureCorrelation,
+	"errors":      FeatureErrors,
+}
+
+// IsFeature report whether name is a feature of messages, so config lists can hold features of socket too
+func IsFeature(name string) bool {
+	_, ok := featureNames[strings.ToLower(strings.TrimSpace(name))]
+	return ok
+}
+
+// ParseFeatures convert names of features (as they are written in config files) to Features
+func ParseFeatures(names []string) (Features, error) {
+	var res Features
+	for _, name := range names {
+		f, ok := featureNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return 0, fmt.Errorf("Unknown feature %q", name)
+		}
+		res |= f
+	}
+	return res, nil
+}
+
+// JoinFeatures put features of socket and messages in one value for hello and welcome messages
+func JoinFeatures(socketFeatures uint32, features Features) uint32 {
+	return socketFeatures&socketFeaturesMask | uint32(features)&^socketFeaturesMask
+}
+
+// SplitFeatures separate features of hello and welcome messages to features of socket and messages
+func SplitFeatures(features uint32) (uint32, Features) {
+	return features & socketFeaturesMask, Features(features &^ socketFeaturesMask)
+}
+
+// Has report whether all the features in f are enabled
+func (features Features) Has(f Features) bool {
+	return features&f == f
+}
@@ -0,0 +1,71 @@
+package message
+
+import "encoding/binary"
+
+const (
+	// helloMsgLen is 1 byte for version, 4 bytes for max frame size and 4 bytes for features
+	helloMsgLen int = 9
+)
+
+// HelloMsg represent first message of client that advertises its capabilities to hub
+type HelloMsg struct {
+	Version      byte
+	MaxFrameSize uint32
+	Features     uint32
+}
+
+// Type get type of hello message
+func (msg HelloMsg) Type() byte {
+	return byte(HelloMgsCode)
+}
+
+// Data get frame bytes of HelloMsg
+func (msg HelloMsg) Data() ([]byte, error) {
+	return getHelloBytes(msg.Version, msg.MaxFrameSize, msg.Features), nil
+}
+
+// DeserializeHello convert stream of bytes to HelloMsg
+func DeserializeHello(bb []byte) (HelloMsg, error) {
+	if len(bb) != helloMsgLen {
+		return HelloMsg{}, ErrParsStream
+	}
+	return HelloMsg{
+		Version:      bb[0],
+		MaxFrameSize: binary.LittleEndian.Uint32(bb[1:5]),
+		Features:     binary.LittleEndian.Uint32(bb[5:9]),
+	}, nil
+}
+
+// WelcomeMsg represent response of hub to hello message and carries the agreed capabilities
+type WelcomeMsg struct {
+	Version      byte
+	MaxFrameSize uint32
+	Features     uint32
+}
+
+// Type get type of hello message
+func (msg WelcomeMsg) Type() byte {
+	return byte(HelloMgsCode)
+}
+
+// Data get frame bytes of WelcomeMsg
+func (msg WelcomeMsg) Data() ([]byte, error) {
+	return getHelloBytes(msg.Version, msg.MaxFrameSize, msg.Features), nil
+}
+
+// DeserializeWelcome convert stream of bytes to WelcomeMsg
+func DeserializeWelcome(bb []byte) (WelcomeMsg, error) {
+	msg, err := DeserializeHello(bb)
+	if err != nil {
+		return WelcomeMsg{}, err
+	}
+	return WelcomeMsg(msg), nil
+}
+
+func getHelloBytes(version byte, maxFrameSize uint32, features uint32) []byte {
+	res := make([]byte, helloMsgLen)
+	res[0] = version
+	binary.LittleEndian.PutUint32(res[1:5], maxFrameSize)
+	binary.LittleEndian.PutUint32(res[5:9], features)
+	return res
+}
@@ -6,6 +6,7 @@ import (
 
 // IDRequestMsg represent request from client to get id from server
 type IDRequestMsg struct {
+	CorrID uint32 // Optional correlation id that hub copies to response, zero means none
 }
 
 // Type get type of id message
@@ -15,12 +16,19 @@ func (msg IDRequestMsg) Type() byte {
 
 // Data get frame bytes of IDRequestMsg
 func (msg IDRequestMsg) Data() ([]byte, error) {
-	return nil, nil
+	return getCorrIDBytes(msg.CorrID), nil
+}
+
+// DeserializeIDReq convert stream of bytes to IDRequestMsg
+func DeserializeIDReq(bb []byte) (IDRequestMsg, error) {
+	corrID, err := deserializeCorrID(bb)
+	return IDRequestMsg{CorrID: corrID}, err
 }
 
 // IDResponseMsg represent response of server to client and assign id to client
 type IDResponseMsg struct {
-	ID uint64
+	ID     uint64
+	CorrID uint32 // Correlation id of request
 }
 
 // Type get type of id message
@@ -29,19 +37,24 @@ func (msg IDResponseMsg) Type() byte {
 }
 
 // Data get frame bytes of IDResponseMsg
+// Correlation id is written after id only when it is set
 func (msg IDResponseMsg) Data() ([]byte, error) {
-	res := make([]byte, 8)
+	res := make([]byte, 8, 8+CorrIDLen)
 	binary.LittleEndian.PutUint64(res, uint64(msg.ID))
-	return res, nil
+	return append(res, getCorrIDBytes(msg.CorrID)...), nil
 }
 
 // DeserializeIDRes convert stream of bytes to IDResponseMsg
 func DeserializeIDRes(bb []byte) (IDResponseMsg, error) {
-	if len(bb) != 8 {
+	if len(bb) != 8 && len(bb) != 8+CorrIDLen {
 		return IDResponseMsg{}, ErrParsStream
 	}
-
+	corrID, err := deserializeCorrID(bb[8:])
+	if err != nil {
+		return IDResponseMsg{}, err
+	}
 	return IDResponseMsg{
-		ID: binary.LittleEndian.Uint64(bb),
+		ID:     binary.LittleEndian.Uint64(bb),
+		CorrID: corrID,
 	}, nil
 }
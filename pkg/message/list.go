@@ -5,12 +5,16 @@ import (
 )
 
 const (
-	// ListMaxItems limited to 1024 * 1024 / 8 that is equal to 1024KB (MAX Message size)
+	// ListMaxItems limited to 1024 * 1024 / 8 that is equal to 1024KB (MAX Message size) in one frame.
+	// Longer lists are sent in fragments when fragmentation is agreed
 	ListMaxItems int = 131072
+	// ListMaxLen is max length of list response with correlation id in one frame
+	ListMaxLen int = ListMaxItems*8 + CorrIDLen
 )
 
 // ListRequestMsg represent request from client to get list of connected clients
 type ListRequestMsg struct {
+	CorrID uint32 // Optional correlation id that hub copies to response, zero means none
 }
 
 // Type get type of list message
@@ -20,12 +24,19 @@ func (msg ListRequestMsg) Type() byte {
 
 // Data get frame bytes of ListRequestMsg
 func (msg ListRequestMsg) Data() ([]byte, error) {
-	return nil, nil
+	return getCorrIDBytes(msg.CorrID), nil
+}
+
+// DeserializeListReq convert stream of bytes to ListRequestMsg
+func DeserializeListReq(bb []byte) (ListRequestMsg, error) {
+	corrID, err := deserializeCorrID(bb)
+	return ListRequestMsg{CorrID: corrID}, err
 }
 
 // ListResponseMsg represent response of server to client return list of connected client
 type ListResponseMsg struct {
-	IDs []uint64
+	IDs    []uint64
+	CorrID uint32 // Correlation id of request
 }
 
 // Type get type of list message
@@ -34,20 +45,26 @@ func (msg ListResponseMsg) Type() byte {
 }
 
 // Data get frame bytes of ListRequestMsg
+// Correlation id is written before ids only when it is set, so length of data tells whether it exists
 func (msg ListResponseMsg) Data() ([]byte, error) {
-	if len(msg.IDs) > ListMaxItems {
-		return nil, ErrInvalidData
+	if msg.CorrID == 0 {
+		return getUnit64Bytes(msg.IDs), nil
 	}
-	return getUnit64Bytes(msg.IDs), nil
+	return appendSlices(getCorrIDBytes(msg.CorrID), getUnit64Bytes(msg.IDs)), nil
 }
 
 // DeserializeListRes convert stream of bytes to ListResponseMsg
 func DeserializeListRes(bb []byte) (ListResponseMsg, error) {
+	var corrID uint32
+	if len(bb)%8 == CorrIDLen {
+		corrID = binary.LittleEndian.Uint32(bb)
+		bb = bb[CorrIDLen:]
+	}
 	if len(bb)%8 != 0 {
 		return ListResponseMsg{}, ErrParsStream
 	}
 	if len(bb) == 0 {
-		return ListResponseMsg{}, nil
+		return ListResponseMsg{CorrID: corrID}, nil
 	}
 	cnt := len(bb) / 8
 	uu := make([]uint64, cnt)
@@ -56,6 +73,7 @@ func DeserializeListRes(bb []byte) (ListResponseMsg, error) {
 	}
 
 	return ListResponseMsg{
-		IDs: uu,
+		IDs:    uu,
+		CorrID: corrID,
 	}, nil
 }
@@ -22,6 +22,10 @@ func TestType(t *testing.T) {
 		{&ListResponseMsg{}, "ListResponseMsg", ListMgsCode},
 		{&RelayRequestMsg{}, "RelayRequestMsg", RelayMgsCode},
 		{&RelayResponseMsg{}, "RelayResponseMsg", RelayMgsCode},
+		{&RelayAckMsg{}, "RelayAckMsg", RelayMgsCode},
+		{&HelloMsg{}, "HelloMsg", HelloMgsCode},
+		{&WelcomeMsg{}, "WelcomeMsg", HelloMgsCode},
+		{&ErrorMsg{}, "ErrorMsg", ErrorMgsCode},
 	}
 	for _, tt := range tests {
 		actual := tt.msg.Type()
@@ -46,18 +50,6 @@ func TestData(t *testing.T) {
 		tooMuchIDRelay.IDs[i] = 123
 	}
 
-	tooMuchDataRelay := RelayRequestMsg{}
-	tooMuchDataRelay.Body = make([]byte, RelayMaxBodySize*2)
-	for i := 0; i < RelayMaxBodySize*2; i++ {
-		tooMuchDataRelay.Body[i] = 123
-	}
-
-	tooMuchDataRelayResp := RelayResponseMsg{}
-	tooMuchDataRelayResp.Body = make([]byte, RelayMaxBodySize*2)
-	for i := 0; i < RelayMaxBodySize*2; i++ {
-		tooMuchDataRelayResp.Body[i] = 123
-	}
-
 	var tests = []struct {
 		msg           messager // input
 		typeName      string
@@ -65,13 +57,18 @@ func TestData(t *testing.T) {
 		expectedError error
 	}{
 		{&IDRequestMsg{}, "IDRequestMsg", nil, nil},
+		{&IDRequestMsg{CorrID: 258}, "IDRequestMsg", []byte{2, 1, 0, 0}, nil},
 		{&IDResponseMsg{ID: 256}, "IDResponseMsg", []byte{0, 1, 0, 0, 0, 0, 0, 0}, nil},
+		{&IDResponseMsg{ID: 256, CorrID: 7}, "IDResponseMsg", []byte{0, 1, 0, 0, 0, 0, 0, 0, 7, 0, 0, 0}, nil},
 
 		{&ListRequestMsg{}, "ListRequestMsg", nil, nil},
+		{&ListRequestMsg{CorrID: 7}, "ListRequestMsg", []byte{7, 0, 0, 0}, nil},
 
 		{&ListResponseMsg{}, "ListResponseMsg", nil, nil},
 		{&ListResponseMsg{IDs: []uint64{}}, "ListResponseMsg", nil, nil},
 		{&ListResponseMsg{IDs: []uint64{1}}, "ListResponseMsg", []byte{1, 0, 0, 0, 0, 0, 0, 0}, nil},
+		{&ListResponseMsg{CorrID: 7}, "ListResponseMsg", []byte{7, 0, 0, 0}, nil},
+		{&ListResponseMsg{IDs: []uint64{1}, CorrID: 7}, "ListResponseMsg", []byte{7, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0}, nil},
 		{&ListResponseMsg{IDs: []uint64{1, 2, 3}}, "ListResponseMsg", []byte{1, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0}, nil},
 
 		{&RelayRequestMsg{}, "RelayRequestMsg", nil, ErrInvalidData},
@@ -81,12 +78,29 @@ func TestData(t *testing.T) {
 		{&RelayRequestMsg{Body: []byte{123, 124, 125}}, "RelayRequestMsg", nil, ErrInvalidData},      // only data with no reciever
 		{&RelayRequestMsg{IDs: []uint64{0, 1, 2, 3, 4, 54}}, "RelayRequestMsg", nil, ErrInvalidData}, // only reciever with no data
 		{&tooMuchIDRelay, "RelayRequestMsg", nil, ErrInvalidData},
-		{&tooMuchDataRelay, "RelayRequestMsg", nil, ErrInvalidData},
 		{&RelayRequestMsg{IDs: []uint64{1, 2}, Body: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}}, "RelayRequestMsg", []byte{2, 1, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, nil},
 
+		{&RelayRequestMsg{IDs: []uint64{1}, Body: []byte{7}, CorrID: 9}, "RelayRequestMsg", []byte{0, 9, 0, 0, 0, 1, 1, 0, 0, 0, 0, 0, 0, 0, 7}, nil},
+		{&RelayAckMsg{}, "RelayAckMsg", nil, ErrInvalidData},
+		{&RelayAckMsg{CorrID: 9}, "RelayAckMsg", []byte{9, 0, 0, 0}, nil},
 		{&RelayResponseMsg{}, "RelayResponseMsg", nil, ErrInvalidData},
 		{&RelayResponseMsg{SenderID: 1, Body: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}}, "RelayRequestMsg", []byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, nil},
-		{&tooMuchDataRelayResp, "RelayResponseMsg", nil, ErrInvalidData},
+
+		{&HelloMsg{}, "HelloMsg", []byte{0, 0, 0, 0, 0, 0, 0, 0, 0}, nil},
+		{&HelloMsg{Version: 1, MaxFrameSize: 1048576, Features: 5}, "HelloMsg", []byte{1, 0, 0, 16, 0, 5, 0, 0, 0}, nil},
+		{&WelcomeMsg{Version: 1, MaxFrameSize: 256, Features: 1}, "WelcomeMsg", []byte{1, 0, 1, 0, 0, 1, 0, 0, 0}, nil},
+	}
+
+	// Bodies larger than one frame are limited by reassembly limits of sockets, not by messages
+	largeBody := make([]byte, RelayMaxBodySize*2)
+	if data, err := (RelayRequestMsg{IDs: []uint64{1}, Body: largeBody}).Data(); err != nil || len(data) != len(largeBody)+9 {
+		t.Errorf("RelayRequestMsg.Data: large body not serialized. Error %v", err)
+	}
+	if data, err := (RelayResponseMsg{SenderID: 1, Body: largeBody}).Data(); err != nil || len(data) != len(largeBody)+8 {
+		t.Errorf("RelayResponseMsg.Data: large body not serialized. Error %v", err)
+	}
+	if data, err := (ListResponseMsg{IDs: make([]uint64, ListMaxItems+1)}).Data(); err != nil || len(data) != (ListMaxItems+1)*8 {
+		t.Errorf("ListResponseMsg.Data: long list not serialized. Error %v", err)
 	}
 
 	for _, tt := range tests {
@@ -110,6 +124,7 @@ func TestDeserializeIDRes(t *testing.T) {
 		{[]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6}, IDResponseMsg{}, ErrParsStream},
 		{[]byte{1, 0, 0, 0, 0, 0, 0, 0}, IDResponseMsg{ID: 1}, nil},
 		{[]byte{1, 1, 0, 0, 0, 0, 0, 0}, IDResponseMsg{ID: 257}, nil},
+		{[]byte{1, 1, 0, 0, 0, 0, 0, 0, 7, 0, 0, 0}, IDResponseMsg{ID: 257, CorrID: 7}, nil},
 	}
 
 	for _, tt := range tests {
@@ -128,8 +143,10 @@ func TestDeserializeListRes(t *testing.T) {
 	}{
 		{nil, ListResponseMsg{}, nil},
 		{[]byte{}, ListResponseMsg{}, nil},
-		{[]byte{1, 2, 3, 4}, ListResponseMsg{}, ErrParsStream},
+		{[]byte{1, 2, 3}, ListResponseMsg{}, ErrParsStream},
+		{[]byte{1, 2, 3, 4}, ListResponseMsg{CorrID: 67305985}, nil}, // Only correlation id
 		{[]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0}, ListResponseMsg{}, ErrParsStream},
+		{[]byte{7, 0, 0, 0, 1, 1, 0, 0, 0, 0, 0, 0}, ListResponseMsg{IDs: []uint64{257}, CorrID: 7}, nil},
 		{[]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6, 7}, ListResponseMsg{}, ErrParsStream},
 		{[]byte{1, 0, 0, 0, 0, 0, 0, 0}, ListResponseMsg{IDs: []uint64{1}}, nil},
 		{[]byte{1, 1, 0, 0, 0, 0, 0, 0}, ListResponseMsg{IDs: []uint64{257}}, nil},
@@ -161,6 +178,8 @@ func TestDeserializeRelayReq(t *testing.T) {
 		{[]byte{1, 1, 0, 0, 0, 0, 0, 0, 0, 200}, RelayRequestMsg{IDs: []uint64{1}, Body: []byte{200}}, nil},
 		{[]byte{1, 1, 0, 0, 0, 0, 0, 0, 0, 72, 196, 124, 38, 231, 35, 0, 0, 200, 201, 202, 203, 204, 205}, RelayRequestMsg{IDs: []uint64{1}, Body: []byte{72, 196, 124, 38, 231, 35, 0, 0, 200, 201, 202, 203, 204, 205}}, nil},
 		{[]byte{2, 1, 0, 0, 0, 0, 0, 0, 0, 72, 196, 124, 38, 231, 35, 0, 0, 200, 201, 202, 203, 204, 205}, RelayRequestMsg{IDs: []uint64{1, 39475690128456}, Body: []byte{200, 201, 202, 203, 204, 205}}, nil},
+		{[]byte{0, 9, 0, 0, 0, 1, 1, 0, 0, 0, 0, 0, 0, 0, 200}, RelayRequestMsg{IDs: []uint64{1}, Body: []byte{200}, CorrID: 9}, nil},
+		{[]byte{0, 9, 0, 0, 0, 1, 1, 0, 0, 0, 0, 0, 0, 0}, RelayRequestMsg{}, ErrParsStream},
 	}
 
 	for _, tt := range tests {
@@ -192,3 +211,140 @@ func TestDeserializeRelayRes(t *testing.T) {
 		}
 	}
 }
+
+func TestDeserializeRelayFromHub(t *testing.T) {
+	msg, err := DeserializeRelayFromHub([]byte{9, 0, 0, 0})
+	if ack, ok := msg.(RelayAckMsg); !ok || ack.CorrID != 9 || err != nil {
+		t.Errorf("DeserializeRelayFromHub: expected ack 9, actual %+v-%v", msg, err)
+	}
+	msg, err = DeserializeRelayFromHub([]byte{1, 0, 0, 0, 0, 0, 0, 0, 72})
+	if res, ok := msg.(RelayResponseMsg); !ok || !ChkRelayResponseMsgEq(res, RelayResponseMsg{SenderID: 1, Body: []byte{72}}) || err != nil {
+		t.Errorf("DeserializeRelayFromHub: expected response, actual %+v-%v", msg, err)
+	}
+	if _, err = DeserializeRelayFromHub([]byte{1, 0, 0}); err != ErrParsStream {
+		t.Errorf("DeserializeRelayFromHub: expected %v, actual %v", ErrParsStream, err)
+	}
+}
+
+func TestDeserializeRequests(t *testing.T) {
+	var tests = []struct {
+		stream []byte
+		corrID uint32
+		err    error
+	}{
+		{nil, 0, nil},
+		{[]byte{7, 0, 0, 0}, 7, nil},
+		{[]byte{7}, 0, ErrParsStream},
+		{[]byte{7, 0, 0, 0, 0}, 0, ErrParsStream},
+	}
+	for _, tt := range tests {
+		idReq, err := DeserializeIDReq(tt.stream)
+		if idReq.CorrID != tt.corrID || err != tt.err {
+			t.Errorf("DeserializeIDReq: expected %d-%v, actual %d-%v", tt.corrID, tt.err, idReq.CorrID, err)
+		}
+		listReq, err := DeserializeListReq(tt.stream)
+		if listReq.CorrID != tt.corrID || err != tt.err {
+			t.Errorf("DeserializeListReq: expected %d-%v, actual %d-%v", tt.corrID, tt.err, listReq.CorrID, err)
+		}
+	}
+}
+
+func TestDeserializeHello(t *testing.T) {
+	var tests = []struct {
+		stream []byte
+		msg    HelloMsg
+		err    error
+	}{
+		{nil, HelloMsg{}, ErrParsStream},
+		{[]byte{}, HelloMsg{}, ErrParsStream},
+		{[]byte{1, 2, 3, 4}, HelloMsg{}, ErrParsStream},
+		{[]byte{1, 0, 0, 16, 0, 5, 0, 0, 0, 0}, HelloMsg{}, ErrParsStream},
+		{[]byte{1, 0, 0, 16, 0, 5, 0, 0, 0}, HelloMsg{Version: 1, MaxFrameSize: 1048576, Features: 5}, nil},
+		{[]byte{2, 1, 0, 0, 0, 255, 255, 255, 255}, HelloMsg{Version: 2, MaxFrameSize: 1, Features: 4294967295}, nil},
+	}
+
+	for _, tt := range tests {
+		actual, err := DeserializeHello(tt.stream)
+		if actual != tt.msg || err != tt.err {
+			t.Errorf("DeserializeHello: expected %+v-%s, actual %+v-%s", tt.msg, tt.err, actual, err)
+		}
+		welcome, err := DeserializeWelcome(tt.stream)
+		if welcome != WelcomeMsg(tt.msg) || err != tt.err {
+			t.Errorf("DeserializeWelcome: expected %+v-%s, actual %+v-%s", tt.msg, tt.err, welcome, err)
+		}
+	}
+}
+
+func TestDeserializeError(t *testing.T) {
+	var tests = []struct {
+		stream []byte
+		msg    ErrorMsg
+		err    error
+	}{
+		{nil, ErrorMsg{}, ErrParsStream},
+		{[]byte{2, 3, 0, 0, 0, 0}, ErrorMsg{}, ErrParsStream},
+		{[]byte{2, 3, 0, 0, 0, 0, 0}, ErrorMsg{ReqType: ListMgsCode, Code: ErrCodeUnknownRecipient}, nil},
+		{[]byte{3, 2, 7, 0, 0, 0, 0, 'n', 'o'}, ErrorMsg{ReqType: RelayMgsCode, Code: ErrCodeNotIdentified, CorrID: 7, Reason: "no"}, nil},
+		{[]byte{3, 3, 7, 0, 0, 0, 2, 4, 0, 0, 0, 0, 0, 0, 0, 5, 0, 0, 0, 0, 0, 0, 0, 'n', 'o'},
+			ErrorMsg{ReqType: RelayMgsCode, Code: ErrCodeUnknownRecipient, CorrID: 7, Reason: "no", IDs: []uint64{4, 5}}, nil},
+		{[]byte{3, 3, 7, 0, 0, 0, 2, 4, 0, 0, 0, 0, 0, 0, 0}, ErrorMsg{}, ErrParsStream},
+		{make([]byte, ErrorMaxLen+1), ErrorMsg{}, ErrParsStream},
+	}
+	for _, tt := range tests {
+		actual, err := DeserializeError(tt.stream)
+		if !ChkErrorMsgEq(actual, tt.msg) || err != tt.err {
+			t.Errorf("DeserializeError: expected %+v-%v, actual %+v-%v", tt.msg, tt.err, actual, err)
+		}
+		if err != nil {
+			continue
+		}
+		data, err := actual.Data()
+		if err != nil || !checkEqByte(data, tt.stream) {
+			t.Errorf("ErrorMsg.Data: expected %v, actual %v-%v", tt.stream, data, err)
+		}
+	}
+	if _, err := (ErrorMsg{Reason: string(make([]byte, ErrorMaxReasonLen+1))}).Data(); err != ErrInvalidData {
+		t.Errorf("ErrorMsg.Data: expected %v for long reason, actual %v", ErrInvalidData, err)
+	}
+}
+
+func TestParseMsgType(t *testing.T) {
+	var tests = []struct {
+		name string
+		typ  MsgType
+		ok   bool
+	}{
+		{"relay", RelayMgsCode, true},
+		{" List", ListMgsCode, true},
+		{"id", IDMgsCode, true},
+		{"unknown", 0, false},
+	}
+	for _, tt := range tests {
+		typ, err := ParseMsgType(tt.name)
+		if typ != tt.typ || (err == nil) != tt.ok {
+			t.Errorf("ParseMsgType(%q): expected %d-%t, actual %d-%v", tt.name, tt.typ, tt.ok, typ, err)
+		}
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	features, err := ParseFeatures([]string{"correlation", " Errors"})
+	if err != nil || features != FeatureCorrelation|FeatureErrors {
+		t.Fatalf("ParseFeatures: expected %b, actual %b-%v", FeatureCorrelation|FeatureErrors, features, err)
+	}
+	if _, err := ParseFeatures([]string{"checksum"}); err == nil {
+		t.Fatal("ParseFeatures: feature of socket parsed as feature of messages")
+	}
+	if !IsFeature("errors") || IsFeature("streams") {
+		t.Fatal("IsFeature: unexpected result")
+	}
+	// Features of socket and messages travel in the same field of hello message
+	joined := JoinFeatures(0x1F, FeatureErrors)
+	socketFeatures, msgFeatures := SplitFeatures(joined)
+	if socketFeatures != 0x1F || msgFeatures != FeatureErrors {
+		t.Fatalf("SplitFeatures(%x): expected %x-%b, actual %x-%b", joined, 0x1F, FeatureErrors, socketFeatures, msgFeatures)
+	}
+	if JoinFeatures(uint32(FeatureCorrelation), 0) != 0 {
+		t.Fatal("JoinFeatures: features of messages taken from features of socket")
+	}
+}
@@ -0,0 +1,99 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrUnknownType happen when a message type is not registered
+	ErrUnknownType = errors.New("Message type is not registered")
+	// ErrRegistered happen when a message type is registered twice
+	ErrRegistered = errors.New("Message type is already registered")
+)
+
+// Decoder convert data of a message to the message
+type Decoder func(bb []byte) (any, error)
+
+// Handler process a decoded message. Src is what owner of registry passes with the message, e.g. the
+// socket data that message is read from
+type Handler[S any] func(src S, msg any)
+
+// Codec is how a message type is read and handled
+type Codec[S any] struct {
+	MaxLen int     // Max length of data of message, longer messages are dropped by socket
+	Decode Decoder // Convert data to message. Handler gets data itself when it is nil
+	Handle Handler[S]
+}
+
+// Registry map message types to their codecs. Owner of sockets builds max length of message types
+// from it and dispatches received messages to their handlers. Types are registered before sockets
+// are started, so registry has no lock
+type Registry[S any] struct {
+	codecs map[MsgType]Codec[S]
+}
+
+// NewRegistry create an empty registry
+func NewRegistry[S any]() *Registry[S] {
+	return &Registry[S]{codecs: make(map[MsgType]Codec[S])}
+}
+
+// Register add codec of a message type
+func (r *Registry[S]) Register(typ MsgType, codec Codec[S]) error {
+	if codec.Handle == nil {
+		return fmt.Errorf("Message type %d has no handler", typ)
+	}
+	if codec.MaxLen < 0 {
+		return fmt.Errorf("Max length of message type %d is negative", typ)
+	}
+	if _, ok := r.codecs[typ]; ok {
+		return fmt.Errorf("%w: %d", ErrRegistered, typ)
+	}
+	r.codecs[typ] = codec
+	return nil
+}
+
+// MsgTypeLen return max length of registered message types in the form that sockets accept
+func (r *Registry[S]) MsgTypeLen() map[byte]int {
+	res := make(map[byte]int, len(r.codecs))
+	for typ, codec := range r.codecs {
+		res[byte(typ)] = codec.MaxLen
+	}
+	return res
+}
+
+// Dispatch decode data of a message and pass it to handler of its type. It returns ErrUnknownType for
+// types that are not registered and the error of decoder for messages that are not valid
+func (r *Registry[S]) Dispatch(src S, typ byte, bb []byte) error {
+	codec, ok := r.codecs[MsgType(typ)]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownType, typ)
+	}
+	var msg any = bb
+	if codec.Decode != nil {
+		var err error
+		if msg, err = codec.Decode(bb); err != nil {
+			return err
+		}
+	}
+	codec.Handle(src, msg)
+	return nil
+}
+
+// Decode adapt a deserialize function of a message to Decoder
+func Decode[M any](deserialize func(bb []byte) (M, error)) Decoder {
+	return func(bb []byte) (any, error) {
+		msg, err := deserialize(bb)
+		if err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+}
+
+// Handle adapt a handler of a message to Handler. Decoder of the type must return M
+func Handle[S, M any](handle func(src S, msg M)) Handler[S] {
+	return func(src S, msg any) {
+		handle(src, msg.(M))
+	}
+}
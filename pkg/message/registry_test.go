@@ -0,0 +1,66 @@
+package message
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry[uint64]()
+	var got []any
+	var srcs []uint64
+	record := func(src uint64, msg any) {
+		srcs = append(srcs, src)
+		got = append(got, msg)
+	}
+	if err := r.Register(IDMgsCode, Codec[uint64]{Decode: Decode(DeserializeIDReq), Handle: record}); err != nil {
+		t.Fatalf("Register failed. Error %v", err)
+	}
+	if err := r.Register(RelayMgsCode, Codec[uint64]{
+		MaxLen: 100,
+		Decode: Decode(DeserializeRelayRes),
+		Handle: Handle(func(src uint64, msg RelayResponseMsg) { record(src, msg.SenderID) }),
+	}); err != nil {
+		t.Fatalf("Register failed. Error %v", err)
+	}
+	// Type of application with no decoder gets data as it is
+	if err := r.Register(MsgType(100), Codec[uint64]{MaxLen: 10, Handle: record}); err != nil {
+		t.Fatalf("Register failed. Error %v", err)
+	}
+	if err := r.Register(IDMgsCode, Codec[uint64]{Handle: record}); !errors.Is(err, ErrRegistered) {
+		t.Fatalf("Expected ErrRegistered, actual %v", err)
+	}
+	if err := r.Register(ListMgsCode, Codec[uint64]{}); err == nil {
+		t.Fatal("Type without handler registered")
+	}
+
+	lens := r.MsgTypeLen()
+	if len(lens) != 3 || lens[byte(IDMgsCode)] != 0 || lens[byte(RelayMgsCode)] != 100 || lens[100] != 10 {
+		t.Fatalf("Unexpected max lengths %v", lens)
+	}
+
+	relay, _ := RelayResponseMsg{SenderID: 9, Body: []byte{1}}.Data()
+	for _, tt := range []struct {
+		typ byte
+		bb  []byte
+		err error
+	}{
+		{byte(IDMgsCode), nil, nil},
+		{byte(RelayMgsCode), relay, nil},
+		{100, []byte{5}, nil},
+		{byte(IDMgsCode), []byte{1}, ErrParsStream},
+		{byte(ListMgsCode), nil, ErrUnknownType},
+	} {
+		if err := r.Dispatch(7, tt.typ, tt.bb); !errors.Is(err, tt.err) {
+			t.Fatalf("Dispatch type %d: expected error %v, actual %v", tt.typ, tt.err, err)
+		}
+	}
+	if len(got) != 3 || got[0] != (IDRequestMsg{}) || got[1] != uint64(9) || !checkEqByte(got[2].([]byte), []byte{5}) {
+		t.Fatalf("Unexpected handled messages %v", got)
+	}
+	for _, src := range srcs {
+		if src != 7 {
+			t.Fatalf("Expected source 7, actual %d", src)
+		}
+	}
+}
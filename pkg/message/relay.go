@@ -5,14 +5,16 @@ import "encoding/binary"
 const (
 	// RelayMaxReciverCount max count of receivers per message
 	RelayMaxReciverCount int = 255
-	// RelayMaxBodySize max length of data
+	// RelayMaxBodySize max length of data in one frame. Larger bodies are sent in fragments when fragmentation
+	// is agreed, up to reassembly limit of relay messages that sockets are configured with
 	RelayMaxBodySize int = 1048576
 )
 
 // RelayRequestMsg represent request from client to relay a message to ither clients
 type RelayRequestMsg struct {
-	IDs  []uint64
-	Body []byte
+	IDs    []uint64
+	Body   []byte
+	CorrID uint32 // Optional correlation id that hub acknowledges relay with, zero means none
 }
 
 // Type get type of Relay message
@@ -20,49 +22,108 @@ func (msg RelayRequestMsg) Type() byte {
 	return byte(RelayMgsCode)
 }
 
+// Len return length of frame bytes of RelayRequestMsg
+func (msg RelayRequestMsg) Len() int {
+	n := (len(msg.IDs) * 8) + len(msg.Body) + 1
+	if msg.CorrID != 0 {
+		n += 1 + CorrIDLen
+	}
+	return n
+}
+
 // Data get frame bytes of ListRequestMsg
+// Correlation id is written after a zero byte before receivers only when it is set. Receiver count is never
+// zero, so hubs that do not know correlation id reject it
 func (msg RelayRequestMsg) Data() ([]byte, error) {
 	if len(msg.IDs) == 0 || len(msg.IDs) > RelayMaxReciverCount {
 		return nil, ErrInvalidData
 	}
-	if len(msg.Body) == 0 || len(msg.Body) > RelayMaxBodySize {
+	if len(msg.Body) == 0 {
 		return nil, ErrInvalidData
 	}
-	data := make([]byte, (len(msg.IDs)*8)+len(msg.Body)+1)
-	data[0] = byte(len(msg.IDs))
-	copy(data[1:], getUnit64Bytes(msg.IDs))
-	copy(data[(len(msg.IDs)*8)+1:], msg.Body)
+	data := make([]byte, msg.Len())
+	bb := data
+	if msg.CorrID != 0 {
+		binary.LittleEndian.PutUint32(bb[1:], msg.CorrID)
+		bb = bb[1+CorrIDLen:]
+	}
+	bb[0] = byte(len(msg.IDs))
+	copy(bb[1:], getUnit64Bytes(msg.IDs))
+	copy(bb[(len(msg.IDs)*8)+1:], msg.Body)
 	return data, nil
 }
 
 // DeserializeRelayReq convert stream of bytes to RelayRequestMsg
 func DeserializeRelayReq(bb []byte) (RelayRequestMsg, error) {
+	var corrID uint32
+	if len(bb) > CorrIDLen && bb[0] == 0 {
+		corrID = binary.LittleEndian.Uint32(bb[1:])
+		bb = bb[1+CorrIDLen:]
+	}
+
 	// 1 byte for reciever list len, 8 byte for at leat one reciever and at least one byte for data
 	if len(bb) < 10 {
 		return RelayRequestMsg{}, ErrParsStream
 	}
 
 	// 1 byte for reciever list len, byte[0] * 8 byte for recievers and at least one byte for data
-	if len(bb) < int(bb[0]*8)+2 {
+	cnt := int(bb[0])
+	if len(bb) < cnt*8+2 {
 		return RelayRequestMsg{}, ErrParsStream
 	}
 
-	if bb[0] == 0 {
+	if cnt == 0 {
 		return RelayRequestMsg{}, ErrParsStream
 	}
 
-	uu := make([]uint64, bb[0])
-	cnt := int(bb[0])
+	uu := make([]uint64, cnt)
 	for i := 0; i < cnt; i++ {
 		uu[i] = binary.LittleEndian.Uint64(bb[(i*8)+1 : ((i+1)*8)+1])
 	}
 
 	return RelayRequestMsg{
-		IDs:  uu,
-		Body: bb[(bb[0]*8)+1:],
+		IDs:    uu,
+		Body:   bb[(cnt*8)+1:],
+		CorrID: corrID,
 	}, nil
 }
 
+// RelayAckMsg represent message from hub to client that tells relay request with correlation id is pushed to
+// send queue of all its recipients
+type RelayAckMsg struct {
+	CorrID uint32 // Correlation id of request
+}
+
+// Type get type of Relay message
+func (msg RelayAckMsg) Type() byte {
+	return byte(RelayMgsCode)
+}
+
+// Data get frame bytes of RelayAckMsg
+func (msg RelayAckMsg) Data() ([]byte, error) {
+	if msg.CorrID == 0 {
+		return nil, ErrInvalidData
+	}
+	return getCorrIDBytes(msg.CorrID), nil
+}
+
+// DeserializeRelayAck convert stream of bytes to RelayAckMsg
+func DeserializeRelayAck(bb []byte) (RelayAckMsg, error) {
+	if len(bb) != CorrIDLen {
+		return RelayAckMsg{}, ErrParsStream
+	}
+	return RelayAckMsg{CorrID: binary.LittleEndian.Uint32(bb)}, nil
+}
+
+// DeserializeRelayFromHub convert stream of bytes that hub sends as relay message to RelayAckMsg or
+// RelayResponseMsg. Ack has only correlation id, so it is shorter than any relay response
+func DeserializeRelayFromHub(bb []byte) (any, error) {
+	if len(bb) == CorrIDLen {
+		return DeserializeRelayAck(bb)
+	}
+	return DeserializeRelayRes(bb)
+}
+
 // RelayResponseMsg represent message from server to clients
 type RelayResponseMsg struct {
 	SenderID uint64
@@ -77,7 +138,7 @@ func (msg RelayResponseMsg) Type() byte {
 // Data get frame bytes of ListRequestMsg
 func (msg RelayResponseMsg) Data() ([]byte, error) {
 
-	if len(msg.Body) == 0 || len(msg.Body) > RelayMaxBodySize {
+	if len(msg.Body) == 0 {
 		return nil, ErrInvalidData
 	}
 
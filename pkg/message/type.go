@@ -1,6 +1,10 @@
 package message
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 // MsgType is type for Defining defferent message types
 type MsgType byte
@@ -19,4 +23,33 @@ const (
 	ListMgsCode MsgType = 2
 	// RelayMgsCode is code for id messages
 	RelayMgsCode MsgType = 3
+	// HelloMgsCode is code for handshake messages
+	HelloMgsCode MsgType = 4
+	// ErrorMgsCode is code for error messages of hub
+	ErrorMgsCode MsgType = 5
+)
+
+const (
+	// HelloMaxLen is length of hello and welcome messages
+	HelloMaxLen int = helloMsgLen
+	// CorrIDLen is length of correlation id of id, list and relay messages. Requests carry it only when
+	// correlation is agreed in handshake, and hub copies it to their responses
+	CorrIDLen int = 4
 )
+
+var msgTypeNames = map[string]MsgType{
+	"id":    IDMgsCode,
+	"list":  ListMgsCode,
+	"relay": RelayMgsCode,
+	"hello": HelloMgsCode,
+	"error": ErrorMgsCode,
+}
+
+// ParseMsgType convert name of message type (as it is written in config files) to MsgType
+func ParseMsgType(name string) (MsgType, error) {
+	typ, ok := msgTypeNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return 0, fmt.Errorf("Unknown message type %q", name)
+	}
+	return typ, nil
+}
@@ -43,6 +43,27 @@ func appendSlices(s1 []byte, s2 []byte) []byte {
 	return bb
 }
 
+// getCorrIDBytes return bytes of correlation id, nil when it is not set
+func getCorrIDBytes(corrID uint32) []byte {
+	if corrID == 0 {
+		return nil
+	}
+	bb := make([]byte, CorrIDLen)
+	binary.LittleEndian.PutUint32(bb, corrID)
+	return bb
+}
+
+// deserializeCorrID convert data of a request that carries only an optional correlation id
+func deserializeCorrID(bb []byte) (uint32, error) {
+	switch len(bb) {
+	case 0:
+		return 0, nil
+	case CorrIDLen:
+		return binary.LittleEndian.Uint32(bb), nil
+	}
+	return 0, ErrParsStream
+}
+
 func getUnit32Bytes(input []uint32) []byte {
 	if len(input) == 0 {
 		return nil
@@ -73,20 +94,26 @@ func getUnit64Bytes(input []uint64) []byte {
 
 // ChkIDResponseMsgEq check equeality of IDResponseMsg message
 func ChkIDResponseMsgEq(a, b IDResponseMsg) bool {
-	return a.ID == b.ID
+	return a.ID == b.ID && a.CorrID == b.CorrID
 }
 
 // ChkListResponseMsgEq check equeality of ListResponseMsg message
 func ChkListResponseMsgEq(a, b ListResponseMsg) bool {
-	return checkEqUint64(a.IDs, b.IDs)
+	return checkEqUint64(a.IDs, b.IDs) && a.CorrID == b.CorrID
 }
 
 // ChkRelayRequestMsgEq check equeality of RelayRequestMsg message
 func ChkRelayRequestMsgEq(a, b RelayRequestMsg) bool {
-	return checkEqUint64(a.IDs, b.IDs) && checkEqByte(a.Body, b.Body)
+	return checkEqUint64(a.IDs, b.IDs) && checkEqByte(a.Body, b.Body) && a.CorrID == b.CorrID
 }
 
 // ChkRelayResponseMsgEq check equeality of RelayResponseMsg message
 func ChkRelayResponseMsgEq(a, b RelayResponseMsg) bool {
 	return checkEqByte(a.Body, b.Body) && a.SenderID == b.SenderID
 }
+
+// ChkErrorMsgEq check equeality of ErrorMsg message
+func ChkErrorMsgEq(a, b ErrorMsg) bool {
+	return a.ReqType == b.ReqType && a.Code == b.Code && a.CorrID == b.CorrID && a.Reason == b.Reason &&
+		checkEqUint64(a.IDs, b.IDs)
+}
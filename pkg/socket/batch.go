@@ -0,0 +1,110 @@
+package socket
+
+import "net"
+
+const (
+	// DefaultBatchBytes is how many bytes of frames writer collects before it writes them
+	DefaultBatchBytes = 64 * 1024
+	// DefaultBatchFrames is how many frames writer collects before it writes them
+	DefaultBatchFrames = 64
+)
+
+// writeBatch collect frames of queued packets, so writer sends them with one write instead of one
+// write for each packet. Prefix, header and trailer of frames are copied and data is only referenced
+type writeBatch struct {
+	maxBytes  int
+	maxFrames int
+	bufs      net.Buffers
+	// Prefix, header and trailer of frames. When it grows buffers keep referring to the old array,
+	// and the old array is not written anymore, so they stay valid
+	meta   []byte
+	pkts   []Packet // Packets that are completely in batch, they are reported as written after write
+	sizes  []int    // Data length of each packet of pkts
+	size   int
+	frames int
+}
+
+func newWriteBatch(maxBytes int, maxFrames int) *writeBatch {
+	if maxBytes <= 0 {
+		maxBytes = DefaultBatchBytes
+	}
+	if maxFrames <= 0 {
+		maxFrames = DefaultBatchFrames
+	}
+	return &writeBatch{
+		maxBytes:  maxBytes,
+		maxFrames: maxFrames,
+		bufs:      make(net.Buffers, 0, 3*maxFrames),
+		meta:      make([]byte, 0, maxFrames*(prefixLen+maxHeaderLen+checksumLen)),
+	}
+}
+
+// add append buffers of a frame that frameEncoder returned. Encoder reuses its arrays and compressed
+// data is in compression buffer of socket, so they are copied
+func (b *writeBatch) add(frame net.Buffers) {
+	head := frame[0]
+	compressed := head[prefixLen]&versionMarker != 0 && head[prefixLen]&flagCompressed != 0
+	for i, bb := range frame {
+		b.size += len(bb)
+		if i == 1 && !compressed {
+			b.bufs = append(b.bufs, bb)
+			continue
+		}
+		if i == 1 {
+			b.bufs = append(b.bufs, append([]byte(nil), bb...))
+			continue
+		}
+		start := len(b.meta)
+		b.meta = append(b.meta, bb...)
+		b.bufs = append(b.bufs, b.meta[start:len(b.meta):len(b.meta)])
+	}
+	b.frames++
+}
+
+// done add a packet of size bytes that all its frames are in batch
+func (b *writeBatch) done(pkt Packet, size int) {
+	b.pkts = append(b.pkts, pkt)
+	b.sizes = append(b.sizes, size)
+}
+
+// full report whether batch reached its budget and must be written
+func (b *writeBatch) full() bool {
+	return b.frames >= b.maxFrames || b.size >= b.maxBytes
+}
+
+func (b *writeBatch) empty() bool {
+	return b.frames == 0
+}
+
+// reset empty batch after it is written. Arrays are kept for the next batch
+func (b *writeBatch) reset() {
+	for i := range b.bufs {
+		b.bufs[i] = nil
+	}
+	for i := range b.pkts {
+		b.pkts[i] = nil
+	}
+	b.bufs = b.bufs[:0]
+	b.pkts = b.pkts[:0]
+	b.sizes = b.sizes[:0]
+	b.meta = b.meta[:0]
+	b.size = 0
+	b.frames = 0
+}
+
+// flusher is a writer that collects writes until Flush, e.g. bufio writer or WebSocket connection
+// that sends them as one message
+type flusher interface {
+	Flush() error
+}
+
+// vectored report whether connection writes net.Buffers with one writev call. Connections that are
+// flushers write a batch as they like, others get batches through a bufio writer, so a batch is
+// still one write for them
+func vectored(conn net.Conn) bool {
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return !isPacketConn(conn)
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package socket
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteBatch(t *testing.T) {
+	var enc frameEncoder
+	var comp bytes.Buffer
+	small := []byte{1, 2, 3}
+	large := bytes.Repeat([]byte{4, 5, 6, 7}, 256)
+	if !compress(&comp, large) {
+		t.Fatal("Data not compressed")
+	}
+	batch := newWriteBatch(4096, 3)
+	// Encoder and compression buffer are reused for each frame, batch must keep its own copy
+	batch.add(*enc.encode(3, FrameV1, 0, small, 0, fragmentInfo{}, 0))
+	batch.add(*enc.encode(3, FrameV2, flagChecksum|flagCompressed, comp.Bytes(), len(large), fragmentInfo{}, 0))
+	expected := append(encodeData(3, small, FrameV1), encodeV2(3, flagChecksum|flagCompressed, append([]byte(nil), comp.Bytes()...), len(large))...)
+	comp.Reset()
+	comp.Write(bytes.Repeat([]byte{0}, 512))
+	if batch.full() {
+		t.Fatal("Batch is full before its budget")
+	}
+	batch.add(*enc.encode(3, FrameV2, flagChecksum, small, 0, fragmentInfo{}, 0))
+	expected = append(expected, encodeV2(3, flagChecksum, small, 0)...)
+	if !bytes.Equal(joinBuffers(batch.bufs), expected) {
+		t.Fatalf("Unexpected frames in batch\nExpected %v\nActual   %v", expected, joinBuffers(batch.bufs))
+	}
+	if !batch.full() || batch.size != len(expected) {
+		t.Fatalf("Batch with 3 frames is not full. Size %d", batch.size)
+	}
+	batch.reset()
+	if !batch.empty() || batch.full() || len(batch.bufs) != 0 {
+		t.Fatal("Batch not reset")
+	}
+	batch.add(*enc.encode(3, FrameV1, 0, make([]byte, 5000), 0, fragmentInfo{}, 0))
+	if !batch.full() {
+		t.Fatal("Batch larger than byte budget is not full")
+	}
+}
+
+func TestBatchedSocket(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	msgTypeLen := map[byte]int{3: 10}
+	srv := NewConnSocket(srvConn, 1, 10, 1024, 1024)
+	cli := NewConnSocket(cliConn, 2, 100, 1024, 1024)
+	cli.SetWriteBatch(100, 0)
+	// Packets are queued before writer starts, so writer collects them in batches
+	for i := 0; i < 100; i++ {
+		cli.Send(rDataPacket{typ: 3, data: []byte{byte(i)}})
+	}
+	srvRead := make(chan RData, 100)
+	cliWrite := make(chan WData, 100)
+	srv.Start(make(chan WData, 10), srvRead, make(chan ProbData, 10), msgTypeLen)
+	cli.Start(cliWrite, make(chan RData, 10), make(chan ProbData, 10), msgTypeLen)
+	defer srv.Close()
+	defer cli.Close()
+
+	for i := 0; i < 100; i++ {
+		select {
+		case rData := <-srvRead:
+			if data, _ := rData.Pkt.Data(); len(data) != 1 || data[0] != byte(i) {
+				t.Fatalf("Packet %d: unexpected data %v", i, data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Packet %d not received", i)
+		}
+		select {
+		case wData := <-cliWrite:
+			if data, _ := wData.Pkt.Data(); data[0] != byte(i) {
+				t.Fatalf("Write of packet %d reported for packet %d", i, data[0])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Write of packet %d not reported", i)
+		}
+	}
+}
+
+func benchmarkSocketWrite(b *testing.B, size int, maxFrames int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Skipf("Cannot listen on loopback: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	skt := NewConnSocket(conn, 1, 1024, 1024, 8192)
+	skt.SetWriteBatch(0, maxFrames)
+	writeChan := make(chan WData, 1024)
+	skt.Start(writeChan, make(chan RData, 1), make(chan ProbData, 10), map[byte]int{3: size})
+	defer skt.Close()
+	pkt := rDataPacket{typ: 3, data: make([]byte, size)}
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			skt.Send(pkt)
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		<-writeChan
+	}
+}
+
+// Batch of one frame is the write path before batching, one write for each packet
+func BenchmarkSocketWrite64BUnbatched(b *testing.B) { benchmarkSocketWrite(b, 64, 1) }
+func BenchmarkSocketWrite64BBatched(b *testing.B)   { benchmarkSocketWrite(b, 64, DefaultBatchFrames) }
+func BenchmarkSocketWrite4KBUnbatched(b *testing.B) { benchmarkSocketWrite(b, 4096, 1) }
+func BenchmarkSocketWrite4KBBatched(b *testing.B)   { benchmarkSocketWrite(b, 4096, DefaultBatchFrames) }
@@ -0,0 +1,85 @@
+package socket
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ProtocolVersion is the version of protocol that this package speaks
+const ProtocolVersion byte = 1
+
+// Features is bitmask of optional protocol features
+type Features uint32
+
+const (
+	// FeatureChecksum means peer accepts v2 frames with CRC32C trailer
+	FeatureChecksum Features = 1 << iota
+	// FeatureCompression means peer accepts compressed frames
+	FeatureCompression
+	// FeatureHeartbeat means peer answers ping frames
+	FeatureHeartbeat
+	// FeatureFragmentation means peer reassembles packets that are split to fragment frames
+	FeatureFragmentation
+	// FeatureStreams means peer accepts frames of streams and gives credit to them, see OnStream
+	FeatureStreams
+)
+
+// SupportedFeatures is set of features that TCPSocket implements
+const SupportedFeatures = FeatureChecksum | FeatureCompression | FeatureHeartbeat | FeatureFragmentation | FeatureStreams
+
+var featureNames = map[string]Features{
+	"checksum":      FeatureChecksum,
+	"compression":   FeatureCompression,
+	"heartbeat":     FeatureHeartbeat,
+	"fragmentation": FeatureFragmentation,
+	"streams":       FeatureStreams,
+}
+
+// ParseFeatures convert names of features (as they are written in config files) to Features
+func ParseFeatures(names []string) (Features, error) {
+	var res Features
+	for _, name := range names {
+		f, ok := featureNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return 0, fmt.Errorf("Unknown feature %q", name)
+		}
+		res |= f
+	}
+	return res, nil
+}
+
+// Capabilities is what one side of connection supports, or what both sides agreed on after handshake
+type Capabilities struct {
+	Version      byte
+	MaxFrameSize int // Max length of data in one frame that receiver accepts. Zero means no limit
+	Features     Features
+}
+
+// LocalCapabilities return capabilities of this implementation limited to maxFrameSize and the given features
+func LocalCapabilities(maxFrameSize int, features Features) Capabilities {
+	return Capabilities{
+		Version:      ProtocolVersion,
+		MaxFrameSize: maxFrameSize,
+		Features:     features & SupportedFeatures,
+	}
+}
+
+// Negotiate return capabilities that local side must respect when talking to remote side.
+// Lower version and the features that both sides support are chosen. Max frame size is taken
+// from remote side, because each side must not send frames larger than its peer accepts
+func Negotiate(local Capabilities, remote Capabilities) Capabilities {
+	res := Capabilities{
+		Version:      local.Version,
+		MaxFrameSize: remote.MaxFrameSize,
+		Features:     local.Features & remote.Features,
+	}
+	if remote.Version < res.Version {
+		res.Version = remote.Version
+	}
+	return res
+}
+
+// Has report whether all the features in f are enabled
+func (c Capabilities) Has(f Features) bool {
+	return c.Features&f == f
+}
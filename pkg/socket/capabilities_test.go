@@ -0,0 +1,40 @@
+package socket
+
+import "testing"
+
+func TestNegotiate(t *testing.T) {
+	var tests = []struct {
+		local    Capabilities
+		remote   Capabilities
+		expected Capabilities
+	}{
+		{Capabilities{1, 100, FeatureChecksum}, Capabilities{1, 200, FeatureChecksum}, Capabilities{1, 200, FeatureChecksum}},
+		{Capabilities{2, 100, FeatureChecksum | FeatureHeartbeat}, Capabilities{1, 0, FeatureHeartbeat | FeatureCompression}, Capabilities{1, 0, FeatureHeartbeat}},
+		{Capabilities{1, 100, FeatureChecksum}, Capabilities{3, 50, 0}, Capabilities{1, 50, 0}},
+	}
+	for _, tt := range tests {
+		actual := Negotiate(tt.local, tt.remote)
+		if actual != tt.expected {
+			t.Errorf("Negotiate(%+v, %+v): expected %+v, actual %+v", tt.local, tt.remote, tt.expected, actual)
+		}
+	}
+}
+
+func TestParseFeatures(t *testing.T) {
+	var tests = []struct {
+		names    []string
+		expected Features
+		valid    bool
+	}{
+		{nil, 0, true},
+		{[]string{"checksum"}, FeatureChecksum, true},
+		{[]string{"Compression", " heartbeat"}, FeatureCompression | FeatureHeartbeat, true},
+		{[]string{"checksum", "encryption"}, 0, false},
+	}
+	for _, tt := range tests {
+		actual, err := ParseFeatures(tt.names)
+		if actual != tt.expected || (err == nil) != tt.valid {
+			t.Errorf("ParseFeatures(%v): expected %b, actual %b-%v", tt.names, tt.expected, actual, err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package socket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vajafari/messagehub/pkg/logging"
+)
+
+// Direction of a captured packet
+type Direction byte
+
+const (
+	// DirIn is a packet that socket read from peer
+	DirIn Direction = 'I'
+	// DirOut is a packet that socket wrote to peer
+	DirOut Direction = 'O'
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirIn:
+		return "in"
+	case DirOut:
+		return "out"
+	}
+	return fmt.Sprintf("Direction(%d)", byte(d))
+}
+
+// captureMagic start every capture file, the last byte is version of format
+var captureMagic = []byte{'M', 'H', 'C', 'A', 'P', 1}
+
+const (
+	// Fixed part of a record: direction, type, time and socket id
+	captureHeadLen = 1 + 1 + 8 + 8
+	// Data of a record is never larger than this, longer length means a corrupted capture
+	maxCaptureDataLen = 64 * 1024 * 1024
+)
+
+// ErrCaptureFormat happen when a file is not a capture or a record is invalid
+var ErrCaptureFormat = errors.New("Invalid capture format")
+
+// CaptureRecord is a packet that a socket read or wrote. Fragmented packets are captured once they are
+// reassembled, control frames are not captured
+type CaptureRecord struct {
+	Dir      Direction
+	Time     time.Time
+	SocketID uint64
+	Type     byte
+	Data     []byte
+	Run      int // Writer that wrote record in file, counted from zero. It is set by reader
+}
+
+// CaptureWriter append records of sockets to a capture. It is safe for concurrent use, so sockets
+// can share it. Each record is written with one write
+type CaptureWriter struct {
+	mutx   sync.Mutex
+	w      io.Writer
+	buf    []byte
+	failed bool
+}
+
+// NewCaptureWriter create a writer that writes records to w. Header of capture is written first
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	if _, err := w.Write(captureMagic); err != nil {
+		return nil, err
+	}
+	return &CaptureWriter{w: w}, nil
+}
+
+// OpenCapture open capture file in append mode, it is created when it does not exist. Every writer
+// writes header again to start a new run, because socket ids and times of runs, e.g. before and
+// after restart of hub, are not related
+func OpenCapture(path string) (*CaptureWriter, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewCaptureWriter(f)
+	if err != nil {
+		f.Close()
+	}
+	return c, err
+}
+
+// Write append a record. After a failed write the writer stops, so the capture stays readable
+// up to the failed record, and the next writes return nil
+func (c *CaptureWriter) Write(rec CaptureRecord) error {
+	c.mutx.Lock()
+	defer c.mutx.Unlock()
+	if c.failed {
+		return nil
+	}
+	c.buf = append(c.buf[:0], byte(rec.Dir), rec.Type)
+	c.buf = binary.LittleEndian.AppendUint64(c.buf, uint64(rec.Time.UnixNano()))
+	c.buf = binary.LittleEndian.AppendUint64(c.buf, rec.SocketID)
+	c.buf = binary.AppendUvarint(c.buf, uint64(len(rec.Data)))
+	c.buf = append(c.buf, rec.Data...)
+	if _, err := c.w.Write(c.buf); err != nil {
+		c.failed = true
+		return err
+	}
+	return nil
+}
+
+// Close close the underlying writer when it is a closer
+func (c *CaptureWriter) Close() error {
+	c.mutx.Lock()
+	defer c.mutx.Unlock()
+	if closer, ok := c.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// CaptureReader read records of a capture
+type CaptureReader struct {
+	r   *bufio.Reader
+	run int
+}
+
+// NewCaptureReader check header of capture and return a reader of its records
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != string(captureMagic) {
+		return nil, ErrCaptureFormat
+	}
+	return &CaptureReader{r: br}, nil
+}
+
+// Next return the next record. It returns io.EOF at the end of capture
+func (c *CaptureReader) Next() (CaptureRecord, error) {
+	// Header between records starts a new run. Direction of records is never the first byte of header
+	for {
+		b, err := c.r.Peek(1)
+		if err != nil {
+			return CaptureRecord{}, err
+		}
+		if b[0] != captureMagic[0] {
+			break
+		}
+		magic := make([]byte, len(captureMagic))
+		if _, err := io.ReadFull(c.r, magic); err != nil || string(magic) != string(captureMagic) {
+			return CaptureRecord{}, ErrCaptureFormat
+		}
+		c.run++
+	}
+	var head [captureHeadLen]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = ErrCaptureFormat
+		}
+		return CaptureRecord{}, err
+	}
+	rec := CaptureRecord{
+		Dir:      Direction(head[0]),
+		Type:     head[1],
+		Time:     time.Unix(0, int64(binary.LittleEndian.Uint64(head[2:10]))),
+		SocketID: binary.LittleEndian.Uint64(head[10:18]),
+		Run:      c.run,
+	}
+	if rec.Dir != DirIn && rec.Dir != DirOut {
+		return CaptureRecord{}, ErrCaptureFormat
+	}
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil || n > maxCaptureDataLen {
+		return CaptureRecord{}, ErrCaptureFormat
+	}
+	rec.Data = make([]byte, n)
+	if _, err := io.ReadFull(c.r, rec.Data); err != nil {
+		return CaptureRecord{}, ErrCaptureFormat
+	}
+	return rec, nil
+}
+
+// SetCapture set writer of captured packets of socket. Nil stops capture. It must be called before Start
+func (s *TCPSocket) SetCapture(c *CaptureWriter) {
+	s.capture = c
+}
+
+// record write a packet to capture of socket, when capture is set
+func (s *TCPSocket) record(dir Direction, typ byte, data []byte, at time.Time) {
+	if s.capture == nil {
+		return
+	}
+	err := s.capture.Write(CaptureRecord{
+		Dir:      dir,
+		Time:     at,
+		SocketID: s.ID(),
+		Type:     typ,
+		Data:     data,
+	})
+	if err != nil {
+		s.logger().Warn("Capture stopped", logging.Err, err)
+	}
+}
@@ -0,0 +1,118 @@
+package socket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCaptureRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.bin")
+	now := time.Now()
+	expected := []CaptureRecord{
+		{Dir: DirIn, Time: now, SocketID: 1, Type: 1},
+		{Dir: DirOut, Time: now.Add(time.Millisecond), SocketID: 1, Type: 3, Data: bytes.Repeat([]byte{7}, 300)},
+		{Dir: DirIn, Time: now.Add(time.Second), SocketID: 1, Type: 2, Run: 1},
+	}
+	// Second writer appends to the same file, its records are another run
+	for _, recs := range [][]CaptureRecord{expected[:2], expected[2:]} {
+		w, err := OpenCapture(path)
+		if err != nil {
+			t.Fatalf("Open capture failed. Error %v", err)
+		}
+		for _, rec := range recs {
+			if err := w.Write(rec); err != nil {
+				t.Fatalf("Write record failed. Error %v", err)
+			}
+		}
+		w.Close()
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := NewCaptureReader(f)
+	if err != nil {
+		t.Fatalf("Read capture failed. Error %v", err)
+	}
+	for i, exp := range expected {
+		rec, err := r.Next()
+		if err != nil {
+			t.Fatalf("Record %d: read failed. Error %v", i, err)
+		}
+		if rec.Dir != exp.Dir || !rec.Time.Equal(exp.Time) || rec.SocketID != exp.SocketID || rec.Type != exp.Type ||
+			!bytes.Equal(rec.Data, exp.Data) || rec.Run != exp.Run {
+			t.Fatalf("Record %d: expected %v, actual %v", i, exp, rec)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("Expected EOF at the end of capture, actual %v", err)
+	}
+
+	if _, err := NewCaptureReader(bytes.NewReader([]byte("garbage"))); err != ErrCaptureFormat {
+		t.Fatalf("Expected format error for file that is not a capture, actual %v", err)
+	}
+	var buf bytes.Buffer
+	w, _ := NewCaptureWriter(&buf)
+	w.Write(expected[1])
+	r, _ = NewCaptureReader(bytes.NewReader(buf.Bytes()[:buf.Len()-10]))
+	if _, err := r.Next(); err != ErrCaptureFormat {
+		t.Fatalf("Expected format error for cut record, actual %v", err)
+	}
+}
+
+func TestSocketCapture(t *testing.T) {
+	msgTypeLen := map[byte]int{3: 64 * 1024}
+	var buf bytes.Buffer
+	capture, _ := NewCaptureWriter(&buf)
+	cli, srv := Pipe(PipeConfig{})
+	srv.SetID(7)
+	srv.SetCapture(capture)
+	srv.SetReassemblyLimits(map[byte]int{3: 64 * 1024})
+	cli.SetFragmentSize(1000)
+	cli.SetCapabilities(Capabilities{Version: ProtocolVersion, MaxFrameSize: 1024, Features: FeatureFragmentation})
+	h := newChanHandler()
+	srv.StartHandler(context.Background(), h, msgTypeLen)
+	cliHandler := newChanHandler()
+	cli.StartHandler(context.Background(), cliHandler, msgTypeLen)
+
+	large := bytes.Repeat([]byte{1, 2, 3}, 1000)
+	cli.Send(rDataPacket{typ: 3, data: large})
+	select {
+	case <-h.read:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Packet not received")
+	}
+	srv.Send(rDataPacket{typ: 3, data: []byte{4, 5}})
+	select {
+	case <-h.written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Packet not written")
+	}
+	cli.Close()
+	srv.Close()
+
+	r, err := NewCaptureReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Read capture failed. Error %v", err)
+	}
+	// Fragments are captured once, as the reassembled packet
+	for i, exp := range []CaptureRecord{{Dir: DirIn, Data: large}, {Dir: DirOut, Data: []byte{4, 5}}} {
+		rec, err := r.Next()
+		if err != nil {
+			t.Fatalf("Record %d: read failed. Error %v", i, err)
+		}
+		if rec.Dir != exp.Dir || rec.SocketID != 7 || rec.Type != 3 || !bytes.Equal(rec.Data, exp.Data) {
+			t.Fatalf("Record %d: expected %s packet with %d bytes, actual %s packet of socket %d with %d bytes",
+				i, exp.Dir, len(exp.Data), rec.Dir, rec.SocketID, len(rec.Data))
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("Expected only 2 records, actual error %v", err)
+	}
+}
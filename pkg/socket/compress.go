@@ -0,0 +1,66 @@
+package socket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+// DefaultCompressMinSize is the smallest data that socket compresses when compression is agreed.
+// Compressing smaller packets costs more CPU than it saves on wire
+const DefaultCompressMinSize = 512
+
+var (
+	// ErrDecompress happen when data of compressed frame is not valid or its size is not the advertised one
+	ErrDecompress = errors.New("Invalid compressed frame")
+
+	// flate writers allocate large tables, so they are reused between frames
+	flateWriters = sync.Pool{
+		New: func() interface{} {
+			w, _ := flate.NewWriter(nil, flate.BestSpeed)
+			return w
+		},
+	}
+	flateReaders = sync.Pool{
+		New: func() interface{} {
+			return flate.NewReader(nil)
+		},
+	}
+)
+
+// compress deflate data into dst. It returns false when compressed data is not smaller than data
+func compress(dst *bytes.Buffer, data []byte) bool {
+	dst.Reset()
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(dst)
+	if _, err := w.Write(data); err != nil {
+		return false
+	}
+	if err := w.Close(); err != nil {
+		return false
+	}
+	return dst.Len() < len(data)
+}
+
+// decompress inflate data of a frame. rawLen is the size that sender advertised and
+// it is validated against msgTypeLen before, so output never grows beyond it
+func decompress(data []byte, rawLen int) ([]byte, error) {
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(data), nil); err != nil {
+		return nil, ErrDecompress
+	}
+	res := make([]byte, rawLen)
+	if _, err := io.ReadFull(r, res); err != nil {
+		return nil, ErrDecompress
+	}
+	// Compressed stream must end exactly at rawLen
+	var extra [1]byte
+	if n, _ := r.Read(extra[:]); n > 0 {
+		return nil, ErrDecompress
+	}
+	return res, nil
+}
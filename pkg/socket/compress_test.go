@@ -0,0 +1,72 @@
+package socket
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	json := bytes.Repeat([]byte(`{"id":12,"name":"sensor","value":42.5},`), 100)
+	var buf bytes.Buffer
+	ok := compress(&buf, json)
+	compressed := buf.Bytes()
+	if !ok || len(compressed)*5 > len(json) {
+		t.Fatalf("compress: repetitive data not compressed. %d -> %d", len(json), len(compressed))
+	}
+	actual, err := decompress(compressed, len(json))
+	if err != nil || !bytes.Equal(actual, json) {
+		t.Fatalf("decompress: data not restored. Error %v", err)
+	}
+	if _, err = decompress(compressed, len(json)-1); err != ErrDecompress {
+		t.Error("decompress: stream longer than raw length accepted")
+	}
+	if _, err = decompress(compressed, len(json)+1); err != ErrDecompress {
+		t.Error("decompress: stream shorter than raw length accepted")
+	}
+	if _, err = decompress([]byte{1, 2, 3, 4}, 10); err != ErrDecompress {
+		t.Error("decompress: invalid stream accepted")
+	}
+	if ok = compress(&buf, []byte{1, 2, 3}); ok {
+		t.Error("compress: incompressible data must be sent raw")
+	}
+}
+
+func TestInspectCompressed(t *testing.T) {
+	msgTypeLen := map[byte]int{2: 0, 3: 4096}
+	raw := bytes.Repeat([]byte{1, 2, 3, 4}, 1000)
+	var buf, bombBuf bytes.Buffer
+	compress(&buf, raw)
+	compressed := buf.Bytes()
+	withCRC := encodeV2(3, flagCompressed|flagChecksum, compressed, len(raw))
+	noCRC := encodeV2(3, flagCompressed, compressed, len(raw))
+	v1 := encodeData(2, nil, FrameV1)
+	// Small frame that expands beyond limit of its type
+	compress(&bombBuf, make([]byte, 8192))
+	bomb := bombBuf.Bytes()
+	bombFrame := encodeV2(3, flagCompressed|flagChecksum, bomb, 8192)
+	// Raw length does not match the compressed stream
+	lying := encodeV2(3, flagCompressed|flagChecksum, compressed, len(raw)-1)
+
+	stream := bytes.Join([][]byte{withCRC, v1, noCRC, bombFrame, v1, lying, v1}, nil)
+	for split := 1; split < len(stream); split += 97 {
+		pi := packetInspector{}
+		pi.resetVariables()
+		actual := pi.inspect(stream[:split], msgTypeLen)
+		actual = append(actual, pi.inspect(stream[split:], msgTypeLen)...)
+		if len(actual) != 6 {
+			t.Fatalf("Split %d: expected 6 packets, actual %d", split, len(actual))
+		}
+		for i, expectedTyp := range []byte{3, 2, 3, 2, 3, 2} {
+			if actual[i].typ != expectedTyp {
+				t.Fatalf("Split %d: packet %d has type %d", split, i, actual[i].typ)
+			}
+		}
+		if !bytes.Equal(actual[0].data, raw) || !bytes.Equal(actual[2].data, raw) || actual[0].err != nil {
+			t.Fatalf("Split %d: compressed packet not restored", split)
+		}
+		if !errors.Is(actual[4].err, ErrDecompress) || !Recoverable(actual[4].err) {
+			t.Fatalf("Split %d: invalid raw length not reported. Error %v", split, actual[4].err)
+		}
+	}
+}
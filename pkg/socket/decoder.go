@@ -0,0 +1,111 @@
+package socket
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// bufPool keeps read buffers and compressed bodies, so sockets do not allocate them for every connection or frame
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		bb := make([]byte, 0)
+		return &bb
+	},
+}
+
+// getBuf return an empty pooled buffer with at least size capacity
+func getBuf(size int) *[]byte {
+	bb := bufPool.Get().(*[]byte)
+	if cap(*bb) < size {
+		*bb = make([]byte, 0, size)
+	}
+	*bb = (*bb)[:0]
+	return bb
+}
+
+func putBuf(bb *[]byte) {
+	bufPool.Put(bb)
+}
+
+// frameDecoder read packets from a stream. Each read is done with a pooled buffer of bufSize bytes
+// and packets that complete in it are returned one by one before the next read.
+// Fragments are reassembled, so only whole packets are returned
+type frameDecoder struct {
+	r          io.Reader
+	msgTypeLen map[byte]int
+	buf        *[]byte
+	pi         packetInspector
+	ra         reassembler
+	pending    []rDataPacket // Packets completed in the last read
+	next       int           // Index of next packet in pending
+	err        error         // Error of the last read, returned after pending packets
+	// Max bytes without a valid frame, stream is failed with ErrGarbageLimit after them. Zero is not limited
+	garbageLimit int
+}
+
+// newFrameDecoder create decoder of stream. fragLimits is max length of reassembled packet of each type,
+// a nil map limits fragmented packets to msgTypeLen
+func newFrameDecoder(r io.Reader, bufSize int, msgTypeLen map[byte]int, fragLimits map[byte]int) *frameDecoder {
+	d := &frameDecoder{
+		r:          r,
+		msgTypeLen: msgTypeLen,
+		buf:        getBuf(bufSize),
+	}
+	*d.buf = (*d.buf)[:bufSize]
+	d.pi.resetVariables()
+	d.pi.fragLimits = fragLimits
+	return d
+}
+
+// Decode return next packet of the stream. A frame with invalid checksum or compressed data, and skipped bytes
+// are returned as packet with err. The returned error is only set when reading from stream fails or
+// garbage limit is exceeded
+func (d *frameDecoder) Decode() (rDataPacket, error) {
+	for {
+		for d.next >= len(d.pending) {
+			if d.err != nil {
+				return rDataPacket{}, d.err
+			}
+			n, err := d.r.Read(*d.buf)
+			d.err = err
+			d.pending = d.pi.feed(d.pending[:0], (*d.buf)[:n], d.msgTypeLen)
+			d.next = 0
+			if len(d.pi.events) > 0 {
+				d.pending = d.withEvents(d.pending)
+			}
+			if d.garbageLimit > 0 && d.pi.garbage > d.garbageLimit && d.err == nil {
+				d.err = fmt.Errorf("%w, %d bytes skipped", ErrGarbageLimit, d.pi.garbage)
+			}
+		}
+		pkt := d.pending[d.next]
+		d.pending[d.next] = rDataPacket{} // Data belongs to the caller from now
+		d.next++
+		if !pkt.frag.isFragment() {
+			return pkt, nil
+		}
+		if pkt, ok := d.ra.add(pkt); ok {
+			return pkt, nil
+		}
+	}
+}
+
+// withEvents return resync events of inspector as packets with err, followed by pkts
+func (d *frameDecoder) withEvents(pkts []rDataPacket) []rDataPacket {
+	res := make([]rDataPacket, 0, len(d.pi.events)+len(pkts))
+	for i, e := range d.pi.events {
+		res = append(res, rDataPacket{err: e})
+		d.pi.events[i] = nil
+	}
+	d.pi.events = d.pi.events[:0]
+	return append(res, pkts...)
+}
+
+// Release return buffers of decoder to the pool. Decoder must not be used after release
+func (d *frameDecoder) Release() {
+	if d.buf != nil {
+		putBuf(d.buf)
+		d.buf = nil
+	}
+	d.pi.resetVariables()
+}
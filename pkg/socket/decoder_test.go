@@ -0,0 +1,153 @@
+package socket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFrameDecoder(t *testing.T) {
+	msgTypeLen := map[byte]int{1: 0, 3: 64 * 1024}
+	var compressed bytes.Buffer
+	raw := bytes.Repeat([]byte("relay body "), 1000)
+	compress(&compressed, raw)
+	expected := []rDataPacket{
+		{typ: 1},
+		{typ: 3, data: []byte{1, 2, 3}},
+		{typ: 3, data: raw},
+		{typ: 3, data: bytes.Repeat([]byte{7}, 10000)},
+		{typ: 1},
+	}
+	stream := bytes.Join([][]byte{
+		{0, 1, 2},
+		encodeData(1, nil, FrameV1),
+		encodeData(3, []byte{1, 2, 3}, FrameV2),
+		encodeV2(3, flagCompressed|flagChecksum, compressed.Bytes(), len(raw)),
+		encodeData(3, bytes.Repeat([]byte{7}, 10000), FrameV1),
+		{83, 79, 70},
+		encodeData(1, nil, FrameV2),
+	}, nil)
+
+	readers := map[string]func() io.Reader{
+		"whole":    func() io.Reader { return bytes.NewReader(stream) },
+		"one byte": func() io.Reader { return iotest.OneByteReader(bytes.NewReader(stream)) },
+		"half":     func() io.Reader { return iotest.HalfReader(bytes.NewReader(stream)) },
+		"data err": func() io.Reader { return iotest.DataErrReader(bytes.NewReader(stream)) },
+	}
+	for name, r := range readers {
+		for _, bufSize := range []int{1, 7, 100, 4096} {
+			dec := newFrameDecoder(r(), bufSize, msgTypeLen, nil)
+			actual := make([]rDataPacket, 0)
+			skipped := 0
+			for {
+				pkt, err := dec.Decode()
+				if err == io.EOF {
+					break
+				}
+				var resyncErr *ResyncError
+				if errors.As(pkt.err, &resyncErr) {
+					skipped += resyncErr.Skipped
+					continue
+				}
+				if err != nil || pkt.err != nil {
+					t.Fatalf("%s/%d: unexpected error %v %v", name, bufSize, err, pkt.err)
+				}
+				actual = append(actual, pkt)
+			}
+			dec.Release()
+			// Packets are compared after the whole stream is read, so sharing memory with read buffer is detected
+			if !checkEqRData(actual, expected) {
+				t.Errorf("%s/%d: expected %d packets, actual %d", name, bufSize, len(expected), len(actual))
+			}
+			if skipped != 6 {
+				t.Errorf("%s/%d: expected 6 skipped bytes, actual %d", name, bufSize, skipped)
+			}
+		}
+	}
+}
+
+// benchStream return a stream of count v2 frames with size bytes of data
+func benchStream(count int, size int) []byte {
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, size/8)
+	frames := make([][]byte, count)
+	for i := range frames {
+		frames[i], _ = encodeFrame(rDataPacket{typ: 3, data: data}, FrameV2)
+	}
+	return bytes.Join(frames, nil)
+}
+
+func benchmarkInspect(b *testing.B, size int) {
+	msgTypeLen := map[byte]int{3: size}
+	stream := benchStream(64, size)
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pi := packetInspector{}
+		pi.resetVariables()
+		for bb := stream; len(bb) > 0; {
+			n := 8192
+			if n > len(bb) {
+				n = len(bb)
+			}
+			pi.inspect(bb[:n], msgTypeLen)
+			bb = bb[n:]
+		}
+	}
+}
+
+func BenchmarkInspect64B(b *testing.B)  { benchmarkInspect(b, 64) }
+func BenchmarkInspect4KB(b *testing.B)  { benchmarkInspect(b, 4096) }
+func BenchmarkInspect64KB(b *testing.B) { benchmarkInspect(b, 64*1024) }
+
+func benchmarkDecoder(b *testing.B, size int) {
+	msgTypeLen := map[byte]int{3: size}
+	stream := benchStream(64, size)
+	r := bytes.NewReader(stream)
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(stream)
+		dec := newFrameDecoder(r, 8192, msgTypeLen, nil)
+		for {
+			if _, err := dec.Decode(); err != nil {
+				break
+			}
+		}
+		dec.Release()
+	}
+}
+
+func BenchmarkDecoder64B(b *testing.B)  { benchmarkDecoder(b, 64) }
+func BenchmarkDecoder4KB(b *testing.B)  { benchmarkDecoder(b, 4096) }
+func BenchmarkDecoder64KB(b *testing.B) { benchmarkDecoder(b, 64*1024) }
+
+func benchmarkEncodeFrame(b *testing.B, size int) {
+	pkt := rDataPacket{typ: 3, data: make([]byte, size)}
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bb, _ := encodeFrame(pkt, FrameV2)
+		ioutil.Discard.Write(bb)
+	}
+}
+
+func BenchmarkEncodeFrame64B(b *testing.B)  { benchmarkEncodeFrame(b, 64) }
+func BenchmarkEncodeFrame64KB(b *testing.B) { benchmarkEncodeFrame(b, 64*1024) }
+
+func benchmarkFrameEncoder(b *testing.B, size int) {
+	data := make([]byte, size)
+	var e frameEncoder
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		e.encode(3, FrameV2, flagChecksum, data, 0, fragmentInfo{}, 0).WriteTo(ioutil.Discard)
+	}
+}
+
+func BenchmarkFrameEncoder64B(b *testing.B)  { benchmarkFrameEncoder(b, 64) }
+func BenchmarkFrameEncoder64KB(b *testing.B) { benchmarkFrameEncoder(b, 64*1024) }
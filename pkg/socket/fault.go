@@ -0,0 +1,244 @@
+package socket
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Faults configure faults that FaultConn injects. Faults are chosen by random sources made from Seed,
+// one for reads and one for writes, so the same calls of each direction get the same faults.
+// Rates are probabilities between 0 and 1
+type Faults struct {
+	Seed int64
+	// Each read returns a random number of bytes between 1 and ReadChunk. Zero keeps reads as they are
+	ReadChunk int
+	// Each write is passed to connection in random chunks between 1 and WriteChunk bytes. Zero keeps writes whole
+	WriteChunk int
+	// Rate of reads and writes that are delayed by a random duration up to MaxDelay
+	DelayRate float64
+	MaxDelay  time.Duration
+	// Rate of writes that stop after a random part of data and return a timeout error
+	PartialWriteRate float64
+	// Rate of writes that write nothing and wait until write deadline passes or connection is closed
+	StallRate float64
+	// Rate of read bytes that are corrupted
+	CorruptRate float64
+	// Connection is closed when this many bytes are read and written, even in the middle of a frame.
+	// Zero never closes connection
+	DropAfter int
+}
+
+// FaultConn is a net.Conn that injects faults in reads and writes of another connection
+type FaultConn struct {
+	net.Conn
+	faults    Faults
+	readRand  *rand.Rand // Used only by reads
+	writeRand *rand.Rand // Used only by writes
+	mutx      sync.Mutex
+	total     int // Bytes that are read and written, for DropAfter
+	dropped   bool
+	deadline  time.Time // Write deadline, stalled writes wait for it
+	changed   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// errNoCloseWrite happen when underlying connection of FaultConn cannot be half-closed
+var errNoCloseWrite = errors.New("Connection does not support half-close")
+
+// errPartialWrite is the error of writes that are stopped by PartialWriteRate
+type errPartialWrite struct{}
+
+func (errPartialWrite) Error() string   { return "Write stopped by fault injection" }
+func (errPartialWrite) Timeout() bool   { return true }
+func (errPartialWrite) Temporary() bool { return true }
+
+// NewFaultConn wrap conn with a connection that injects faults
+func NewFaultConn(conn net.Conn, faults Faults) *FaultConn {
+	return &FaultConn{
+		Conn:      conn,
+		faults:    faults,
+		readRand:  rand.New(rand.NewSource(faults.Seed)),
+		writeRand: rand.New(rand.NewSource(faults.Seed + 1)),
+		changed:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (c *FaultConn) Read(bb []byte) (int, error) {
+	c.delay(c.readRand)
+	if c.faults.ReadChunk > 0 && len(bb) > 0 {
+		if n := 1 + c.readRand.Intn(c.faults.ReadChunk); n < len(bb) {
+			bb = bb[:n]
+		}
+	}
+	bb, ok := c.allowed(bb)
+	if !ok {
+		c.drop()
+		return 0, io.ErrClosedPipe
+	}
+	n, err := c.Conn.Read(bb)
+	drop := c.count(n)
+	if c.faults.CorruptRate > 0 {
+		for i := 0; i < n; i++ {
+			if c.readRand.Float64() < c.faults.CorruptRate {
+				bb[i] ^= byte(1 + c.readRand.Intn(255))
+			}
+		}
+	}
+	if drop {
+		c.drop()
+	}
+	return n, err
+}
+
+func (c *FaultConn) Write(bb []byte) (int, error) {
+	c.delay(c.writeRand)
+	if c.faults.StallRate > 0 && c.writeRand.Float64() < c.faults.StallRate {
+		return 0, c.stall()
+	}
+	partial := false
+	if c.faults.PartialWriteRate > 0 && len(bb) > 1 && c.writeRand.Float64() < c.faults.PartialWriteRate {
+		bb = bb[:1+c.writeRand.Intn(len(bb)-1)]
+		partial = true
+	}
+	total := 0
+	for len(bb) > 0 {
+		chunk := bb
+		if c.faults.WriteChunk > 0 {
+			if n := 1 + c.writeRand.Intn(c.faults.WriteChunk); n < len(chunk) {
+				chunk = chunk[:n]
+			}
+		}
+		chunk, ok := c.allowed(chunk)
+		if !ok {
+			c.drop()
+			return total, io.ErrClosedPipe
+		}
+		n, err := c.Conn.Write(chunk)
+		total += n
+		if c.count(n) {
+			c.drop()
+			return total, io.ErrClosedPipe
+		}
+		if err != nil {
+			return total, err
+		}
+		bb = bb[n:]
+	}
+	if partial {
+		return total, errPartialWrite{}
+	}
+	return total, nil
+}
+
+// allowed limit bb to the bytes that may be transferred before connection is dropped.
+// It returns false when no byte is left
+func (c *FaultConn) allowed(bb []byte) ([]byte, bool) {
+	if c.faults.DropAfter <= 0 {
+		return bb, true
+	}
+	c.mutx.Lock()
+	defer c.mutx.Unlock()
+	left := c.faults.DropAfter - c.total
+	if left <= 0 {
+		return nil, false
+	}
+	if left < len(bb) {
+		return bb[:left], true
+	}
+	return bb, true
+}
+
+// count add transferred bytes, it returns true when connection must be dropped
+func (c *FaultConn) count(n int) bool {
+	if c.faults.DropAfter <= 0 {
+		return false
+	}
+	c.mutx.Lock()
+	defer c.mutx.Unlock()
+	c.total += n
+	return c.total >= c.faults.DropAfter
+}
+
+// drop close connection, like a network failure
+func (c *FaultConn) drop() {
+	c.mutx.Lock()
+	c.dropped = true
+	c.mutx.Unlock()
+	c.Close()
+}
+
+func (c *FaultConn) delay(rnd *rand.Rand) {
+	if c.faults.DelayRate <= 0 || c.faults.MaxDelay <= 0 || rnd.Float64() >= c.faults.DelayRate {
+		return
+	}
+	time.Sleep(time.Duration(rnd.Int63n(int64(c.faults.MaxDelay))))
+}
+
+// stall wait until write deadline passes or connection is closed
+func (c *FaultConn) stall() error {
+	for {
+		c.mutx.Lock()
+		deadline, changed := c.deadline, c.changed
+		c.mutx.Unlock()
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			timeout = time.After(wait)
+		}
+		select {
+		case <-timeout:
+			return os.ErrDeadlineExceeded
+		case <-changed:
+		case <-c.done:
+			return io.ErrClosedPipe
+		}
+	}
+}
+
+// Dropped report whether connection is closed by DropAfter
+func (c *FaultConn) Dropped() bool {
+	c.mutx.Lock()
+	defer c.mutx.Unlock()
+	return c.dropped
+}
+
+// CloseWrite half-close underlying connection when it supports it
+func (c *FaultConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errNoCloseWrite
+}
+
+func (c *FaultConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+func (c *FaultConn) SetDeadline(t time.Time) error {
+	c.setWriteDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *FaultConn) SetWriteDeadline(t time.Time) error {
+	c.setWriteDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *FaultConn) setWriteDeadline(t time.Time) {
+	c.mutx.Lock()
+	c.deadline = t
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mutx.Unlock()
+}
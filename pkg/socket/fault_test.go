@@ -0,0 +1,275 @@
+package socket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// faultyReader write stream to a pipe and return the other side wrapped with faults
+func faultyReader(stream []byte, faults Faults) *FaultConn {
+	c1, c2 := PipeConns(PipeConfig{BufferSize: len(stream) + 1})
+	c1.Write(stream)
+	c1.Close()
+	return NewFaultConn(c2, faults)
+}
+
+func TestFaultConnDeterministic(t *testing.T) {
+	stream := bytes.Repeat([]byte{1, 2, 3}, 100)
+	reads := func(seed int64) []int {
+		conn := faultyReader(stream, Faults{Seed: seed, ReadChunk: 10})
+		sizes := make([]int, 0)
+		bb := make([]byte, 100)
+		for {
+			n, err := conn.Read(bb)
+			if err != nil {
+				break
+			}
+			sizes = append(sizes, n)
+		}
+		return sizes
+	}
+	first, again, other := reads(1), reads(1), reads(2)
+	if len(first) != len(again) {
+		t.Fatalf("Same seed produced %d and %d reads", len(first), len(again))
+	}
+	for i := range first {
+		if first[i] != again[i] || first[i] > 10 {
+			t.Fatalf("Read %d: expected %d bytes, actual %d", i, first[i], again[i])
+		}
+	}
+	if len(first) == len(other) {
+		same := true
+		for i := range first {
+			same = same && first[i] == other[i]
+		}
+		if same {
+			t.Fatal("Different seeds produced same reads")
+		}
+	}
+}
+
+func TestFaultConnDrop(t *testing.T) {
+	c1, c2 := PipeConns(PipeConfig{})
+	conn := NewFaultConn(c1, Faults{Seed: 1, WriteChunk: 7, DropAfter: 30})
+	n, err := conn.Write(make([]byte, 100))
+	if n != 30 || err != io.ErrClosedPipe || !conn.Dropped() {
+		t.Fatalf("Expected drop after 30 bytes, actual %d bytes. Error %v", n, err)
+	}
+	read, _ := io.ReadAll(c2)
+	if len(read) != 30 {
+		t.Fatalf("Peer expected 30 bytes before EOF, actual %d", len(read))
+	}
+}
+
+func TestFaultConnStall(t *testing.T) {
+	c1, c2 := PipeConns(PipeConfig{})
+	defer c2.Close()
+	conn := NewFaultConn(c1, Faults{Seed: 1, StallRate: 1})
+	conn.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if n, err := conn.Write([]byte{1}); n != 0 || err != os.ErrDeadlineExceeded {
+		t.Fatalf("Write not stalled until deadline. %d bytes written, error %v", n, err)
+	}
+	go conn.Close()
+	conn.SetWriteDeadline(time.Time{})
+	if _, err := conn.Write([]byte{1}); err != io.ErrClosedPipe {
+		t.Fatalf("Stalled write not stopped by close. Error %v", err)
+	}
+}
+
+// faultyStream return garbage, frames, fragments of interleaved packets and packets that
+// are expected from it
+func faultyStream() ([]byte, []rDataPacket) {
+	large := bytes.Repeat([]byte("snapshot "), 500)
+	other := bytes.Repeat([]byte{9}, 300)
+	garbage, _ := garbageStream()
+	stream := bytes.Join([][]byte{
+		garbage,
+		encodeFragment(3, flagChecksum, large[:1000], 0, fragmentInfo{id: 1, total: len(large)}),
+		encodeFragment(3, 0, other[:100], 0, fragmentInfo{id: 2, total: len(other)}),
+		[]byte("SOS"),
+		encodeData(1, nil, FrameV2),
+		encodeFragment(3, flagChecksum, large[1000:], 0, fragmentInfo{id: 1, total: len(large), offset: 1000}),
+		encodeFragment(3, 0, other[100:], 0, fragmentInfo{id: 2, total: len(other), offset: 100}),
+	}, nil)
+	return stream, []rDataPacket{
+		{typ: 3, data: []byte{1, 2, 3}},
+		{typ: 3, data: []byte{1, 2, 3}},
+		{typ: 1},
+		{typ: 3, data: large},
+		{typ: 3, data: other},
+	}
+}
+
+func TestFaultyReads(t *testing.T) {
+	msgTypeLen := map[byte]int{1: 0, 3: 1024}
+	fragLimits := map[byte]int{3: 64 * 1024}
+	stream, expected := faultyStream()
+	for seed := int64(0); seed < 200; seed++ {
+		conn := faultyReader(stream, Faults{Seed: seed, ReadChunk: 1 + int(seed%13)})
+		dec := newFrameDecoder(conn, 1+int(seed%300), msgTypeLen, fragLimits)
+		actual := make([]rDataPacket, 0)
+		for {
+			pkt, err := dec.Decode()
+			if err != nil {
+				break
+			}
+			var resyncErr *ResyncError
+			if errors.As(pkt.err, &resyncErr) {
+				continue
+			}
+			if pkt.err != nil {
+				t.Fatalf("Seed %d: unexpected error %v", seed, pkt.err)
+			}
+			actual = append(actual, pkt)
+		}
+		dec.Release()
+		if !checkEqRData(actual, expected) {
+			t.Fatalf("Seed %d: expected %d packets, actual %d", seed, len(expected), len(actual))
+		}
+	}
+}
+
+func TestFaultyCorruption(t *testing.T) {
+	msgTypeLen := map[byte]int{1: 0, 3: 1024}
+	fragLimits := map[byte]int{3: 64 * 1024}
+	payload := bytes.Repeat([]byte{7, 8}, 200)
+	stream := make([]byte, 0)
+	for i := 0; i < 20; i++ {
+		stream = append(stream, encodeData(3, payload, FrameV2)...)
+		stream = append(stream, encodeFragment(3, flagChecksum, payload[:100], 0, fragmentInfo{id: uint32(i), total: len(payload)})...)
+		stream = append(stream, encodeFragment(3, flagChecksum, payload[100:], 0, fragmentInfo{id: uint32(i), total: len(payload), offset: 100})...)
+	}
+	for seed := int64(0); seed < 100; seed++ {
+		conn := faultyReader(stream, Faults{Seed: seed, ReadChunk: 64, CorruptRate: 0.002})
+		dec := newFrameDecoder(conn, 256, msgTypeLen, fragLimits)
+		delivered := 0
+		for {
+			pkt, err := dec.Decode()
+			if err != nil {
+				break
+			}
+			if pkt.err != nil {
+				if !Recoverable(pkt.err) {
+					t.Fatalf("Seed %d: corruption is not recoverable. Error %v", seed, pkt.err)
+				}
+				continue
+			}
+			// Checksum never lets a corrupted packet through
+			if !bytes.Equal(pkt.data, payload) {
+				t.Fatalf("Seed %d: corrupted packet delivered", seed)
+			}
+			delivered++
+		}
+		dec.Release()
+		if delivered == 0 {
+			t.Fatalf("Seed %d: stream not resynced after corruption", seed)
+		}
+	}
+}
+
+func TestSocketFaults(t *testing.T) {
+	msgTypeLen := map[byte]int{3: 1024}
+	large := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 4*1024)
+	for seed := int64(0); seed < 20; seed++ {
+		faults := Faults{Seed: seed, ReadChunk: 50, WriteChunk: 30, DelayRate: 0.05, MaxDelay: time.Millisecond}
+		cli, srv := Pipe(PipeConfig{Faults: &faults})
+		srv.SetReassemblyLimits(map[byte]int{3: len(large)})
+		cli.SetFragmentSize(1000)
+		cli.SetCapabilities(Capabilities{Version: ProtocolVersion, MaxFrameSize: 1024, Features: FeatureChecksum | FeatureFragmentation})
+		h := newChanHandler()
+		srv.StartHandler(context.Background(), h, msgTypeLen)
+		cli.Start(make(chan WData, 10), make(chan RData, 10), make(chan ProbData, 10), msgTypeLen)
+		cli.Send(rDataPacket{typ: 3, data: large})
+		cli.Send(rDataPacket{typ: 3, data: []byte{9}})
+		for _, expected := range [][]byte{{9}, large} {
+			select {
+			case rData := <-h.read:
+				if data, _ := rData.Pkt.Data(); !bytes.Equal(data, expected) {
+					t.Fatalf("Seed %d: expected packet with %d bytes, actual %d bytes", seed, len(expected), len(data))
+				}
+			case prob := <-h.probs:
+				t.Fatalf("Seed %d: unexpected problem %v", seed, prob.Err)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Seed %d: packet not received", seed)
+			}
+		}
+		cli.Close()
+		srv.Close()
+	}
+}
+
+func TestSocketDroppedMidFrame(t *testing.T) {
+	msgTypeLen := map[byte]int{3: 1024}
+	for seed := int64(0); seed < 20; seed++ {
+		// Connection of client is dropped in the middle of the third frame
+		cli, srv := Pipe(PipeConfig{Faults: &Faults{Seed: seed, WriteChunk: 9, DropAfter: 2*(prefixLen+HeaderLen+100) + 50}})
+		h := newChanHandler()
+		srv.StartHandler(context.Background(), h, msgTypeLen)
+		cliProb := make(chan ProbData, 10)
+		cli.Start(make(chan WData, 10), make(chan RData, 10), cliProb, msgTypeLen)
+		for i := 0; i < 3; i++ {
+			cli.Send(rDataPacket{typ: 3, data: bytes.Repeat([]byte{byte(i)}, 100)})
+		}
+		select {
+		case err := <-h.closed:
+			if err == nil {
+				t.Fatalf("Seed %d: dropped connection closed without error", seed)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Seed %d: dropped connection not closed", seed)
+		}
+		select {
+		case <-cliProb:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Seed %d: dropped connection not reported to writer", seed)
+		}
+		// Frame that is cut is never delivered
+		if len(h.read) != 2 {
+			t.Fatalf("Seed %d: expected 2 packets, actual %d", seed, len(h.read))
+		}
+		cli.Close()
+	}
+}
+
+func TestSocketPartialWrites(t *testing.T) {
+	msgTypeLen := map[byte]int{3: 1024}
+	completed := 0
+	for seed := int64(0); seed < 20; seed++ {
+		// Partial write is retried once, socket is closed when the retry is partial too
+		cli, srv := Pipe(PipeConfig{Faults: &Faults{Seed: seed, PartialWriteRate: 0.2}})
+		h := newChanHandler()
+		srv.StartHandler(context.Background(), h, msgTypeLen)
+		cliHandler := newChanHandler()
+		cli.StartHandler(context.Background(), cliHandler, msgTypeLen)
+		received := 0
+	loop:
+		for i := 0; i < 10; i++ {
+			cli.Send(rDataPacket{typ: 3, data: bytes.Repeat([]byte{byte(i)}, 50)})
+			select {
+			case rData := <-h.read:
+				if data, _ := rData.Pkt.Data(); len(data) != 50 || data[0] != byte(i) {
+					t.Fatalf("Seed %d: packet %d is corrupted", seed, i)
+				}
+				received++
+			case <-cliHandler.closed:
+				break loop
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Seed %d: packet %d not received", seed, i)
+			}
+		}
+		if received == 10 {
+			completed++
+		}
+		cli.Close()
+		srv.Close()
+	}
+	// Without retry two of ten writes fail, so most connections would be closed
+	if completed < 10 {
+		t.Fatalf("Partial writes are not retried, %d of 20 connections completed", completed)
+	}
+}
@@ -0,0 +1,154 @@
+package socket
+
+// DefaultFragmentSize is the max data of one fragment when fragmentation is agreed.
+// Small enough that other packets wait at most for one fragment, large enough to keep overhead low
+const DefaultFragmentSize = 64 * 1024
+
+// maxReassemblies is how many fragmented packets a socket reassembles at the same time.
+// A peer that starts more transfers loses the oldest ones, so memory of a socket stays bounded
+const maxReassemblies = 8
+
+// maxFailedFragments bounds how many dropped packets reassembler remembers to ignore their remaining fragments
+const maxFailedFragments = 64
+
+// reassembly is a fragmented packet that is partly received
+type reassembly struct {
+	typ     byte
+	version byte
+	stream  uint32
+	total   int
+	data    []byte // Received data. It grows as fragments arrive, so headers alone allocate nothing
+	seq     uint64 // Order of creation, used to drop the oldest reassembly
+}
+
+// reassembler put fragments back together. Fragments of one packet arrive in order,
+// but fragments of different packets can interleave
+type reassembler struct {
+	parts  map[uint32]*reassembly
+	failed map[uint32]bool // Packets that lost a fragment, their next fragments are dropped silently
+	seq    uint64
+}
+
+// add store data of a fragment. It returns the whole packet when fragment is the last one.
+// Invalid fragment is returned as packet with err and the reassembly of its packet is dropped
+func (ra *reassembler) add(pkt rDataPacket) (rDataPacket, bool) {
+	frag := pkt.frag
+	if pkt.err != nil {
+		if _, ok := ra.parts[frag.id]; ok || frag.offset == 0 {
+			ra.fail(frag.id, frag.last)
+		}
+		return rDataPacket{typ: pkt.typ, version: pkt.version, err: pkt.err}, true
+	}
+	if ra.failed[frag.id] {
+		if frag.last {
+			delete(ra.failed, frag.id)
+		}
+		return rDataPacket{}, false
+	}
+	part, ok := ra.parts[frag.id]
+	if !ok && frag.offset == 0 {
+		part = ra.start(pkt)
+	}
+	if part == nil {
+		// Not a fragment of a known packet, nothing to drop
+		return rDataPacket{typ: pkt.typ, version: pkt.version, err: &FrameError{Type: pkt.typ, Err: ErrFragment}}, true
+	}
+	end := frag.offset + len(pkt.data)
+	if part.typ != pkt.typ || part.stream != pkt.stream || part.total != frag.total || len(part.data) != frag.offset ||
+		end > part.total || (frag.last && end != part.total) {
+		ra.fail(frag.id, frag.last)
+		return rDataPacket{typ: pkt.typ, version: pkt.version, err: &FrameError{Type: pkt.typ, Err: ErrFragment}}, true
+	}
+	part.grow(len(pkt.data))
+	part.data = append(part.data, pkt.data...)
+	if !frag.last {
+		return rDataPacket{}, false
+	}
+	delete(ra.parts, frag.id)
+	return rDataPacket{typ: part.typ, version: part.version, stream: part.stream, data: part.data}, true
+}
+
+// start allocate a reassembly for first fragment of a packet
+func (ra *reassembler) start(pkt rDataPacket) *reassembly {
+	if ra.parts == nil {
+		ra.parts = make(map[uint32]*reassembly)
+	}
+	if len(ra.parts) >= maxReassemblies {
+		var oldest *reassembly
+		var oldestID uint32
+		for id, part := range ra.parts {
+			if oldest == nil || part.seq < oldest.seq {
+				oldest, oldestID = part, id
+			}
+		}
+		ra.fail(oldestID, false)
+	}
+	ra.seq++
+	part := &reassembly{
+		typ:     pkt.typ,
+		version: pkt.version,
+		stream:  pkt.stream,
+		total:   pkt.frag.total,
+		seq:     ra.seq,
+	}
+	ra.parts[pkt.frag.id] = part
+	return part
+}
+
+// grow make room for n more bytes of data. Capacity doubles, so copies stay cheap, but it never
+// exceeds total length of packet
+func (part *reassembly) grow(n int) {
+	need := len(part.data) + n
+	if need <= cap(part.data) {
+		return
+	}
+	size := 2 * cap(part.data)
+	if size < need {
+		size = need
+	}
+	if size > part.total {
+		size = part.total
+	}
+	data := make([]byte, len(part.data), size)
+	copy(data, part.data)
+	part.data = data
+}
+
+// fail drop reassembly of packet id. Unless the failed fragment was the last one,
+// the remaining fragments of the packet are ignored
+func (ra *reassembler) fail(id uint32, last bool) {
+	delete(ra.parts, id)
+	if last {
+		return
+	}
+	if ra.failed == nil || len(ra.failed) >= maxFailedFragments {
+		ra.failed = make(map[uint32]bool)
+	}
+	ra.failed[id] = true
+}
+
+// transfer is an outgoing packet that is sent in fragments
+type transfer struct {
+	pkt    Packet
+	typ    byte
+	stream uint32
+	data   []byte
+	id     uint32
+	offset int
+}
+
+// next return data of the next fragment and its position in the packet
+func (t *transfer) next(size int) ([]byte, fragmentInfo) {
+	end := t.offset + size
+	if end > len(t.data) {
+		end = len(t.data)
+	}
+	frag := fragmentInfo{id: t.id, total: len(t.data), offset: t.offset}
+	bb := t.data[t.offset:end]
+	t.offset = end
+	return bb, frag
+}
+
+func (t *transfer) done() bool {
+	return t.offset >= len(t.data)
+}
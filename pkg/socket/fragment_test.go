@@ -0,0 +1,179 @@
+package socket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFragmentReassembly(t *testing.T) {
+	msgTypeLen := map[byte]int{1: 0, 3: 1024}
+	fragLimits := map[byte]int{3: 64 * 1024}
+	large := bytes.Repeat([]byte("snapshot "), 4000)
+	other := bytes.Repeat([]byte{9}, 3000)
+	var compressed bytes.Buffer
+	compress(&compressed, large[1000:])
+
+	stream := bytes.Join([][]byte{
+		encodeFragment(3, flagChecksum, large[:1000], 0, fragmentInfo{id: 1, total: len(large)}),
+		// A fragment of another packet and a whole packet interleave with the first packet
+		encodeFragment(3, 0, other[:1000], 0, fragmentInfo{id: 2, total: len(other)}),
+		encodeData(1, nil, FrameV2),
+		encodeFragment(3, flagCompressed, compressed.Bytes(), len(large)-1000, fragmentInfo{id: 1, total: len(large), offset: 1000}),
+		encodeFragment(3, 0, other[1000:], 0, fragmentInfo{id: 2, total: len(other), offset: 1000}),
+	}, nil)
+	expected := []rDataPacket{
+		{typ: 1},
+		{typ: 3, data: large},
+		{typ: 3, data: other},
+	}
+	for _, bufSize := range []int{1, 100, 4096} {
+		dec := newFrameDecoder(iotest.HalfReader(bytes.NewReader(stream)), bufSize, msgTypeLen, fragLimits)
+		actual := make([]rDataPacket, 0)
+		for {
+			pkt, err := dec.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil || pkt.err != nil {
+				t.Fatalf("%d: unexpected error %v %v", bufSize, err, pkt.err)
+			}
+			actual = append(actual, pkt)
+		}
+		dec.Release()
+		if !checkEqRData(actual, expected) {
+			t.Errorf("%d: expected %d packets, actual %d", bufSize, len(expected), len(actual))
+		}
+	}
+}
+
+func TestFragmentErrors(t *testing.T) {
+	msgTypeLen := map[byte]int{3: 1024}
+	fragLimits := map[byte]int{3: 4096}
+	data := bytes.Repeat([]byte{5}, 4096)
+	tests := []struct {
+		name     string
+		stream   []byte
+		expected []error
+	}{
+		{
+			name: "above limit",
+			stream: bytes.Join([][]byte{
+				encodeFragment(3, 0, data[:1000], 0, fragmentInfo{id: 1, total: 5000}),
+				encodeData(3, data[:10], FrameV2),
+			}, nil),
+			// Header is skipped, then fragment data until the next prefix
+			expected: []error{ErrFrameLength, ErrNoPrefix, nil},
+		},
+		{
+			name: "missing first fragment",
+			stream: bytes.Join([][]byte{
+				encodeFragment(3, 0, data[:1000], 0, fragmentInfo{id: 1, total: 2000, offset: 1000}),
+				encodeData(3, data[:10], FrameV2),
+			}, nil),
+			expected: []error{ErrFragment, nil},
+		},
+		{
+			name: "gap",
+			stream: bytes.Join([][]byte{
+				encodeFragment(3, 0, data[:1000], 0, fragmentInfo{id: 1, total: 3000}),
+				encodeFragment(3, 0, data[:1000], 0, fragmentInfo{id: 1, total: 3000, offset: 2000}),
+				encodeData(3, data[:10], FrameV2),
+			}, nil),
+			expected: []error{ErrFragment, nil},
+		},
+		{
+			name: "corrupted fragment",
+			stream: func() []byte {
+				bad := encodeFragment(3, flagChecksum, data[:1000], 0, fragmentInfo{id: 1, total: 3000, offset: 1000})
+				bad[len(bad)-1]++
+				return bytes.Join([][]byte{
+					encodeFragment(3, 0, data[:1000], 0, fragmentInfo{id: 1, total: 3000}),
+					bad,
+					// Rest of the dropped packet is ignored without more errors
+					encodeFragment(3, 0, data[:1000], 0, fragmentInfo{id: 1, total: 3000, offset: 2000}),
+					encodeData(3, data[:10], FrameV2),
+				}, nil)
+			}(),
+			expected: []error{ErrChecksum, nil},
+		},
+	}
+	for _, tt := range tests {
+		dec := newFrameDecoder(bytes.NewReader(tt.stream), 4096, msgTypeLen, fragLimits)
+		actual := make([]error, 0)
+		for {
+			pkt, err := dec.Decode()
+			if err == io.EOF {
+				break
+			}
+			actual = append(actual, pkt.err)
+		}
+		dec.Release()
+		if len(actual) != len(tt.expected) {
+			t.Errorf("%s: expected %d packets, actual %d", tt.name, len(tt.expected), len(actual))
+			continue
+		}
+		for i := range actual {
+			if !errors.Is(actual[i], tt.expected[i]) {
+				t.Errorf("%s: packet %d expected error %v, actual %v", tt.name, i, tt.expected[i], actual[i])
+			}
+		}
+	}
+}
+
+func TestReassemblerEvictsOldest(t *testing.T) {
+	var ra reassembler
+	for id := uint32(1); id <= maxReassemblies+1; id++ {
+		if _, ok := ra.add(rDataPacket{typ: 3, data: []byte{1}, frag: fragmentInfo{id: id, total: 2}}); ok {
+			t.Fatalf("Packet %d completed by first fragment", id)
+		}
+	}
+	if len(ra.parts) != maxReassemblies {
+		t.Fatalf("Expected %d reassemblies, actual %d", maxReassemblies, len(ra.parts))
+	}
+	if _, ok := ra.add(rDataPacket{typ: 3, data: []byte{2}, frag: fragmentInfo{id: 1, total: 2, offset: 1, last: true}}); ok {
+		t.Fatal("Fragment of evicted packet is not ignored")
+	}
+	pkt, ok := ra.add(rDataPacket{typ: 3, data: []byte{2}, frag: fragmentInfo{id: 2, total: 2, offset: 1, last: true}})
+	if !ok || pkt.err != nil || !bytes.Equal(pkt.data, []byte{1, 2}) {
+		t.Fatal("Packet is not reassembled")
+	}
+}
+
+func TestReassemblerGrowsWithFragments(t *testing.T) {
+	var ra reassembler
+	// Peer sends only first fragments that claim large packets, memory follows the received data
+	for id := uint32(1); id <= maxReassemblies; id++ {
+		ra.add(rDataPacket{typ: 3, data: []byte{1}, frag: fragmentInfo{id: id, total: 50 * 1024 * 1024}})
+	}
+	allocated := 0
+	for _, part := range ra.parts {
+		allocated += cap(part.data)
+	}
+	if allocated > maxReassemblies {
+		t.Fatalf("Expected at most %d bytes allocated for headers, actual %d", maxReassemblies, allocated)
+	}
+
+	data := bytes.Repeat([]byte("fragment"), 1000)
+	var pkt rDataPacket
+	for offset := 0; offset < len(data); offset += 300 {
+		end := offset + 300
+		if end > len(data) {
+			end = len(data)
+		}
+		pkt, _ = ra.add(rDataPacket{typ: 3, data: data[offset:end],
+			frag: fragmentInfo{id: 100, total: len(data), offset: offset, last: end == len(data)}})
+	}
+	if pkt.err != nil || !bytes.Equal(pkt.data, data) || cap(pkt.data) != len(data) {
+		t.Fatalf("Packet not reassembled. Error %v, %d bytes of %d capacity", pkt.err, len(pkt.data), cap(pkt.data))
+	}
+
+	// Last fragment that does not complete the packet is not valid
+	ra.add(rDataPacket{typ: 3, data: []byte{1}, frag: fragmentInfo{id: 200, total: 3}})
+	pkt, _ = ra.add(rDataPacket{typ: 3, data: []byte{2}, frag: fragmentInfo{id: 200, total: 3, offset: 1, last: true}})
+	if !errors.Is(pkt.err, ErrFragment) {
+		t.Fatalf("Expected fragment error for short packet, actual %v", pkt.err)
+	}
+}
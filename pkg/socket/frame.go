@@ -0,0 +1,328 @@
+package socket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+)
+
+const (
+	prefixLen = 7
+	// FrameV1 is the original frame: prefix, type, length and data
+	FrameV1 byte = 1
+	// FrameV2 add version/flags byte before type and optional CRC32C trailer after data
+	FrameV2 byte = 2
+
+	// A header that starts with a byte with high bit set is versioned header.
+	// Bits 4-6 of this byte hold version and bits 0-3 hold flags
+	versionMarker byte = 0x80
+	versionMask   byte = 0x70
+	flagsMask     byte = 0x0F
+
+	flagChecksum   byte = 0x01 // Frame has CRC32C trailer
+	flagCompressed byte = 0x02 // Data is deflated and header is followed by length of raw data
+	flagFragment   byte = 0x04 // Data is a part of a larger packet and header is followed by fragment info
+	flagStream     byte = 0x08 // Frame belongs to a stream and header is followed by stream id
+	knownFlags          = flagChecksum | flagCompressed | flagFragment | flagStream
+
+	checksumLen    = 4
+	rawLenSize     = 4  // Size of raw data length that follows header of compressed frames
+	fragmentExtLen = 12 // Size of packet id, total length and offset that follow header of fragments
+	streamExtLen   = 4  // Size of stream id that follows header of stream frames
+	// Longest header, with all the extensions
+	maxHeaderLen = HeaderLenV2 + rawLenSize + fragmentExtLen + streamExtLen
+)
+
+var (
+	packetPrefix = []byte{83, 79, 70, 83, 79, 70, 10}
+	// prefixFallback[i] is length of the longest proper suffix of packetPrefix[:i] that is also its prefix
+	prefixFallback = []int{0, 0, 0, 0, 1, 2, 3}
+	crcTable       = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrChecksum happen when CRC32C trailer of frame does not match its header and data
+	ErrChecksum = errors.New("Frame checksum mismatch")
+	// ErrFrameTooLarge happen when data of outgoing packet is larger than max frame size that peer accepts
+	ErrFrameTooLarge = errors.New("Frame is larger than peer max frame size")
+	// ErrFragment happen when a fragment does not continue the packet that it belongs to
+	ErrFragment = errors.New("Fragment is out of order")
+
+	// Reasons of invalid headers, they are reported in ResyncError
+	ErrFrameVersion  = errors.New("Unknown frame version or flags")
+	ErrMessageType   = errors.New("Unknown message type")
+	ErrFrameLength   = errors.New("Frame is longer than limit of its type")
+	ErrFragmentRange = errors.New("Fragment is outside of its packet")
+)
+
+// FrameError report a frame that is dropped by socket. Connection is still usable after this error
+type FrameError struct {
+	Type byte
+	Err  error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("Invalid frame of type %d: %s", e.Type, e.Err.Error())
+}
+
+// Unwrap return the reason of error
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// frameHeader hold parsed header of v1 and v2 frames
+type frameHeader struct {
+	version byte
+	flags   byte
+	typ     byte
+	length  int // Length of data on wire
+	rawLen  int // Length of data after decompression, only set for compressed frames
+	frag    fragmentInfo
+	stream  uint32 // Zero is the default stream
+}
+
+// fragmentInfo locate data of a fragment frame in the packet that it belongs to.
+// Zero total means frame is not a fragment
+type fragmentInfo struct {
+	id     uint32 // Sender-assigned id of the packet, unique among packets in transfer
+	total  int    // Length of data of the whole packet
+	offset int    // Position of fragment data in the whole packet
+	last   bool   // Fragment ends the packet, set by parseHeader
+}
+
+func (f fragmentInfo) isFragment() bool {
+	return f.total > 0
+}
+
+// dataLen return length of frame data after decompression
+func (hdr frameHeader) dataLen() int {
+	if hdr.flags&flagCompressed != 0 {
+		return hdr.rawLen
+	}
+	return hdr.length
+}
+
+// headerLen return length of header based on its first byte
+func headerLen(first byte) int {
+	if first&versionMarker == 0 {
+		return HeaderLen
+	}
+	n := HeaderLenV2
+	if first&flagCompressed != 0 {
+		n += rawLenSize
+	}
+	if first&flagFragment != 0 {
+		n += fragmentExtLen
+	}
+	if first&flagStream != 0 {
+		n += streamExtLen
+	}
+	return n
+}
+
+// parseHeader parse and validate complete header against max length of message types.
+// Fragments are validated against fragLimits, the max length of reassembled packet of each type.
+// Types that are not in fragLimits can be fragmented up to their msgTypeLen. Error is the reason of invalid header
+func parseHeader(h []byte, msgTypeLen map[byte]int, fragLimits map[byte]int) (frameHeader, error) {
+	hdr := frameHeader{version: FrameV1}
+	if h[0]&versionMarker == 0 {
+		hdr.typ = h[0]
+		hdr.length = int(binary.LittleEndian.Uint32(h[1:]))
+	} else {
+		hdr.version = (h[0] & versionMask) >> 4
+		hdr.flags = h[0] & flagsMask
+		if hdr.version != FrameV2 || hdr.flags&^knownFlags != 0 {
+			return hdr, ErrFrameVersion
+		}
+		hdr.typ = h[1]
+		hdr.length = int(binary.LittleEndian.Uint32(h[2:]))
+		ext := h[HeaderLenV2:]
+		if hdr.flags&flagCompressed != 0 {
+			hdr.rawLen = int(binary.LittleEndian.Uint32(ext))
+			ext = ext[rawLenSize:]
+		}
+		if hdr.flags&flagFragment != 0 {
+			hdr.frag = fragmentInfo{
+				id:     binary.LittleEndian.Uint32(ext),
+				total:  int(binary.LittleEndian.Uint32(ext[4:])),
+				offset: int(binary.LittleEndian.Uint32(ext[8:])),
+			}
+			ext = ext[fragmentExtLen:]
+		}
+		if hdr.flags&flagStream != 0 {
+			hdr.stream = binary.LittleEndian.Uint32(ext)
+		}
+	}
+	maxLen, ok := msgTypeLen[hdr.typ]
+	if isControl(hdr.typ) {
+		// Control frames are never fragmented and belong to no stream
+		maxLen, ok = controlLen, hdr.flags&(flagFragment|flagStream) == 0
+	}
+	if !ok {
+		return hdr, ErrMessageType
+	}
+	if hdr.flags&flagFragment != 0 {
+		if limit, ok := fragLimits[hdr.typ]; ok {
+			maxLen = limit
+		}
+		// Fragment must lie inside the packet, and the packet must not exceed the limit of its type
+		frag := hdr.frag
+		if maxLen < frag.total {
+			return hdr, ErrFrameLength
+		}
+		if frag.total <= 0 || hdr.length > frag.total ||
+			frag.offset >= frag.total || hdr.dataLen() > frag.total-frag.offset {
+			return hdr, ErrFragmentRange
+		}
+		hdr.frag.last = frag.offset+hdr.dataLen() == frag.total
+		return hdr, nil
+	}
+	if maxLen < hdr.length {
+		return hdr, ErrFrameLength
+	}
+	// Limit is checked against decompressed size, so a small frame cannot expand to a huge packet
+	if hdr.flags&flagCompressed != 0 && maxLen < hdr.rawLen {
+		return hdr, ErrFrameLength
+	}
+	return hdr, nil
+}
+
+// bodyLen return count of bytes after header, data and trailer
+func (hdr frameHeader) bodyLen() int {
+	if hdr.flags&flagChecksum != 0 {
+		return hdr.length + checksumLen
+	}
+	return hdr.length
+}
+
+// frameChecksum calculate CRC32C of header and data
+func frameChecksum(header []byte, data []byte) uint32 {
+	return crc32.Update(crc32.Checksum(header, crcTable), crcTable, data)
+}
+
+// encodeFrame compose bytes of packet as it must be sent on wire
+// V1 frame structure is prefix, one byte type, four bytes little endian length and data
+// V2 frame structure is prefix, version/flags byte, type, length, data and CRC32C of header and data
+func encodeFrame(pkt Packet, version byte) ([]byte, error) {
+	bb, err := pkt.Data()
+	if err != nil {
+		return nil, err
+	}
+	return encodeData(pkt.Type(), bb, version), nil
+}
+
+// encodeData compose frame of already serialized packet data
+func encodeData(typ byte, bb []byte, version byte) []byte {
+	if version == FrameV2 {
+		return encodeV2(typ, flagChecksum, bb, 0)
+	}
+	var e frameEncoder
+	return joinBuffers(*e.encode(typ, FrameV1, 0, bb, 0, fragmentInfo{}, 0))
+}
+
+// encodeV2 compose v2 frame with the given flags. For compressed frames bb is compressed data
+// and rawLen is length of data before compression
+func encodeV2(typ byte, flags byte, bb []byte, rawLen int) []byte {
+	var e frameEncoder
+	return joinBuffers(*e.encode(typ, FrameV2, flags, bb, rawLen, fragmentInfo{}, 0))
+}
+
+// encodeFragment compose v2 fragment frame of a part of packet data
+func encodeFragment(typ byte, flags byte, bb []byte, rawLen int, frag fragmentInfo) []byte {
+	var e frameEncoder
+	return joinBuffers(*e.encode(typ, FrameV2, flags|flagFragment, bb, rawLen, frag, 0))
+}
+
+// encodeStream compose v2 frame of packet data on a stream
+func encodeStream(typ byte, flags byte, bb []byte, stream uint32) []byte {
+	var e frameEncoder
+	return joinBuffers(*e.encode(typ, FrameV2, flags|flagStream, bb, 0, fragmentInfo{}, stream))
+}
+
+func joinBuffers(bufs net.Buffers) []byte {
+	return bytes.Join(bufs, nil)
+}
+
+// frameEncoder compose frames without copying data. Prefix, header and trailer are written in
+// arrays of encoder and data is only referenced, so buffers are valid until the next encode
+type frameEncoder struct {
+	head    [prefixLen + maxHeaderLen]byte
+	trailer [checksumLen]byte
+	vec     [3][]byte
+	bufs    net.Buffers
+}
+
+// encode return buffers of a frame. Flags are only used in v2 frames, frag is only used with flagFragment
+// and stream is only used with flagStream
+func (e *frameEncoder) encode(typ byte, version byte, flags byte, bb []byte, rawLen int, frag fragmentInfo, stream uint32) *net.Buffers {
+	copy(e.head[:], packetPrefix)
+	if version != FrameV2 {
+		e.head[prefixLen] = typ
+		binary.LittleEndian.PutUint32(e.head[prefixLen+1:], uint32(len(bb)))
+		e.vec[0] = e.head[:prefixLen+HeaderLen]
+		e.vec[1] = bb
+		e.bufs = e.vec[:2]
+		return &e.bufs
+	}
+	hLen := headerLen(versionMarker | flags)
+	header := e.head[prefixLen : prefixLen+hLen]
+	header[0] = versionMarker | FrameV2<<4 | flags
+	header[1] = typ
+	binary.LittleEndian.PutUint32(header[2:], uint32(len(bb)))
+	ext := header[HeaderLenV2:]
+	if flags&flagCompressed != 0 {
+		binary.LittleEndian.PutUint32(ext, uint32(rawLen))
+		ext = ext[rawLenSize:]
+	}
+	if flags&flagFragment != 0 {
+		binary.LittleEndian.PutUint32(ext, frag.id)
+		binary.LittleEndian.PutUint32(ext[4:], uint32(frag.total))
+		binary.LittleEndian.PutUint32(ext[8:], uint32(frag.offset))
+		ext = ext[fragmentExtLen:]
+	}
+	if flags&flagStream != 0 {
+		binary.LittleEndian.PutUint32(ext, stream)
+	}
+	e.vec[0] = e.head[:prefixLen+hLen]
+	e.vec[1] = bb
+	e.bufs = e.vec[:2]
+	if flags&flagChecksum != 0 {
+		binary.LittleEndian.PutUint32(e.trailer[:], frameChecksum(header, bb))
+		e.vec[2] = e.trailer[:]
+		e.bufs = e.vec[:3]
+	}
+	return &e.bufs
+}
+
+// isPacketConn report whether connection preserve message boundaries (like unixpacket).
+// On these connections a read with a smaller buffer than the written message lose the remaining bytes
+func isPacketConn(conn net.Conn) bool {
+	addr := conn.LocalAddr()
+	return addr != nil && addr.Network() == "unixpacket"
+}
+
+// chunkWriter split each write to chunks no longer than size.
+// It used for message oriented connections, so peer with read buffer of the same size never truncate a message
+type chunkWriter struct {
+	w    io.Writer
+	size int
+}
+
+func (cw chunkWriter) Write(bb []byte) (int, error) {
+	total := 0
+	for len(bb) > 0 {
+		n := len(bb)
+		if n > cw.size {
+			n = cw.size
+		}
+		nn, err := cw.w.Write(bb[:n])
+		total += nn
+		if err != nil {
+			return total, err
+		}
+		bb = bb[n:]
+	}
+	return total, nil
+}
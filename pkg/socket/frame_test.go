@@ -0,0 +1,149 @@
+package socket
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEncodeFrame(t *testing.T) {
+	msgTypeLen := map[byte]int{1: 0, 3: 1024}
+	var tests = []rDataPacket{
+		{typ: 1, data: nil},
+		{typ: 3, data: []byte{1, 2, 3}},
+		{typ: 3, data: []byte{83, 79, 70, 83, 79, 70, 10, 1, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		bb, err := encodeFrame(tt, FrameV1)
+		if err != nil {
+			t.Fatalf("encodeFrame: unexpected error %s", err)
+		}
+		if !bytes.HasPrefix(bb, packetPrefix) || len(bb) != prefixLen+HeaderLen+len(tt.data) {
+			t.Errorf("encodeFrame: invalid frame %v", bb)
+		}
+		pi := packetInspector{}
+		pi.resetVariables()
+		actual := pi.inspect(bb, msgTypeLen)
+		if !checkEqRData(actual, []rDataPacket{tt}) {
+			t.Errorf("encodeFrame: expected %v, actual %v", tt, actual)
+		}
+	}
+}
+
+func TestEncodeFrameV2(t *testing.T) {
+	msgTypeLen := map[byte]int{1: 0, 3: 1024}
+	var tests = []rDataPacket{
+		{typ: 1, data: nil},
+		{typ: 3, data: []byte{1, 2, 3}},
+		{typ: 3, data: []byte{83, 79, 70, 83, 79, 70, 10, 1, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		bb, err := encodeFrame(tt, FrameV2)
+		if err != nil {
+			t.Fatalf("encodeFrame: unexpected error %s", err)
+		}
+		if len(bb) != prefixLen+HeaderLenV2+len(tt.data)+checksumLen || bb[prefixLen] != 0xA1 {
+			t.Errorf("encodeFrame: invalid v2 frame %v", bb)
+		}
+		pi := packetInspector{}
+		pi.resetVariables()
+		actual := pi.inspect(bb, msgTypeLen)
+		if !checkEqRData(actual, []rDataPacket{tt}) || actual[0].version != FrameV2 || actual[0].err != nil {
+			t.Errorf("encodeFrame: expected %v, actual %v", tt, actual)
+		}
+	}
+}
+
+func TestInspectV2(t *testing.T) {
+	msgTypeLen := map[byte]int{1: 0, 2: 0, 3: 1024}
+	v1, _ := encodeFrame(rDataPacket{typ: 2}, FrameV1)
+	v2, _ := encodeFrame(rDataPacket{typ: 3, data: []byte{1, 2, 3, 4, 5}}, FrameV2)
+	corrupted := append([]byte{}, v2...)
+	corrupted[prefixLen+HeaderLenV2+2] ^= 0xFF
+	badCRC := append([]byte{}, v2...)
+	badCRC[len(badCRC)-1] ^= 0xFF
+	unknownVersion := append([]byte{}, v2...)
+	unknownVersion[prefixLen] = versionMarker | 3<<4 | flagChecksum
+	onStream := encodeStream(3, flagChecksum, []byte{1, 2, 3, 4, 5}, 9)
+	// Control frames belong to no stream
+	controlOnStream := encodeStream(pingType, 0, make([]byte, controlLen), 9)
+
+	join := func(frames ...[]byte) []byte {
+		return bytes.Join(frames, nil)
+	}
+	var tests = []struct {
+		name     string
+		stream   []byte
+		expected []rDataPacket
+		errCnt   int
+	}{
+		{"v1 and v2 mixed", join(v1, v2, v1), []rDataPacket{{typ: 2}, {typ: 3, data: []byte{1, 2, 3, 4, 5}}, {typ: 2}}, 0},
+		{"corrupted data", join(v1, corrupted, v1), []rDataPacket{{typ: 2}, {typ: 3}, {typ: 2}}, 1},
+		{"corrupted trailer", join(badCRC, v2), []rDataPacket{{typ: 3}, {typ: 3, data: []byte{1, 2, 3, 4, 5}}}, 1},
+		{"unknown version", join(unknownVersion, v1), []rDataPacket{{typ: 2}}, 0},
+		{"stream", join(onStream, v1), []rDataPacket{{typ: 3, data: []byte{1, 2, 3, 4, 5}, stream: 9}, {typ: 2}}, 0},
+		{"control on stream", join(controlOnStream, v2), []rDataPacket{{typ: 3, data: []byte{1, 2, 3, 4, 5}}}, 0},
+	}
+	for _, tt := range tests {
+		// Feed stream in all possible two part splits
+		for split := 0; split <= len(tt.stream); split++ {
+			pi := packetInspector{}
+			pi.resetVariables()
+			actual := pi.inspect(tt.stream[:split], msgTypeLen)
+			actual = append(actual, pi.inspect(tt.stream[split:], msgTypeLen)...)
+			errCnt := 0
+			for _, pkt := range actual {
+				if pkt.err != nil {
+					errCnt++
+					if !Recoverable(pkt.err) || !errors.Is(pkt.err, ErrChecksum) {
+						t.Errorf("%s: not expected error %s", tt.name, pkt.err)
+					}
+				}
+			}
+			if !checkEqRData(actual, tt.expected) || errCnt != tt.errCnt {
+				t.Errorf("%s (split %d): expected %v, actual %v", tt.name, split, tt.expected, actual)
+			}
+		}
+	}
+}
+
+type recordWriter struct {
+	writes [][]byte
+}
+
+func (w *recordWriter) Write(bb []byte) (int, error) {
+	w.writes = append(w.writes, append([]byte{}, bb...))
+	return len(bb), nil
+}
+
+func TestChunkWriter(t *testing.T) {
+	var tests = []struct {
+		size     int
+		data     []byte
+		expected int // Expected count of writes
+	}{
+		{4, []byte{}, 0},
+		{4, []byte{1, 2, 3}, 1},
+		{4, []byte{1, 2, 3, 4}, 1},
+		{4, []byte{1, 2, 3, 4, 5}, 2},
+		{2, []byte{1, 2, 3, 4, 5, 6, 7}, 4},
+	}
+	for _, tt := range tests {
+		rw := &recordWriter{}
+		n, err := chunkWriter{w: rw, size: tt.size}.Write(tt.data)
+		if err != nil || n != len(tt.data) {
+			t.Fatalf("chunkWriter: expected %d bytes written, actual %d, %v", len(tt.data), n, err)
+		}
+		if len(rw.writes) != tt.expected {
+			t.Errorf("chunkWriter: expected %d writes, actual %d", tt.expected, len(rw.writes))
+		}
+		for _, w := range rw.writes {
+			if len(w) > tt.size {
+				t.Errorf("chunkWriter: chunk %d bytes is longer than %d", len(w), tt.size)
+			}
+		}
+		if !bytes.Equal(bytes.Join(rw.writes, nil), tt.data) {
+			t.Errorf("chunkWriter: data changed")
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrStarted happen when a socket that is already started is started again
+var ErrStarted = errors.New("Socket is already started")
+
+// Handler receive events of a socket that is started with StartHandler, instead of channels of Start.
+// Methods are called from go routines of socket, so they may run concurrently. Packets are passed to
+// OnPacket in the order they are read, and a slow OnPacket slows down reading. Methods may call
+// methods of socket, even Close
+type Handler interface {
+	// OnPacket is called for each packet that is read
+	OnPacket(RData)
+	// OnWritten is called for each packet that is written to connection
+	OnWritten(WData)
+	// OnError is called for each problem of socket. After a problem that is not Recoverable and is not
+	// ErrUndelivered, socket is closed
+	OnError(ProbData)
+	// OnClose is called once after socket is closed, no other method is called after it. err is the problem
+	// that closed socket, error of ctx when ctx is done, or nil when socket is closed by Close or Shutdown
+	OnClose(id uint64, err error)
+}
+
+// StartHandler start socket with a handler. Socket is closed when ctx is done.
+// It returns ErrStarted when socket is already started by Start or StartHandler
+func (s *TCPSocket) StartHandler(ctx context.Context, h Handler, msgTypeLen map[byte]int) error {
+	if !atomic.CompareAndSwapInt32(&s.started, 0, 1) {
+		return ErrStarted
+	}
+	s.handler = h
+	s.run(msgTypeLen)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.close(ctx.Err())
+		case <-s.closeGoes:
+		}
+		// Go routines of socket may still report problems and undelivered packets
+		s.running.Wait()
+		h.OnClose(s.ID(), s.closeErr)
+	}()
+	return nil
+}
+
+// deliver pass a read packet to owner of socket. It returns false when socket is closed while
+// owner is not ready for the packet
+func (s *TCPSocket) deliver(rData RData) bool {
+	if s.handler != nil {
+		s.handler.OnPacket(rData)
+		return true
+	}
+	select {
+	case s.readChan <- rData:
+		return true
+	case <-s.closeGoes:
+		return false
+	}
+}
+
+// written tell owner of socket that a packet is written
+func (s *TCPSocket) written(wData WData) {
+	if s.handler != nil {
+		s.handler.OnWritten(wData)
+		return
+	}
+	s.writeChan <- wData
+}
+
+// report pass a problem to owner of socket. With a handler, socket is closed after a problem that
+// is not recoverable, because no owner closes it
+func (s *TCPSocket) report(prob ProbData) {
+	if s.handler == nil {
+		s.probChan <- prob
+		return
+	}
+	s.handler.OnError(prob)
+	if !Recoverable(prob.Err) && !errors.Is(prob.Err, ErrUndelivered) {
+		s.close(prob.Err)
+	}
+}
+
+// reportOpen pass a problem to owner of socket, unless socket is closed while owner is not ready for it
+func (s *TCPSocket) reportOpen(prob ProbData) {
+	if s.handler != nil {
+		s.report(prob)
+		return
+	}
+	select {
+	case s.probChan <- prob:
+	case <-s.closeGoes:
+	}
+}
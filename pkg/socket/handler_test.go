@@ -0,0 +1,105 @@
+package socket
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// chanHandler pass events of socket to channels, so tests wait for them
+type chanHandler struct {
+	read    chan RData
+	written chan WData
+	probs   chan ProbData
+	closed  chan error
+}
+
+func newChanHandler() *chanHandler {
+	return &chanHandler{
+		read:    make(chan RData, 10),
+		written: make(chan WData, 10),
+		probs:   make(chan ProbData, 10),
+		closed:  make(chan error, 1),
+	}
+}
+
+func (h *chanHandler) OnPacket(rData RData)         { h.read <- rData }
+func (h *chanHandler) OnWritten(wData WData)        { h.written <- wData }
+func (h *chanHandler) OnError(prob ProbData)        { h.probs <- prob }
+func (h *chanHandler) OnClose(id uint64, err error) { h.closed <- err }
+
+func TestStartHandler(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	msgTypeLen := map[byte]int{3: 10}
+	srv := NewConnSocket(srvConn, 1, 10, 1024, 1024)
+	cli := NewConnSocket(cliConn, 2, 10, 1024, 1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	srvHandler, cliHandler := newChanHandler(), newChanHandler()
+	if err := srv.StartHandler(ctx, srvHandler, msgTypeLen); err != nil {
+		t.Fatalf("Socket not started. Error %v", err)
+	}
+	if err := cli.StartHandler(context.Background(), cliHandler, msgTypeLen); err != nil {
+		t.Fatalf("Socket not started. Error %v", err)
+	}
+	defer cli.Close()
+	if err := srv.StartHandler(ctx, srvHandler, msgTypeLen); err != ErrStarted {
+		t.Fatalf("Socket started twice. Error %v", err)
+	}
+
+	cli.Send(rDataPacket{typ: 3, data: []byte{1, 2, 3}})
+	select {
+	case rData := <-srvHandler.read:
+		if data, _ := rData.Pkt.Data(); len(data) != 3 || rData.SourceID != 1 {
+			t.Fatalf("Unexpected packet %v", rData)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Packet not passed to handler")
+	}
+	select {
+	case <-cliHandler.written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write not passed to handler")
+	}
+
+	// Context controls lifetime of socket
+	cancel()
+	select {
+	case err := <-srvHandler.closed:
+		if err != context.Canceled {
+			t.Fatalf("Expected close by context, actual %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Socket not closed when context is done")
+	}
+	if err := srv.TrySend(rDataPacket{typ: 3}); err != ErrClosed {
+		t.Fatalf("Send on closed socket. Error %v", err)
+	}
+}
+
+func TestHandlerClosedByProblem(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	srv := NewConnSocket(srvConn, 1, 10, 1024, 1024)
+	h := newChanHandler()
+	srv.StartHandler(context.Background(), h, map[byte]int{3: 10})
+	cliConn.Close()
+
+	var closeErr error
+	select {
+	case closeErr = <-h.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Socket not closed after problem")
+	}
+	if closeErr == nil {
+		t.Fatal("Problem that closed socket not passed to OnClose")
+	}
+	// Problem is reported before OnClose
+	reported := false
+	for len(h.probs) > 0 {
+		prob := <-h.probs
+		reported = reported || prob.Err == closeErr
+	}
+	if !reported {
+		t.Fatalf("Problem %v not reported before OnClose", closeErr)
+	}
+}
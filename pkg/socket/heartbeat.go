@@ -0,0 +1,98 @@
+package socket
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Message types reserved for control frames of socket. They are handled by socket itself
+	// and never reach the owner of socket
+	pingType byte = 0xFE
+	pongType byte = 0xFF
+	// Data of ping is the time it is sent, pong echoes it
+	controlLen = 8
+
+	// DefaultHeartbeatInterval is how often socket pings its peer when heartbeat is agreed
+	DefaultHeartbeatInterval = 30 * time.Second
+	// DefaultMaxMissedPongs is how many pings may stay unanswered before connection is closed
+	DefaultMaxMissedPongs = 3
+)
+
+// ErrHeartbeatTimeout happen when peer does not answer pings, connection is considered dead
+var ErrHeartbeatTimeout = errors.New("Peer does not answer heartbeat")
+
+// isControl report whether type is reserved for control frames
+func isControl(typ byte) bool {
+	return typ == pingType || typ == pongType || typ == windowType || typ == closeStreamType
+}
+
+// heartbeat ping peer at each interval when heartbeat feature is agreed. A ping that is not answered
+// before the next one is missed, and after maxMissedPongs misses in a row the connection is reported dead
+func (s *TCPSocket) heartbeat() {
+	defer s.running.Done()
+	ticker := time.NewTicker(s.heartbeatInterval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-s.closeGoes:
+			return
+		case <-ticker.C:
+		}
+		if !s.Capabilities().Has(FeatureHeartbeat) {
+			continue
+		}
+		if atomic.LoadInt64(&s.pingSent) != 0 {
+			missed++
+			if missed >= s.maxMissedPongs {
+				s.countProb(ErrHeartbeatTimeout)
+				s.reportOpen(ProbData{SourceID: s.ID(), Err: ErrHeartbeatTimeout})
+				return
+			}
+		} else {
+			missed = 0
+		}
+		now := time.Now().UnixNano()
+		atomic.StoreInt64(&s.pingSent, now)
+		s.sendControl(pingType, now)
+	}
+}
+
+// sendControl queue a control frame. Control frames skip the send queue, so they are not delayed
+// by queued packets. When control queue is full the frame is dropped, peer pings again
+func (s *TCPSocket) sendControl(typ byte, stamp int64) {
+	data := make([]byte, controlLen)
+	binary.LittleEndian.PutUint64(data, uint64(stamp))
+	select {
+	case s.ctrlQueue <- rDataPacket{typ: typ, data: data}:
+	default:
+	}
+}
+
+// handleControl answer ping of peer, measure round trip time from pong and apply control frames of streams
+func (s *TCPSocket) handleControl(pkt rDataPacket) {
+	if len(pkt.data) != controlLen {
+		return
+	}
+	if pkt.typ == windowType || pkt.typ == closeStreamType {
+		s.handleStreamControl(pkt)
+		return
+	}
+	stamp := int64(binary.LittleEndian.Uint64(pkt.data))
+	if pkt.typ == pingType {
+		s.sendControl(pongType, stamp)
+		return
+	}
+	// Pong of an older ping is ignored, that ping is already counted as missed
+	if stamp != 0 && atomic.CompareAndSwapInt64(&s.pingSent, stamp, 0) {
+		atomic.StoreInt64(&s.rtt, time.Now().UnixNano()-stamp)
+	}
+}
+
+// RTT return round trip time measured by the last answered ping. It is zero before the first pong
+func (s *TCPSocket) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
@@ -0,0 +1,227 @@
+package socket
+
+import (
+	"encoding/binary"
+)
+
+// slabSize is size of memory that data of small packets is carved from. Slabs are never reused,
+// so packets can outlive the inspector
+const slabSize = 16 * 1024
+
+// packetInspector extract frames from the stream of bytes read from connection.
+// Bytes before packetPrefix are dropped and an invalid header cause inspector to search for the next prefix,
+// both are kept in resync events.
+// Data of each packet is allocated once with its final size and handed over to the packet,
+// so packets never share memory with the read buffer
+type packetInspector struct {
+	completeFindPrefix bool
+	partialFindPrefix  bool
+	headerVerified     bool
+	prevPrefixCnt      int
+	lastIndexPrefix    int
+	currentPkgLen      int
+	curPkgHeader       []byte
+	curPkg             []byte
+	header             frameHeader // Parsed header of current package, valid when headerVerified is true
+	headerBuf          [maxHeaderLen]byte
+	fragLimits         map[byte]int // Max length of reassembled packet of each type, see parseHeader
+	scratch            *[]byte      // Pooled buffer that holds compressed body until it is decompressed
+	slab               []byte       // Free part of current slab
+	// Invalid headers and bytes that are skipped because they are not part of a valid frame.
+	// They are never reset
+	resyncs   uint64
+	discarded uint64
+	skipped   int            // Bytes before prefix that are not in events yet
+	garbage   int            // Bytes that are skipped since the last valid header
+	events    []*ResyncError // Resyncs since events were taken by decoder
+}
+
+func (pi *packetInspector) resetVariables() {
+	pi.completeFindPrefix = false
+	pi.partialFindPrefix = false
+	pi.headerVerified = false
+	pi.prevPrefixCnt = 0
+	pi.lastIndexPrefix = 0
+	pi.currentPkgLen = 0
+	pi.curPkgHeader = pi.headerBuf[:0]
+	pi.curPkg = nil
+	pi.header = frameHeader{}
+	if pi.scratch != nil {
+		putBuf(pi.scratch)
+		pi.scratch = nil
+	}
+}
+
+// packet create packet from body of current frame, verify its checksum and decompress its data.
+// When body is not owned by inspector (it is part of the read buffer) data is copied
+func (pi *packetInspector) packet(body []byte, owned bool) rDataPacket {
+	pkt := rDataPacket{typ: pi.header.typ, version: pi.header.version, frag: pi.header.frag, stream: pi.header.stream}
+	data := body[:pi.header.length]
+	if pi.header.flags&flagChecksum != 0 &&
+		frameChecksum(pi.curPkgHeader, data) != binary.LittleEndian.Uint32(body[pi.header.length:]) {
+		pkt.err = &FrameError{Type: pi.header.typ, Err: ErrChecksum}
+		return pkt
+	}
+	if pi.header.flags&flagCompressed != 0 {
+		raw, err := decompress(data, pi.header.rawLen)
+		if err != nil {
+			pkt.err = &FrameError{Type: pi.header.typ, Err: err}
+			return pkt
+		}
+		data = raw
+	} else if !owned {
+		data = append(pi.alloc(len(data)), data...)
+	}
+	pkt.data = data
+	return pkt
+}
+
+// alloc return an empty slice with capacity n for data of a packet.
+// Small packets share a slab, so reading many small packets costs one allocation per slab
+func (pi *packetInspector) alloc(n int) []byte {
+	if n > slabSize/4 {
+		return make([]byte, 0, n)
+	}
+	if n > cap(pi.slab) {
+		pi.slab = make([]byte, slabSize)
+	}
+	res := pi.slab[:0:n]
+	pi.slab = pi.slab[n:]
+	return res
+}
+
+// startBody allocate body of a frame that continues in the next reads
+func (pi *packetInspector) startBody(bb []byte) {
+	if pi.header.flags&flagCompressed != 0 {
+		// Compressed body is only needed until decompression
+		pi.scratch = getBuf(pi.currentPkgLen)
+		pi.curPkg = append(*pi.scratch, bb...)
+		return
+	}
+	pi.curPkg = append(pi.alloc(pi.currentPkgLen), bb...)
+}
+
+// findPrefix search packetPrefix in bb. Matched bytes at the end of bb are kept in prevPrefixCnt,
+// so search continues in the next buffer. On mismatch it falls back to the longest matched part that is
+// also start of the prefix (like "SOF" in "SOFSOF"), so no prefix is missed whatever the read boundaries are
+func (pi *packetInspector) findPrefix(bb []byte) {
+	if pi.completeFindPrefix {
+		return
+	}
+	matched := pi.prevPrefixCnt
+	for i, b := range bb {
+		for matched > 0 && packetPrefix[matched] != b {
+			matched = prefixFallback[matched]
+		}
+		if packetPrefix[matched] == b {
+			matched++
+		}
+		if matched == prefixLen {
+			// Matched bytes of previous buffers and bytes of bb before the prefix are skipped
+			pi.skip(pi.prevPrefixCnt + i + 1 - prefixLen)
+			pi.completeFindPrefix = true
+			pi.partialFindPrefix = false
+			pi.prevPrefixCnt = 0
+			pi.lastIndexPrefix = i
+			return
+		}
+	}
+	pi.skip(pi.prevPrefixCnt + len(bb) - matched)
+	pi.partialFindPrefix = matched > 0
+	pi.prevPrefixCnt = matched
+}
+
+// skip count n bytes before prefix that are dropped
+func (pi *packetInspector) skip(n int) {
+	pi.discarded += uint64(n)
+	pi.skipped += n
+	pi.garbage += n
+}
+
+func (pi *packetInspector) inspect(bb []byte, msgTypeLen map[byte]int) []rDataPacket {
+	return pi.feed(make([]rDataPacket, 0), bb, msgTypeLen)
+}
+
+// feed process bytes read from connection and append the completed packets to res.
+// Each iteration handles one frame, the loop continues with the bytes after it
+func (pi *packetInspector) feed(res []rDataPacket, bb []byte, msgTypeLen map[byte]int) []rDataPacket {
+	for len(bb) > 0 {
+		dataStartIndex := 0
+		if !pi.completeFindPrefix {
+			pi.findPrefix(bb)
+			if !pi.completeFindPrefix {
+				return res
+			}
+			dataStartIndex = pi.lastIndexPrefix + 1
+			if pi.skipped > 0 {
+				pi.events = append(pi.events, &ResyncError{Skipped: pi.skipped, Reason: ErrNoPrefix})
+				pi.skipped = 0
+			}
+		}
+		if dataStartIndex >= len(bb) {
+			//after finding prefix we reach to the end of slice
+			return res
+		}
+		if !pi.headerVerified {
+			endOfHeader := 0
+			// Length of header depends on its first byte (v1 or versioned header)
+			first := bb[dataStartIndex]
+			if len(pi.curPkgHeader) > 0 {
+				first = pi.curPkgHeader[0]
+			}
+			hLen := headerLen(first)
+			if len(pi.curPkgHeader) < hLen {
+				// Incomplete header
+				if (len(pi.curPkgHeader) + len(bb[dataStartIndex:])) < hLen {
+					pi.curPkgHeader = append(pi.curPkgHeader, bb[dataStartIndex:]...)
+					return res
+				}
+				endOfHeader = dataStartIndex + (hLen - len(pi.curPkgHeader))
+				pi.curPkgHeader = append(pi.curPkgHeader, bb[dataStartIndex:endOfHeader]...)
+			}
+			header, err := parseHeader(pi.curPkgHeader, msgTypeLen, pi.fragLimits)
+			if err != nil {
+				// Version, message type or message len is not valid. Search continues after the prefix,
+				// so prefix and header bytes of previous buffers are skipped
+				n := prefixLen + len(pi.curPkgHeader) - (endOfHeader - dataStartIndex)
+				pi.resyncs++
+				pi.discarded += uint64(n)
+				pi.garbage += n
+				pi.events = append(pi.events, &ResyncError{
+					Skipped: n,
+					Reason:  err,
+					Header:  append([]byte(nil), pi.curPkgHeader...),
+				})
+				pi.resetVariables()
+				bb = bb[dataStartIndex:]
+				continue
+			}
+			pi.header = header
+			pi.headerVerified = true
+			pi.garbage = 0
+			pi.currentPkgLen = header.bodyLen()
+			dataStartIndex = endOfHeader
+			if pi.currentPkgLen <= len(bb[dataStartIndex:]) {
+				res = append(res, pi.packet(bb[dataStartIndex:dataStartIndex+pi.currentPkgLen], false))
+				dataStartIndex += pi.currentPkgLen
+				pi.resetVariables()
+				bb = bb[dataStartIndex:]
+				continue
+			}
+			pi.startBody(bb[dataStartIndex:])
+			return res
+		}
+		// Message prefix and header find previously
+		// so just append to current package and search for next package
+		if pi.currentPkgLen > len(pi.curPkg)+len(bb) {
+			pi.curPkg = append(pi.curPkg, bb...)
+			return res
+		}
+		remainLen := pi.currentPkgLen - len(pi.curPkg)
+		pi.curPkg = append(pi.curPkg, bb[0:remainLen]...)
+		res = append(res, pi.packet(pi.curPkg, true))
+		pi.resetVariables()
+		bb = bb[remainLen:]
+	}
+	return res
+}
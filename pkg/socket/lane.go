@@ -0,0 +1,138 @@
+package socket
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Lane is a priority lane of send queue. Each lane is a FIFO queue with its own depth, and writer
+// takes packets from lanes by their weights, so one kind of traffic does not wait behind another
+type Lane int
+
+const (
+	// LaneControl is for signalling like handshake, it has the largest weight
+	LaneControl Lane = iota
+	// LaneInteractive is for small request and response messages. Types without a lane use it
+	LaneInteractive
+	// LaneBulk is for large messages like relay bodies
+	LaneBulk
+	numLanes
+)
+
+// DefaultLaneWeights is how many packets writer takes from each lane in turn when all lanes have packets
+var DefaultLaneWeights = map[Lane]int{
+	LaneControl:     8,
+	LaneInteractive: 4,
+	LaneBulk:        1,
+}
+
+var laneNames = map[string]Lane{
+	"control":     LaneControl,
+	"interactive": LaneInteractive,
+	"bulk":        LaneBulk,
+}
+
+// ParseLane convert name of lane (as it is written in config files) to Lane
+func ParseLane(name string) (Lane, error) {
+	lane, ok := laneNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return 0, fmt.Errorf("Unknown lane %q", name)
+	}
+	return lane, nil
+}
+
+// ParseLaneMap convert a map from name of lane to a number, like lane depths in config files
+func ParseLaneMap(values map[string]int) (map[Lane]int, error) {
+	res := make(map[Lane]int)
+	for name, value := range values {
+		lane, err := ParseLane(name)
+		if err != nil {
+			return nil, err
+		}
+		res[lane] = value
+	}
+	return res, nil
+}
+
+// laneScheduler is a weighted round robin over lanes. Current lane is served until its credit is
+// used or it is empty, then the next lane gets credit as much as its weight
+type laneScheduler struct {
+	weights [numLanes]int
+	lane    Lane
+	credit  int
+}
+
+// next return the next packet of lanes, or nil when all lanes are empty. It never waits
+func (sch *laneScheduler) next(lanes *[numLanes]chan Packet) Packet {
+	// Current lane may have no credit, so each lane is visited once after it
+	for i := 0; i <= int(numLanes); i++ {
+		if sch.credit > 0 {
+			select {
+			case pkt := <-lanes[sch.lane]:
+				sch.credit--
+				return pkt
+			default:
+			}
+		}
+		sch.lane = (sch.lane + 1) % numLanes
+		sch.credit = sch.weights[sch.lane]
+	}
+	return nil
+}
+
+// took account a packet that writer took from lane while it was waiting for packets
+func (sch *laneScheduler) took(lane Lane) {
+	sch.lane = lane
+	sch.credit = sch.weights[lane] - 1
+}
+
+// laneOf return lane of a packet. Control frames of socket are always in control lane
+func (s *TCPSocket) laneOf(typ byte) Lane {
+	if isControl(typ) {
+		return LaneControl
+	}
+	if lane, ok := s.typeLanes[typ]; ok {
+		return lane
+	}
+	return LaneInteractive
+}
+
+// SetLanes assign message types to lanes. Types that are not set are sent in LaneInteractive
+// It must be called before Start
+func (s *TCPSocket) SetLanes(lanes map[byte]Lane) {
+	s.typeLanes = make(map[byte]Lane)
+	for typ, lane := range lanes {
+		if lane >= 0 && lane < numLanes {
+			s.typeLanes[typ] = lane
+		}
+	}
+}
+
+// SetLaneDepths set how many packets each lane holds. Lanes that are not set keep the send queue size
+// of socket. It must be called before any packet is sent
+func (s *TCPSocket) SetLaneDepths(depths map[Lane]int) {
+	for lane, depth := range depths {
+		if lane >= 0 && lane < numLanes && depth > 0 {
+			s.lanes[lane] = make(chan Packet, depth)
+		}
+	}
+}
+
+// SetLaneWeights set how many packets writer takes from each lane in turn. Lanes that are not set keep
+// their default weight. It must be called before Start
+func (s *TCPSocket) SetLaneWeights(weights map[Lane]int) {
+	for lane, weight := range weights {
+		if lane >= 0 && lane < numLanes && weight > 0 {
+			s.sched.weights[lane] = weight
+		}
+	}
+}
+
+// queuedLen return number of packets in all lanes
+func (s *TCPSocket) queuedLen() int {
+	n := 0
+	for _, q := range s.lanes {
+		n += len(q)
+	}
+	return n
+}
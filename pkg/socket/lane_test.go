@@ -0,0 +1,52 @@
+package socket
+
+import "testing"
+
+func TestParseLane(t *testing.T) {
+	var tests = []struct {
+		name      string
+		expected  Lane
+		expectErr bool
+	}{
+		{"control", LaneControl, false},
+		{" Interactive", LaneInteractive, false},
+		{"BULK", LaneBulk, false},
+		{"", 0, true},
+		{"urgent", 0, true},
+	}
+	for _, tt := range tests {
+		lane, err := ParseLane(tt.name)
+		if (err != nil) != tt.expectErr || (err == nil && lane != tt.expected) {
+			t.Errorf("ParseLane(%q): expected %d-%t, actual %d-%v", tt.name, tt.expected, tt.expectErr, lane, err)
+		}
+	}
+	if _, err := ParseLaneMap(map[string]int{"bulk": 2, "slow": 1}); err == nil {
+		t.Error("ParseLaneMap: unknown lane accepted")
+	}
+}
+
+func TestLaneScheduler(t *testing.T) {
+	var lanes [numLanes]chan Packet
+	for lane := range lanes {
+		lanes[lane] = make(chan Packet, 3)
+		for i := 0; i < 3; i++ {
+			lanes[lane] <- rDataPacket{typ: byte(lane)}
+		}
+	}
+	sch := laneScheduler{weights: [numLanes]int{2, 1, 1}, lane: numLanes - 1}
+	// Lanes are served by their weights, and empty lanes give their turn to the others
+	expected := []Lane{LaneControl, LaneControl, LaneInteractive, LaneBulk, LaneControl, LaneInteractive, LaneBulk, LaneInteractive, LaneBulk}
+	for i, lane := range expected {
+		pkt := sch.next(&lanes)
+		if pkt == nil || Lane(pkt.Type()) != lane {
+			t.Fatalf("Packet %d: expected lane %d, actual %v", i, lane, pkt)
+		}
+	}
+	if pkt := sch.next(&lanes); pkt != nil {
+		t.Fatalf("Packet taken from empty lanes %v", pkt)
+	}
+	lanes[LaneBulk] <- rDataPacket{typ: byte(LaneBulk)}
+	if pkt := sch.next(&lanes); pkt == nil || Lane(pkt.Type()) != LaneBulk {
+		t.Fatalf("Packet of bulk lane not taken %v", pkt)
+	}
+}
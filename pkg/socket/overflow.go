@@ -0,0 +1,53 @@
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrQueueFull happen when send queue of socket has no room for a packet
+	ErrQueueFull = errors.New("Send queue of socket is full")
+	// ErrClosed happen when packet is sent to a closed socket
+	ErrClosed = errors.New("Socket is closed")
+	// ErrUndelivered is reported for each queued packet that is not written before socket is closed
+	ErrUndelivered = errors.New("Packet is not delivered before socket closed")
+)
+
+// OverflowPolicy specifies what socket does with a packet when its send queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes Send wait until queue has room. TrySend fails with ErrQueueFull
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the packet that is being sent
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest queued packet to make room for the new one, and reports it
+	// through ProbData with ErrQueueFull like other dropped frames
+	OverflowDropOldest
+	// OverflowDisconnect drops the packet and reports ErrQueueFull through ProbData,
+	// so owner of socket closes a peer that does not keep up
+	OverflowDisconnect
+)
+
+var overflowPolicyNames = map[string]OverflowPolicy{
+	"block":       OverflowBlock,
+	"drop-newest": OverflowDropNewest,
+	"drop-oldest": OverflowDropOldest,
+	"disconnect":  OverflowDisconnect,
+}
+
+// ParseOverflowPolicy convert name of policy (as it is written in config files) to OverflowPolicy.
+// Empty name is OverflowBlock
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return OverflowBlock, nil
+	}
+	policy, ok := overflowPolicyNames[name]
+	if !ok {
+		return 0, fmt.Errorf("Unknown overflow policy %q", name)
+	}
+	return policy, nil
+}
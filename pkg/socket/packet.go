@@ -3,7 +3,11 @@ package socket
 // HeaderLen is Length for header of frames
 const HeaderLen int = 5
 
+// HeaderLenV2 is length of header of v2 frames, version/flags byte added before type
+const HeaderLenV2 int = 6
+
 // Packet define standrd for message type
+// Type of packets must be less than 0x80, the higher values are reserved to mark versioned frames
 type Packet interface {
 	Type() byte
 	Data() ([]byte, error)
@@ -0,0 +1,303 @@
+package socket
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPipeBufferSize is how many bytes one side of pipe writes before the other side reads them
+	DefaultPipeBufferSize = 64 * 1024
+	// Queue and buffer sizes of sockets of Pipe, when PipeConfig does not set them
+	defaultPipeQueueSize = 32
+	defaultPipeIOSize    = 8192
+)
+
+// PipeConfig configure connection and sockets of Pipe. Zero values use defaults
+type PipeConfig struct {
+	// Delay of each write before peer can read it
+	Latency time.Duration
+	// Bytes of each direction that are written but not read yet. Writes block when buffer is full
+	BufferSize int
+	// Faults that both connections inject, see FaultConn. Second connection uses Seed+2, so sides
+	// get different faults. Nil injects no fault
+	Faults *Faults
+	// Sizes that are passed to constructor of sockets
+	SendQueueSize int
+	ReadBufSize   int
+	WriteBufSize  int
+}
+
+// Pipe create two connected sockets in memory. Frames go through the same encoder and inspector as
+// network connections. Sockets have no id, call SetID before adding them to a hub
+func Pipe(conf PipeConfig) (*TCPSocket, *TCPSocket) {
+	c1, c2 := PipeConns(conf)
+	queueSize, readBufSize, writeBufSize := conf.SendQueueSize, conf.ReadBufSize, conf.WriteBufSize
+	if queueSize <= 0 {
+		queueSize = defaultPipeQueueSize
+	}
+	if readBufSize <= 0 {
+		readBufSize = defaultPipeIOSize
+	}
+	if writeBufSize <= 0 {
+		writeBufSize = defaultPipeIOSize
+	}
+	return newTCPSocket(c1, 0, queueSize, readBufSize, writeBufSize),
+		newTCPSocket(c2, 0, queueSize, readBufSize, writeBufSize)
+}
+
+// PipeConns create two connected in memory connections with latency and buffer of conf.
+// Unlike net.Pipe, writes return when data is buffered. Connections support deadlines and CloseWrite
+func PipeConns(conf PipeConfig) (net.Conn, net.Conn) {
+	size := conf.BufferSize
+	if size <= 0 {
+		size = DefaultPipeBufferSize
+	}
+	b1 := newPipeBuffer(size, conf.Latency)
+	b2 := newPipeBuffer(size, conf.Latency)
+	c1 := &pipeConn{in: b1, out: b2, done: make(chan struct{}), readDeadline: makePipeDeadline(), writeDeadline: makePipeDeadline()}
+	c2 := &pipeConn{in: b2, out: b1, done: make(chan struct{}), readDeadline: makePipeDeadline(), writeDeadline: makePipeDeadline()}
+	if conf.Faults == nil {
+		return c1, c2
+	}
+	faults := *conf.Faults
+	f1 := NewFaultConn(c1, faults)
+	faults.Seed += 2
+	return f1, NewFaultConn(c2, faults)
+}
+
+// pipeChunk is data of one write, it is readable after at
+type pipeChunk struct {
+	data []byte
+	at   time.Time
+}
+
+// pipeBuffer is one direction of pipe
+type pipeBuffer struct {
+	mutx    sync.Mutex
+	chunks  []pipeChunk
+	size    int // Buffered bytes
+	limit   int
+	latency time.Duration
+	eof     bool          // Writer closed, reader gets EOF after buffered data
+	broken  bool          // Reader closed, writes fail
+	changed chan struct{} // Closed and replaced when state changes, so waiters check again
+}
+
+func newPipeBuffer(limit int, latency time.Duration) *pipeBuffer {
+	return &pipeBuffer{limit: limit, latency: latency, changed: make(chan struct{})}
+}
+
+// notify wake waiters of buffer, mutx must be held
+func (b *pipeBuffer) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *pipeBuffer) closeWrite() {
+	b.mutx.Lock()
+	b.eof = true
+	b.notify()
+	b.mutx.Unlock()
+}
+
+func (b *pipeBuffer) closeRead() {
+	b.mutx.Lock()
+	b.broken = true
+	b.notify()
+	b.mutx.Unlock()
+}
+
+type pipeConn struct {
+	in            *pipeBuffer
+	out           *pipeBuffer
+	done          chan struct{}
+	closeOnce     sync.Once
+	readDeadline  pipeDeadline
+	writeDeadline pipeDeadline
+}
+
+func (c *pipeConn) Read(bb []byte) (int, error) {
+	b := c.in
+	for {
+		select {
+		case <-c.done:
+			return 0, io.ErrClosedPipe
+		default:
+		}
+		b.mutx.Lock()
+		var delay <-chan time.Time
+		if len(b.chunks) > 0 {
+			wait := time.Until(b.chunks[0].at)
+			if wait <= 0 {
+				n := copy(bb, b.chunks[0].data)
+				if b.chunks[0].data = b.chunks[0].data[n:]; len(b.chunks[0].data) == 0 {
+					b.chunks[0] = pipeChunk{}
+					b.chunks = b.chunks[1:]
+				}
+				b.size -= n
+				b.notify()
+				b.mutx.Unlock()
+				return n, nil
+			}
+			delay = time.After(wait)
+		} else if b.eof {
+			b.mutx.Unlock()
+			return 0, io.EOF
+		}
+		changed := b.changed
+		b.mutx.Unlock()
+		select {
+		case <-changed:
+		case <-delay:
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.done:
+			return 0, io.ErrClosedPipe
+		}
+	}
+}
+
+func (c *pipeConn) Write(bb []byte) (int, error) {
+	b := c.out
+	total := 0
+	for {
+		select {
+		case <-c.done:
+			return total, io.ErrClosedPipe
+		case <-c.writeDeadline.wait():
+			return total, os.ErrDeadlineExceeded
+		default:
+		}
+		b.mutx.Lock()
+		if b.eof || b.broken {
+			b.mutx.Unlock()
+			return total, io.ErrClosedPipe
+		}
+		if room := b.limit - b.size; room > 0 && len(bb) > 0 {
+			n := len(bb)
+			if n > room {
+				n = room
+			}
+			chunk := pipeChunk{data: append([]byte(nil), bb[:n]...)}
+			if b.latency > 0 {
+				chunk.at = time.Now().Add(b.latency)
+			}
+			b.chunks = append(b.chunks, chunk)
+			b.size += n
+			b.notify()
+			total += n
+			bb = bb[n:]
+		}
+		if len(bb) == 0 {
+			b.mutx.Unlock()
+			return total, nil
+		}
+		changed := b.changed
+		b.mutx.Unlock()
+		select {
+		case <-changed:
+		case <-c.writeDeadline.wait():
+			return total, os.ErrDeadlineExceeded
+		case <-c.done:
+			return total, io.ErrClosedPipe
+		}
+	}
+}
+
+// CloseWrite tell peer that no more data is written, peer reads EOF after the buffered data
+func (c *pipeConn) CloseWrite() error {
+	c.out.closeWrite()
+	return nil
+}
+
+func (c *pipeConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.out.closeWrite()
+		c.in.closeRead()
+	})
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return pipeAddr{} }
+func (c *pipeConn) RemoteAddr() net.Addr { return pipeAddr{} }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// pipeDeadline is a deadline that can be changed while an operation waits for it
+type pipeDeadline struct {
+	mutx   sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // Closed when deadline passes
+}
+
+func makePipeDeadline() pipeDeadline {
+	return pipeDeadline{cancel: make(chan struct{})}
+}
+
+// set deadline, zero time means no deadline
+func (d *pipeDeadline) set(t time.Time) {
+	d.mutx.Lock()
+	defer d.mutx.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Timer already fired, wait until it closes cancel
+	}
+	d.timer = nil
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait return a channel that is closed when deadline passes
+func (d *pipeDeadline) wait() chan struct{} {
+	d.mutx.Lock()
+	defer d.mutx.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
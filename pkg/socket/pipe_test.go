@@ -0,0 +1,115 @@
+package socket
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPipe(t *testing.T) {
+	msgTypeLen := map[byte]int{3: 1024}
+	s1, s2 := Pipe(PipeConfig{})
+	s1.SetID(1)
+	s2.SetID(2)
+	read1, read2 := make(chan RData, 10), make(chan RData, 10)
+	prob2 := make(chan ProbData, 10)
+	s1.Start(make(chan WData, 10), read1, make(chan ProbData, 10), msgTypeLen)
+	s2.Start(make(chan WData, 10), read2, prob2, msgTypeLen)
+	defer s1.Close()
+	defer s2.Close()
+
+	s1.Send(rDataPacket{typ: 3, data: []byte{1, 2, 3}})
+	s2.Send(rDataPacket{typ: 3, data: []byte{4, 5}})
+	for _, tt := range []struct {
+		read     chan RData
+		sourceID uint64
+		len      int
+	}{{read2, 2, 3}, {read1, 1, 2}} {
+		select {
+		case rData := <-tt.read:
+			if data, _ := rData.Pkt.Data(); rData.SourceID != tt.sourceID || len(data) != tt.len {
+				t.Fatalf("Unexpected packet %v", rData)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Packet not passed through pipe")
+		}
+	}
+
+	// Shutdown half-closes pipe, so peer reads every frame before EOF
+	for i := 0; i < 5; i++ {
+		s1.Send(rDataPacket{typ: 3, data: []byte{byte(i)}})
+	}
+	go func() {
+		// Peer closes its side when it reads EOF
+		prob := <-prob2
+		if prob.Err != io.EOF {
+			t.Errorf("Expected EOF, actual %v", prob.Err)
+		}
+		s2.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s1.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed. Error %v", err)
+	}
+	if len(read2) != 5 {
+		t.Fatalf("Expected 5 packets before EOF, actual %d", len(read2))
+	}
+}
+
+func TestPipeLatency(t *testing.T) {
+	latency := 50 * time.Millisecond
+	c1, c2 := PipeConns(PipeConfig{Latency: latency})
+	defer c1.Close()
+	defer c2.Close()
+	start := time.Now()
+	c1.Write([]byte{1, 2, 3})
+	bb := make([]byte, 10)
+	n, err := c2.Read(bb)
+	if err != nil || n != 3 {
+		t.Fatalf("Expected 3 bytes, actual %d. Error %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Fatalf("Data read after %v, latency is %v", elapsed, latency)
+	}
+}
+
+func TestPipeBuffer(t *testing.T) {
+	c1, c2 := PipeConns(PipeConfig{BufferSize: 10})
+	defer c2.Close()
+	if n, err := c1.Write(make([]byte, 10)); n != 10 || err != nil {
+		t.Fatalf("Write to buffer failed. %d bytes written, error %v", n, err)
+	}
+	// Full buffer blocks writer until peer reads
+	c1.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if n, err := c1.Write([]byte{1}); n != 0 || err != os.ErrDeadlineExceeded {
+		t.Fatalf("Write to full buffer not blocked. %d bytes written, error %v", n, err)
+	}
+	c1.SetWriteDeadline(time.Time{})
+	done := make(chan error)
+	go func() {
+		_, err := c1.Write(make([]byte, 15))
+		c1.Close()
+		done <- err
+	}()
+	total := 0
+	bb := make([]byte, 4)
+	for {
+		n, err := c2.Read(bb)
+		total += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed. Error %v", err)
+		}
+	}
+	if err := <-done; err != nil || total != 25 {
+		t.Fatalf("Expected 25 bytes, actual %d. Write error %v", total, err)
+	}
+	if _, err := c2.Write([]byte{1}); err != io.ErrClosedPipe {
+		t.Fatalf("Write to closed peer. Error %v", err)
+	}
+}
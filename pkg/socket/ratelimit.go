@@ -0,0 +1,209 @@
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRateLimited happen when traffic of socket is over its rate limit
+var ErrRateLimited = errors.New("Rate limit exceeded")
+
+// RateLimit is max rate of traffic of socket in one direction. Zero fields are not limited.
+// Bursts up to one second of traffic are allowed
+type RateLimit struct {
+	BytesPerSec  int
+	FramesPerSec int
+}
+
+// RateLimitAction specifies what socket does with a packet that is over rate limit
+type RateLimitAction int
+
+const (
+	// RateLimitDelay waits until rate allows the packet. For inbound traffic socket stops reading,
+	// so peer is slowed down by TCP backpressure
+	RateLimitDelay RateLimitAction = iota
+	// RateLimitDrop drops the packet and reports it as a recoverable FrameError
+	RateLimitDrop
+	// RateLimitDisconnect reports RateLimitError, so owner of socket closes the connection
+	RateLimitDisconnect
+)
+
+var rateLimitActionNames = map[string]RateLimitAction{
+	"delay":      RateLimitDelay,
+	"drop":       RateLimitDrop,
+	"disconnect": RateLimitDisconnect,
+}
+
+// ParseRateLimitAction convert name of action (as it is written in config files) to RateLimitAction.
+// Empty name is RateLimitDelay
+func ParseRateLimitAction(name string) (RateLimitAction, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return RateLimitDelay, nil
+	}
+	action, ok := rateLimitActionNames[name]
+	if !ok {
+		return 0, fmt.Errorf("Unknown rate limit action %q", name)
+	}
+	return action, nil
+}
+
+// RateLimitError is reported when socket is disconnected because of its rate limit
+type RateLimitError struct {
+	Inbound bool
+	Limit   RateLimit
+}
+
+func (e *RateLimitError) Error() string {
+	direction := "Outbound"
+	if e.Inbound {
+		direction = "Inbound"
+	}
+	return fmt.Sprintf("%s rate limit of %d bytes and %d frames per second exceeded", direction, e.Limit.BytesPerSec, e.Limit.FramesPerSec)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// tokenBucket allow rate tokens per second with burst of one second. Zero rate is not limited
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) tokenBucket {
+	return tokenBucket{rate: float64(rate), tokens: float64(rate)}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+}
+
+// allow report whether n tokens are available. Request larger than burst is allowed when bucket is full
+func (b *tokenBucket) allow(n int, now time.Time) bool {
+	if b.rate == 0 {
+		return true
+	}
+	b.refill(now)
+	need := float64(n)
+	if need > b.rate {
+		need = b.rate
+	}
+	return b.tokens >= need
+}
+
+// take remove n tokens. Tokens may become negative, then the next requests wait for them
+func (b *tokenBucket) take(n int) {
+	if b.rate > 0 {
+		b.tokens -= float64(n)
+	}
+}
+
+// wait return how long caller must wait until bucket has tokens again
+func (b *tokenBucket) wait() time.Duration {
+	if b.rate == 0 || b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimiter limit bytes and frames of one direction. It is used only by one go routine
+type rateLimiter struct {
+	limit  RateLimit
+	bytes  tokenBucket
+	frames tokenBucket
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.BytesPerSec <= 0 && limit.FramesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		limit:  limit,
+		bytes:  newTokenBucket(limit.BytesPerSec),
+		frames: newTokenBucket(limit.FramesPerSec),
+	}
+}
+
+// allow take tokens of a packet if both rates allow it
+func (l *rateLimiter) allow(size int, now time.Time) bool {
+	if !l.bytes.allow(size, now) || !l.frames.allow(1, now) {
+		return false
+	}
+	l.bytes.take(size)
+	l.frames.take(1)
+	return true
+}
+
+// reserve take tokens of a packet and return how long caller must wait before it is sent or read
+func (l *rateLimiter) reserve(size int, now time.Time) time.Duration {
+	l.bytes.refill(now)
+	l.frames.refill(now)
+	l.bytes.take(size)
+	l.frames.take(1)
+	wait := l.bytes.wait()
+	if w := l.frames.wait(); w > wait {
+		wait = w
+	}
+	return wait
+}
+
+// SetRateLimits set max rate of packets that socket reads and writes, and what it does with packets
+// over the limit. It must be called before Start
+func (s *TCPSocket) SetRateLimits(in RateLimit, out RateLimit, action RateLimitAction) {
+	s.inLimit = newRateLimiter(in)
+	s.outLimit = newRateLimiter(out)
+	s.rateAction = action
+}
+
+// RateLimited return number of read and written packets that were over rate limit of socket
+func (s *TCPSocket) RateLimited() (in uint64, out uint64) {
+	return atomic.LoadUint64(&s.inLimited), atomic.LoadUint64(&s.outLimited)
+}
+
+// limitRate apply rate limit of one direction to a packet of size bytes. It returns how long packet must wait
+// with RateLimitDelay, or the error that must be reported when packet is over limit with other actions
+func (s *TCPSocket) limitRate(l *rateLimiter, counter *uint64, inbound bool, pkt Packet, size int) (time.Duration, error) {
+	if l == nil {
+		return 0, nil
+	}
+	now := time.Now()
+	if s.rateAction == RateLimitDelay {
+		wait := l.reserve(size, now)
+		if wait > 0 {
+			atomic.AddUint64(counter, 1)
+		}
+		return wait, nil
+	}
+	if l.allow(size, now) {
+		return 0, nil
+	}
+	atomic.AddUint64(counter, 1)
+	if s.rateAction == RateLimitDrop {
+		return 0, &FrameError{Type: pkt.Type(), Err: ErrRateLimited}
+	}
+	return 0, &RateLimitError{Inbound: inbound, Limit: l.limit}
+}
+
+// sleep wait for d. It returns false when socket is closed meanwhile
+func (s *TCPSocket) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.closeGoes:
+		return false
+	}
+}
@@ -0,0 +1,145 @@
+package socket
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimitAction(t *testing.T) {
+	var tests = []struct {
+		name      string
+		expected  RateLimitAction
+		expectErr bool
+	}{
+		{"", RateLimitDelay, false},
+		{"delay", RateLimitDelay, false},
+		{" Drop ", RateLimitDrop, false},
+		{"disconnect", RateLimitDisconnect, false},
+		{"block", 0, true},
+	}
+	for _, tt := range tests {
+		action, err := ParseRateLimitAction(tt.name)
+		if (err != nil) != tt.expectErr || (err == nil && action != tt.expected) {
+			t.Errorf("ParseRateLimitAction(%q): expected %d-%t, actual %d-%v", tt.name, tt.expected, tt.expectErr, action, err)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	if newRateLimiter(RateLimit{}) != nil {
+		t.Fatal("Limiter created without limits")
+	}
+	now := time.Now()
+	l := newRateLimiter(RateLimit{BytesPerSec: 100, FramesPerSec: 10})
+	// Burst of one second is allowed
+	for i := 0; i < 10; i++ {
+		if !l.allow(10, now) {
+			t.Fatalf("Packet %d of burst not allowed", i)
+		}
+	}
+	if l.allow(1, now) {
+		t.Fatal("Packet over frame rate allowed")
+	}
+	now = now.Add(100 * time.Millisecond)
+	if !l.allow(10, now) || l.allow(10, now) {
+		t.Fatal("Tokens not refilled by rate")
+	}
+	// Packet larger than burst is allowed when bucket is full
+	now = now.Add(time.Second)
+	if !l.allow(500, now) || l.allow(1, now.Add(time.Second)) {
+		t.Fatal("Large packet not allowed or not accounted")
+	}
+
+	l = newRateLimiter(RateLimit{BytesPerSec: 100})
+	now = time.Now()
+	if wait := l.reserve(100, now); wait != 0 {
+		t.Fatalf("Burst delayed %v", wait)
+	}
+	if wait := l.reserve(50, now); wait != 500*time.Millisecond {
+		t.Fatalf("Expected wait of 500ms, actual %v", wait)
+	}
+}
+
+func TestRateLimitedSocket(t *testing.T) {
+	var tests = []struct {
+		action    RateLimitAction
+		delivered int
+	}{
+		{RateLimitDrop, 5},
+		{RateLimitDisconnect, 5},
+	}
+	for _, tt := range tests {
+		cliConn, srvConn := net.Pipe()
+		msgTypeLen := map[byte]int{3: 10}
+		srv := NewConnSocket(srvConn, 1, 10, 1024, 1024)
+		cli := NewConnSocket(cliConn, 2, 20, 1024, 1024)
+		srv.SetRateLimits(RateLimit{FramesPerSec: 5}, RateLimit{}, tt.action)
+		for i := 0; i < 10; i++ {
+			cli.Send(rDataPacket{typ: 3, data: []byte{byte(i)}})
+		}
+		srvRead := make(chan RData, 20)
+		srvProb := make(chan ProbData, 20)
+		srv.Start(make(chan WData, 10), srvRead, srvProb, msgTypeLen)
+		cli.Start(make(chan WData, 20), make(chan RData, 10), make(chan ProbData, 10), msgTypeLen)
+
+		for i := 0; i < tt.delivered; i++ {
+			select {
+			case <-srvRead:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Action %d: packet %d in rate not received", tt.action, i)
+			}
+		}
+		select {
+		case prob := <-srvProb:
+			if !errors.Is(prob.Err, ErrRateLimited) || Recoverable(prob.Err) != (tt.action == RateLimitDrop) {
+				t.Fatalf("Action %d: unexpected problem %v", tt.action, prob.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Action %d: packet over rate not reported", tt.action)
+		}
+		if in, out := srv.RateLimited(); in == 0 || out != 0 {
+			t.Fatalf("Action %d: unexpected rate limited counters %d-%d", tt.action, in, out)
+		}
+		select {
+		case rData := <-srvRead:
+			t.Fatalf("Action %d: packet over rate delivered %v", tt.action, rData)
+		default:
+		}
+		srv.Close()
+		cli.Close()
+	}
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	msgTypeLen := map[byte]int{3: 10}
+	srv := NewConnSocket(srvConn, 1, 10, 1024, 1024)
+	cli := NewConnSocket(cliConn, 2, 20, 1024, 1024)
+	cli.SetRateLimits(RateLimit{}, RateLimit{FramesPerSec: 20}, RateLimitDelay)
+	srvRead := make(chan RData, 30)
+	srv.Start(make(chan WData, 10), srvRead, make(chan ProbData, 10), msgTypeLen)
+	cli.Start(make(chan WData, 30), make(chan RData, 10), make(chan ProbData, 10), msgTypeLen)
+	defer srv.Close()
+	defer cli.Close()
+
+	start := time.Now()
+	for i := 0; i < 25; i++ {
+		cli.Send(rDataPacket{typ: 3, data: []byte{byte(i)}})
+	}
+	for i := 0; i < 25; i++ {
+		select {
+		case <-srvRead:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Packet %d not received", i)
+		}
+	}
+	// Burst of 20 frames is sent at once, the other 5 are sent in rate
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("Packets over rate not delayed, all sent in %v", elapsed)
+	}
+	if _, out := cli.RateLimited(); out == 0 || out > 5 {
+		t.Fatalf("Expected up to 5 delayed packets, actual %d", out)
+	}
+}
@@ -0,0 +1,40 @@
+package socket
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNoPrefix is reason of bytes that are skipped because they are not preceded by frame prefix
+	ErrNoPrefix = errors.New("Bytes before frame prefix")
+	// ErrGarbageLimit happen when peer sends more bytes than garbage limit of socket without a valid frame.
+	// Peer probably speaks another protocol, so the connection is closed
+	ErrGarbageLimit = errors.New("Too many bytes without a valid frame")
+)
+
+// ResyncError report bytes of stream that reader skipped to find the next frame. Connection is still usable
+// after this error, it is a diagnostic of a peer that sends corrupted or foreign data
+type ResyncError struct {
+	Skipped int    // Bytes that are dropped
+	Reason  error  // ErrNoPrefix, or the reason of invalid header
+	Header  []byte // The invalid header, nil for ErrNoPrefix
+}
+
+func (e *ResyncError) Error() string {
+	if e.Header == nil {
+		return fmt.Sprintf("%d bytes skipped: %s", e.Skipped, e.Reason.Error())
+	}
+	return fmt.Sprintf("%d bytes skipped: %s. Header % x", e.Skipped, e.Reason.Error(), e.Header)
+}
+
+// Unwrap return the reason of resync
+func (e *ResyncError) Unwrap() error {
+	return e.Reason
+}
+
+// SetGarbageLimit set how many bytes peer may send without a valid frame before connection is reported
+// with ErrGarbageLimit. Zero is not limited. It must be called before Start
+func (s *TCPSocket) SetGarbageLimit(limit int) {
+	s.garbageLimit = limit
+}
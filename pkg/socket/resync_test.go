@@ -0,0 +1,105 @@
+package socket
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResyncEvents(t *testing.T) {
+	msgTypeLen := map[byte]int{3: 1024}
+	stream, discarded := garbageStream()
+	expected := []ResyncError{
+		{Skipped: 5, Reason: ErrNoPrefix},
+		{Skipped: prefixLen, Reason: ErrMessageType, Header: []byte{9, 0, 0, 0, 0}},
+		// Header of unknown frame is searched for prefix again
+		{Skipped: HeaderLen, Reason: ErrNoPrefix},
+	}
+	for _, bufSize := range []int{1, 7, 4096} {
+		dec := newFrameDecoder(bytes.NewReader(stream), bufSize, msgTypeLen, nil)
+		actual := make([]ResyncError, 0)
+		skipped := 0
+		for {
+			pkt, err := dec.Decode()
+			if err != nil {
+				break
+			}
+			var resyncErr *ResyncError
+			if errors.As(pkt.err, &resyncErr) {
+				actual = append(actual, *resyncErr)
+				skipped += resyncErr.Skipped
+			}
+		}
+		dec.Release()
+		if len(actual) != len(expected) || uint64(skipped) != discarded {
+			t.Fatalf("Buffer %d: expected %d events of %d bytes, actual %v", bufSize, len(expected), discarded, actual)
+		}
+		for i := range expected {
+			if actual[i].Reason != expected[i].Reason || !bytes.Equal(actual[i].Header, expected[i].Header) {
+				t.Errorf("Buffer %d: expected event %v, actual %v", bufSize, expected[i], actual[i])
+			}
+			// Header bytes of previous reads are not searched again, so they are skipped with the header
+			if bufSize > len(stream) && actual[i].Skipped != expected[i].Skipped {
+				t.Errorf("Expected %d skipped bytes, actual %d", expected[i].Skipped, actual[i].Skipped)
+			}
+		}
+	}
+}
+
+func TestParseHeaderReasons(t *testing.T) {
+	msgTypeLen := map[byte]int{3: 10}
+	var tests = []struct {
+		name     string
+		header   []byte
+		expected error
+	}{
+		{"valid", []byte{3, 10, 0, 0, 0}, nil},
+		{"unknown type", []byte{4, 0, 0, 0, 0}, ErrMessageType},
+		{"over length", []byte{3, 11, 0, 0, 0}, ErrFrameLength},
+		{"unknown version", []byte{0xB1, 3, 0, 0, 0, 0}, ErrFrameVersion},
+		{"fragmented control", append([]byte{0xA4, pingType, 1, 0, 0, 0}, make([]byte, fragmentExtLen)...), ErrMessageType},
+	}
+	for _, tt := range tests {
+		if _, err := parseHeader(tt.header, msgTypeLen, nil); err != tt.expected {
+			t.Errorf("%s: expected %v, actual %v", tt.name, tt.expected, err)
+		}
+	}
+}
+
+func TestGarbageLimit(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	msgTypeLen := map[byte]int{3: 1024}
+	srv := NewConnSocket(srvConn, 1, 10, 1024, 1024)
+	srv.SetGarbageLimit(1000)
+	srvProb := make(chan ProbData, 10)
+	srv.Start(make(chan WData, 10), make(chan RData, 10), srvProb, msgTypeLen)
+	defer srv.Close()
+	defer cliConn.Close()
+
+	// Garbage below the limit is tolerated, count restarts after a valid frame
+	valid, _ := encodeFrame(rDataPacket{typ: 3, data: []byte{1}}, FrameV1)
+	go func() {
+		cliConn.Write(append(bytes.Repeat([]byte{1}, 900), valid...))
+		cliConn.Write(bytes.Repeat([]byte{1}, 900))
+		cliConn.Write(bytes.Repeat([]byte{1}, 900))
+	}()
+	for {
+		select {
+		case prob := <-srvProb:
+			if Recoverable(prob.Err) {
+				continue
+			}
+			if !errors.Is(prob.Err, ErrGarbageLimit) {
+				t.Fatalf("Unexpected problem %v", prob.Err)
+			}
+			if st := srv.Stats(); st.DiscardedBytes < 1800 || st.In.Frames != 1 {
+				t.Fatalf("Connection closed before garbage limit. Stats %+v", st)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("Garbage limit not reported")
+		}
+	}
+}
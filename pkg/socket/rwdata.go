@@ -1,5 +1,7 @@
 package socket
 
+import "errors"
+
 // WData hold inforamtion wrote frame result
 type WData struct {
 	Pkt      Packet
@@ -10,6 +12,7 @@ type WData struct {
 type RData struct {
 	Pkt      Packet
 	SourceID uint64
+	Stream   uint32 // Stream that packet is read from, zero is the default stream
 }
 
 // ProbData hold inforamtion problem on socket
@@ -19,9 +22,20 @@ type ProbData struct {
 	Err      error
 }
 
+// Recoverable report whether problem only dropped a frame or skipped bytes, and socket is still usable
+func Recoverable(err error) bool {
+	var frameErr *FrameError
+	var resyncErr *ResyncError
+	return errors.As(err, &frameErr) || errors.As(err, &resyncErr)
+}
+
 type rDataPacket struct {
-	typ  byte
-	data []byte
+	typ     byte
+	data    []byte
+	version byte         // Frame version that packet received in
+	err     error        // Set when frame is received but it is not valid
+	frag    fragmentInfo // Set when packet is a fragment that is not reassembled yet
+	stream  uint32
 }
 
 func (pkt rDataPacket) Type() byte {
@@ -1,10 +1,21 @@
 package socket
 
-//Socket define standard for communication channel
+import "context"
+
+// Socket define standard for communication channel
 type Socket interface {
 	Start(chan<- WData, chan<- RData, chan<- ProbData, map[byte]int)
+	StartHandler(ctx context.Context, h Handler, msgTypeLen map[byte]int) error
 	Close() error
+	Shutdown(ctx context.Context) error
 	ID() uint64
 	SetID(uint64)
 	Send(frm Packet)
+	TrySend(frm Packet) error
+	SendContext(ctx context.Context, frm Packet) error
+	SetCapabilities(Capabilities)
+	Stats() Stats
+	SetManualCredit(manual bool)
+	GrantCredit(stream uint32, n int)
+	CloseStream(stream uint32)
 }
@@ -0,0 +1,167 @@
+package socket
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TrafficStats is amount of traffic in one direction
+type TrafficStats struct {
+	Bytes  uint64 // Data of packets before compression, frame headers are not included
+	Frames uint64 // Number of packets, a fragmented packet is counted once
+}
+
+func (t *TrafficStats) add(other TrafficStats) {
+	t.Bytes += other.Bytes
+	t.Frames += other.Frames
+}
+
+// Stats is statistics of a socket since it is created. Control frames of socket are not counted as traffic
+type Stats struct {
+	ConnectedAt time.Time
+	LastRead    time.Time // Zero before the first read frame
+	LastWrite   time.Time // Zero before the first write
+	In          TrafficStats
+	Out         TrafficStats
+	InByType    map[byte]TrafficStats
+	OutByType   map[byte]TrafficStats
+	// Packets that wait in send queue and the largest number of packets that ever waited in it
+	QueueDepth     int
+	QueueHighWater int
+	// Invalid headers that made reader search for the next frame, and bytes that reader skipped
+	// because they are not part of a valid frame
+	Resyncs        uint64
+	DiscardedBytes uint64
+	FrameErrors    uint64 // Frames that are dropped because of checksum, size, rate or serialization
+	Errors         uint64 // Problems that broke the connection
+	Dropped        uint64 // Packets that are dropped by overflow policy
+	RateLimitedIn  uint64
+	RateLimitedOut uint64
+}
+
+// Add sum statistics of another socket to st. Times are the earliest connect and the latest read and write,
+// QueueHighWater is the largest of both
+func (st *Stats) Add(other Stats) {
+	if st.ConnectedAt.IsZero() || (!other.ConnectedAt.IsZero() && other.ConnectedAt.Before(st.ConnectedAt)) {
+		st.ConnectedAt = other.ConnectedAt
+	}
+	if other.LastRead.After(st.LastRead) {
+		st.LastRead = other.LastRead
+	}
+	if other.LastWrite.After(st.LastWrite) {
+		st.LastWrite = other.LastWrite
+	}
+	st.In.add(other.In)
+	st.Out.add(other.Out)
+	st.InByType = addByType(st.InByType, other.InByType)
+	st.OutByType = addByType(st.OutByType, other.OutByType)
+	st.QueueDepth += other.QueueDepth
+	if other.QueueHighWater > st.QueueHighWater {
+		st.QueueHighWater = other.QueueHighWater
+	}
+	st.Resyncs += other.Resyncs
+	st.DiscardedBytes += other.DiscardedBytes
+	st.FrameErrors += other.FrameErrors
+	st.Errors += other.Errors
+	st.Dropped += other.Dropped
+	st.RateLimitedIn += other.RateLimitedIn
+	st.RateLimitedOut += other.RateLimitedOut
+}
+
+func addByType(dst map[byte]TrafficStats, src map[byte]TrafficStats) map[byte]TrafficStats {
+	if dst == nil {
+		dst = make(map[byte]TrafficStats)
+	}
+	for typ, t := range src {
+		sum := dst[typ]
+		sum.add(t)
+		dst[typ] = sum
+	}
+	return dst
+}
+
+// trafficCounter count traffic of one direction by message type. It is updated by reader or writer
+// go routine and read by Stats
+type trafficCounter struct {
+	mutx   sync.Mutex
+	byType map[byte]TrafficStats
+	last   int64 // Unix nanoseconds of the last frame
+}
+
+func (c *trafficCounter) add(typ byte, size int, now time.Time) {
+	c.mutx.Lock()
+	if c.byType == nil {
+		c.byType = make(map[byte]TrafficStats)
+	}
+	t := c.byType[typ]
+	t.add(TrafficStats{Bytes: uint64(size), Frames: 1})
+	c.byType[typ] = t
+	c.mutx.Unlock()
+	c.touch(now)
+}
+
+// touch set time of the last frame
+func (c *trafficCounter) touch(now time.Time) {
+	atomic.StoreInt64(&c.last, now.UnixNano())
+}
+
+// snapshot return total traffic, a copy of traffic by type and time of the last frame
+func (c *trafficCounter) snapshot() (TrafficStats, map[byte]TrafficStats, time.Time) {
+	var total TrafficStats
+	byType := make(map[byte]TrafficStats)
+	c.mutx.Lock()
+	for typ, t := range c.byType {
+		byType[typ] = t
+		total.add(t)
+	}
+	c.mutx.Unlock()
+	var last time.Time
+	if n := atomic.LoadInt64(&c.last); n != 0 {
+		last = time.Unix(0, n)
+	}
+	return total, byType, last
+}
+
+// Stats return statistics of socket. It is safe to call from any go routine
+func (s *TCPSocket) Stats() Stats {
+	st := Stats{
+		ConnectedAt:    s.connectedAt,
+		QueueDepth:     s.queuedLen(),
+		QueueHighWater: int(atomic.LoadInt64(&s.queueHighWater)),
+		Resyncs:        atomic.LoadUint64(&s.resyncs),
+		DiscardedBytes: atomic.LoadUint64(&s.discarded),
+		FrameErrors:    atomic.LoadUint64(&s.frameErrors),
+		Errors:         atomic.LoadUint64(&s.errorCount),
+		Dropped:        atomic.LoadUint64(&s.dropped),
+	}
+	st.In, st.InByType, st.LastRead = s.inTraffic.snapshot()
+	st.Out, st.OutByType, st.LastWrite = s.outTraffic.snapshot()
+	st.RateLimitedIn, st.RateLimitedOut = s.RateLimited()
+	return st
+}
+
+// countQueued update high-water mark of send queue after a packet is queued
+func (s *TCPSocket) countQueued() {
+	depth := int64(s.queuedLen())
+	for {
+		high := atomic.LoadInt64(&s.queueHighWater)
+		if depth <= high || atomic.CompareAndSwapInt64(&s.queueHighWater, high, depth) {
+			return
+		}
+	}
+}
+
+// countProb count a problem that is reported to owner of socket. Resyncs are counted by inspector
+func (s *TCPSocket) countProb(err error) {
+	var resyncErr *ResyncError
+	if errors.As(err, &resyncErr) {
+		return
+	}
+	if Recoverable(err) {
+		atomic.AddUint64(&s.frameErrors, 1)
+		return
+	}
+	atomic.AddUint64(&s.errorCount, 1)
+}
@@ -0,0 +1,116 @@
+package socket
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// garbageStream return a stream with garbage before a frame, a frame of unknown type and two valid frames.
+// Garbage, prefix and header of the unknown frame are discarded
+func garbageStream() ([]byte, uint64) {
+	garbage := []byte("xyzSO")
+	valid, _ := encodeFrame(rDataPacket{typ: 3, data: []byte{1, 2, 3}}, FrameV1)
+	unknown, _ := encodeFrame(rDataPacket{typ: 9}, FrameV1)
+	stream := append(append([]byte(nil), garbage...), valid...)
+	stream = append(append(stream, unknown...), valid...)
+	return stream, uint64(len(garbage) + len(unknown))
+}
+
+func TestInspectorDiscarded(t *testing.T) {
+	msgTypeLen := map[byte]int{3: 1024}
+	stream, discarded := garbageStream()
+	// Discarded bytes are counted once whatever the read boundaries are
+	for split := 0; split <= len(stream); split++ {
+		pi := packetInspector{}
+		pi.resetVariables()
+		pkts := pi.inspect(stream[:split], msgTypeLen)
+		pkts = append(pkts, pi.inspect(stream[split:], msgTypeLen)...)
+		if len(pkts) != 2 {
+			t.Fatalf("Split %d: expected 2 packets, actual %d", split, len(pkts))
+		}
+		if pi.resyncs != 1 || pi.discarded != discarded {
+			t.Fatalf("Split %d: expected 1 resync and %d discarded bytes, actual %d-%d", split, discarded, pi.resyncs, pi.discarded)
+		}
+	}
+}
+
+func TestSocketStats(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	msgTypeLen := map[byte]int{1: 0, 3: 1024}
+	srv := NewConnSocket(srvConn, 1, 10, 1024, 1024)
+	cli := NewConnSocket(cliConn, 2, 10, 1024, 1024)
+	for i := 0; i < 3; i++ {
+		cli.Send(rDataPacket{typ: 3, data: []byte{1, 2, 3, 4}})
+	}
+	cli.Send(rDataPacket{typ: 1})
+	if st := cli.Stats(); st.QueueDepth != 4 || st.QueueHighWater != 4 || st.ConnectedAt.IsZero() {
+		t.Fatalf("Unexpected queue stats %d-%d", st.QueueDepth, st.QueueHighWater)
+	}
+	srvRead := make(chan RData, 10)
+	cliWrite := make(chan WData, 10)
+	srv.Start(make(chan WData, 10), srvRead, make(chan ProbData, 10), msgTypeLen)
+	cli.Start(cliWrite, make(chan RData, 10), make(chan ProbData, 10), msgTypeLen)
+	defer srv.Close()
+	defer cli.Close()
+	for i := 0; i < 4; i++ {
+		select {
+		case <-srvRead:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Packet %d not received", i)
+		}
+		<-cliWrite
+	}
+
+	for _, st := range []Stats{srv.Stats(), cli.Stats()} {
+		traffic, byType := st.In, st.InByType
+		if st.LastRead.IsZero() {
+			traffic, byType = st.Out, st.OutByType
+		}
+		if traffic.Frames != 4 || traffic.Bytes != 12 || byType[3].Frames != 3 || byType[1].Bytes != 0 {
+			t.Fatalf("Unexpected traffic %v - %v", traffic, byType)
+		}
+	}
+	if st := cli.Stats(); st.LastWrite.IsZero() || st.QueueDepth != 0 || st.QueueHighWater != 4 {
+		t.Fatalf("Unexpected write stats %v-%d-%d", st.LastWrite, st.QueueDepth, st.QueueHighWater)
+	}
+}
+
+func TestSocketStatsErrors(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	msgTypeLen := map[byte]int{3: 1024}
+	srv := NewConnSocket(srvConn, 1, 10, 1024, 1024)
+	srvRead := make(chan RData, 10)
+	srvProb := make(chan ProbData, 10)
+	srv.Start(make(chan WData, 10), srvRead, srvProb, msgTypeLen)
+	defer srv.Close()
+	defer cliConn.Close()
+
+	stream, discarded := garbageStream()
+	corrupt, _ := encodeFrame(rDataPacket{typ: 3, data: []byte{1, 2, 3}}, FrameV2)
+	corrupt[len(corrupt)-1]++
+	go cliConn.Write(append(stream, corrupt...))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-srvRead:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Packet %d not received", i)
+		}
+	}
+	for checksum := false; !checksum; {
+		select {
+		case prob := <-srvProb:
+			if !Recoverable(prob.Err) {
+				t.Fatalf("Unexpected problem %v", prob.Err)
+			}
+			checksum = errors.Is(prob.Err, ErrChecksum)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Invalid checksum not reported")
+		}
+	}
+	st := srv.Stats()
+	if st.Resyncs != 1 || st.DiscardedBytes != discarded || st.FrameErrors != 1 || st.Errors != 0 || st.In.Frames != 2 {
+		t.Fatalf("Unexpected stats %+v", st)
+	}
+}
@@ -0,0 +1,320 @@
+package socket
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// Control frames of streams. Data of both is stream id, window update adds credit after it
+	windowType      byte = 0xFD
+	closeStreamType byte = 0xFC
+
+	// StreamWindow is the credit of a stream when it is opened. Sender stops sending on a stream
+	// when its credit is used, until receiver consumes packets and gives credit back
+	StreamWindow = 256 * 1024
+)
+
+// ErrStreamBlocked happen when a stream has no credit and its queue of waiting packets is full
+var ErrStreamBlocked = errors.New("Stream has no credit and its queue is full")
+
+// streamPacket is a packet that is sent on a stream
+type streamPacket struct {
+	Packet
+	stream uint32
+}
+
+// OnStream return packet that is sent on stream. Zero is the default stream that every connection has.
+// Streams are opened by their first packet and each has its own credit, so a stream that receiver
+// does not consume does not block other streams. When streams are not agreed with peer, packets are
+// sent on the default stream
+func OnStream(stream uint32, pkt Packet) Packet {
+	pkt = PacketOf(pkt)
+	if stream == 0 {
+		return pkt
+	}
+	return streamPacket{Packet: pkt, stream: stream}
+}
+
+// StreamOf return stream of a packet that is passed to OnStream, zero for other packets
+func StreamOf(pkt Packet) uint32 {
+	switch p := pkt.(type) {
+	case streamPacket:
+		return p.stream
+	case rDataPacket:
+		return p.stream
+	}
+	return 0
+}
+
+// PacketOf return packet that is passed to OnStream, other packets are returned as they are. Owners of
+// socket use it to find their packets in WData and ProbData
+func PacketOf(pkt Packet) Packet {
+	if sp, ok := pkt.(streamPacket); ok {
+		return sp.Packet
+	}
+	return pkt
+}
+
+// streamState is flow control of one stream
+type streamState struct {
+	credit   int // Bytes that may be sent, a packet is sent when any credit is left so it can go negative
+	consumed int // Bytes that are consumed and not given back to peer yet
+}
+
+// streamOf return stream that packet is sent on. Packets are sent on the default stream when
+// streams are not agreed
+func streamOf(pkt Packet, caps Capabilities) uint32 {
+	if !caps.Has(FeatureStreams) {
+		return 0
+	}
+	return StreamOf(pkt)
+}
+
+// stream return state of a stream, it is created when stream is not open. streamMutx must be held
+func (s *TCPSocket) stream(id uint32) *streamState {
+	if s.streams == nil {
+		s.streams = make(map[uint32]*streamState)
+	}
+	st, ok := s.streams[id]
+	if !ok {
+		st = &streamState{credit: StreamWindow}
+		s.streams[id] = st
+	}
+	return st
+}
+
+// takeCredit use credit of stream for a packet of size bytes. It returns false when stream has no credit
+func (s *TCPSocket) takeCredit(id uint32, size int) bool {
+	s.streamMutx.Lock()
+	defer s.streamMutx.Unlock()
+	st := s.stream(id)
+	if st.credit <= 0 {
+		return false
+	}
+	st.credit -= size
+	return true
+}
+
+// SetManualCredit make owner of socket give credit of streams with GrantCredit when it consumes packets,
+// instead of socket giving it when packets are delivered. It must be called before Start
+func (s *TCPSocket) SetManualCredit(manual bool) {
+	s.manualCredit = manual
+}
+
+// GrantCredit tell peer that n bytes of stream are consumed, so it can send more. Credit is sent to peer
+// in batches of half a window. The default stream has no credit, it is limited by the connection itself
+func (s *TCPSocket) GrantCredit(stream uint32, n int) {
+	if stream == 0 || n <= 0 {
+		return
+	}
+	s.streamMutx.Lock()
+	st := s.stream(stream)
+	st.consumed += n
+	if st.consumed < StreamWindow/2 {
+		s.streamMutx.Unlock()
+		return
+	}
+	if s.grants == nil {
+		s.grants = make(map[uint32]int)
+	}
+	s.grants[stream] += st.consumed
+	st.consumed = 0
+	s.streamMutx.Unlock()
+	s.signalStreams()
+}
+
+// CloseStream tell peer that stream is closed. Credit of stream is reset on both sides, so stream can be
+// opened again by its next packet. Packets of stream that wait for credit are reported with ErrUndelivered
+func (s *TCPSocket) CloseStream(stream uint32) {
+	if stream == 0 {
+		return
+	}
+	s.streamMutx.Lock()
+	delete(s.streams, stream)
+	delete(s.grants, stream)
+	s.closes = append(s.closes, stream)
+	s.streamMutx.Unlock()
+	s.signalStreams()
+}
+
+// signalStreams wake writer to send credit and close frames, and to retry streams that wait for credit
+func (s *TCPSocket) signalStreams() {
+	select {
+	case s.streamSignal <- struct{}{}:
+	default:
+	}
+}
+
+// takeStreamControl return control frames of streams that must be sent and streams that are closed by owner
+func (s *TCPSocket) takeStreamControl() ([]rDataPacket, []uint32) {
+	s.streamMutx.Lock()
+	defer s.streamMutx.Unlock()
+	frames := make([]rDataPacket, 0, len(s.grants)+len(s.closes))
+	for id, n := range s.grants {
+		frames = append(frames, rDataPacket{typ: windowType, data: streamControl(id, uint32(n))})
+	}
+	s.grants = nil
+	for _, id := range s.closes {
+		frames = append(frames, rDataPacket{typ: closeStreamType, data: streamControl(id, 0)})
+	}
+	closes := s.closes
+	s.closes = nil
+	return frames, closes
+}
+
+func streamControl(stream uint32, value uint32) []byte {
+	data := make([]byte, controlLen)
+	binary.LittleEndian.PutUint32(data, stream)
+	binary.LittleEndian.PutUint32(data[4:], value)
+	return data
+}
+
+// handleStreamControl apply credit and close frames of peer
+func (s *TCPSocket) handleStreamControl(pkt rDataPacket) {
+	id := binary.LittleEndian.Uint32(pkt.data)
+	if id == 0 {
+		return
+	}
+	s.streamMutx.Lock()
+	if pkt.typ == windowType {
+		s.stream(id).credit += int(binary.LittleEndian.Uint32(pkt.data[4:]))
+	} else {
+		// Peer consumes nothing more of stream, so stream starts again with a full window
+		delete(s.streams, id)
+		delete(s.grants, id)
+	}
+	s.streamMutx.Unlock()
+	s.signalStreams()
+}
+
+// consumed give credit of a delivered packet, unless owner gives credit itself
+func (s *TCPSocket) consumed(pkt rDataPacket) {
+	if pkt.stream != 0 && !s.manualCredit {
+		s.GrantCredit(pkt.stream, len(pkt.data))
+	}
+}
+
+// parkedStreams hold packets of streams that wait for credit. It is used only by writer go routine
+type parkedStreams struct {
+	pkts  map[uint32][]parkedPacket
+	count int
+}
+
+// parkedPacket is a packet that waits for credit with its data, so it is serialized only once
+type parkedPacket struct {
+	pkt  Packet
+	data []byte
+}
+
+// park add packet and its data to the end of its stream
+func (p *parkedStreams) park(id uint32, pkt Packet, data []byte) {
+	if p.pkts == nil {
+		p.pkts = make(map[uint32][]parkedPacket)
+	}
+	p.pkts[id] = append(p.pkts[id], parkedPacket{pkt: pkt, data: data})
+	p.count++
+}
+
+// waiting report whether packets of stream wait for credit, so next packets of stream must wait too
+func (p *parkedStreams) waiting(id uint32) bool {
+	return len(p.pkts[id]) > 0
+}
+
+// full report whether limit packets of stream wait for credit
+func (p *parkedStreams) full(id uint32, limit int) bool {
+	return len(p.pkts[id]) >= limit
+}
+
+// empty report whether no packet waits for credit
+func (p *parkedStreams) empty() bool {
+	return p.count == 0
+}
+
+// take remove packets of stream
+func (p *parkedStreams) take(id uint32) []Packet {
+	parked := p.pkts[id]
+	delete(p.pkts, id)
+	p.count -= len(parked)
+	pkts := make([]Packet, len(parked))
+	for i, pp := range parked {
+		pkts[i] = pp.pkt
+	}
+	return pkts
+}
+
+// pop remove the first packet of stream
+func (p *parkedStreams) pop(id uint32) {
+	pkts := p.pkts[id]
+	pkts[0] = parkedPacket{}
+	if len(pkts) == 1 {
+		delete(p.pkts, id)
+	} else {
+		p.pkts[id] = pkts[1:]
+	}
+	p.count--
+}
+
+// all return packets of all streams
+func (p *parkedStreams) all() []Packet {
+	res := make([]Packet, 0, p.count)
+	for _, pkts := range p.pkts {
+		for _, pp := range pkts {
+			res = append(res, pp.pkt)
+		}
+	}
+	return res
+}
+
+// batchStreams add control frames of streams to batch and the packets of streams that got credit.
+// Packets that must be fragmented are returned as transfers
+func (s *TCPSocket) batchStreams(batch *writeBatch, parked *parkedStreams) []*transfer {
+	frames, closes := s.takeStreamControl()
+	for _, frame := range frames {
+		s.batchControl(batch, frame)
+	}
+	for _, id := range closes {
+		for _, pkt := range parked.take(id) {
+			s.report(ProbData{
+				Pkt:      pkt,
+				SourceID: s.ID(),
+				Err:      ErrUndelivered,
+			})
+		}
+	}
+	var transfers []*transfer
+	for id := range parked.pkts {
+		for parked.waiting(id) {
+			pp := parked.pkts[id][0]
+			if !s.takeCredit(id, len(pp.data)) {
+				break
+			}
+			parked.pop(id)
+			if t := s.batchPacket(batch, pp.pkt, pp.data); t != nil {
+				transfers = append(transfers, t)
+			}
+		}
+	}
+	return transfers
+}
+
+// sendOnStream add packet of a stream to batch when stream has credit, otherwise packet waits for credit.
+// It returns false when packet is parked or dropped
+func (s *TCPSocket) sendOnStream(id uint32, parked *parkedStreams, pkt Packet, data []byte) bool {
+	if !parked.waiting(id) && s.takeCredit(id, len(data)) {
+		return true
+	}
+	if parked.full(id, s.streamQueueSize) {
+		err := &FrameError{Type: pkt.Type(), Err: ErrStreamBlocked}
+		s.countProb(err)
+		s.report(ProbData{
+			Pkt:      pkt,
+			SourceID: s.ID(),
+			Err:      err,
+		})
+		return false
+	}
+	// Packet is serialized once, its data waits with it
+	parked.park(id, pkt, data)
+	return false
+}
@@ -0,0 +1,186 @@
+package socket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// streamPair return sockets over a pipe that agreed streams, and handlers of them. Receiver gives credit
+// itself when manual is set
+func streamPair(t *testing.T, manual bool) (*TCPSocket, *chanHandler, *TCPSocket, *chanHandler) {
+	msgTypeLen := map[byte]int{3: 128 * 1024}
+	cli, srv := Pipe(PipeConfig{})
+	caps := Capabilities{Version: ProtocolVersion, Features: FeatureChecksum | FeatureFragmentation | FeatureStreams}
+	cli.SetCapabilities(caps)
+	srv.SetCapabilities(caps)
+	cli.SetFragmentSize(16 * 1024)
+	srv.SetReassemblyLimits(map[byte]int{3: 256 * 1024})
+	srv.SetManualCredit(manual)
+	cliHandler, srvHandler := newChanHandler(), newChanHandler()
+	cliHandler.written = make(chan WData, 100)
+	srvHandler.read = make(chan RData, 100)
+	cli.StartHandler(context.Background(), cliHandler, msgTypeLen)
+	srv.StartHandler(context.Background(), srvHandler, msgTypeLen)
+	t.Cleanup(func() {
+		cli.Close()
+		srv.Close()
+	})
+	return cli, cliHandler, srv, srvHandler
+}
+
+// readStream wait for a packet and check its stream and first byte
+func readStream(t *testing.T, h *chanHandler, stream uint32, first byte) {
+	t.Helper()
+	select {
+	case rData := <-h.read:
+		data, _ := rData.Pkt.Data()
+		if rData.Stream != stream || data[0] != first {
+			t.Fatalf("Expected packet %d of stream %d, actual packet %d of stream %d", first, stream, data[0], rData.Stream)
+		}
+	case prob := <-h.probs:
+		t.Fatalf("Unexpected problem %v", prob.Err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Packet %d of stream %d not received", first, stream)
+	}
+}
+
+// noPacket check that no packet is received for a while
+func noPacket(t *testing.T, h *chanHandler) {
+	t.Helper()
+	select {
+	case rData := <-h.read:
+		t.Fatalf("Unexpected packet of stream %d", rData.Stream)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	cli, _, srv, h := streamPair(t, true)
+	size := 100 * 1024
+	for i := 0; i < 5; i++ {
+		cli.Send(OnStream(1, rDataPacket{typ: 3, data: bytes.Repeat([]byte{byte(i)}, size)}))
+	}
+	// Stream 1 is blocked after its window, other streams are not
+	for i := 0; i < 3; i++ {
+		readStream(t, h, 1, byte(i))
+	}
+	noPacket(t, h)
+	cli.Send(OnStream(2, rDataPacket{typ: 3, data: []byte{9}}))
+	cli.Send(rDataPacket{typ: 3, data: []byte{8}})
+	readStream(t, h, 2, 9)
+	readStream(t, h, 0, 8)
+
+	// Credit is sent in batches of half a window
+	srv.GrantCredit(1, StreamWindow/2-1)
+	noPacket(t, h)
+	srv.GrantCredit(1, 2*size)
+	for i := 3; i < 5; i++ {
+		readStream(t, h, 1, byte(i))
+	}
+}
+
+// countedPacket count how many times it is serialized
+type countedPacket struct {
+	rDataPacket
+	count *int32
+}
+
+func (pkt countedPacket) Data() ([]byte, error) {
+	atomic.AddInt32(pkt.count, 1)
+	return pkt.rDataPacket.Data()
+}
+
+func TestParkedData(t *testing.T) {
+	cli, _, srv, h := streamPair(t, true)
+	var count int32
+	size := 200 * 1024
+	for i := 0; i < 3; i++ {
+		cli.Send(OnStream(1, countedPacket{rDataPacket: rDataPacket{typ: 3, data: bytes.Repeat([]byte{byte(i)}, size)}, count: &count}))
+	}
+	readStream(t, h, 1, 0)
+	readStream(t, h, 1, 1)
+	// Writer tries the waiting packet again on each credit, it is not serialized again
+	srv.GrantCredit(1, StreamWindow/2)
+	noPacket(t, h)
+	srv.GrantCredit(1, StreamWindow/2)
+	readStream(t, h, 1, 2)
+	if n := atomic.LoadInt32(&count); n != 3 {
+		t.Fatalf("Expected each packet to be serialized once, actual %d times for 3 packets", n)
+	}
+}
+
+func TestStreamAutoCredit(t *testing.T) {
+	cli, _, _, h := streamPair(t, false)
+	for i := 0; i < 20; i++ {
+		cli.Send(OnStream(1, rDataPacket{typ: 3, data: bytes.Repeat([]byte{byte(i)}, 50*1024)}))
+	}
+	for i := 0; i < 20; i++ {
+		readStream(t, h, 1, byte(i))
+	}
+}
+
+func TestCloseStream(t *testing.T) {
+	cli, cliHandler, srv, h := streamPair(t, true)
+	size := 200 * 1024
+	for i := 0; i < 3; i++ {
+		cli.Send(OnStream(1, rDataPacket{typ: 3, data: bytes.Repeat([]byte{byte(i)}, size)}))
+	}
+	readStream(t, h, 1, 0)
+	readStream(t, h, 1, 1)
+	noPacket(t, h)
+	// Receiver closes stream, so sender starts it again with a full window
+	srv.CloseStream(1)
+	readStream(t, h, 1, 2)
+
+	// Packet 2 used most of the new window
+	for i := 3; i < 5; i++ {
+		cli.Send(OnStream(1, rDataPacket{typ: 3, data: bytes.Repeat([]byte{byte(i)}, size)}))
+	}
+	readStream(t, h, 1, 3)
+	noPacket(t, h)
+	// Packets that wait for credit are not sent when sender closes stream
+	cli.CloseStream(1)
+	select {
+	case prob := <-cliHandler.probs:
+		if data, _ := prob.Pkt.Data(); !errors.Is(prob.Err, ErrUndelivered) || data[0] != 4 {
+			t.Fatalf("Expected waiting packet to be undelivered, actual error %v", prob.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Waiting packet not reported")
+	}
+	noPacket(t, h)
+}
+
+func TestStreamBlocked(t *testing.T) {
+	cli, cliHandler, _, h := streamPair(t, true)
+	cli.streamQueueSize = 1
+	for i := 0; i < 4; i++ {
+		cli.Send(OnStream(1, rDataPacket{typ: 3, data: bytes.Repeat([]byte{byte(i)}, 200*1024)}))
+	}
+	readStream(t, h, 1, 0)
+	readStream(t, h, 1, 1)
+	select {
+	case prob := <-cliHandler.probs:
+		if !errors.Is(prob.Err, ErrStreamBlocked) || !Recoverable(prob.Err) {
+			t.Fatalf("Expected recoverable blocked stream error, actual %v", prob.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Packet over queue of blocked stream not reported")
+	}
+}
+
+func TestStreamsNotAgreed(t *testing.T) {
+	cli, srv := Pipe(PipeConfig{})
+	h := newChanHandler()
+	srv.StartHandler(context.Background(), h, map[byte]int{3: 10})
+	cli.StartHandler(context.Background(), newChanHandler(), map[byte]int{3: 10})
+	defer cli.Close()
+	defer srv.Close()
+	// Peer that does not know streams gets packets on the default stream
+	cli.Send(OnStream(1, rDataPacket{typ: 3, data: []byte{7}}))
+	readStream(t, h, 0, 7)
+}
@@ -2,360 +2,946 @@ package socket
 
 import (
 	"bufio"
-	"encoding/binary"
-	"fmt"
+	"bytes"
+	"context"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/vajafari/messagehub/pkg/logging"
 )
 
 const (
-	readTimeout  = 2 * time.Hour
-	writeTimeout = 120 * time.Second
-	prefixLen    = 7
-)
-
-var (
-	packetPrefix = []byte{83, 79, 70, 83, 79, 70, 10}
+	// DefaultReadTimeout is how long socket waits for data of peer before connection is closed
+	DefaultReadTimeout = 2 * time.Hour
+	// DefaultWriteTimeout is how long socket waits for a write before it is retried
+	DefaultWriteTimeout = 120 * time.Second
 )
 
 // TCPSocket holds information a connection between client and server
 // This class designed to be reusable across projects
+// Despite the name, it runs over any net.Conn (TCP, TLS, unix and unixpacket)
 type TCPSocket struct {
-	conn      *net.TCPConn    // TCP connection.
-	id        uint64          // Assigned ID to current TCPSocket
-	sendQueue chan Packet     // Outgoing packets queue. We use a buffered channel of packets as thread-safe FIFO queue
-	closeGoes chan bool       // This channel used to stop all go routines of TCPSocekt
-	readChan  chan<- RData    // if successful read happen signal send through this channel
-	writeChan chan<- WData    // if successful write happen signal send through this channel
-	probChan  chan<- ProbData // if error occur signal to send through this channel
+	// 64-bit fields that are accessed atomically come first, so they are aligned on 32-bit platforms
+	pingSent int64 // Send time of the unanswered ping in unix nanoseconds, zero when it is answered
+	rtt      int64 // Round trip time of the last answered ping in nanoseconds
+	// Number of read and written packets that were over rate limit
+	inLimited  uint64
+	outLimited uint64
+	// Counters of Stats
+	queueHighWater int64
+	resyncs        uint64 // Copied from inspector of reader
+	discarded      uint64 // Copied from inspector of reader
+	frameErrors    uint64
+	errorCount     uint64
+	dropped        uint64
+	conn           net.Conn      // Underlying stream connection
+	id             uint64        // Assigned ID to current TCPSocket
+	ctrlQueue      chan Packet   // Outgoing control frames, they are written before queued packets
+	closeGoes      chan bool     // This channel used to stop all go routines of TCPSocekt, it is closed by Close
+	done           chan struct{} // Closed when socket stops accepting packets, so senders stop waiting for the queue
+	sendMutx       sync.RWMutex  // Held by senders while pushing to queue, so no packet is queued after done is closed
+	drain          chan struct{} // Closed by Shutdown, writer flushes the queue and closes flushed
+	flushed        chan struct{} // Closed when writer stops writing, because queue is flushed or write failed
+	readDone       chan struct{} // Closed when reader stops
+	stopOnce       sync.Once
+	drainOnce      sync.Once
+	flushOnce      sync.Once
+	closeOnce      sync.Once
+	readChan       chan<- RData    // if successful read happen signal send through this channel
+	writeChan      chan<- WData    // if successful write happen signal send through this channel
+	probChan       chan<- ProbData // if error occur signal to send through this channel
+	handler        Handler         // Receives the signals instead of channels when socket is started by StartHandler
+	started        int32           // Set by Start and StartHandler
+	running        sync.WaitGroup  // Go routines that may signal the owner
+	closeErr       error           // Problem or ctx error that closed the socket, set once by close
 	// This is a map that specifies how much data is valid for each type of message
 	// We use this to prevent the client from sending irrational data.
 	// Each packet type (first byte of packet) has max length
 	msgTypeLen   map[byte]int
 	readBufSize  int
 	writeBufSize int
+	// Frame version of outgoing packets. It is v2 only when checksum is agreed, see SetCapabilities
+	frameVersion uint32
+	caps         Capabilities // Capabilities agreed with peer in handshake
+	capsMutx     sync.RWMutex
+	// Packets with smaller data are sent uncompressed even if compression is agreed
+	compressMinSize int
+	enc             frameEncoder // Used only by writer go routine
+	compBuf         bytes.Buffer // Compressed data of current packet, used only by writer go routine
+	// Packets with larger data are split to fragments of this size when fragmentation is agreed
+	fragmentSize int
+	// Max length of reassembled packet of each type. Types that are not in map are limited by msgTypeLen
+	fragLimits map[byte]int
+	nextFragID uint32 // ID of the next fragmented packet, used only by writer go routine
+	// Budget of frames that writer collects and writes together
+	batchBytes  int
+	batchFrames int
+	// Rate limits of read and written packets, nil is not limited
+	inLimit    *rateLimiter // Used only by reader go routine
+	outLimit   *rateLimiter // Used only by writer go routine
+	rateAction RateLimitAction
+	// What Send and TrySend do when send queue is full
+	overflowPolicy OverflowPolicy
+	overflowed     int32 // Set when overflow is reported with OverflowDisconnect
+	// Outgoing packets queues by priority. Each lane is a buffered channel used as thread-safe FIFO queue
+	lanes        [numLanes]chan Packet
+	typeLanes    map[byte]Lane // Lane of each message type
+	sched        laneScheduler // Used only by writer go routine to take packets from lanes by their weights
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	garbageLimit int // Max bytes that peer may send without a valid frame, zero is not limited
+	// Heartbeat is only active when it is agreed with peer. Zero interval disables it
+	heartbeatInterval time.Duration
+	maxMissedPongs    int
+	// Traffic of delivered packets by message type
+	connectedAt time.Time
+	inTraffic   trafficCounter
+	outTraffic  trafficCounter
+	log         logging.Logger
+	capture     *CaptureWriter
+	// Flow control of streams, see OnStream
+	streamMutx      sync.Mutex
+	streams         map[uint32]*streamState
+	grants          map[uint32]int // Credit that is not sent to peer yet
+	closes          []uint32       // Streams that are closed by owner and peer is not told yet
+	streamSignal    chan struct{}  // Wakes writer to send credit and retry streams that wait for credit
+	streamQueueSize int            // Max packets of each stream that wait for credit
+	manualCredit    bool
 }
 
-//NewTCPSocket create TCP Socket object to hold client collection info
+// NewTCPSocket create TCP Socket object to hold client collection info
 func NewTCPSocket(conn *net.TCPConn, id uint64, sendQueueSize int, readBufSize int, writeBufSize int) *TCPSocket {
+	return newTCPSocket(conn, id, sendQueueSize, readBufSize, writeBufSize)
+}
+
+// NewConnSocket create socket object over any kind of net.Conn
+// For unixpacket connections readBufSize of each side must be at least writeBufSize of the other side
+func NewConnSocket(conn net.Conn, id uint64, sendQueueSize int, readBufSize int, writeBufSize int) *TCPSocket {
+	return newTCPSocket(conn, id, sendQueueSize, readBufSize, writeBufSize)
+}
+
+func newTCPSocket(conn net.Conn, id uint64, sendQueueSize int, readBufSize int, writeBufSize int) *TCPSocket {
 	s := TCPSocket{
 		conn:         conn,
-		sendQueue:    make(chan Packet, sendQueueSize),
-		closeGoes:    make(chan bool, 1),
+		ctrlQueue:    make(chan Packet, 4),
+		closeGoes:    make(chan bool),
+		done:         make(chan struct{}),
+		drain:        make(chan struct{}),
+		flushed:      make(chan struct{}),
+		readDone:     make(chan struct{}),
+		streamSignal: make(chan struct{}, 1),
 		readBufSize:  readBufSize,
 		writeBufSize: writeBufSize,
 		id:           id,
+		frameVersion: uint32(FrameV1),
+
+		compressMinSize: DefaultCompressMinSize,
+		fragmentSize:    DefaultFragmentSize,
+		batchBytes:      DefaultBatchBytes,
+		batchFrames:     DefaultBatchFrames,
+
+		readTimeout:       DefaultReadTimeout,
+		writeTimeout:      DefaultWriteTimeout,
+		heartbeatInterval: DefaultHeartbeatInterval,
+		maxMissedPongs:    DefaultMaxMissedPongs,
+
+		connectedAt:     time.Now(),
+		log:             logging.Default(),
+		streamQueueSize: sendQueueSize,
+	}
+	for lane := range s.lanes {
+		s.lanes[lane] = make(chan Packet, sendQueueSize)
+		s.sched.weights[lane] = DefaultLaneWeights[Lane(lane)]
 	}
+	// Scheduler moves to the next lane first, so the first turn is of control lane
+	s.sched.lane = numLanes - 1
 	return &s
 }
 
-//Start set channels to communicate with the socket manager
+// SetFrameVersion set frame version of outgoing packets. V1 keeps old peers working,
+// both versions are always accepted on read
+func (s *TCPSocket) SetFrameVersion(version byte) {
+	atomic.StoreUint32(&s.frameVersion, uint32(version))
+}
+
+// FrameVersion return frame version of outgoing packets
+func (s *TCPSocket) FrameVersion() byte {
+	return byte(atomic.LoadUint32(&s.frameVersion))
+}
+
+// SetCapabilities apply capabilities agreed with peer. Checksum feature selects v2 frames and
+// packets larger than max frame size are dropped instead of sending
+func (s *TCPSocket) SetCapabilities(caps Capabilities) {
+	s.capsMutx.Lock()
+	s.caps = caps
+	s.capsMutx.Unlock()
+	if caps.Has(FeatureChecksum) {
+		s.SetFrameVersion(FrameV2)
+	} else {
+		s.SetFrameVersion(FrameV1)
+	}
+}
+
+// SetCompressMinSize set the smallest data that is compressed when compression is agreed with peer
+// It must be called before Start
+func (s *TCPSocket) SetCompressMinSize(size int) {
+	s.compressMinSize = size
+}
+
+// SetFragmentSize set max data of one fragment. Larger packets are split when fragmentation is agreed with peer
+// It must be called before Start
+func (s *TCPSocket) SetFragmentSize(size int) {
+	s.fragmentSize = size
+}
+
+// SetReassemblyLimits set max length of reassembled packet of each message type. It lets a type carry
+// larger packets in fragments than msgTypeLen allows in one frame. It must be called before Start
+func (s *TCPSocket) SetReassemblyLimits(limits map[byte]int) {
+	s.fragLimits = limits
+}
+
+// SetWriteBatch set how many bytes and frames of queued packets writer collects and writes together.
+// One frame writes each packet on its own. Zero keeps the current value. It must be called before Start
+func (s *TCPSocket) SetWriteBatch(maxBytes int, maxFrames int) {
+	if maxBytes > 0 {
+		s.batchBytes = maxBytes
+	}
+	if maxFrames > 0 {
+		s.batchFrames = maxFrames
+	}
+}
+
+// SetOverflowPolicy set what socket does with packets when its send queue is full
+// It must be called before Start
+func (s *TCPSocket) SetOverflowPolicy(policy OverflowPolicy) {
+	s.overflowPolicy = policy
+}
+
+// SetTimeouts set how long socket waits for data of peer and for each write. Zero keeps the current value
+// It must be called before Start
+func (s *TCPSocket) SetTimeouts(read time.Duration, write time.Duration) {
+	if read > 0 {
+		s.readTimeout = read
+	}
+	if write > 0 {
+		s.writeTimeout = write
+	}
+}
+
+// SetHeartbeat set how often peer is pinged and how many pings it may miss before connection is
+// reported dead. Zero interval disables heartbeat. It must be called before Start
+func (s *TCPSocket) SetHeartbeat(interval time.Duration, maxMissedPongs int) {
+	s.heartbeatInterval = interval
+	if maxMissedPongs > 0 {
+		s.maxMissedPongs = maxMissedPongs
+	}
+}
+
+// Capabilities return capabilities agreed with peer. It is zero value before handshake
+func (s *TCPSocket) Capabilities() Capabilities {
+	s.capsMutx.RLock()
+	defer s.capsMutx.RUnlock()
+	return s.caps
+}
+
+// Start set channels to communicate with the socket manager. A socket is started only once,
+// see StartHandler for the handler based API
 func (s *TCPSocket) Start(writeChan chan<- WData, readChan chan<- RData, probChan chan<- ProbData, msgTypeLen map[byte]int) {
-	if s.writeChan != nil || s.readChan != nil || s.probChan != nil || s.msgTypeLen != nil {
+	if !atomic.CompareAndSwapInt32(&s.started, 0, 1) {
+		s.logger().Warn("Socket is already started")
 		return
 	}
 	s.readChan = readChan
 	s.writeChan = writeChan
 	s.probChan = probChan
+	s.run(msgTypeLen)
+}
+
+// run start go routines of socket
+func (s *TCPSocket) run(msgTypeLen map[byte]int) {
 	s.msgTypeLen = msgTypeLen
+	s.running.Add(2)
 	go s.reader()
 	go s.writer()
+	if s.heartbeatInterval > 0 {
+		s.running.Add(1)
+		go s.heartbeat()
+	}
+}
+
+// isStarted report whether Start or StartHandler is called
+func (s *TCPSocket) isStarted() bool {
+	return atomic.LoadInt32(&s.started) != 0
 }
 
-//Send Add packet to send queue
+// Send Add packet to lane of its type. When lane is full, packet is handled by overflow policy of socket,
+// with OverflowBlock it waits for room. Packets that cannot be queued are dropped
 func (s *TCPSocket) Send(pkt Packet) {
-	s.sendQueue <- pkt
+	var err error
+	if s.overflowPolicy == OverflowBlock {
+		err = s.SendContext(context.Background(), pkt)
+	} else {
+		err = s.TrySend(pkt)
+	}
+	if err != nil {
+		s.logger().Warn("Packet dropped", logging.MsgType, pkt.Type(), logging.Err, err)
+	}
+}
+
+// TrySend add packet to lane of its type without waiting. When lane is full, packet is handled by
+// overflow policy of socket and ErrQueueFull is returned unless the packet is queued
+func (s *TCPSocket) TrySend(pkt Packet) error {
+	s.sendMutx.RLock()
+	defer s.sendMutx.RUnlock()
+	select {
+	case <-s.done:
+		return ErrClosed
+	default:
+	}
+	q := s.lanes[s.laneOf(pkt.Type())]
+	select {
+	case q <- pkt:
+		s.countQueued()
+		return nil
+	default:
+	}
+	return s.overflow(q, pkt)
 }
 
-// Close tcpSocket and release all the resources
+// SendContext add packet to lane of its type. It waits for room in lane until ctx is done or socket is closed
+func (s *TCPSocket) SendContext(ctx context.Context, pkt Packet) error {
+	s.sendMutx.RLock()
+	defer s.sendMutx.RUnlock()
+	select {
+	case <-s.done:
+		return ErrClosed
+	default:
+	}
+	select {
+	case s.lanes[s.laneOf(pkt.Type())] <- pkt:
+		s.countQueued()
+		return nil
+	case <-s.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// overflow apply overflow policy to a packet that does not fit in its lane
+func (s *TCPSocket) overflow(q chan Packet, pkt Packet) error {
+	switch s.overflowPolicy {
+	case OverflowDropOldest:
+		select {
+		case old := <-q:
+			atomic.AddUint64(&s.dropped, 1)
+			s.logger().Warn("Send queue is full, oldest packet dropped", logging.MsgType, old.Type())
+			s.reportDropped(old)
+		default:
+		}
+		select {
+		case q <- pkt:
+			s.countQueued()
+			return nil
+		default:
+		}
+	case OverflowDisconnect:
+		if s.isStarted() && atomic.CompareAndSwapInt32(&s.overflowed, 0, 1) {
+			s.countProb(ErrQueueFull)
+			// Senders may hold locks of the socket owner, so problem is reported in background
+			s.running.Add(1)
+			go func() {
+				defer s.running.Done()
+				s.report(ProbData{
+					Pkt:      pkt,
+					SourceID: s.ID(),
+					Err:      ErrQueueFull,
+				})
+			}()
+		}
+	}
+	atomic.AddUint64(&s.dropped, 1)
+	return ErrQueueFull
+}
+
+// reportDropped tell owner that a queued packet is dropped by overflow policy, like other dropped frames.
+// It is counted as dropped packet only. Senders may hold locks of the socket owner, so it is reported in background
+func (s *TCPSocket) reportDropped(pkt Packet) {
+	if !s.isStarted() {
+		return
+	}
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		s.reportOpen(ProbData{
+			Pkt:      pkt,
+			SourceID: s.ID(),
+			Err:      &FrameError{Type: pkt.Type(), Err: ErrQueueFull},
+		})
+	}()
+}
+
+// Close tcpSocket and release all the resources. Packets that are still queued are reported through
+// ProbData with ErrUndelivered. It is safe to call Close more than once
 func (s *TCPSocket) Close() error {
-	err := s.conn.Close()
-	if err == nil {
-		s.closeGoes <- true
-		s.closeGoes <- true
-		close(s.sendQueue)
+	return s.close(nil)
+}
+
+// close close socket once, cause is the problem that is passed to OnClose of handler
+func (s *TCPSocket) close(cause error) error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.closeErr = cause
+		s.stopSending()
+		err = s.conn.Close()
+		if err != nil {
+			s.logger().Debug("Error on closing connection", logging.Err, err)
+		}
 		close(s.closeGoes)
-	} else {
-		fmt.Println(err)
+	})
+	return err
+}
+
+// Shutdown stop accepting packets, write the queued packets and half-close the connection, so peer
+// reads every frame before EOF. Then it waits for peer to close its side and closes the socket.
+// When ctx is done first, socket is closed at once and ctx error is returned
+func (s *TCPSocket) Shutdown(ctx context.Context) error {
+	s.stopSending()
+	s.drainOnce.Do(func() {
+		close(s.drain)
+	})
+	var err error
+	if s.isStarted() {
+		select {
+		case <-s.flushed:
+			// Connections without half-close (like WebSocket) are closed without waiting for peer
+			if cw, ok := s.conn.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+				select {
+				case <-s.readDone:
+				case <-ctx.Done():
+					err = ctx.Err()
+				}
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if errClose := s.Close(); err == nil {
+		err = errClose
 	}
 	return err
 }
 
+// closed report whether Close is called
+func (s *TCPSocket) closed() bool {
+	select {
+	case <-s.closeGoes:
+		return true
+	default:
+		return false
+	}
+}
+
+// shuttingDown report whether Shutdown is called
+func (s *TCPSocket) shuttingDown() bool {
+	select {
+	case <-s.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopSending make next sends fail with ErrClosed and wait for senders that are pushing to queue
+func (s *TCPSocket) stopSending() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		s.sendMutx.Lock()
+		s.sendMutx.Unlock()
+	})
+}
+
 // ID return current channel id
 func (s *TCPSocket) ID() uint64 {
-	return s.id
+	return atomic.LoadUint64(&s.id)
+}
+
+// SetLogger set logger of socket events. Socket id and remote address are added to each record
+func (s *TCPSocket) SetLogger(l logging.Logger) {
+	s.log = l
+}
+
+// logger return logger of socket with fields of socket
+func (s *TCPSocket) logger() logging.Logger {
+	addr := ""
+	if s.conn != nil && s.conn.RemoteAddr() != nil {
+		addr = s.conn.RemoteAddr().String()
+	}
+	return logging.With(s.log, logging.SocketID, s.ID(), logging.RemoteAddr, addr)
 }
 
 // SetID return current channel id
 func (s *TCPSocket) SetID(id uint64) {
-	s.id = id
+	atomic.StoreUint64(&s.id, id)
 }
 
 func (s *TCPSocket) writer() {
-	bufio.NewWriterSize(s.conn, s.writeBufSize)
-	buf := bufio.NewWriter(s.conn)
+	defer s.running.Done()
+	var w io.Writer = s.conn
+	if _, ok := s.conn.(flusher); !ok && !vectored(s.conn) {
+		// Buffered writer keeps the first error, so timeouts are retried under it
+		w = retryWriter{conn: s.conn, timeout: s.writeTimeout}
+		if isPacketConn(s.conn) {
+			w = chunkWriter{w: w, size: s.writeBufSize}
+		}
+		w = bufio.NewWriterSize(w, s.writeBufSize)
+	}
+	// Frames are collected while packets are queued, and they are written when queue is empty
+	// or batch is full
+	batch := newWriteBatch(s.batchBytes, s.batchFrames)
+	// Fragmented packets in progress. One fragment of each is sent in turn, and
+	// packets that are queued meanwhile are sent between fragments
+	var transfers []*transfer
+	// Packets of streams that wait for credit of peer
+	var parked parkedStreams
+	// Packets that are not written when socket is closed are reported to owner of socket
+	defer func() {
+		s.reportUndelivered(batch.pkts, transfers, parked.all())
+	}()
+	draining := false
+	drain := s.drain
 	for {
-		//When we close 'send' channel, It still received buffered packets so
-		//writer go routine continue to work. we use the following select to make sure that
-		//this go routine closes immediately when we call TCPSocket close method
+		if batch.full() {
+			if err := s.flush(w, batch); err != nil {
+				s.writeFailed(nil, err)
+				return
+			}
+		}
+		// Control frames go first, so pongs are not delayed by a long queue
 		select {
-		case <-s.closeGoes:
+		case ctrl := <-s.ctrlQueue:
+			s.batchControl(batch, ctrl)
+			continue
+		case <-s.streamSignal:
+			transfers = append(transfers, s.batchStreams(batch, &parked)...)
+			continue
+		default:
+		}
+		if draining && len(transfers) == 0 && s.queuedLen() == 0 && parked.empty() {
+			if err := s.flush(w, batch); err != nil {
+				s.writeFailed(nil, err)
+				return
+			}
+			// Shutdown waits for this, no packet is queued after drain starts
+			s.stopWriting()
+			<-s.closeGoes
 			return
-		case pkt := <-s.sendQueue:
-			if pkt == nil {
-				continue
+		}
+		pkt := s.sched.next(&s.lanes)
+		//Writer go routine stops immediately when we call TCPSocket close method,
+		//even if packets are still queued
+		if pkt == nil && len(transfers) == 0 {
+			// Nothing is left to collect, so batch is written before waiting for packets
+			if err := s.flush(w, batch); err != nil {
+				s.writeFailed(nil, err)
+				return
 			}
-			// Prepare data for sending on wire!!!
-			bb, err := pkt.Data()
-			if err != nil {
+			select {
+			case <-s.closeGoes:
+				return
+			case <-drain:
+				// Packets of streams may still wait for credit, so drain is not selected again
+				draining, drain = true, nil
 				continue
+			case ctrl := <-s.ctrlQueue:
+				s.batchControl(batch, ctrl)
+				continue
+			case <-s.streamSignal:
+				transfers = append(transfers, s.batchStreams(batch, &parked)...)
+				continue
+			case pkt = <-s.lanes[LaneControl]:
+				s.sched.took(LaneControl)
+			case pkt = <-s.lanes[LaneInteractive]:
+				s.sched.took(LaneInteractive)
+			case pkt = <-s.lanes[LaneBulk]:
+				s.sched.took(LaneBulk)
 			}
-			pktBytes := make([]byte, prefixLen+HeaderLen+len(bb))
-			copy(pktBytes, packetPrefix)     //Prefix
-			pktBytes[prefixLen] = pkt.Type() //Type
-			lenBytes := make([]byte, 4)
-			binary.LittleEndian.PutUint32(lenBytes, uint32(len(bb)))
-			copy(pktBytes[prefixLen+1:], lenBytes) //Lent
-			copy(pktBytes[prefixLen+HeaderLen:], bb)
-			// Data composed
-			_, err = s.writeWithRetry(buf, pktBytes, writeTimeout)
-			if err != nil {
-				fmt.Printf("TCPSocket, Error on send data--- Socket%d   %s\n", s.id, err.Error())
-				res := ProbData{
-					Pkt:      pkt,
-					SourceID: s.id,
-					Err:      err,
-				}
-				s.probChan <- res
+		} else {
+			select {
+			case <-s.closeGoes:
 				return
+			default:
 			}
-			res := WData{
-				Pkt:      pkt,
-				SourceID: s.id,
+		}
+		if pkt != nil {
+			if data, err := pkt.Data(); err != nil {
+				// Packets that cannot be serialized are dropped, owner learns it like other dropped frames
+				s.dropInvalid(pkt, err)
+			} else {
+				pass, ok := s.limitWrite(w, batch, pkt, len(data))
+				if !ok {
+					return
+				}
+				if id := streamOf(pkt, s.Capabilities()); pass && id != 0 {
+					pass = s.sendOnStream(id, &parked, pkt, data)
+				}
+				if pass {
+					if t := s.batchPacket(batch, pkt, data); t != nil {
+						transfers = append(transfers, t)
+					}
+				}
 			}
-			//fmt.Printf("TcpSocket, Data Sent-- Socket %d- Len %d\n", s.id, nn)
-			s.writeChan <- res
+		}
+		if len(transfers) == 0 {
+			continue
+		}
+		t := transfers[0]
+		transfers = transfers[1:]
+		s.batchFragment(batch, t)
+		if !t.done() {
+			transfers = append(transfers, t)
+			continue
+		}
+		batch.done(t.pkt, len(t.data))
+	}
+}
 
+// dropInvalid report a packet that cannot be serialized as a dropped frame
+func (s *TCPSocket) dropInvalid(pkt Packet, err error) {
+	frameErr := &FrameError{Type: pkt.Type(), Err: err}
+	s.countProb(frameErr)
+	s.report(ProbData{
+		Pkt:      pkt,
+		SourceID: s.ID(),
+		Err:      frameErr,
+	})
+}
+
+// limitWrite apply outbound rate limit to a packet. It returns whether packet can be sent, and false ok
+// when writer must stop because socket is closed or disconnected by rate limit
+func (s *TCPSocket) limitWrite(w io.Writer, batch *writeBatch, pkt Packet, size int) (pass bool, ok bool) {
+	wait, err := s.limitRate(s.outLimit, &s.outLimited, false, pkt, size)
+	if err != nil {
+		if !Recoverable(err) {
+			s.writeFailed(pkt, err)
+			return false, false
+		}
+		s.countProb(err)
+		s.report(ProbData{
+			Pkt:      pkt,
+			SourceID: s.ID(),
+			Err:      err,
+		})
+		return false, true
+	}
+	if wait > 0 {
+		// Frames that are already collected are not delayed. Packet is not in batch, so it is reported itself
+		if err := s.flush(w, batch); err != nil {
+			s.writeFailed(nil, err)
+			s.reportUndeliveredPacket(pkt)
+			return false, false
+		}
+		if !s.sleep(wait) {
+			s.reportUndeliveredPacket(pkt)
+			return false, false
 		}
 	}
+	return true, true
 }
 
-func (s *TCPSocket) writeWithRetry(buf *bufio.Writer, bb []byte, timeout time.Duration) (int, error) {
+// flush write frames of batch and report its packets as written
+func (s *TCPSocket) flush(w io.Writer, batch *writeBatch) error {
+	if batch.empty() {
+		return nil
+	}
+	// Write consumes buffers, so batch keeps its own slice for reuse
+	bufs := batch.bufs
+	if _, err := s.writeWithRetry(w, &bufs, s.writeTimeout); err != nil {
+		return err
+	}
+	now := time.Now()
+	s.outTraffic.touch(now)
+	for i, pkt := range batch.pkts {
+		s.outTraffic.add(pkt.Type(), batch.sizes[i], now)
+		if s.capture != nil {
+			data, _ := pkt.Data()
+			s.record(DirOut, pkt.Type(), data, now)
+		}
+		s.written(WData{
+			Pkt:      pkt,
+			SourceID: s.ID(),
+		})
+	}
+	batch.reset()
+	return nil
+}
+
+// stopWriting tell Shutdown that writer does not write anymore
+func (s *TCPSocket) stopWriting() {
+	s.flushOnce.Do(func() {
+		close(s.flushed)
+	})
+}
+
+// reportUndelivered report packets of batch that is not written, unfinished transfers, packets that wait
+// for credit and the queue with ErrUndelivered. It waits until socket is closed, so no packet is queued
+// after the queue is emptied
+func (s *TCPSocket) reportUndelivered(pkts []Packet, transfers []*transfer, parked []Packet) {
+	s.stopWriting()
+	<-s.closeGoes
+	pkts = append(pkts, parked...)
+	for _, pkt := range pkts {
+		s.report(ProbData{
+			Pkt:      pkt,
+			SourceID: s.ID(),
+			Err:      ErrUndelivered,
+		})
+	}
+	for _, t := range transfers {
+		s.report(ProbData{
+			Pkt:      t.pkt,
+			SourceID: s.ID(),
+			Err:      ErrUndelivered,
+		})
+	}
+	for _, q := range s.lanes {
+		for len(q) > 0 {
+			s.report(ProbData{
+				Pkt:      <-q,
+				SourceID: s.ID(),
+				Err:      ErrUndelivered,
+			})
+		}
+	}
+}
+
+// reportUndeliveredPacket report a packet that writer took from queue, but it is closed before packet is batched
+func (s *TCPSocket) reportUndeliveredPacket(pkt Packet) {
+	s.report(ProbData{
+		Pkt:      pkt,
+		SourceID: s.ID(),
+		Err:      ErrUndelivered,
+	})
+}
+
+// batchPacket add frame of packet to batch. Packet that must be fragmented is returned as transfer
+// and its fragments are added by writer later
+func (s *TCPSocket) batchPacket(batch *writeBatch, pkt Packet, data []byte) *transfer {
+	caps := s.Capabilities()
+	stream := streamOf(pkt, caps)
+	if caps.Has(FeatureFragmentation) && len(data) > s.maxFragment(caps) {
+		s.nextFragID++
+		return &transfer{pkt: pkt, typ: pkt.Type(), stream: stream, data: data, id: s.nextFragID}
+	}
+	if maxSize := caps.MaxFrameSize; maxSize > 0 && len(data) > maxSize {
+		err := &FrameError{Type: pkt.Type(), Err: ErrFrameTooLarge}
+		s.countProb(err)
+		s.report(ProbData{
+			Pkt:      pkt,
+			SourceID: s.ID(),
+			Err:      err,
+		})
+		return nil
+	}
+	batch.add(*s.encode(pkt.Type(), data, caps, fragmentInfo{}, stream))
+	batch.done(pkt, len(data))
+	return nil
+}
+
+// batchFragment add the next fragment of a transfer to batch
+func (s *TCPSocket) batchFragment(batch *writeBatch, t *transfer) {
+	caps := s.Capabilities()
+	bb, frag := t.next(s.maxFragment(caps))
+	batch.add(*s.encode(t.typ, bb, caps, frag, t.stream))
+}
+
+// batchControl add a control frame to batch. Control frames are small, so they are never compressed or fragmented
+func (s *TCPSocket) batchControl(batch *writeBatch, pkt Packet) {
+	data, _ := pkt.Data()
+	batch.add(*s.encode(pkt.Type(), data, Capabilities{}, fragmentInfo{}, 0))
+}
+
+// maxFragment return max data of one fragment, it is never larger than max frame size of peer
+func (s *TCPSocket) maxFragment(caps Capabilities) int {
+	size := s.fragmentSize
+	if size <= 0 {
+		size = DefaultFragmentSize
+	}
+	if caps.MaxFrameSize > 0 && caps.MaxFrameSize < size {
+		size = caps.MaxFrameSize
+	}
+	return size
+}
+
+func (s *TCPSocket) writeFailed(pkt Packet, err error) {
+	s.logger().Warn("Error on send data", logging.Err, err)
+	s.countProb(err)
+	s.report(ProbData{
+		Pkt:      pkt,
+		SourceID: s.ID(),
+		Err:      err,
+	})
+}
+
+// encode compose frame of packet, or of a fragment when frag is set. Frames of streams other than
+// the default stream carry stream id. Data is compressed when compression is agreed and data is not too small
+// Returned buffers are valid until the next call
+func (s *TCPSocket) encode(typ byte, data []byte, caps Capabilities, frag fragmentInfo, stream uint32) *net.Buffers {
+	version := s.FrameVersion()
+	flags := byte(0)
+	if version == FrameV2 {
+		flags = flagChecksum
+	}
+	if frag.isFragment() {
+		// Fragment info is an extension of v2 header
+		version = FrameV2
+		flags |= flagFragment
+	}
+	if stream != 0 {
+		// Stream id is an extension of v2 header too
+		version = FrameV2
+		flags |= flagStream
+	}
+	if isControl(typ) {
+		// High bit of control types marks a v2 header, so they cannot be sent in v1 frames
+		version = FrameV2
+	}
+	if caps.Has(FeatureCompression) && len(data) >= s.compressMinSize && compress(&s.compBuf, data) {
+		// Peer that accepts compression reads v2 frames, so compressed frames are always v2
+		return s.enc.encode(typ, FrameV2, flags|flagCompressed, s.compBuf.Bytes(), len(data), frag, stream)
+	}
+	return s.enc.encode(typ, version, flags, data, 0, frag, stream)
+}
+
+// writeWithRetry write buffers to w, and flush w when it is a flusher
+func (s *TCPSocket) writeWithRetry(w io.Writer, bufs *net.Buffers, timeout time.Duration) (int, error) {
 	s.conn.SetWriteDeadline(time.Now().Add(timeout))
-	nn, err := buf.Write(bb)
+	// Buffers are consumed as they are written, so retry continues from the first unwritten byte
+	nn, err := bufs.WriteTo(w)
 	if err != nil {
 		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
 			s.conn.SetWriteDeadline(time.Now().Add(timeout))
-			nn, err = buf.Write(bb)
+			var n int64
+			n, err = bufs.WriteTo(w)
+			nn += n
 		}
 		if err != nil {
-			err = errors.Wrapf(err, "TcpSocket, Error on REwrite data to tcpSocket %d. Error Message is %s", s.id, err.Error())
-			return nn, err
+			err = errors.Wrapf(err, "TcpSocket, Error on REwrite data to tcpSocket %d. Error Message is %s", s.ID(), err.Error())
+			return int(nn), err
 		}
 	}
+	buf, ok := w.(flusher)
+	if !ok {
+		return int(nn), nil
+	}
+	// Timeouts are already retried by retryWriter under bufio writer
 	err = buf.Flush()
 	if err != nil {
-		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-			s.conn.SetWriteDeadline(time.Now().Add(timeout))
-			err = buf.Flush()
-			if err != nil {
-				err = errors.Wrapf(err, "TcpSocket, Error on REflushing data to tcpSocket %d. Error Message is %s", s.id, err.Error())
-			}
-		}
+		err = errors.Wrapf(err, "TcpSocket, Error on REflushing data to tcpSocket %d. Error Message is %s", s.ID(), err.Error())
 	}
-	return nn, err
+	return int(nn), err
 }
 
 func (s *TCPSocket) reader() {
-	bb := make([]byte, s.readBufSize)
-	buf := bufio.NewReaderSize(s.conn, s.readBufSize)
-	pi := packetInspector{}
-	pi.resetVariables()
+	defer s.running.Done()
+	dec := newFrameDecoder(deadlineReader{conn: s.conn, timeout: s.readTimeout}, s.readBufSize, s.msgTypeLen, s.fragLimits)
+	dec.garbageLimit = s.garbageLimit
+	defer dec.Release()
+	defer close(s.readDone)
 	for {
 		select {
 		case <-s.closeGoes:
 			return
 		default:
 		}
-		s.conn.SetReadDeadline(time.Now().Add(readTimeout))
-		n, err := buf.Read(bb)
+		pkt, err := dec.Decode()
+		atomic.StoreUint64(&s.resyncs, dec.pi.resyncs)
+		atomic.StoreUint64(&s.discarded, dec.pi.discarded)
 		if err != nil {
-			s.probChan <- ProbData{
-				Err:      err,
-				SourceID: s.ID(),
+			// Read fails when socket is closed, and peer closes its side in answer to Shutdown.
+			// These are not problems of connection
+			if !s.closed() && !(err == io.EOF && s.shuttingDown()) {
+				s.countProb(err)
+				s.report(ProbData{
+					Err:      err,
+					SourceID: s.ID(),
+				})
 			}
 			return
 		}
-		if n == 0 {
+		now := time.Now()
+		s.inTraffic.touch(now)
+		if pkt.err != nil {
+			s.countProb(pkt.err)
+			s.report(ProbData{
+				Pkt:      pkt,
+				SourceID: s.ID(),
+				Err:      pkt.err,
+			})
+			continue
+		}
+		if isControl(pkt.typ) {
+			s.handleControl(pkt)
 			continue
 		}
-		packets := pi.inspect(bb[0:n], s.msgTypeLen)
-		//fmt.Printf("LEN PACKETS:%d---CFP:%t--PFP:%t--HV:%t--PPC:%d--LIP:%d--CPL:%d--CPH:%d--CP:%d\n",
-		//	len(packets), pi.completeFindPrefix, pi.partialFindPrefix, pi.headerVerified,
-		//	pi.prevPrefixCnt, pi.lastIndexPrefix, pi.currentPkgLen, len(pi.curPkgHeader), len(pi.curPkg))
-		if len(packets) > 0 {
-			for _, pkt := range packets {
-				s.readChan <- RData{
-					Pkt:      pkt,
-					SourceID: s.id,
-				}
+		// While reader waits for rate limit, peer is slowed down by TCP backpressure
+		wait, err := s.limitRate(s.inLimit, &s.inLimited, true, pkt, len(pkt.data))
+		if err != nil {
+			s.countProb(err)
+			s.report(ProbData{
+				Pkt:      pkt,
+				SourceID: s.ID(),
+				Err:      err,
+			})
+			if !Recoverable(err) {
+				return
 			}
+			continue
 		}
-
+		if wait > 0 && !s.sleep(wait) {
+			return
+		}
+		s.inTraffic.add(pkt.typ, len(pkt.data), now)
+		s.record(DirIn, pkt.typ, pkt.data, now)
+		if !s.deliver(RData{
+			Pkt:      pkt,
+			SourceID: s.ID(),
+			Stream:   pkt.stream,
+		}) {
+			return
+		}
+		s.consumed(pkt)
 	}
 }
 
-type packetInspector struct {
-	completeFindPrefix bool
-	partialFindPrefix  bool
-	headerVerified     bool
-	prevPrefixCnt      int
-	lastIndexPrefix    int
-	currentPkgLen      int
-	curPkgHeader       []byte
-	curPkg             []byte
-}
-
-func (pi *packetInspector) resetVariables() {
-	pi.completeFindPrefix = false
-	pi.partialFindPrefix = false
-	pi.headerVerified = false
-	pi.prevPrefixCnt = 0
-	pi.lastIndexPrefix = 0
-	pi.currentPkgLen = 0
-	pi.curPkgHeader = make([]byte, 0)
-	pi.curPkg = make([]byte, 0)
+// retryWriter write the rest of data once more after a write timeout
+type retryWriter struct {
+	conn    net.Conn
+	timeout time.Duration
 }
 
-func (pi *packetInspector) findPrefix(bb []byte) {
-	//p := packetInspector{}
-	if pi.completeFindPrefix {
-		return
-	}
-
-	if pi.partialFindPrefix && pi.prevPrefixCnt > 0 {
-		// There was a match with the end of the previous buffer
-		// so we must find remaining of pattern in the start of the current buffer
-		j := 0
-		for i := pi.prevPrefixCnt; i < prefixLen; i++ {
-			if j >= len(bb) {
-				return
-			}
-			if packetPrefix[i] != bb[j] {
-				break
-			}
-			pi.prevPrefixCnt++
-			if pi.prevPrefixCnt == len(packetPrefix) {
-				pi.completeFindPrefix = true
-				pi.partialFindPrefix = false
-				pi.prevPrefixCnt = 0
-				pi.lastIndexPrefix = j
-				break
-			}
-			j++
-		}
-	}
-	// Patten does not exist partially in previous
-	// buffer and must find it in the current buffer
-	for i := 0; i < len(bb); i++ {
-		if bb[i] == packetPrefix[0] {
-			pi.partialFindPrefix = true
-			pi.prevPrefixCnt = 1
-			for j := 1; j < prefixLen; j++ {
-				if j+i >= len(bb) {
-					return
-				}
-				if bb[i+j] != packetPrefix[j] {
-					pi.partialFindPrefix = false
-					pi.prevPrefixCnt = 0
-					break
-				}
-				pi.prevPrefixCnt++
-				if pi.prevPrefixCnt == prefixLen {
-					pi.completeFindPrefix = true
-					pi.partialFindPrefix = false
-					pi.prevPrefixCnt = 0
-					pi.lastIndexPrefix = i + j
-					return
-				}
-			}
-		}
+func (w retryWriter) Write(bb []byte) (int, error) {
+	n, err := w.conn.Write(bb)
+	if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+		var m int
+		m, err = w.conn.Write(bb[n:])
+		n += m
 	}
+	return n, err
+}
 
+// deadlineReader extend read deadline of connection before each read
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
 }
 
-func (pi *packetInspector) inspect(bb []byte, msgTypeLen map[byte]int) []rDataPacket {
-	res := make([]rDataPacket, 0)
-	if len(bb) == 0 {
-		return res
-	}
-	dataStartIndex := 0
-	if !pi.completeFindPrefix {
-		pi.findPrefix(bb)
-		if !pi.completeFindPrefix {
-			return res
-		}
-		dataStartIndex = pi.lastIndexPrefix + 1
-	}
-	if dataStartIndex >= len(bb) {
-		//after finding prefix we reach to the end of slice
-		return res
-	}
-	if !pi.headerVerified {
-		endOfHeader := 0
-		if len(pi.curPkgHeader) < HeaderLen {
-			// Incomplete header
-			if (len(pi.curPkgHeader) + len(bb[dataStartIndex:len(bb)])) < HeaderLen {
-				pi.curPkgHeader = append(pi.curPkgHeader, bb[dataStartIndex:len(bb)]...)
-				return res
-			}
-			endOfHeader = dataStartIndex + (HeaderLen - len(pi.curPkgHeader))
-			pi.curPkgHeader = append(pi.curPkgHeader, bb[dataStartIndex:endOfHeader]...)
-		}
-		msgTypeMaxLen, ok := msgTypeLen[pi.curPkgHeader[0]]
-		currentPkgLen := int(binary.LittleEndian.Uint32(pi.curPkgHeader[1:]))
-
-		if !ok || msgTypeMaxLen < currentPkgLen {
-			// Message type or message len is not valid
-			pi.resetVariables()
-			res = append(res, pi.inspect(bb[dataStartIndex:], msgTypeLen)...)
-			return res
-		}
-		pi.headerVerified = true
-		pi.currentPkgLen = currentPkgLen
-		dataStartIndex = endOfHeader
-		if currentPkgLen <= len(bb[dataStartIndex:]) {
-			pkt := rDataPacket{typ: pi.curPkgHeader[0], data: bb[dataStartIndex : dataStartIndex+currentPkgLen]}
-			res = append(res, pkt)
-			dataStartIndex += currentPkgLen
-			if dataStartIndex > len(bb) {
-				//After finding prefix we reach to the end of slice
-				return res
-			}
-			pi.resetVariables()
-			res = append(res, pi.inspect(bb[dataStartIndex:], msgTypeLen)...)
-			return res
-		}
-		pi.curPkg = append(pi.curPkg, bb[dataStartIndex:]...)
-		return res
-	}
-	// Message prefix and header find previously
-	// so just append to current package and search for next package
-	if pi.currentPkgLen > len(pi.curPkg)+len(bb) {
-		pi.curPkg = append(pi.curPkg, bb...)
-		return res
-	}
-	remainLen := pi.currentPkgLen - len(pi.curPkg)
-	pi.curPkg = append(pi.curPkg, bb[0:remainLen]...)
-	pkt := rDataPacket{typ: pi.curPkgHeader[0], data: pi.curPkg}
-	res = append(res, pkt)
-	// if remainLen >= len(bb) {
-	// 	//aafter finding prefix we reach to the rnd of slice
-	// 	return res
-	// }
-	pi.resetVariables()
-	res = append(res, pi.inspect(bb[remainLen:], msgTypeLen)...)
-	return res
+func (r deadlineReader) Read(bb []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.conn.Read(bb)
 }
@@ -1,8 +1,18 @@
 package socket
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestInspect(t *testing.T) {
@@ -848,7 +858,7 @@ func checkEqRData(a, b []rDataPacket) bool {
 	}
 	if len(a) > 0 {
 		for i := 0; i < len(a); i++ {
-			if !checkEqByte(a[i].data, b[i].data) || a[i].typ != b[i].typ {
+			if !checkEqByte(a[i].data, b[i].data) || a[i].typ != b[i].typ || a[i].stream != b[i].stream {
 				return false
 			}
 		}
@@ -978,3 +988,561 @@ func checkEqRData(a, b []rDataPacket) bool {
 // 		curPkg:             nil,
 // 	}, false,
 // },
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "messagehub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, network := range []string{"unix", "unixpacket"} {
+		addr := &net.UnixAddr{Name: filepath.Join(dir, network+".sock"), Net: network}
+		ln, err := net.ListenUnix(network, addr)
+		if err != nil {
+			t.Skipf("%s sockets are not supported: %s", network, err)
+		}
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, _ := ln.Accept()
+			accepted <- conn
+		}()
+		cliConn, err := net.Dial(network, addr.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srvConn := <-accepted
+		if srvConn == nil {
+			t.Fatal("Error on accepting connection")
+		}
+
+		// Body is larger than write buffer, so frame is split to several messages on unixpacket
+		body := make([]byte, 3000)
+		for i := range body {
+			body[i] = byte(i)
+		}
+		msgTypeLen := map[byte]int{3: len(body)}
+		srv := NewConnSocket(srvConn, 1, 10, 1024, 1024)
+		cli := NewConnSocket(cliConn, 2, 10, 1024, 1024)
+		srvRead := make(chan RData, 10)
+		prob := make(chan ProbData, 10)
+		srv.Start(make(chan WData, 10), srvRead, prob, msgTypeLen)
+		cli.Start(make(chan WData, 10), make(chan RData, 10), prob, msgTypeLen)
+
+		cli.Send(rDataPacket{typ: 3, data: body})
+		select {
+		case rData := <-srvRead:
+			data, _ := rData.Pkt.Data()
+			if rData.Pkt.Type() != 3 || !checkEqByte(data, body) {
+				t.Errorf("%s: not expected packet received", network)
+			}
+		case p := <-prob:
+			t.Errorf("%s: error on socket %s", network, p.Err)
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: packet not received", network)
+		}
+		cli.Close()
+		srv.Close()
+		ln.Close()
+	}
+}
+
+func TestFrameVersion(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	msgTypeLen := map[byte]int{3: 1024}
+	srv := NewConnSocket(srvConn, 1, 10, 1024, 1024)
+	cli := NewConnSocket(cliConn, 2, 10, 1024, 1024)
+	srvRead := make(chan RData, 10)
+	srvProb := make(chan ProbData, 10)
+	srv.Start(make(chan WData, 10), srvRead, srvProb, msgTypeLen)
+	cli.Start(make(chan WData, 10), make(chan RData, 10), make(chan ProbData, 10), msgTypeLen)
+	defer srv.Close()
+	defer cli.Close()
+
+	if srv.FrameVersion() != FrameV1 {
+		t.Fatalf("Default frame version must be v1, actual %d", srv.FrameVersion())
+	}
+	cli.SetFrameVersion(FrameV2)
+	cli.Send(rDataPacket{typ: 3, data: []byte{1, 2, 3}})
+	select {
+	case <-srvRead:
+	case p := <-srvProb:
+		t.Fatalf("Error on socket %s", p.Err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Packet not received")
+	}
+	// Only capabilities agreed in handshake change frame version, see SetCapabilities
+	if srv.FrameVersion() != FrameV1 {
+		t.Fatal("Socket upgraded to v2 frames without handshake")
+	}
+
+	// Corrupted frame reported as recoverable problem
+	bb, _ := encodeFrame(rDataPacket{typ: 3, data: []byte{1, 2, 3}}, FrameV2)
+	bb[len(bb)-5] ^= 0xFF
+	go cliConn.Write(bb)
+	select {
+	case p := <-srvProb:
+		if !Recoverable(p.Err) || p.SourceID != 1 {
+			t.Fatalf("Not expected problem %s", p.Err)
+		}
+	case <-srvRead:
+		t.Fatal("Corrupted packet delivered")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Corrupted packet not reported")
+	}
+}
+
+// invalidPacket is a packet that cannot be serialized
+type invalidPacket struct{}
+
+func (invalidPacket) Type() byte { return 3 }
+func (invalidPacket) Data() ([]byte, error) {
+	return nil, errors.New("Invalid packet")
+}
+
+func TestInvalidPacket(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	msgTypeLen := map[byte]int{3: 1024}
+	srv := NewConnSocket(srvConn, 1, 10, 1024, 1024)
+	cli := NewConnSocket(cliConn, 2, 10, 1024, 1024)
+	srvRead := make(chan RData, 10)
+	cliProb := make(chan ProbData, 10)
+	srv.Start(make(chan WData, 10), srvRead, make(chan ProbData, 10), msgTypeLen)
+	cli.Start(make(chan WData, 10), make(chan RData, 10), cliProb, msgTypeLen)
+	defer srv.Close()
+	defer cli.Close()
+
+	cli.Send(invalidPacket{})
+	select {
+	case p := <-cliProb:
+		if !Recoverable(p.Err) || p.Pkt != (invalidPacket{}) {
+			t.Fatalf("Not expected problem %s", p.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Packet that cannot be serialized not reported")
+	}
+	if cli.Stats().FrameErrors != 1 {
+		t.Fatalf("Expected one frame error, actual %d", cli.Stats().FrameErrors)
+	}
+	// Next packets are still written
+	cli.Send(rDataPacket{typ: 3, data: []byte{1, 2, 3}})
+	select {
+	case <-srvRead:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Packet after invalid packet not received")
+	}
+}
+
+func TestSetCapabilities(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	msgTypeLen := map[byte]int{3: 1024}
+	srv := NewConnSocket(srvConn, 1, 10, 1024, 1024)
+	cli := NewConnSocket(cliConn, 2, 10, 1024, 1024)
+	srvRead := make(chan RData, 10)
+	cliProb := make(chan ProbData, 10)
+	srv.Start(make(chan WData, 10), srvRead, make(chan ProbData, 10), msgTypeLen)
+	cli.Start(make(chan WData, 10), make(chan RData, 10), cliProb, msgTypeLen)
+	defer srv.Close()
+	defer cli.Close()
+
+	cli.SetCapabilities(Capabilities{Version: ProtocolVersion, MaxFrameSize: 3, Features: FeatureChecksum})
+	if cli.FrameVersion() != FrameV2 {
+		t.Fatal("Checksum feature must select v2 frames")
+	}
+	cli.Send(rDataPacket{typ: 3, data: []byte{1, 2, 3, 4}})
+	select {
+	case p := <-cliProb:
+		if !Recoverable(p.Err) || !errors.Is(p.Err, ErrFrameTooLarge) {
+			t.Fatalf("Not expected problem %s", p.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Large packet not reported")
+	}
+	cli.Send(rDataPacket{typ: 3, data: []byte{1, 2, 3}})
+	select {
+	case rData := <-srvRead:
+		if pkt := rData.Pkt.(rDataPacket); pkt.version != FrameV2 {
+			t.Fatalf("Packet received in frame version %d", pkt.version)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Packet in max frame size not received")
+	}
+
+	cli.SetCapabilities(Capabilities{Version: ProtocolVersion})
+	if cli.FrameVersion() != FrameV1 {
+		t.Fatal("Without checksum feature socket must send v1 frames")
+	}
+}
+
+func TestCompressedSocket(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	msgTypeLen := map[byte]int{3: 64 * 1024}
+	srv := NewConnSocket(srvConn, 1, 10, 1024, 1024)
+	cli := NewConnSocket(cliConn, 2, 10, 1024, 1024)
+	srvRead := make(chan RData, 10)
+	srv.Start(make(chan WData, 10), srvRead, make(chan ProbData, 10), msgTypeLen)
+	cli.Start(make(chan WData, 10), make(chan RData, 10), make(chan ProbData, 10), msgTypeLen)
+	defer srv.Close()
+	defer cli.Close()
+
+	cli.SetCapabilities(Capabilities{Version: ProtocolVersion, Features: FeatureChecksum | FeatureCompression})
+	cli.SetCompressMinSize(100)
+	small := []byte{1, 2, 3}
+	large := []byte(strings.Repeat(`{"id":1,"value":"abc"}`, 1000))
+	// Both packets may arrive in one read, data of first one must not be overwritten by the next read
+	cli.Send(rDataPacket{typ: 3, data: small})
+	cli.Send(rDataPacket{typ: 3, data: large})
+	for _, expected := range [][]byte{small, large} {
+		select {
+		case rData := <-srvRead:
+			data, _ := rData.Pkt.Data()
+			if !bytes.Equal(data, expected) {
+				t.Fatalf("Packet with %d bytes not restored", len(expected))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Packet not received")
+		}
+	}
+	// Writer of cli owns its encoder, so frames are checked on another socket
+	enc := NewConnSocket(nil, 3, 1, 1024, 1024)
+	enc.SetCompressMinSize(100)
+	caps := cli.Capabilities()
+	enc.SetCapabilities(caps)
+	if frame := joinBuffers(*enc.encode(3, large, caps, fragmentInfo{}, 0)); len(frame) >= len(large) || frame[prefixLen]&flagCompressed == 0 {
+		t.Fatal("Large packet is not compressed")
+	}
+	if frame := joinBuffers(*enc.encode(3, small, caps, fragmentInfo{}, 0)); frame[prefixLen]&flagCompressed != 0 {
+		t.Fatal("Packet smaller than threshold is compressed")
+	}
+}
+
+func TestFragmentedSocket(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	msgTypeLen := map[byte]int{3: 1024}
+	srv := NewConnSocket(srvConn, 1, 10, 1024, 1024)
+	cli := NewConnSocket(cliConn, 2, 10, 1024, 1024)
+	srv.SetReassemblyLimits(map[byte]int{3: 1024 * 1024})
+	cli.SetFragmentSize(1000)
+	cli.SetCapabilities(Capabilities{Version: ProtocolVersion, MaxFrameSize: 1024, Features: FeatureChecksum | FeatureFragmentation})
+	large := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 64*1024)
+	small := []byte{9, 9, 9}
+	// Both packets are queued before writer starts, so small one is sent between fragments of large one
+	cli.Send(rDataPacket{typ: 3, data: large})
+	cli.Send(rDataPacket{typ: 3, data: small})
+	srvRead := make(chan RData, 10)
+	cliWrite := make(chan WData, 10)
+	srv.Start(make(chan WData, 10), srvRead, make(chan ProbData, 10), msgTypeLen)
+	cli.Start(cliWrite, make(chan RData, 10), make(chan ProbData, 10), msgTypeLen)
+	defer srv.Close()
+	defer cli.Close()
+
+	for _, expected := range [][]byte{small, large} {
+		select {
+		case rData := <-srvRead:
+			data, _ := rData.Pkt.Data()
+			if !bytes.Equal(data, expected) {
+				t.Fatalf("Expected packet with %d bytes, actual %d bytes", len(expected), len(data))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Packet not received")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-cliWrite:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Write of packet not reported")
+		}
+	}
+}
+
+func TestTrySend(t *testing.T) {
+	pkt1 := rDataPacket{typ: 3, data: []byte{1}}
+	pkt2 := rDataPacket{typ: 3, data: []byte{2}}
+	var tests = []struct {
+		policy   OverflowPolicy
+		err      error
+		expected Packet // Packet that remains in queue
+	}{
+		{OverflowBlock, ErrQueueFull, pkt1},
+		{OverflowDropNewest, ErrQueueFull, pkt1},
+		{OverflowDropOldest, nil, pkt2},
+		{OverflowDisconnect, ErrQueueFull, pkt1},
+	}
+	for _, tt := range tests {
+		// Socket is not started, so nothing is taken from queue
+		skt := NewConnSocket(nil, 1, 1, 1024, 1024)
+		skt.SetOverflowPolicy(tt.policy)
+		if err := skt.TrySend(pkt1); err != nil {
+			t.Fatalf("Policy %d: packet not queued in empty queue. Error %v", tt.policy, err)
+		}
+		if err := skt.TrySend(pkt2); err != tt.err {
+			t.Errorf("Policy %d: expected error %v, actual %v", tt.policy, tt.err, err)
+		}
+		if actual := <-skt.lanes[LaneInteractive]; !checkEqRData([]rDataPacket{actual.(rDataPacket)}, []rDataPacket{tt.expected.(rDataPacket)}) {
+			t.Errorf("Policy %d: unexpected packet in queue %v", tt.policy, actual)
+		}
+	}
+}
+
+func TestSendContext(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	// Nobody reads from the other side of pipe, so writer blocks on the first packet and queue fills
+	skt := NewConnSocket(cliConn, 1, 1, 1024, 1024)
+	skt.SetOverflowPolicy(OverflowDisconnect)
+	// Writer does not collect the second packet in the batch of the first one
+	skt.SetWriteBatch(0, 1)
+	probChan := make(chan ProbData, 10)
+	skt.Start(make(chan WData, 10), make(chan RData, 10), probChan, map[byte]int{3: 10})
+	pkt := rDataPacket{typ: 3, data: []byte{1}}
+	for i := 0; i < 2; i++ {
+		if err := skt.SendContext(context.Background(), pkt); err != nil {
+			t.Fatalf("Packet %d not queued. Error %v", i, err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := skt.SendContext(ctx, pkt); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline error on full queue, actual %v", err)
+	}
+
+	// SendContext waits regardless of policy, TrySend applies it
+	if err := skt.TrySend(pkt); err != ErrQueueFull {
+		t.Fatalf("Expected ErrQueueFull, actual %v", err)
+	}
+	select {
+	case prob := <-probChan:
+		if prob.Err != ErrQueueFull || Recoverable(prob.Err) {
+			t.Fatalf("Unexpected problem reported %v", prob.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Overflow not reported with disconnect policy")
+	}
+
+	skt.Close()
+	if err := skt.TrySend(pkt); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed after close, actual %v", err)
+	}
+	if err := skt.SendContext(context.Background(), pkt); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed after close, actual %v", err)
+	}
+	// Send on closed socket must not panic
+	skt.Send(pkt)
+	// Writer was blocked on the first packet, the second one is still in queue
+	for {
+		select {
+		case prob := <-probChan:
+			if prob.Err == ErrUndelivered {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Queued packet not reported as undelivered")
+		}
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	// Nobody reads from the other side of pipe, so writer blocks on the first packet and queue fills
+	skt := NewConnSocket(cliConn, 1, 1, 1024, 1024)
+	skt.SetOverflowPolicy(OverflowDropOldest)
+	skt.SetWriteBatch(0, 1)
+	probChan := make(chan ProbData, 10)
+	skt.Start(make(chan WData, 10), make(chan RData, 10), probChan, map[byte]int{3: 10})
+	defer skt.Close()
+	for i := byte(1); i <= 2; i++ {
+		if err := skt.SendContext(context.Background(), rDataPacket{typ: 3, data: []byte{i}}); err != nil {
+			t.Fatalf("Packet %d not queued. Error %v", i, err)
+		}
+	}
+	if err := skt.TrySend(rDataPacket{typ: 3, data: []byte{3}}); err != nil {
+		t.Fatalf("Packet not queued with drop oldest policy. Error %v", err)
+	}
+	// Packet that is dropped to make room is reported like other dropped frames
+	select {
+	case prob := <-probChan:
+		data, _ := prob.Pkt.Data()
+		if !errors.Is(prob.Err, ErrQueueFull) || !Recoverable(prob.Err) || data[0] != 2 {
+			t.Fatalf("Unexpected problem reported %v for packet %v", prob.Err, data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Dropped packet not reported")
+	}
+	if st := skt.Stats(); st.Dropped != 1 || st.FrameErrors != 0 {
+		t.Fatalf("Expected one dropped packet, actual %+v", st)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	cliConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvConn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgTypeLen := map[byte]int{3: 1024}
+	srv := NewConnSocket(srvConn, 1, 10, 1024, 1024)
+	cli := NewConnSocket(cliConn, 2, 100, 1024, 1024)
+	srvRead := make(chan RData, 100)
+	srvProb := make(chan ProbData, 10)
+	srv.Start(make(chan WData, 100), srvRead, srvProb, msgTypeLen)
+	cliProb := make(chan ProbData, 100)
+	cli.Start(make(chan WData, 100), make(chan RData, 10), cliProb, msgTypeLen)
+
+	const count = 50
+	for i := 0; i < count; i++ {
+		cli.Send(rDataPacket{typ: 3, data: []byte{byte(i)}})
+	}
+	go func() {
+		// Peer closes its socket when client half-closes the connection
+		<-srvProb
+		srv.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cli.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed. Error %v", err)
+	}
+	if len(srvRead) != count {
+		t.Fatalf("Expected %d packets before EOF, actual %d", count, len(srvRead))
+	}
+	if err := cli.TrySend(rDataPacket{typ: 3}); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed after shutdown, actual %v", err)
+	}
+	if err := cli.Close(); err != nil {
+		t.Fatalf("Second close failed. Error %v", err)
+	}
+	select {
+	case prob := <-cliProb:
+		t.Fatalf("Unexpected problem reported %v", prob.Err)
+	default:
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	defer srvConn.Close()
+	// Nobody reads from the other side of pipe, so queued packets cannot be written
+	skt := NewConnSocket(cliConn, 1, 10, 1024, 1024)
+	probChan := make(chan ProbData, 10)
+	skt.Start(make(chan WData, 10), make(chan RData, 10), probChan, map[byte]int{3: 10})
+	for i := 0; i < 3; i++ {
+		skt.Send(rDataPacket{typ: 3, data: []byte{byte(i)}})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := skt.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline error, actual %v", err)
+	}
+	undelivered := 0
+	for undelivered < 2 {
+		select {
+		case prob := <-probChan:
+			if prob.Err == ErrUndelivered {
+				undelivered++
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected 2 undelivered packets, actual %d", undelivered)
+		}
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	msgTypeLen := map[byte]int{3: 10}
+	srv := NewConnSocket(srvConn, 1, 10, 1024, 1024)
+	cli := NewConnSocket(cliConn, 2, 10, 1024, 1024)
+	caps := Capabilities{Version: ProtocolVersion, MaxFrameSize: 1024, Features: FeatureHeartbeat}
+	for _, skt := range []*TCPSocket{srv, cli} {
+		skt.SetHeartbeat(10*time.Millisecond, 3)
+		skt.SetCapabilities(caps)
+	}
+	srvRead := make(chan RData, 10)
+	cliProb := make(chan ProbData, 10)
+	srv.Start(make(chan WData, 10), srvRead, make(chan ProbData, 10), msgTypeLen)
+	cli.Start(make(chan WData, 10), make(chan RData, 10), cliProb, msgTypeLen)
+	defer srv.Close()
+	defer cli.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.RTT() == 0 || cli.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Round trip time not measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case rData := <-srvRead:
+		t.Fatalf("Control frame delivered to owner of socket %+v", rData)
+	case prob := <-cliProb:
+		t.Fatalf("Unexpected problem %v", prob.Err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	// Peer reads frames but never answers
+	go io.Copy(ioutil.Discard, srvConn)
+	defer srvConn.Close()
+	skt := NewConnSocket(cliConn, 2, 10, 1024, 1024)
+	skt.SetHeartbeat(10*time.Millisecond, 2)
+	skt.SetCapabilities(Capabilities{Version: ProtocolVersion, MaxFrameSize: 1024, Features: FeatureHeartbeat})
+	probChan := make(chan ProbData, 10)
+	skt.Start(make(chan WData, 10), make(chan RData, 10), probChan, map[byte]int{3: 10})
+	defer skt.Close()
+
+	select {
+	case prob := <-probChan:
+		if prob.Err != ErrHeartbeatTimeout {
+			t.Fatalf("Expected heartbeat timeout, actual %v", prob.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dead peer not reported")
+	}
+}
+
+func TestLanes(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	msgTypeLen := map[byte]int{1: 10, 3: 1024}
+	srv := NewConnSocket(srvConn, 1, 10, 1024, 1024)
+	cli := NewConnSocket(cliConn, 2, 30, 1024, 1024)
+	cli.SetLanes(map[byte]Lane{3: LaneBulk})
+	cli.SetLaneDepths(map[Lane]int{LaneBulk: 20})
+	bulk := make([]byte, 1000)
+	for i := 0; i < 20; i++ {
+		if err := cli.TrySend(rDataPacket{typ: 3, data: bulk}); err != nil {
+			t.Fatalf("Bulk packet %d not queued. Error %v", i, err)
+		}
+	}
+	if err := cli.TrySend(rDataPacket{typ: 3, data: bulk}); err != ErrQueueFull {
+		t.Fatalf("Packet queued in full bulk lane. Error %v", err)
+	}
+	// Interactive packet is queued after all bulk packets, but it is not sent after them
+	cli.Send(rDataPacket{typ: 1, data: []byte{1}})
+	srvRead := make(chan RData, 30)
+	srv.Start(make(chan WData, 30), srvRead, make(chan ProbData, 10), msgTypeLen)
+	cli.Start(make(chan WData, 30), make(chan RData, 10), make(chan ProbData, 10), msgTypeLen)
+	defer srv.Close()
+	defer cli.Close()
+
+	for i := 0; i < 21; i++ {
+		select {
+		case rData := <-srvRead:
+			if rData.Pkt.Type() == 1 && i > 1 {
+				t.Fatalf("Interactive packet received after %d bulk packets", i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Packet not received")
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package socket
+
+import (
+	"crypto/tls"
+)
+
+// NewTLSSocket create socket object that runs the same framing as TCPSocket over a TLS connection.
+// The handshake is not forced here, it happens on the first read or write of the socket
+func NewTLSSocket(conn *tls.Conn, id uint64, sendQueueSize int, readBufSize int, writeBufSize int) *TCPSocket {
+	return newTCPSocket(conn, id, sendQueueSize, readBufSize, writeBufSize)
+}
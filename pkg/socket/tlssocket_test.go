@@ -0,0 +1,110 @@
+package socket
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSignedCert generate a certificate for 127.0.0.1 that is valid for one hour
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "messagehub-test"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestTLSSocket(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Mutual TLS, both sides trust the same self signed certificate
+	srvConf := &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	cliConf := &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool, ServerName: "127.0.0.1"}
+
+	accepted := make(chan *net.TCPConn, 1)
+	go func() {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	cliConn, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvConn, ok := <-accepted
+	if !ok {
+		t.Fatal("Error on accepting connection")
+	}
+
+	msgTypeLen := map[byte]int{1: 0, 3: 1024}
+	srv := NewTLSSocket(tls.Server(srvConn, srvConf), 1, 10, 1024, 1024)
+	cli := NewTLSSocket(tls.Client(cliConn, cliConf), 2, 10, 1024, 1024)
+	srvRead := make(chan RData, 10)
+	cliRead := make(chan RData, 10)
+	prob := make(chan ProbData, 10)
+	srv.Start(make(chan WData, 10), srvRead, prob, msgTypeLen)
+	cli.Start(make(chan WData, 10), cliRead, prob, msgTypeLen)
+	defer srv.Close()
+	defer cli.Close()
+
+	cli.Send(rDataPacket{typ: 3, data: []byte{1, 2, 3, 4, 5}})
+	select {
+	case rData := <-srvRead:
+		if !checkEqRData([]rDataPacket{rData.Pkt.(rDataPacket)}, []rDataPacket{{typ: 3, data: []byte{1, 2, 3, 4, 5}}}) {
+			t.Fatalf("Not expected packet %+v", rData.Pkt)
+		}
+	case p := <-prob:
+		t.Fatalf("Error on TLS socket %s", p.Err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Packet not received over TLS")
+	}
+
+	srv.Send(rDataPacket{typ: 1})
+	select {
+	case rData := <-cliRead:
+		if rData.Pkt.Type() != 1 {
+			t.Fatalf("Not expected packet type %d", rData.Pkt.Type())
+		}
+	case p := <-prob:
+		t.Fatalf("Error on TLS socket %s", p.Err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Packet not received over TLS")
+	}
+}
@@ -0,0 +1,83 @@
+package socket
+
+import (
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsConn adapt a WebSocket connection to net.Conn, so TCPSocket runs the same framing over it.
+// Writes are collected until Flush, so every flush of socket writer is sent as exactly one binary
+// message that contains one or more whole frames. Reads treat the incoming binary messages as a
+// stream of bytes, so peers may split or join frames in messages as they like. Text messages are ignored
+type wsConn struct {
+	*websocket.Conn
+	reader io.Reader      // Reader of current binary message
+	writer io.WriteCloser // Writer of the message that is sent by the next Flush
+}
+
+// NewWSSocket create socket object that exchanges frames in binary WebSocket messages
+func NewWSSocket(conn *websocket.Conn, id uint64, sendQueueSize int, readBufSize int, writeBufSize int) *TCPSocket {
+	return newTCPSocket(&wsConn{Conn: conn}, id, sendQueueSize, readBufSize, writeBufSize)
+}
+
+func (c *wsConn) Read(bb []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			typ, r, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if typ != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = r
+		}
+		n, err := c.reader.Read(bb)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(bb []byte) (int, error) {
+	if c.writer == nil {
+		w, err := c.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			return 0, err
+		}
+		c.writer = w
+	}
+	return c.writer.Write(bb)
+}
+
+// Flush complete the binary message of writes since the last flush
+func (c *wsConn) Flush() error {
+	if c.writer == nil {
+		return nil
+	}
+	w := c.writer
+	c.writer = nil
+	return w.Close()
+}
+
+// Close send close message to peer and close underlying connection
+func (c *wsConn) Close() error {
+	c.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return c.Conn.Close()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
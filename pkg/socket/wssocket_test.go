@@ -0,0 +1,105 @@
+package socket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWSSocket(t *testing.T) {
+	msgTypeLen := map[byte]int{1: 0, 3: 4096}
+	srvRead := make(chan RData, 10)
+	prob := make(chan ProbData, 10)
+	srvSkt := make(chan *TCPSocket, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		skt := NewWSSocket(conn, 1, 10, 1024, 1024)
+		skt.Start(make(chan WData, 10), srvRead, prob, msgTypeLen)
+		srvSkt <- skt
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cliRead := make(chan RData, 10)
+	cli := NewWSSocket(conn, 2, 10, 1024, 1024)
+	cli.Start(make(chan WData, 10), cliRead, prob, msgTypeLen)
+	defer cli.Close()
+	s := <-srvSkt
+	defer s.Close()
+
+	// Body is larger than read buffer, so it is read in several parts of the same message
+	body := make([]byte, 3000)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	cli.Send(rDataPacket{typ: 3, data: body})
+	select {
+	case rData := <-srvRead:
+		data, _ := rData.Pkt.Data()
+		if rData.Pkt.Type() != 3 || !checkEqByte(data, body) {
+			t.Fatal("Not expected packet received over WebSocket")
+		}
+	case p := <-prob:
+		t.Fatalf("Error on WebSocket %s", p.Err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Packet not received over WebSocket")
+	}
+
+	s.Send(rDataPacket{typ: 1})
+	select {
+	case rData := <-cliRead:
+		if rData.Pkt.Type() != 1 {
+			t.Fatalf("Not expected packet type %d", rData.Pkt.Type())
+		}
+	case p := <-prob:
+		t.Fatalf("Error on WebSocket %s", p.Err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Packet not received over WebSocket")
+	}
+}
+
+func TestWSSocketMessage(t *testing.T) {
+	srvSkt := make(chan *TCPSocket, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		// Frame is larger than write buffer, it must still be sent as one message
+		skt := NewWSSocket(conn, 1, 10, 1024, 1024)
+		skt.Start(make(chan WData, 10), make(chan RData, 10), make(chan ProbData, 10), map[byte]int{3: 4096})
+		srvSkt <- skt
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s := <-srvSkt
+	defer s.Close()
+
+	body := make([]byte, 3000)
+	s.Send(rDataPacket{typ: 3, data: body})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	typ, msg, err := conn.ReadMessage()
+	if err != nil || typ != websocket.BinaryMessage {
+		t.Fatalf("Binary message not received. Error %v", err)
+	}
+	if len(msg) != prefixLen+HeaderLen+len(body) {
+		t.Fatalf("Expected one message with whole frame of %d bytes, actual %d bytes", prefixLen+HeaderLen+len(body), len(msg))
+	}
+}